@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// cidrListener drops TCP connections whose source address is outside
+// allow. Like peerCredListener it checks in Accept, so a rejected client
+// never reaches a handler, or AUTH.
+type cidrListener struct {
+	net.Listener
+	allow []netip.Prefix
+}
+
+func (l *cidrListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if allowedAddr(c.RemoteAddr(), l.allow) {
+			return c, nil
+		}
+		slog.Warn("rejected connection outside -allow-cidr", "addr", c.RemoteAddr())
+		c.Close()
+	}
+}
+
+// allowedAddr reports whether addr falls in one of allow. IPv4-mapped IPv6
+// addresses are matched as IPv4.
+func allowedAddr(addr net.Addr, allow []netip.Prefix) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, p := range allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses -allow-cidr values. Each may hold several
+// comma-separated ranges, and a bare address is a range of one.
+func parseCIDRs(specs []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, spec := range specs {
+		for _, f := range strings.Split(spec, ",") {
+			f = strings.TrimSpace(f)
+			if !strings.Contains(f, "/") {
+				ip, err := netip.ParseAddr(f)
+				if err != nil {
+					return nil, fmt.Errorf("invalid -allow-cidr %q", f)
+				}
+				out = append(out, netip.PrefixFrom(ip, ip.BitLen()))
+				continue
+			}
+			p, err := netip.ParsePrefix(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -allow-cidr %q", f)
+			}
+			out = append(out, p.Masked())
+		}
+	}
+	return out, nil
+}
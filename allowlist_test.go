@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	got, err := parseCIDRs([]string{"10.1.2.3/8, 192.168.0.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.0.1/32", "::1/128"}
+	if len(got) != len(want) {
+		t.Fatalf("parseCIDRs = %v", got)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("range %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "host", ""} {
+		if _, err := parseCIDRs([]string{bad}); err == nil {
+			t.Errorf("parseCIDRs(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestAllowedAddr(t *testing.T) {
+	allow := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	for addr, want := range map[string]bool{
+		"10.9.8.7:1234":          true,
+		"[::ffff:10.9.8.7]:1234": true,
+		"11.0.0.1:1234":          false,
+		"[2001:db8::1]:1234":     false,
+	} {
+		tcp, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := allowedAddr(tcp, allow); got != want {
+			t.Errorf("allowedAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestCIDRListener(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		allow string
+		want  bool
+	}{
+		{"allowed", "127.0.0.0/8", true},
+		{"rejected", "10.0.0.0/8", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tl, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln := &cidrListener{Listener: tl, allow: []netip.Prefix{netip.MustParsePrefix(tc.allow)}}
+			defer ln.Close()
+			go newServer(config{}).serve(ln)
+			c, err := net.Dial("tcp", tl.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Write([]byte("PING\n"))
+			line, err := bufio.NewReader(c).ReadString('\n')
+			if got := err == nil && line == "PONG\n"; got != tc.want {
+				t.Fatalf("served = %v (%q, %v), want %v", got, line, err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// With -aof the server keeps an append-only log of database 0 next to its
+// snapshots. Every successful SET, SETNX, SETB, SETFROMFILE, MSET, BULKSET
+// and DEL is appended as it is applied. The other writes to keys, listed in
+// aofKeys, are followed by a record of the whole state of each key they
+// touched, its deadline included, a key that expires or is evicted by a
+// delete, and SCHEMA by the database's new rules.
+// LOAD, SWAPDB and FLUSHALL append the whole new contents of the database,
+// so replaying the log from the start rebuilds it. rewriteAOF replaces the
+// log with a single record holding a snapshot of the database.
+//
+// An AOF is aofMagic, a format byte, the key derivation parameters as in a
+// save file header (see kdf.go), a 16-byte salt and a 16-byte file id. The
+// password and salt derive a master key once at startup; each file is
+// encrypted with an HMAC of its id under the master key, so a rewrite
+// starts a new file without deriving again. Records follow the header,
+// each a big-endian uint32 length and an AES-GCM ciphertext whose nonce is
+// its index in the file and whose additional data is the header, so
+// records cannot be reordered, copied between files or dropped from the
+// middle. A partial record at the end, left by a crash while appending,
+// is ignored.
+//
+// A record's plaintext is its op followed by its fields, each a uvarint
+// length and the bytes: the stored name and value for aofSet, the stored
+// name for aofDel, for aofKey the stored name and, unless the key no
+// longer exists, a snapshot of just that key as JSON, for aofSchemas the
+// rules as JSON, and for aofFull the key-name HMAC key (empty unless the
+// names are hashed) and the snapshot as JSON.
+const (
+	aofMagic     = "BoSa"
+	aofFormat    = 1
+	aofHeaderLen = len(aofMagic) + 1 + 1 + 4 + 4 + 1 + 16 + 16
+)
+
+// Record ops.
+const (
+	aofSet     = 'S'
+	aofDel     = 'D'
+	aofKey     = 'K'
+	aofSchemas = 'R'
+	aofFull    = 'F'
+)
+
+var errNoAOF = errors.New("no append-only log; start the server with -aof")
+
+// aofSyncInterval is how often appended records are fsynced.
+const aofSyncInterval = time.Second
+
+// aofLog appends records to an AOF. Writers append with the locks of the
+// shards they change held, so the log is in the order the writes were
+// applied; the lock order is shard locks, then mu.
+type aofLog struct {
+	file   string
+	master []byte
+	kdf    kdfParams
+	salt   []byte
+
+	// rewriteMu serializes rewrites.
+	rewriteMu sync.Mutex
+
+	mu     sync.Mutex
+	f      *os.File
+	header []byte
+	aead   cipher.AEAD
+	seq    uint64 // index of the next record
+	dirty  bool   // records written since the last fsync
+
+	// err is the first failed write. No records are appended after one
+	// until a rewrite succeeds.
+	err error
+
+	// rewriting is set while a rewrite runs. pending collects the records
+	// appended meanwhile, which the new file must also hold.
+	rewriting bool
+	pending   [][]byte
+}
+
+func aofHeader(p kdfParams, salt, id []byte) []byte {
+	h := append([]byte(aofMagic), aofFormat, p.id)
+	h = binary.BigEndian.AppendUint32(h, p.time)
+	h = binary.BigEndian.AppendUint32(h, p.memory)
+	h = append(h, p.threads)
+	h = append(h, salt...)
+	return append(h, id...)
+}
+
+// parseAOFHeader splits an AOF into its header, the key derivation it asks
+// for, its salt and id, and the records.
+func parseAOFHeader(data []byte) (header []byte, p kdfParams, salt, id, rest []byte, err error) {
+	if len(data) < aofHeaderLen || !bytes.HasPrefix(data, []byte(aofMagic)) {
+		return nil, p, nil, nil, nil, errors.New("not a BoS append-only log")
+	}
+	h := data[len(aofMagic):]
+	if h[0] != aofFormat {
+		return nil, p, nil, nil, nil, fmt.Errorf("unsupported log format %d", h[0])
+	}
+	p = kdfParams{
+		id:      h[1],
+		time:    binary.BigEndian.Uint32(h[2:]),
+		memory:  binary.BigEndian.Uint32(h[6:]),
+		threads: h[10],
+	}
+	if err := p.check(); err != nil {
+		return nil, p, nil, nil, nil, err
+	}
+	return data[:aofHeaderLen], p, h[11:27], h[27:43], data[aofHeaderLen:], nil
+}
+
+// aofCipher returns the cipher for the file with the given id.
+func aofCipher(master, id []byte) (cipher.AEAD, error) {
+	key := hmacSHA512(master, append([]byte("bos-aof"), id...))[:32]
+	defer zero(key)
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+func aofNonce(g cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, g.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// sealRecord frames the encryption of pt as record seq of a file.
+func sealRecord(g cipher.AEAD, header []byte, seq uint64, pt []byte) []byte {
+	out := make([]byte, 4, 4+len(pt)+g.Overhead())
+	out = g.Seal(out, aofNonce(g, seq), pt, header)
+	binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+	return out
+}
+
+func aofRecord(op byte, fields ...[]byte) []byte {
+	n := 1
+	for _, f := range fields {
+		n += binary.MaxVarintLen64 + len(f)
+	}
+	pt := append(make([]byte, 0, n), op)
+	for _, f := range fields {
+		pt = binary.AppendUvarint(pt, uint64(len(f)))
+		pt = append(pt, f...)
+	}
+	return pt
+}
+
+func parseAOFRecord(pt []byte) (op byte, fields [][]byte, err error) {
+	if len(pt) == 0 {
+		return 0, nil, errors.New("empty record")
+	}
+	op, pt = pt[0], pt[1:]
+	for len(pt) > 0 {
+		n, w := binary.Uvarint(pt)
+		if w <= 0 || n > uint64(len(pt)-w) {
+			return 0, nil, errors.New("truncated record field")
+		}
+		fields = append(fields, pt[w:w+int(n)])
+		pt = pt[w+int(n):]
+	}
+	return op, fields, nil
+}
+
+// fullRecord is the aofFull record for d, whose key names are hashed with
+// mac unless it is nil.
+func fullRecord(d *dump, mac []byte) []byte {
+	blob, err := json.Marshal(d)
+	if err != nil {
+		// A dump holds only strings, numbers and maps of them.
+		panic(err)
+	}
+	defer zero(blob)
+	return aofRecord(aofFull, mac, blob)
+}
+
+// firstKey and firstTwoKeys pick the keys of commands that name them at
+// the start of their arguments.
+func firstKey(args []string) []string { return args[:1] }
+
+func firstTwoKeys(args []string) []string { return args[:2] }
+
+// aofKeys gives, for each write to keys that does not log itself, the keys
+// it may have changed, as the client named them. dispatch logs their state
+// once the command has run, whatever it replied.
+var aofKeys = map[string]func(args []string) []string{
+	"APPEND":      firstKey,
+	"SETRANGE":    firstKey,
+	"EXPIRE":      firstKey,
+	"DELTOKEN":    firstKey,
+	"INCR":        firstKey,
+	"DECR":        firstKey,
+	"EVAL":        firstKey,
+	"NEXTID":      firstKey,
+	"JSONCOMPACT": firstKey,
+	"JSONPATCH":   firstKey,
+	"PFADD":       firstKey,
+	"PFMERGE":     firstKey,
+	"GEOADD":      firstKey,
+	"XADD":        firstKey,
+	"XTRIM":       firstKey,
+	"XACK":        firstKey,
+	"RENAME":      firstTwoKeys,
+	"XGROUP": func(args []string) []string {
+		if len(args) < 2 {
+			return nil
+		}
+		return args[1:2]
+	},
+	"XREADGROUP": func(args []string) []string {
+		if len(args) < 3 {
+			return nil
+		}
+		sa, _ := parseStreamsArgs(args[3:])
+		return sa.keys
+	},
+}
+
+// logKeys appends the state of each of keys, as the client named them, to
+// the log. Reading the state and appending it under the shard's lock keeps
+// the last record of a key no older than the last write to it, even when
+// another write to the key slips in before this one is logged.
+func (k *kv) logKeys(keys []string) {
+	for _, key := range keys {
+		sh, key := k.route(key)
+		sh.mu.RLock()
+		k.aof.append(sh.keyRecordLocked(key))
+		sh.mu.RUnlock()
+	}
+}
+
+// keyRecordLocked is the aofKey record of the stored name key. k.mu must
+// be held.
+func (k *kvShard) keyRecordLocked(key string) []byte {
+	if k.expiredLocked(key, time.Now()) || k.typeLocked(key) == "none" {
+		return aofRecord(aofKey, []byte(key))
+	}
+	d := &dump{Version: snapshotVersion, Data: map[string]string{}}
+	if st, ok := k.streams[key]; ok {
+		d.Streams = map[string]*streamDump{key: st.dump()}
+	} else if n, ok := k.counters[key]; ok {
+		d.Counters = map[string]int64{key: n}
+	} else if g, ok := k.geos[key]; ok {
+		d.Geo = map[string]map[string]uint64{key: maps.Clone(g.hashes)}
+	} else {
+		v, _, fresh := k.valueLocked(key)
+		d.Data[key] = string(v)
+		if fresh {
+			zero(v)
+		}
+		if k.hll[key] {
+			d.HLL = map[string]bool{key: true}
+		}
+	}
+	if t, ok := k.expiry[key]; ok {
+		d.Expiry = map[string]int64{key: t.UnixMilli()}
+	}
+	blob, err := json.Marshal(d)
+	if err != nil {
+		panic(err) // as in fullRecord
+	}
+	defer zero(blob)
+	return aofRecord(aofKey, []byte(key), blob)
+}
+
+// restoreKey replaces whatever the stored name key holds with its value in
+// d, which must hold no other key, or deletes it if d is nil.
+func (k *kv) restoreKey(key string, d *dump) error {
+	var streams map[string]*stream
+	if d != nil {
+		if d.len() != 1 || !d.has(key) {
+			return fmt.Errorf("record for %q holds other keys", key)
+		}
+		var err error
+		if streams, err = d.restoreStreams(); err != nil {
+			return err
+		}
+	}
+	sh := k.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.deleteLocked(key)
+	if d != nil {
+		k.storeDumpLocked(d, streams)
+		sh.notePeakLocked()
+	}
+	return nil
+}
+
+// dropLocked deletes key when it expires or is evicted, which no command
+// asked for, and logs the delete. k.mu must be held.
+func (k *kvShard) dropLocked(key string) {
+	if k.deleteLocked(key) && k.aof != nil {
+		k.aof.del(key)
+	}
+}
+
+// attachAOF sets the log the store and its shards append to.
+func (k *kv) attachAOF(a *aofLog) {
+	k.aof = a
+	for _, sh := range k.shards {
+		sh.aof = a
+	}
+}
+
+// schemasRecord is the aofSchemas record of ss.
+func schemasRecord(ss schemas) []byte {
+	blob, err := json.Marshal(ss.dump())
+	if err != nil {
+		panic(err) // a map of strings
+	}
+	return aofRecord(aofSchemas, blob)
+}
+
+// applyAOF applies one decrypted record to the store.
+func (k *kv) applyAOF(pt []byte) error {
+	op, f, err := parseAOFRecord(pt)
+	if err != nil {
+		return err
+	}
+	switch {
+	case op == aofSet && len(f) == 2:
+		name := string(f[0])
+		k.shardOf(name).setBytes(name, bytes.Clone(f[1]))
+	case op == aofDel && len(f) == 1:
+		name := string(f[0])
+		k.shardOf(name).del(name)
+	case op == aofKey && (len(f) == 1 || len(f) == 2):
+		var d *dump
+		if len(f) == 2 {
+			if d, err = decodeSnapshot(f[1]); err != nil {
+				return err
+			}
+		}
+		return k.restoreKey(string(f[0]), d)
+	case op == aofSchemas && len(f) == 1:
+		var m map[string]string
+		if err := json.Unmarshal(f[0], &m); err != nil {
+			return err
+		}
+		ss, err := parseSchemas(m)
+		if err != nil {
+			return err
+		}
+		k.schemaMu.Lock()
+		k.schemas.Store(&ss)
+		k.schemaMu.Unlock()
+	case op == aofFull && len(f) == 2:
+		d, err := decodeSnapshot(f[1])
+		if err != nil {
+			return err
+		}
+		if len(f[0]) > 0 {
+			d.mac = bytes.Clone(f[0])
+		}
+		return k.replace(d)
+	default:
+		return fmt.Errorf("invalid record %q", op)
+	}
+	return nil
+}
+
+// replayAOF applies every record of the AOF read from file to k, which has
+// no log attached. It returns a log keyed like the file, not yet attached,
+// and how many records it applied.
+func replayAOF(k *kv, file string, data, pass []byte) (aof *aofLog, records int, err error) {
+	header, p, salt, id, rest, err := parseAOFHeader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	a := &aofLog{file: file, master: p.derive(pass, salt), kdf: p, salt: bytes.Clone(salt)}
+	g, err := aofCipher(a.master, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	for seq := uint64(0); len(rest) > 0; seq++ {
+		if len(rest) < 4 {
+			break
+		}
+		n := binary.BigEndian.Uint32(rest)
+		if uint64(n) > uint64(len(rest)-4) {
+			break
+		}
+		pt, err := g.Open(nil, aofNonce(g, seq), rest[4:4+n], header)
+		if err != nil {
+			return nil, records, fmt.Errorf("record %d: %w", seq, err)
+		}
+		err = k.applyAOF(pt)
+		zero(pt)
+		if err != nil {
+			return nil, records, fmt.Errorf("record %d: %w", seq, err)
+		}
+		records++
+		rest = rest[4+n:]
+	}
+	if len(rest) > 0 {
+		slog.Warn("ignoring a partial record at the end of the append-only log", "file", a.file, "bytes", len(rest))
+	}
+	return a, records, nil
+}
+
+// openAOF replays the AOF in file into k, if it exists, and attaches a log
+// to k that starts with a rewrite of its contents. A new log derives its
+// key with kdf, or defaultKDF if that is zero.
+func openAOF(k *kv, file string, pass []byte, kdf kdfParams) (records int, err error) {
+	data, err := os.ReadFile(file)
+	var a *aofLog
+	switch {
+	case err == nil:
+		a, records, err = replayAOF(k, file, data, pass)
+		zero(data)
+		if err != nil {
+			return records, err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		if kdf == (kdfParams{}) {
+			kdf = defaultKDF
+		}
+		if err := kdf.check(); err != nil {
+			return 0, err
+		}
+		a = &aofLog{file: file, kdf: kdf, salt: make([]byte, 16)}
+		if _, err := rand.Read(a.salt); err != nil {
+			return 0, err
+		}
+		a.master = kdf.derive(pass, a.salt)
+	default:
+		return 0, err
+	}
+	k.attachAOF(a)
+	if err := k.rewriteAOF(); err != nil {
+		k.attachAOF(nil)
+		return records, err
+	}
+	return records, nil
+}
+
+// append encrypts pt onto the log and takes ownership of it. The locks of
+// the shards the record changes must be held.
+func (a *aofLog) append(pt []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil && a.f != nil {
+		if _, err := a.f.Write(sealRecord(a.aead, a.header, a.seq, pt)); err != nil {
+			a.err = err
+			slog.Error("append-only log write failed; writes are not logged until it is rewritten", "file", a.file, "err", err)
+		}
+		a.seq++
+		a.dirty = true
+	}
+	if a.rewriting {
+		a.pending = append(a.pending, pt)
+		return
+	}
+	zero(pt)
+}
+
+// set and del log a write to the stored name key.
+func (a *aofLog) set(key string, val []byte) {
+	a.append(aofRecord(aofSet, []byte(key), val))
+}
+
+func (a *aofLog) del(key string) {
+	a.append(aofRecord(aofDel, []byte(key)))
+}
+
+// sync fsyncs the records appended since the last sync.
+func (a *aofLog) sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.dirty || a.f == nil {
+		return nil
+	}
+	a.dirty = false
+	return a.f.Sync()
+}
+
+// syncEvery fsyncs the log every interval, so a crash of the machine
+// loses at most that much of it.
+func (a *aofLog) syncEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.sync(); err != nil {
+			slog.Error("append-only log fsync failed", "file", a.file, "err", err)
+		}
+	}
+}
+
+// rewriteAOF replaces the store's log with a new file that holds a
+// snapshot of the store and then the records appended while it was being
+// written. Writers only wait for the snapshot to be copied and for the
+// final records to reach the new file; the new file is fsynced and renamed
+// into place as writeDurable does.
+func (k *kv) rewriteAOF() error {
+	a := k.aof
+	if a == nil {
+		return errNoAOF
+	}
+	a.rewriteMu.Lock()
+	defer a.rewriteMu.Unlock()
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	g, err := aofCipher(a.master, id)
+	if err != nil {
+		return err
+	}
+	header := aofHeader(a.kdf, a.salt, id)
+
+	k.rlockAll()
+	pt := fullRecord(k.snapshotLocked(), k.hashedWith())
+	a.mu.Lock()
+	a.rewriting = true
+	a.mu.Unlock()
+	k.runlockAll()
+
+	dir := filepath.Dir(a.file)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(a.file)+".tmp-*")
+	if err == nil {
+		_, err = f.Write(append(bytes.Clone(header), sealRecord(g, header, 0, pt)...))
+	}
+	zero(pt)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	seq := uint64(1)
+	for _, p := range a.pending {
+		if err == nil {
+			_, err = f.Write(sealRecord(g, header, seq, p))
+		}
+		zero(p)
+		seq++
+	}
+	a.rewriting, a.pending = false, nil
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), a.file)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		return err
+	}
+	if a.f != nil {
+		a.f.Close()
+	}
+	a.f, a.aead, a.header, a.seq = f, g, header, seq
+	a.dirty, a.err = false, nil
+	return nil
+}
+
+// openAOF replays -aof into database 0 and starts logging its writes, with
+// the password in passFile. replayed reports that the log existed and
+// replaced the data set.
+func (s *server) openAOF(file, passFile string) (replayed bool, err error) {
+	pass, err := readPassFile(passFile)
+	if err != nil {
+		return false, fmt.Errorf("read -aof-pass-file: %w", err)
+	}
+	defer zero(pass)
+	records, err := openAOF(s.dbs[0], file, pass, s.cfg.save.kdf)
+	if err != nil {
+		return false, fmt.Errorf("replay %s: %w", file, err)
+	}
+	slog.Info("opened append-only log", "file", file, "records", records, "keys", s.dbs[0].len())
+	go s.dbs[0].aof.syncEvery(aofSyncInterval)
+	return records > 0, nil
+}
+
+// cmdRewriteAOF handles REWRITEAOF, which compacts the append-only log to
+// a snapshot of database 0.
+func cmdRewriteAOF(s *server, cl *client, args []string) reply {
+	if err := s.dbs[0].rewriteAOF(); err != nil {
+		return errReply(err.Error())
+	}
+	return okReply
+}
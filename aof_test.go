@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// reopenAOF replays a copy of file, as a restarted server would, and
+// returns the server. Opening rewrites the log, so replaying file itself
+// would leave the server that is still writing to it logging to a file
+// that has been replaced.
+func reopenAOF(t *testing.T, file, pass string) *server {
+	t.Helper()
+	copied := filepath.Join(t.TempDir(), "aof")
+	if data, err := os.ReadFile(file); err == nil {
+		if err := os.WriteFile(copied, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return openAOFServer(t, copied, pass)
+}
+
+// openAOFServer returns a server logging database 0 to file.
+func openAOFServer(t *testing.T, file, pass string) *server {
+	t.Helper()
+	srv := newServer(config{})
+	if _, err := openAOF(srv.dbs[0], file, []byte(pass), kdfParams{}); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func snapshotJSON(k *kv) string {
+	b, _ := json.Marshal(k.snapshot())
+	return string(b)
+}
+
+func TestAOF(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aof")
+	srv := openAOFServer(t, file, "pw")
+	cl := &client{}
+	for _, args := range [][]string{
+		{"SET", "a", "1"},
+		{"SET", "b", "2"},
+		{"MSET", "c", "3", "d", "4"},
+		{"DEL", "b"},
+		{"SET", "a", "one"},
+	} {
+		srv.dispatch(cl, args)
+	}
+	// Writes to other databases are not logged.
+	srv.dispatch(&client{db: 1}, []string{"SET", "x", "elsewhere"})
+
+	got := reopenAOF(t, file, "pw")
+	if a, b := snapshotJSON(got.dbs[0]), snapshotJSON(srv.dbs[0]); a != b {
+		t.Errorf("replayed %s, want %s", a, b)
+	}
+	if got.dbs[1].len() != 0 {
+		t.Errorf("database 1 has %d keys after replay", got.dbs[1].len())
+	}
+
+	// SWAPDB logs the new contents of database 0.
+	srv.dispatch(&client{}, []string{"SWAPDB", "0", "1"})
+	got = reopenAOF(t, file, "pw")
+	if v, _ := got.dbs[0].get("x"); v != "elsewhere" || got.dbs[0].len() != 1 {
+		t.Errorf("after SWAPDB replayed %s", snapshotJSON(got.dbs[0]))
+	}
+
+	if _, err := openAOF(newKV(), file, []byte("wrong"), kdfParams{}); err == nil {
+		t.Error("replayed the log with the wrong password")
+	}
+}
+
+// TestAOFEveryWrite replays a log of every kind of write to a key.
+func TestAOFEveryWrite(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aof")
+	srv := openAOFServer(t, file, "pw")
+	cl := &client{}
+	for _, args := range [][]string{
+		{"SET", "n", "1"},
+		{"INCR", "n"},
+		{"APPEND", "n", "x"},
+		{"SET", "t", "v"},
+		{"EXPIRE", "t", "100"},
+		{"SET", "gone", "v"},
+		{"EXPIRE", "gone", "0"},
+		{"SET", "r", "abc"},
+		{"SETRANGE", "r", "1", "Z"},
+		{"EVAL", "r", "upper"},
+		{"RENAME", "r", "r2"},
+		{"SET", "doc", `{ "a": 1 }`},
+		{"JSONCOMPACT", "doc"},
+		{"JSONPATCH", "doc", `{"b":2}`},
+		{"SET", "tok", "me"},
+		{"DELTOKEN", "tok", "me"},
+		{"NEXTID", "seq"},
+		{"DECR", "d"},
+		{"PFADD", "h", "a", "b"},
+		{"PFMERGE", "h2", "h"},
+		{"GEOADD", "g", "13.4", "52.5", "berlin"},
+		{"XADD", "s", "1-0", "f", "v"},
+		{"XADD", "s", "2-0", "f", "w"},
+		{"XGROUP", "CREATE", "s", "grp", "0"},
+		{"XREADGROUP", "GROUP", "grp", "c", "COUNT", "1", "STREAMS", "s", ">"},
+		{"XTRIM", "s", "MAXLEN", "5"},
+		{"SCHEMA", "SET", "doc", "json"},
+		{"SET", "e", "v"},
+		{"EXPIRE", "e", "100"},
+	} {
+		if r := srv.dispatch(cl, args); r.kind == kindErr {
+			t.Fatalf("%v = %+v", args, r)
+		}
+	}
+	db := srv.dbs[0]
+	backdate(db, "e")
+	db.get("e") // reaps it
+	c, _ := pipelineConn(t, srv)
+	io.WriteString(c, "ATOMIC 1\nINCR n2\n")
+	r := bufio.NewReader(c)
+	for range 2 {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := reopenAOF(t, file, "pw")
+	if a, b := snapshotJSON(got.dbs[0]), snapshotJSON(db); a != b {
+		t.Errorf("replayed %s\nwant %s", a, b)
+	}
+	if v, _ := got.dbs[0].get("n"); v != "2x" {
+		t.Errorf("n = %q after replay", v)
+	}
+	if left, _, hasTTL := got.dbs[0].ttl("t"); !hasTTL || left <= 0 {
+		t.Errorf("t has TTL %v after replay", left)
+	}
+	if got.dbs[0].exists("e") || got.dbs[0].exists("gone") || got.dbs[0].exists("r") {
+		t.Error("a deleted key came back")
+	}
+	if r := got.dispatch(cl, []string{"SET", "doc", "{"}); r.text != errSchemaViolation.Error() {
+		t.Errorf("SET against a replayed schema = %+v", r)
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aof")
+	srv := openAOFServer(t, file, "pw")
+	db := srv.dbs[0]
+	for i := 0; i < 500; i++ {
+		db.set("k", strconv.Itoa(i))
+	}
+	db.set("n", "1")
+	db.expire("n", 3600e9)
+	before, _ := os.Stat(file)
+	if got := srv.dispatch(&client{}, []string{"REWRITEAOF"}); got.kind != kindOK {
+		t.Fatalf("REWRITEAOF = %+v", got)
+	}
+	after, _ := os.Stat(file)
+	if after.Size() >= before.Size() {
+		t.Errorf("rewrite grew the log from %d to %d bytes", before.Size(), after.Size())
+	}
+	got := reopenAOF(t, file, "pw")
+	if v, _ := got.dbs[0].get("k"); v != "499" {
+		t.Errorf("k = %q after rewrite", v)
+	}
+	// The rewrite snapshot carries the TTL that EXPIRE did not log.
+	if _, _, hasTTL := got.dbs[0].ttl("n"); !hasTTL {
+		t.Error("TTL of n lost in the rewrite")
+	}
+
+	// Writes made during a rewrite land in the new file.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 300; i++ {
+			db.set("w"+strconv.Itoa(i%50), strconv.Itoa(i))
+			db.del("w" + strconv.Itoa((i+25)%50))
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if err := db.rewriteAOF(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	got = reopenAOF(t, file, "pw")
+	if a, b := snapshotJSON(got.dbs[0]), snapshotJSON(db); a != b {
+		t.Errorf("replayed %s, want %s", a, b)
+	}
+
+	if got := srv.dispatch(&client{}, []string{"REWRITEAOF"}); got.kind != kindOK {
+		t.Fatalf("REWRITEAOF = %+v", got)
+	}
+	noLog := newServer(config{})
+	if got := noLog.dispatch(&client{}, []string{"REWRITEAOF"}); got.text != errNoAOF.Error() {
+		t.Errorf("REWRITEAOF without -aof = %+v", got)
+	}
+}
+
+func TestAOFPartialTail(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aof")
+	srv := openAOFServer(t, file, "pw")
+	srv.dbs[0].set("a", "1")
+	srv.dbs[0].set("b", "2")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash in the middle of appending the last record leaves part of it.
+	if err := os.WriteFile(file, data[:len(data)-3], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got := reopenAOF(t, file, "pw")
+	if v, _ := got.dbs[0].get("a"); v != "1" || got.dbs[0].exists("b") {
+		t.Errorf("replayed %s", snapshotJSON(got.dbs[0]))
+	}
+
+	// A complete record that fails to decrypt is an error.
+	data, _ = os.ReadFile(file)
+	data[aofHeaderLen+6] ^= 1
+	os.WriteFile(file, data, 0o600)
+	if _, err := openAOF(newKV(), file, []byte("pw"), kdfParams{}); err == nil {
+		t.Error("replayed a damaged log")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxAtomicCommands bounds the commands in one ATOMIC batch.
+const maxAtomicCommands = 1000
+
+// atomicCommands are the commands ATOMIC runs, by their original names.
+// Each one runs with the write lock of sh, the shard holding the stored
+// name key, already held, and args are the command's arguments after the
+// key. check is the schema check for the key as the client named it, or
+// nil; SET and SETNX values are checked before the batch runs.
+var atomicCommands = map[string]atomicFunc{
+	"GET":    atomicGet,
+	"EXISTS": atomicExists,
+	"SET":    atomicSet,
+	"SETNX":  atomicSetNX,
+	"DEL":    atomicDel,
+	"INCR":   atomicIncr,
+	"DECR":   atomicDecr,
+}
+
+type atomicFunc func(k *kv, sh *kvShard, key string, args []string, check func([]byte) error) reply
+
+func atomicGet(k *kv, sh *kvShard, key string, _ []string, _ func([]byte) error) reply {
+	sh.reapLocked(key)
+	if n, ok := sh.counters[key]; ok {
+		return strReply(strconv.FormatInt(n, 10))
+	}
+	v, ok, fresh := sh.valueLocked(key)
+	if !ok {
+		if t := sh.typeLocked(key); t == "stream" || t == "geo" {
+			return errReply(errWrongType.Error())
+		}
+		return nilReply
+	}
+	r := strReply(string(v))
+	if fresh {
+		zero(v)
+	}
+	if sh.lru != nil {
+		sh.lru.touch(key)
+	}
+	return r
+}
+
+func atomicExists(k *kv, sh *kvShard, key string, _ []string, _ func([]byte) error) reply {
+	sh.reapLocked(key)
+	if sh.typeLocked(key) != "none" {
+		return intReply(1)
+	}
+	return intReply(0)
+}
+
+// commandValue is the value of SET or SETNX, as cmdSet reads it.
+func commandValue(args []string) string {
+	val := strings.Join(args, " ")
+	if val == emptyValue {
+		return ""
+	}
+	return val
+}
+
+func atomicIncr(k *kv, sh *kvShard, key string, _ []string, check func([]byte) error) reply {
+	return k.logIncr(sh, key, 1, check)
+}
+
+func atomicDecr(k *kv, sh *kvShard, key string, _ []string, check func([]byte) error) reply {
+	return k.logIncr(sh, key, -1, check)
+}
+
+// logIncr adds delta to the counter at key, logging the result as
+// dispatch logs INCR.
+func (k *kv) logIncr(sh *kvShard, key string, delta int64, check func([]byte) error) reply {
+	r := incrReply(sh.incrByLocked(key, delta, check))
+	if k.aof != nil {
+		k.aof.append(sh.keyRecordLocked(key))
+	}
+	return r
+}
+
+func atomicSet(k *kv, sh *kvShard, key string, args []string, _ func([]byte) error) reply {
+	k.setLocked(sh, key, []byte(commandValue(args)))
+	return okReply
+}
+
+func atomicSetNX(k *kv, sh *kvShard, key string, args []string, _ func([]byte) error) reply {
+	if k.setNXLocked(sh, key, []byte(commandValue(args))) {
+		return intReply(1)
+	}
+	return intReply(0)
+}
+
+func atomicDel(k *kv, sh *kvShard, key string, _ []string, _ func([]byte) error) reply {
+	if k.delLocked(sh, key) {
+		return okReply
+	}
+	return nilReply
+}
+
+// cmdAtomic handles ATOMIC n. The line is followed on the connection by n
+// command lines, which run together with the write locks of every shard
+// they touch held, so no other client sees the store between them. Only
+// the commands in atomicCommands may appear. Every line is read and
+// checked before any runs: an unknown, disabled or disallowed command, a
+// wrong argument count or a value SET would refuse fails the whole batch.
+// Otherwise the reply holds each command's reply in order; a command that
+// fails as it runs, such as INCR of a non-integer, replies with its error
+// and the others still run.
+func cmdAtomic(s *server, cl *client, args []string) reply {
+	count, err := strconv.Atoi(args[0])
+	if err != nil || count < 1 || count > maxAtomicCommands {
+		return errReply(fmt.Sprintf("ATOMIC count must be from 1 to %d", maxAtomicCommands))
+	}
+	if cl.r == nil {
+		return errReply("ATOMIC needs a connection to read from")
+	}
+	cmds := make([][]string, count)
+	for i := range cmds {
+		line, err := cl.r.ReadString('\n')
+		if err != nil {
+			cl.hangup = true
+			return errReply(fmt.Sprintf("ATOMIC ended after %d of %d commands", i, count))
+		}
+		cmds[i] = strings.Fields(line)
+	}
+	db := s.db(cl)
+	runs := make([]atomicFunc, count)
+	names := make([]string, count)
+	checks := make([]func([]byte) error, count)
+	for i, cmd := range cmds {
+		if r, ok := s.checkAtomic(cl, cmd); !ok {
+			return errReply(fmt.Sprintf("ATOMIC command %d: %s", i+1, r.text))
+		}
+		runs[i] = atomicCommands[s.commands[strings.ToUpper(cmd[0])].name]
+		names[i] = db.name(cmd[1])
+		checks[i] = db.schemaCheck(cmd[1])
+	}
+	out := reply{kind: kindArray, items: make([]reply, count)}
+	unlock := db.lockNames(names, true)
+	for i, cmd := range cmds {
+		out.items[i] = runs[i](db, db.shardOf(names[i]), names[i], cmd[2:], checks[i])
+	}
+	unlock()
+	return out
+}
+
+// checkAtomic checks one command of an ATOMIC batch without running it.
+func (s *server) checkAtomic(cl *client, cmd []string) (reply, bool) {
+	if len(cmd) == 0 {
+		return errReply("empty command"), false
+	}
+	c, ok := s.commands[strings.ToUpper(cmd[0])]
+	if !ok {
+		return errReply(fmt.Sprintf("unknown command '%s'", cmd[0])), false
+	}
+	if c.disabled {
+		return errReply("command disabled"), false
+	}
+	if atomicCommands[c.name] == nil {
+		return errReply(fmt.Sprintf("%s is not allowed in ATOMIC", cmd[0])), false
+	}
+	args := cmd[1:]
+	if len(args) < c.minArgs || (c.maxArgs >= 0 && len(args) > c.maxArgs) {
+		return wrongArgs(cmd[0]), false
+	}
+	var val []byte
+	if c.name == "SET" || c.name == "SETNX" {
+		val = []byte(commandValue(args[1:]))
+		if s.cfg.maxValueBytes > 0 && len(val) > s.cfg.maxValueBytes {
+			return errReply(errValueTooLarge.Error()), false
+		}
+		if err := s.db(cl).checkSchema(args[0], val); err != nil {
+			return errReply(err.Error()), false
+		}
+	}
+	if c.name == "SET" || c.name == "SETNX" || c.name == "DEL" {
+		return s.controlChars(cl, c.name, args[0], val)
+	}
+	return reply{}, true
+}
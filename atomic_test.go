@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAtomic(t *testing.T) {
+	srv := newServer(config{maxValueBytes: 16})
+	c, _ := pipelineConn(t, srv)
+	r := bufio.NewReader(c)
+	// send writes a request and reads n reply lines.
+	send := func(req string, n int) string {
+		t.Helper()
+		io.WriteString(c, req)
+		var out []string
+		for range n {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, strings.TrimSuffix(line, "\n"))
+		}
+		return strings.Join(out, "|")
+	}
+
+	srv.dbs[0].set("s", "text")
+	got := send("ATOMIC 7\nSET a 1\nINCR a\nget a\nSETNX a 5\nINCR s\nDEL a\nEXISTS a\n", 8)
+	if want := "7|OK|2|2|0|ERR not an integer|OK|0"; got != want {
+		t.Errorf("ATOMIC = %q, want %q", got, want)
+	}
+	if got := send("PING\n", 1); got != "PONG" {
+		t.Fatalf("PING after ATOMIC = %q", got)
+	}
+
+	// A bad command anywhere fails the batch before anything runs.
+	for req, want := range map[string]string{
+		"ATOMIC 2\nSET b 1\nGET\n":                                   "ERR ATOMIC command 2: wrong number of arguments for 'get'",
+		"ATOMIC 2\nSET b 1\nFLUSHALL\n":                              "ERR ATOMIC command 2: FLUSHALL is not allowed in ATOMIC",
+		"ATOMIC 2\nSET b 1\nNOPE x\n":                                "ERR ATOMIC command 2: unknown command 'NOPE'",
+		"ATOMIC 2\nSET b 1\n\n":                                      "ERR ATOMIC command 2: empty command",
+		"ATOMIC 2\nSET b 1\nSET c " + strings.Repeat("x", 17) + "\n": "ERR ATOMIC command 2: value too large",
+	} {
+		if got := send(req, 1); got != want {
+			t.Errorf("%q = %q, want %q", req, got, want)
+		}
+		if srv.dbs[0].exists("b") {
+			t.Fatalf("%q applied part of the batch", req)
+		}
+		if got := send("PING\n", 1); got != "PONG" {
+			t.Fatalf("PING after %q = %q", req, got)
+		}
+	}
+	if got := send("ATOMIC 0\n", 1); !strings.HasPrefix(got, "ERR ATOMIC count") {
+		t.Errorf("ATOMIC 0 = %q", got)
+	}
+}
+
+// TestAtomicIsolation checks that a reader never sees half of a batch.
+func TestAtomicIsolation(t *testing.T) {
+	srv := newServer(config{})
+	c, _ := pipelineConn(t, srv)
+	r := bufio.NewReader(c)
+	db := srv.dbs[0]
+	db.set("x", "0")
+	db.set("y", "0")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			vals := srv.dispatch(&client{}, []string{"MGET", "x", "y"})
+			if vals.items[0].text != vals.items[1].text {
+				t.Errorf("MGET saw x=%s y=%s", vals.items[0].text, vals.items[1].text)
+				return
+			}
+		}
+	}()
+	for i := 1; i <= 200; i++ {
+		n := strconv.Itoa(i)
+		io.WriteString(c, "ATOMIC 2\nSET x "+n+"\nSET y "+n+"\n")
+		for range 3 {
+			if _, err := r.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"strings"
+)
+
+var (
+	errNoAuth    = errors.New("NOAUTH authentication required")
+	errWrongPass = errors.New("WRONGPASS invalid password")
+	errNoPass    = errors.New("AUTH called without a password configured")
+)
+
+// auth runs AUTH password for handle, which tracks whether each
+// connection has authenticated, and reports whether the password is
+// -requirepass. Both sides are hashed before the constant-time comparison
+// so that it does not leak the password's length either.
+func (s *server) auth(args []string) (reply, bool) {
+	if s.cfg.requirePass == "" {
+		return errReply(errNoPass.Error()), false
+	}
+	if len(args) != 1 {
+		return wrongArgs("AUTH"), false
+	}
+	want := sha256.Sum256([]byte(s.cfg.requirePass))
+	got := sha256.Sum256([]byte(args[0]))
+	if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+		return errReply(errWrongPass.Error()), false
+	}
+	return okReply, true
+}
+
+// beforeAuth reports whether the command name may run on a connection that
+// has not authenticated. Only PING may, under whatever name it has, so
+// health checks need no password.
+func (s *server) beforeAuth(name string) bool {
+	c, ok := s.commands[strings.ToUpper(name)]
+	return ok && c.name == "PING"
+}
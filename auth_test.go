@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestRequirePass(t *testing.T) {
+	srv := newServer(config{requirePass: "s3cret"})
+	c, r := connect(t, srv)
+	for _, tc := range []struct{ req, want string }{
+		{"SET a 1", "ERR " + errNoAuth.Error() + "\n"},
+		{"GET a", "ERR " + errNoAuth.Error() + "\n"},
+		{"AUTH wrong", "ERR " + errWrongPass.Error() + "\n"},
+		{"AUTH s3cre", "ERR " + errWrongPass.Error() + "\n"},
+		// Health checks run unauthenticated.
+		{"PING", "PONG\n"},
+		{"PING are you there", "are you there\n"},
+		{"AUTH", "ERR wrong number of arguments for 'auth'\n"},
+		{"AUTH s3cret", "OK\n"},
+		{"SET a 1", "OK\n"},
+		// A failed AUTH does not undo an earlier one.
+		{"AUTH wrong", "ERR " + errWrongPass.Error() + "\n"},
+		{"GET a", "1\n"},
+	} {
+		if got := roundTrip(t, c, r, tc.req); got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.req, got, tc.want)
+		}
+	}
+	// Authentication is per connection.
+	c2, r2 := connect(t, srv)
+	if got := roundTrip(t, c2, r2, "GET a"); got != "ERR "+errNoAuth.Error()+"\n" {
+		t.Errorf("GET on a new connection = %q", got)
+	}
+
+	c3, r3 := connect(t, newServer(config{}))
+	if got := roundTrip(t, c3, r3, "AUTH x"); got != "ERR "+errNoPass.Error()+"\n" {
+		t.Errorf("AUTH without -requirepass = %q", got)
+	}
+	if got := roundTrip(t, c3, r3, "SET a 1"); got != "OK\n" {
+		t.Errorf("SET without -requirepass = %q", got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamSignal returns a channel that is closed the next time a stream in
+// k gains entries or k's contents are replaced wholesale. Like a condition
+// variable broadcast, it wakes every waiter, which then re-checks.
+func (k *kv) streamSignal() <-chan struct{} {
+	k.sigMu.Lock()
+	defer k.sigMu.Unlock()
+	if k.streamAdded == nil {
+		k.streamAdded = make(chan struct{})
+	}
+	return k.streamAdded
+}
+
+// signal wakes the waiters of streamSignal.
+func (k *kv) signal() {
+	k.sigMu.Lock()
+	defer k.sigMu.Unlock()
+	if k.streamAdded != nil {
+		close(k.streamAdded)
+		k.streamAdded = nil
+	}
+}
+
+// linesOrBlock runs read and replies with its lines. When there are none
+// and sa asks to block, it waits for new stream entries in db and retries
+// until read finds some, the timeout passes (NIL), or the connection goes
+// away. cmd names the command for CLIENT LIST.
+func linesOrBlock(cl *client, db *kv, cmd string, sa streamsArgs, read func() ([]string, error)) reply {
+	lines, err := read()
+	if err == nil && len(lines) == 0 && sa.blocking {
+		lines, err = cl.block(db, sa.block, cmd+":"+strings.Join(sa.keys, ","), read)
+	}
+	if err != nil {
+		return errReply(err.Error())
+	}
+	if len(lines) == 0 {
+		return nilReply
+	}
+	return arrayReply(lines)
+}
+
+// block waits for read to return lines. timeout 0 waits until the client
+// disconnects or CLIENT UNBLOCK releases it; on describes the wait. Replies
+// queued by earlier pipelined commands are flushed first so the client is
+// not left waiting on them too.
+func (cl *client) block(db *kv, timeout time.Duration, on string, read func() ([]string, error)) ([]string, error) {
+	ctx, cancel := context.WithCancel(cl.context())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	if cl.w != nil {
+		cl.flush()
+	}
+	unblock := cl.startBlock(on)
+	defer cl.endBlock()
+	cl.blocked.Store(true)
+	defer cl.blocked.Store(false)
+	defer cl.watchDisconnect(cancel)()
+	for {
+		// Take the signal before reading, so an XADD between the read and
+		// the wait still wakes us.
+		wake := db.streamSignal()
+		lines, err := read()
+		if err != nil || len(lines) > 0 {
+			return lines, err
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, nil
+		case err := <-unblock:
+			return nil, err
+		}
+	}
+}
+
+// errUnblocked is what a command released by CLIENT UNBLOCK ERROR replies.
+var errUnblocked = errors.New("UNBLOCKED client unblocked via CLIENT UNBLOCK")
+
+// startBlock records that cl is blocked on on and returns the channel
+// CLIENT UNBLOCK sends to.
+func (cl *client) startBlock(on string) <-chan error {
+	cl.bmu.Lock()
+	defer cl.bmu.Unlock()
+	cl.blockedOn = on
+	cl.unblock = make(chan error, 1)
+	return cl.unblock
+}
+
+func (cl *client) endBlock() {
+	cl.bmu.Lock()
+	cl.blockedOn, cl.unblock = "", nil
+	cl.bmu.Unlock()
+}
+
+// wake releases cl from a blocking command, which then replies NIL as if
+// it had timed out, or with err if it is not nil. It reports whether cl
+// was blocked.
+func (cl *client) wake(err error) bool {
+	cl.bmu.Lock()
+	defer cl.bmu.Unlock()
+	if cl.unblock == nil {
+		return false
+	}
+	cl.unblock <- err
+	cl.blockedOn, cl.unblock = "", nil
+	return true
+}
+
+// context is cancelled when the connection is closed.
+func (cl *client) context() context.Context {
+	if cl.ctx == nil {
+		return context.Background()
+	}
+	return cl.ctx
+}
+
+// watchDisconnect calls cancel if the peer hangs up while the handler is
+// blocked in a command, by peeking at the handler's reader. The returned
+// stop must be called before the handler reads again: it interrupts the
+// peek with a read deadline and waits for it to finish.
+func (cl *client) watchDisconnect(cancel func()) (stop func()) {
+	if cl.r == nil {
+		return func() {}
+	}
+	// -idle-timeout does not apply while the client waits.
+	cl.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := cl.r.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+	return func() {
+		cl.SetReadDeadline(time.Now())
+		<-done
+		cl.SetReadDeadline(time.Time{})
+	}
+}
+
+// clientUnblock handles CLIENT UNBLOCK id [TIMEOUT|ERROR]. It replies 1 if
+// the client was blocked and 0 otherwise.
+func clientUnblock(s *server, args []string) reply {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs("client unblock")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errReply("client id is not an integer")
+	}
+	var reason error
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "ERROR":
+			reason = errUnblocked
+		case "TIMEOUT":
+		default:
+			return errReply("syntax error")
+		}
+	}
+	s.mu.Lock()
+	cl := s.clients[id]
+	s.mu.Unlock()
+	if cl == nil || !cl.wake(reason) {
+		return intReply(0)
+	}
+	return intReply(1)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func blockedClients(srv *server) int {
+	n := 0
+	for _, cl := range srv.clientsByID() {
+		if cl.blocked.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestXReadBlockTimeout(t *testing.T) {
+	c, r := connect(t, newServer(config{}))
+	start := time.Now()
+	if got := roundTrip(t, c, r, "XREAD BLOCK 20 STREAMS s 0"); got != "NIL\n" {
+		t.Fatalf("XREAD BLOCK timeout = %q", got)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("returned after %v, before the timeout", d)
+	}
+}
+
+func TestXReadBlockWakesOnXAdd(t *testing.T) {
+	srv := newServer(config{})
+	reader, rr := connect(t, srv)
+	if _, err := reader.Write([]byte("XREAD BLOCK 0 STREAMS s 0\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reader to block", func() bool { return blockedClients(srv) == 1 })
+	if n := srv.closeIdle(time.Minute, time.Now().Add(time.Hour)); n != 0 {
+		t.Errorf("idle sweep closed %d blocked connections", n)
+	}
+
+	writer, wr := connect(t, srv)
+	if got := roundTrip(t, writer, wr, "XADD s 7-0 f v"); got != "7-0\n" {
+		t.Fatalf("XADD = %q", got)
+	}
+	if got, _ := rr.ReadString('\n'); got != "1\n" {
+		t.Fatalf("XREAD BLOCK count = %q", got)
+	}
+	if got, _ := rr.ReadString('\n'); got != "s 7-0 f v\n" {
+		t.Fatalf("XREAD BLOCK entry = %q", got)
+	}
+	if got := roundTrip(t, reader, rr, "PING"); got != "PONG\n" {
+		t.Errorf("PING after a blocking read = %q", got)
+	}
+}
+
+func TestXReadBlockReleasedOnDisconnect(t *testing.T) {
+	srv := newServer(config{})
+	c, _ := connect(t, srv)
+	if _, err := c.Write([]byte("XREAD BLOCK 0 STREAMS s $\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reader to block", func() bool { return blockedClients(srv) == 1 })
+	c.Close()
+	waitFor(t, "the handler to exit", func() bool { return len(srv.clientsByID()) == 0 })
+}
+
+func TestClientUnblock(t *testing.T) {
+	srv := newServer(config{})
+	reader, rr := connect(t, srv)
+	admin, ar := connect(t, srv)
+	if _, err := reader.Write([]byte("XREAD BLOCK 0 STREAMS s t $ $\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reader to block", func() bool { return blockedClients(srv) == 1 })
+	var id int64
+	for _, cl := range srv.clientsByID() {
+		if cl.blocked.Load() {
+			id = cl.id
+		}
+	}
+	list := strings.Join(lineTexts(srv.dispatch(&client{}, []string{"CLIENT", "LIST"})), "\n")
+	if !strings.Contains(list, "blocked=XREAD:s,t") {
+		t.Errorf("CLIENT LIST = %q, want the blocked read", list)
+	}
+
+	if got := roundTrip(t, admin, ar, fmt.Sprintf("CLIENT UNBLOCK %d", id)); got != "1\n" {
+		t.Fatalf("CLIENT UNBLOCK = %q", got)
+	}
+	if got, _ := rr.ReadString('\n'); got != "NIL\n" {
+		t.Errorf("unblocked XREAD = %q, want a timeout", got)
+	}
+	if got := roundTrip(t, admin, ar, fmt.Sprintf("CLIENT UNBLOCK %d", id)); got != "0\n" {
+		t.Errorf("CLIENT UNBLOCK of an idle client = %q", got)
+	}
+
+	if _, err := reader.Write([]byte("XREAD BLOCK 0 STREAMS s $\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reader to block", func() bool { return blockedClients(srv) == 1 })
+	roundTrip(t, admin, ar, fmt.Sprintf("CLIENT UNBLOCK %d ERROR", id))
+	if got, _ := rr.ReadString('\n'); got != "ERR "+errUnblocked.Error()+"\n" {
+		t.Errorf("XREAD unblocked with ERROR = %q", got)
+	}
+	if got := roundTrip(t, reader, rr, "PING"); got != "PONG\n" {
+		t.Errorf("PING after CLIENT UNBLOCK = %q", got)
+	}
+	if got := roundTrip(t, admin, ar, "CLIENT UNBLOCK 999 NOW"); got != "ERR syntax error\n" {
+		t.Errorf("CLIENT UNBLOCK with a bad reason = %q", got)
+	}
+}
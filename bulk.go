@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxBulkKeyBytes bounds the keys of a BULKSET frame. Line protocol keys
+// cannot be that long in practice; a frame claiming more is malformed.
+const maxBulkKeyBytes = 64 << 10
+
+var errBulkKeyTooLarge = errors.New("key too large")
+
+// readBulkField reads one length-prefixed field of a BULKSET frame: a
+// 4-byte big-endian length, then that many bytes, as readPayload.
+func readBulkField(r *bufio.Reader, limit int) (field []byte, tooLarge bool, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, false, err
+	}
+	return readPayload(r, int64(binary.BigEndian.Uint32(hdr[:])), limit)
+}
+
+// readPayload reads n raw bytes following a command. A payload over limit
+// (0 is no limit) is read past and discarded, so the connection stays in
+// sync, and tooLarge is set. The buffer grows only as data arrives, so a
+// bogus length cannot allocate memory the client never sends.
+func readPayload(r *bufio.Reader, n int64, limit int) (payload []byte, tooLarge bool, err error) {
+	if limit > 0 && n > int64(limit) {
+		_, err := io.CopyN(io.Discard, r, n)
+		return nil, true, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, min(n, ioBufferSize)))
+	if _, err := io.CopyN(buf, r, n); err != nil {
+		zero(buf.Bytes())
+		return nil, false, err
+	}
+	return buf.Bytes(), false, nil
+}
+
+// setMany stores every key/value pair with the write locks of all their
+// shards held, so no reader sees part of the batch. The store takes
+// ownership of the values.
+func (k *kv) setMany(keys []string, vals [][]byte) {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = k.name(key)
+	}
+	defer k.lockNames(names, true)()
+	for i, name := range names {
+		k.setLocked(k.shardOf(name), name, vals[i])
+	}
+}
+
+// cmdBulkSet handles BULKSET count. The line is followed on the connection
+// by count key/value pairs, each field framed as by readBulkField. Every
+// pair is read before any is stored: a key or value over its limit fails
+// the whole batch once the frame has been read, and a truncated frame
+// stores nothing. The reply is the number of keys set.
+func cmdBulkSet(s *server, cl *client, args []string) reply {
+	count, err := strconv.Atoi(args[0])
+	if err != nil || count < 0 {
+		return errReply("invalid count")
+	}
+	if cl.r == nil {
+		return errReply("BULKSET needs a connection to read from")
+	}
+	keys := make([]string, 0, min(count, 1024))
+	vals := make([][]byte, 0, min(count, 1024))
+	discard := func() {
+		for _, v := range vals {
+			zero(v)
+		}
+	}
+	var limitErr error
+	for i := 0; i < count; i++ {
+		key, keyLarge, err := readBulkField(cl.r, maxBulkKeyBytes)
+		if err == nil && keyLarge {
+			limitErr = errBulkKeyTooLarge
+		}
+		var val []byte
+		var valLarge bool
+		if err == nil {
+			val, valLarge, err = readBulkField(cl.r, s.cfg.maxValueBytes)
+		}
+		if err != nil {
+			discard()
+			return errReply(fmt.Sprintf("bad BULKSET frame at pair %d: %v", i, err))
+		}
+		if valLarge && limitErr == nil {
+			limitErr = errValueTooLarge
+		}
+		if limitErr == nil {
+			if _, ok := s.controlChars(cl, "BULKSET", string(key), val); !ok {
+				limitErr = errInvalidChars
+			}
+		}
+		if limitErr == nil {
+			limitErr = s.db(cl).checkSchema(string(key), val)
+		}
+		if limitErr != nil {
+			zero(val)
+			continue
+		}
+		keys = append(keys, string(key))
+		vals = append(vals, val)
+	}
+	if limitErr != nil {
+		discard()
+		return errReply(limitErr.Error())
+	}
+	s.db(cl).setMany(keys, vals)
+	return intReply(int64(len(keys)))
+}
+
+// maxValueLen caps the length of a value built by SETB, SETRANGE or
+// APPEND, even without -max-value-bytes. Past it a SETB length is taken
+// for a framing error rather than read.
+const maxValueLen = 512 << 20
+
+// cmdSetB handles SETB key nbytes. The line is followed on the connection
+// by exactly nbytes raw bytes, which become the value, so it may hold any
+// byte including newlines. A trailing newline after the payload is
+// skipped as an empty line, with no reply even in strict mode. A value
+// over -max-value-bytes is read and discarded. A length that is not a
+// number or is beyond maxValueLen leaves the connection out of sync, so
+// it is closed after the error.
+func cmdSetB(s *server, cl *client, args []string) reply {
+	if cl.r == nil {
+		return errReply("SETB needs a connection to read from")
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || n < 0 || n > maxValueLen {
+		cl.hangup = true
+		return errReply(fmt.Sprintf("invalid SETB length, want 0 to %d", maxValueLen))
+	}
+	val, tooLarge, err := readPayload(cl.r, n, s.cfg.maxValueBytes)
+	cl.afterPayload = err == nil
+	switch {
+	case err != nil:
+		cl.hangup = true
+		return errReply("bad SETB payload: " + err.Error())
+	case tooLarge:
+		return errReply(errValueTooLarge.Error())
+	}
+	if r, ok := s.controlChars(cl, "SETB", args[0], val); !ok {
+		zero(val)
+		return r
+	}
+	db := s.db(cl)
+	if err := db.checkSchema(args[0], val); err != nil {
+		zero(val)
+		return errReply(err.Error())
+	}
+	db.setBytes(args[0], val)
+	return okReply
+}
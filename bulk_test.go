@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// bulkFrame builds the framed pairs that follow a BULKSET line.
+func bulkFrame(pairs ...string) []byte {
+	var b bytes.Buffer
+	for _, p := range pairs {
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(len(p))))
+		b.WriteString(p)
+	}
+	return b.Bytes()
+}
+
+func TestBulkSet(t *testing.T) {
+	srv := newServer(config{maxValueBytes: 16})
+	c, _ := pipelineConn(t, srv)
+	r := bufio.NewReader(c)
+	send := func(line string, frame []byte) string {
+		t.Helper()
+		c.Write(append([]byte(line), frame...))
+		reply, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	var pairs []string
+	for i := 0; i < 1000; i++ {
+		pairs = append(pairs, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	pairs = append(pairs, "with space", "", "nl\nkey", "line\r\nbreak")
+	if got := send("BULKSET 1002\n", bulkFrame(pairs...)); got != "1002\n" {
+		t.Fatalf("BULKSET = %q", got)
+	}
+	for key, want := range map[string]string{"k0": "v0", "k999": "v999", "with space": "", "nl\nkey": "line\r\nbreak"} {
+		if v, ok := srv.dbs[0].get(key); !ok || v != want {
+			t.Errorf("%q = %q, %v; want %q", key, v, ok, want)
+		}
+	}
+	// The connection is back on the line protocol.
+	if got := send("GET k1\n", nil); got != "v1\n" {
+		t.Fatalf("GET after BULKSET = %q", got)
+	}
+
+	// An oversized value fails the batch but the frame is consumed.
+	frame := bulkFrame("a", "1", "b", strings.Repeat("x", 17), "c", "3")
+	if got := send("BULKSET 3\n", frame); got != "ERR value too large\n" {
+		t.Fatalf("BULKSET with a large value = %q", got)
+	}
+	if _, ok := srv.dbs[0].get("a"); ok {
+		t.Error("part of a rejected batch was stored")
+	}
+	if got := send("PING\n", nil); got != "PONG\n" {
+		t.Fatalf("PING after rejected BULKSET = %q", got)
+	}
+	if got := send("BULKSET x\n", nil); got != "ERR invalid count\n" {
+		t.Fatalf("BULKSET x = %q", got)
+	}
+}
+
+func TestBulkSetTruncated(t *testing.T) {
+	srv := newServer(config{})
+	c, _ := pipelineConn(t, srv)
+	frame := bulkFrame("a", "1", "b")
+	c.Write(append([]byte("BULKSET 2\n"), frame...))
+	c.(interface{ CloseWrite() error }).CloseWrite()
+	reply, _ := bufio.NewReader(c).ReadString('\n')
+	if !strings.HasPrefix(reply, "ERR bad BULKSET frame at pair 1") {
+		t.Fatalf("truncated BULKSET = %q", reply)
+	}
+	if srv.dbs[0].len() != 0 {
+		t.Error("truncated batch stored keys")
+	}
+}
+
+func TestSetB(t *testing.T) {
+	srv := newServer(config{maxValueBytes: 32})
+	c, _ := pipelineConn(t, srv)
+	r := bufio.NewReader(c)
+	send := func(data string) string {
+		t.Helper()
+		c.Write([]byte(data))
+		reply, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	val := "two\nlines  and\x00binary"
+	if got := send(fmt.Sprintf("SETB k %d\n%s\n", len(val), val)); got != "OK\n" {
+		t.Fatalf("SETB = %q", got)
+	}
+	if v, _ := srv.dbs[0].get("k"); v != val {
+		t.Fatalf("stored %q, want %q", v, val)
+	}
+	if got := send("SETB empty 0\nPING\n"); got != "OK\n" {
+		t.Fatalf("SETB of an empty value = %q", got)
+	}
+	if got, _ := r.ReadString('\n'); got != "PONG\n" {
+		t.Fatalf("PING after SETB = %q", got)
+	}
+	// Over -max-value-bytes: the payload is skipped, not run as commands.
+	payload := strings.Repeat("DEL k\n", 6) + "\n\n\n\n"
+	if got := send(fmt.Sprintf("SETB big %d\n%s", len(payload), payload)); got != "ERR value too large\n" {
+		t.Fatalf("SETB over the limit = %q", got)
+	}
+	if got := send("PING\n"); got != "PONG\n" {
+		t.Fatalf("PING after rejected SETB = %q", got)
+	}
+	if _, ok := srv.dbs[0].get("k"); !ok {
+		t.Fatal("the payload of a rejected SETB ran as commands")
+	}
+
+	for _, n := range []string{"-1", "x", "99999999999"} {
+		c, _ := pipelineConn(t, srv)
+		c.Write([]byte("SETB k " + n + "\nDEL k\n"))
+		r := bufio.NewReader(c)
+		if got, _ := r.ReadString('\n'); !strings.HasPrefix(got, "ERR invalid SETB length") {
+			t.Errorf("SETB length %s = %q", n, got)
+		}
+		if got, err := r.ReadString('\n'); err == nil {
+			t.Errorf("connection still served %q after SETB length %s", got, n)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Package client talks to a BoS server from Go.
+//
+// A Client holds one connection and switches it to the binary reply
+// protocol (HELLO BINARY), so values read back exactly, whatever bytes
+// they hold. Values are sent with SETB for the same reason. The binary
+// protocol does not carry error messages, so a command the server refuses
+// fails with an error wrapping ErrServer.
+//
+// Servers started with -requirepass are not supported.
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Status bytes of the binary reply protocol.
+const (
+	statusOK    byte = 0
+	statusNil   byte = 1
+	statusErr   byte = 2
+	statusValue byte = 3
+)
+
+// maxValueLen mirrors the server's limit on a value.
+const maxValueLen = 512 << 20
+
+var (
+	// ErrServer is wrapped by the error of a command the server replied
+	// ERR to.
+	ErrServer = errors.New("bos: server replied ERR")
+
+	// ErrWord is returned for a key, file name or password that is empty
+	// or holds whitespace, which the line protocol cannot send.
+	ErrWord = errors.New("bos: argument must be a single non-empty word")
+
+	errReply = errors.New("bos: unexpected reply")
+)
+
+// Client is a connection to a BoS server. It is safe for concurrent use:
+// requests are sent one at a time, each waiting for its reply.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// err is set once the connection fails. The stream may then be out of
+	// step with the requests, so every later call returns it.
+	err error
+}
+
+// Dial connects to a server, as net.Dial does.
+func Dial(network, addr string) (*Client, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// New returns a client using conn, which it switches to the binary
+// protocol. The client owns conn from then on.
+func New(conn net.Conn) (*Client, error) {
+	c := &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.send("HELLO BINARY\n", ""); err != nil {
+		return nil, err
+	}
+	// The reply is a count and that many lines.
+	n, err := c.readValue()
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil {
+		return nil, errReply
+	}
+	for range count {
+		if _, err := c.readValue(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Set stores value at key, clearing any TTL the key had.
+func (c *Client) Set(key, value string) error {
+	if err := checkWord(key); err != nil {
+		return err
+	}
+	if len(value) > maxValueLen {
+		return fmt.Errorf("bos: value of %d bytes is over the %d byte limit", len(value), maxValueLen)
+	}
+	return c.expectOK("SETB", "SETB "+key+" "+strconv.Itoa(len(value))+"\n", value)
+}
+
+// Get returns the value at key and whether the key holds one.
+func (c *Client) Get(key string) (string, bool, error) {
+	if err := checkWord(key); err != nil {
+		return "", false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, val, err := c.do("GET " + key + "\n")
+	switch {
+	case err != nil:
+		return "", false, err
+	case status == statusNil:
+		return "", false, nil
+	case status == statusValue:
+		return val, true, nil
+	}
+	return "", false, c.unexpected("GET", status)
+}
+
+// Del deletes key and reports whether it existed.
+func (c *Client) Del(key string) (bool, error) {
+	if err := checkWord(key); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status, _, err := c.do("DEL " + key + "\n")
+	switch {
+	case err != nil:
+		return false, err
+	case status == statusOK:
+		return true, nil
+	case status == statusNil:
+		return false, nil
+	}
+	return false, c.unexpected("DEL", status)
+}
+
+// Save writes the selected database to file on the server, encrypted with
+// password.
+func (c *Client) Save(file, password string) error {
+	if err := checkWord(file); err != nil {
+		return err
+	}
+	if err := checkWord(password); err != nil {
+		return err
+	}
+	return c.expectOK("SAVE", "SAVE "+file+" "+password+"\n", "")
+}
+
+// Load replaces the selected database with the snapshot in file on the
+// server.
+func (c *Client) Load(file, password string) error {
+	if err := checkWord(file); err != nil {
+		return err
+	}
+	if err := checkWord(password); err != nil {
+		return err
+	}
+	return c.expectOK("LOAD", "LOAD "+file+" "+password+"\n", "")
+}
+
+func checkWord(s string) error {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\v\f") {
+		return ErrWord
+	}
+	return nil
+}
+
+// expectOK sends a request whose reply is OK on success.
+func (c *Client) expectOK(cmd, line, payload string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.send(line, payload); err != nil {
+		return err
+	}
+	status, _, err := c.read()
+	switch {
+	case err != nil:
+		return err
+	case status == statusOK:
+		return nil
+	}
+	return c.unexpected(cmd, status)
+}
+
+// do sends a request line and reads its reply. c.mu must be held.
+func (c *Client) do(line string) (status byte, val string, err error) {
+	if err := c.send(line, ""); err != nil {
+		return 0, "", err
+	}
+	return c.read()
+}
+
+// send writes a request line and the payload that follows it. c.mu must
+// be held.
+func (c *Client) send(line, payload string) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.w.WriteString(line)
+	c.w.WriteString(payload)
+	if err := c.w.Flush(); err != nil {
+		c.err = err
+		return err
+	}
+	return nil
+}
+
+// read reads one reply. c.mu must be held.
+func (c *Client) read() (status byte, val string, err error) {
+	status, err = c.r.ReadByte()
+	if err != nil {
+		c.err = err
+		return 0, "", err
+	}
+	if status != statusValue {
+		return status, "", nil
+	}
+	var n [4]byte
+	if _, err := io.ReadFull(c.r, n[:]); err != nil {
+		c.err = err
+		return 0, "", err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(n[:]))
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		c.err = err
+		return 0, "", err
+	}
+	return status, string(b), nil
+}
+
+// readValue reads a reply that must be a value. c.mu must be held.
+func (c *Client) readValue() (string, error) {
+	status, val, err := c.read()
+	if err != nil {
+		return "", err
+	}
+	if status != statusValue {
+		return "", c.unexpected("HELLO", status)
+	}
+	return val, nil
+}
+
+// unexpected is the error for a reply of the wrong kind. A reply the
+// client cannot interpret leaves it unable to find the next one, so any
+// status other than ERR also breaks the connection.
+func (c *Client) unexpected(cmd string, status byte) error {
+	if status == statusErr {
+		return fmt.Errorf("%s: %w", cmd, ErrServer)
+	}
+	c.err = fmt.Errorf("%s: %w (status %d)", cmd, errReply, status)
+	return c.err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	bos "github.com/bas1c1/BoS/client"
+)
+
+// TestClientPackage drives a server listening on loopback through the Go
+// client.
+func TestClientPackage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := newServer(config{})
+	go srv.serve(ln)
+	c, err := bos.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Values that the text protocol could not carry come back intact.
+	for _, v := range []string{"plain", "", "OK", "NIL", "two  spaces\nand a newline"} {
+		if err := c.Set("k", v); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok, err := c.Get("k"); err != nil || !ok || got != v {
+			t.Errorf("Get after Set(%q) = %q, %v, %v", v, got, ok, err)
+		}
+	}
+	if _, ok, err := c.Get("missing"); ok || err != nil {
+		t.Errorf("Get missing = %v, %v", ok, err)
+	}
+	if ok, err := c.Del("k"); !ok || err != nil {
+		t.Errorf("Del = %v, %v", ok, err)
+	}
+	if ok, err := c.Del("k"); ok || err != nil {
+		t.Errorf("second Del = %v, %v", ok, err)
+	}
+	if err := c.Set("two words", "v"); !errors.Is(err, bos.ErrWord) {
+		t.Errorf("Set with a spaced key = %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "db")
+	c.Set("saved", "1")
+	if err := c.Save(file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("saved", "2")
+	if err := c.Load(file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := c.Get("saved"); got != "1" {
+		t.Errorf("saved = %q after Load", got)
+	}
+	if err := c.Load(file, "wrong"); !errors.Is(err, bos.ErrServer) {
+		t.Errorf("Load with the wrong password = %v", err)
+	}
+	srv.dispatch(&client{}, []string{"XADD", "s", "*", "f", "v"})
+	if _, _, err := c.Get("s"); !errors.Is(err, bos.ErrServer) {
+		t.Errorf("Get of a stream = %v", err)
+	}
+
+	// Concurrent callers each get their own reply.
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := "g" + strconv.Itoa(i)
+			for j := range 50 {
+				want := strconv.Itoa(j)
+				if err := c.Set(key, want); err != nil {
+					t.Error(err)
+					return
+				}
+				if got, _, err := c.Get(key); got != want || err != nil {
+					t.Errorf("Get %s = %q, %v, want %q", key, got, err, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ioBufferSize is the size of each connection's read and write buffers,
+// large enough to take a pipelined batch of commands in few syscalls.
+const ioBufferSize = 64 << 10
+
+// client is the per-connection state of a handler.
+type client struct {
+	net.Conn
+	id      int64
+	db      int  // selected database, only touched by the handler
+	pinned  bool // db is fixed by the listener (a TLS tenant); SELECT and SWAPDB are refused
+	eol     string
+	created time.Time
+
+	lastActive atomic.Int64 // unix nanoseconds of the last command
+	commands   atomic.Int64 // commands dispatched
+	cmdNanos   atomic.Int64 // total time spent running them
+	name       string       // set by CLIENT SETNAME, only touched by the handler
+	blocked    atomic.Bool  // waiting in a blocking command; exempt from the idle sweep
+	closeOnce  sync.Once
+	closeErr   error
+
+	// blockedOn describes the blocking command cl is waiting in, such as
+	// "XREAD:s1,s2", for CLIENT LIST, and unblock wakes it early for
+	// CLIENT UNBLOCK. Both are guarded by bmu and empty when cl is not
+	// blocked.
+	bmu       sync.Mutex
+	blockedOn string
+	unblock   chan error
+
+	// ctx is cancelled by Close, releasing a blocked command.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// r is the handler's reader. Only the handler uses it, except that
+	// watchDisconnect peeks at it while the handler is blocked.
+	r *bufio.Reader
+
+	// wmu serializes writes; publishers write to subscribers from their
+	// own handler goroutines. It guards w and binary.
+	wmu    sync.Mutex
+	w      *bufio.Writer
+	binary bool // replies use the binary protocol (HELLO BINARY)
+
+	// tcp is the client's TCP connection, if it has one. With cork set,
+	// a reply that overflows w corks it until the next flush; corked
+	// records that. Both are guarded by wmu.
+	tcp    *net.TCPConn
+	cork   bool
+	corked bool
+
+	// hangup asks handle to close the connection once the current reply
+	// is sent, after a framing error it cannot recover from. Only the
+	// handler goroutine touches it.
+	hangup bool
+
+	// strict is set by HELLO STRICT: every line gets exactly one reply,
+	// a blank one included. afterPayload marks that the line just read
+	// ended a SETB payload, whose newline is not a request. Only the
+	// handler goroutine touches them.
+	strict       bool
+	afterPayload bool
+
+	// subs and psubs are the channels and patterns this connection is
+	// subscribed to. Only the owning handler changes them, under the
+	// server's pubsub lock.
+	subs  map[string]bool
+	psubs map[string]bool
+}
+
+// send queues a reply in the write buffer. The handler flushes once it
+// has consumed every pipelined command already read. An error means the
+// connection is broken; the buffer keeps failing from then on.
+func (cl *client) send(r reply) error {
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+	return cl.writeLocked(r)
+}
+
+// push writes a reply that does not answer a command of this connection,
+// such as a pub/sub message, and flushes it right away. If the write
+// fails the connection is closed, so its handler exits on its next read
+// instead of the connection lingering until then.
+func (cl *client) push(r reply) {
+	cl.wmu.Lock()
+	err := cl.writeLocked(r)
+	if err == nil {
+		err = cl.flushLocked()
+	}
+	cl.wmu.Unlock()
+	if err != nil {
+		slog.Debug("push to client failed, closing connection", "client", cl.id, "err", err)
+		cl.Close()
+	}
+}
+
+func (cl *client) writeLocked(r reply) error {
+	var out string
+	if cl.binary {
+		var b bytes.Buffer
+		r.appendBinary(&b)
+		out = b.String()
+	} else {
+		var b strings.Builder
+		r.appendText(&b, cl.eol)
+		out = b.String()
+	}
+	if cl.cork && !cl.corked && len(out) > cl.w.Available() {
+		cl.corked = setCork(cl.tcp, true) == nil
+	}
+	_, err := cl.w.WriteString(out)
+	return err
+}
+
+func (cl *client) flush() error {
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+	return cl.flushLocked()
+}
+
+func (cl *client) flushLocked() error {
+	err := cl.w.Flush()
+	if cl.corked {
+		cl.corked = false
+		setCork(cl.tcp, false)
+	}
+	return err
+}
+
+func (cl *client) setBinary(on bool) {
+	cl.wmu.Lock()
+	cl.binary = on
+	cl.wmu.Unlock()
+}
+
+func (cl *client) touch() {
+	cl.lastActive.Store(time.Now().UnixNano())
+}
+
+func (cl *client) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, cl.lastActive.Load()))
+}
+
+// Close closes the connection once; both the handler and the idle sweeper
+// may call it.
+func (cl *client) Close() error {
+	cl.closeOnce.Do(func() {
+		if cl.cancel != nil {
+			cl.cancel()
+		}
+		cl.closeErr = cl.Conn.Close()
+	})
+	return cl.closeErr
+}
+
+var (
+	errShuttingDown = errors.New("server is shutting down")
+	errMaxClients   = errors.New("max number of clients reached")
+)
+
+// register sets up the client state for c. It fails once the server is
+// shutting down, or while -maxconns clients are connected.
+func (s *server) register(c net.Conn) (*client, error) {
+	cl := &client{
+		Conn:    c,
+		w:       bufio.NewWriterSize(c, ioBufferSize),
+		eol:     "\n",
+		created: time.Now(),
+		subs:    make(map[string]bool),
+		psubs:   make(map[string]bool),
+	}
+	cl.ctx, cl.cancel = context.WithCancel(context.Background())
+	if s.cfg.crlf {
+		cl.eol = "\r\n"
+	}
+	if tc, ok := c.(*tenantConn); ok {
+		cl.db, cl.pinned = tc.db, true
+	}
+	if cl.tcp = tcpConn(c); cl.tcp != nil {
+		cl.tcp.SetNoDelay(!s.cfg.nagle)
+		cl.cork = s.cfg.cork && corkSupported
+	}
+	cl.touch()
+	s.mu.Lock()
+	if s.draining.Load() {
+		s.mu.Unlock()
+		cl.cancel()
+		return nil, errShuttingDown
+	}
+	if s.cfg.maxConns > 0 && len(s.clients) >= s.cfg.maxConns {
+		s.mu.Unlock()
+		cl.cancel()
+		return nil, errMaxClients
+	}
+	s.handlers.Add(1)
+	s.nextID++
+	cl.id = s.nextID
+	s.clients[cl.id] = cl
+	s.mu.Unlock()
+	return cl, nil
+}
+
+// refuse tells a client register turned away why, without waiting long
+// for it to read the reply.
+func (s *server) refuse(c net.Conn, err error) {
+	eol := "\n"
+	if s.cfg.crlf {
+		eol = "\r\n"
+	}
+	var b strings.Builder
+	errReply(err.Error()).appendText(&b, eol)
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, b.String())
+}
+
+// tcpConn returns the TCP connection under c, looking through TLS, or nil.
+func tcpConn(c net.Conn) *net.TCPConn {
+	if tc, ok := c.(*tenantConn); ok {
+		c = tc.Conn
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	tcp, _ := c.(*net.TCPConn)
+	return tcp
+}
+
+func (s *server) unregister(cl *client) {
+	s.mu.Lock()
+	delete(s.clients, cl.id)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+func (s *server) clientsByID() []*client {
+	s.mu.Lock()
+	out := make([]*client, 0, len(s.clients))
+	for _, cl := range s.clients {
+		out = append(out, cl)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// info describes cl for CLIENT INFO.
+func (cl *client) info(now time.Time) string {
+	return fmt.Sprintf("id=%d name=%s addr=%s db=%d commands=%d cmd-time=%s age=%d idle=%d",
+		cl.id, cl.name, cl.RemoteAddr(), cl.db, cl.commands.Load(), time.Duration(cl.cmdNanos.Load()),
+		int(now.Sub(cl.created).Seconds()), int(cl.idle(now).Seconds()))
+}
+
+func (s *server) clientList(now time.Time) []string {
+	var out []string
+	for _, cl := range s.clientsByID() {
+		cl.bmu.Lock()
+		on := cl.blockedOn
+		cl.bmu.Unlock()
+		out = append(out, fmt.Sprintf("id=%d addr=%s age=%d idle=%d blocked=%s",
+			cl.id, cl.RemoteAddr(), int(now.Sub(cl.created).Seconds()), int(cl.idle(now).Seconds()), on))
+	}
+	return out
+}
+
+// closeIdle closes every connection whose last command is older than
+// maxIdle, other than those waiting in a blocking command and subscribers,
+// which only listen, and reports how many it closed. The handler notices
+// the closed connection on its next read and unregisters itself.
+func (s *server) closeIdle(maxIdle time.Duration, now time.Time) int {
+	n := 0
+	for _, cl := range s.clientsByID() {
+		if !cl.blocked.Load() && cl.idle(now) > maxIdle && !s.pubsub.subscribed(cl) {
+			cl.Close()
+			n++
+		}
+	}
+	return n
+}
+
+func (s *server) sweepIdle(maxIdle time.Duration) {
+	interval := maxIdle / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		s.closeIdle(maxIdle, now)
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command describes a built-in command. Arity counts the arguments after
+// the command name; maxArgs < 0 means no upper bound. Arity is checked in
+// dispatch, so run can rely on it.
+type command struct {
+	name    string
+	minArgs int
+	maxArgs int
+	write   bool // the command modifies the data set
+	run     func(s *server, cl *client, args []string) reply
+
+	category string
+	summary  string
+
+	// always marks health checks that cannot be disabled.
+	always   bool
+	disabled bool
+
+	// latency records how long run takes, for LATENCY.
+	latency latencyHist
+}
+
+// Command categories, reported by COMMAND DOCS.
+const (
+	catRead   = "read"
+	catWrite  = "write"
+	catAdmin  = "admin"
+	catPubsub = "pubsub"
+)
+
+func builtinCommands() []*command {
+	return []*command{
+		{name: "PING", minArgs: 0, maxArgs: -1, category: catAdmin, always: true, run: cmdPing,
+			summary: "Check that the server is alive, replying PONG or echoing a message"},
+		{name: "HELLO", minArgs: 0, maxArgs: 2, category: catAdmin, run: cmdHello,
+			summary: "Choose the reply protocol (TEXT or BINARY) and whether blank lines get a reply (STRICT or LAX)"},
+		{name: "SELECT", minArgs: 1, maxArgs: 1, category: catAdmin, run: cmdSelect,
+			summary: "Switch the connection to another database"},
+		{name: "SWAPDB", minArgs: 2, maxArgs: 2, write: true, category: catAdmin, run: cmdSwapDB,
+			summary: "Exchange the contents of two databases"},
+		{name: "FLUSHALL", minArgs: 0, maxArgs: 0, write: true, category: catAdmin, run: cmdFlushAll,
+			summary: "Delete every key in every database"},
+		{name: "SET", minArgs: 2, maxArgs: -1, write: true, category: catWrite, run: cmdSet,
+			summary: "Set a key to a value"},
+		{name: "SETNX", minArgs: 2, maxArgs: -1, write: true, category: catWrite, run: cmdSetNX,
+			summary: "Set a key to a value only if it does not exist"},
+		{name: "SETB", minArgs: 2, maxArgs: 2, write: true, category: catWrite, run: cmdSetB,
+			summary: "Set a key to the nbytes raw bytes that follow the command"},
+		{name: "ATOMIC", minArgs: 1, maxArgs: 1, write: true, category: catWrite, run: cmdAtomic,
+			summary: "Run the count commands that follow the command under one lock"},
+		{name: "BULKSET", minArgs: 1, maxArgs: 1, write: true, category: catWrite, run: cmdBulkSet,
+			summary: "Set count length-prefixed key/value pairs that follow the command"},
+		{name: "APPEND", minArgs: 2, maxArgs: -1, write: true, category: catWrite, run: cmdAppend,
+			summary: "Append to the value of a key and return its new length"},
+		{name: "SETRANGE", minArgs: 3, maxArgs: -1, write: true, category: catWrite, run: cmdSetRange,
+			summary: "Overwrite part of a value from an offset and return its new length"},
+		{name: "GET", minArgs: 1, maxArgs: 1, category: catRead, run: cmdGet,
+			summary: "Get the value of a key"},
+		{name: "GETRANGE", minArgs: 3, maxArgs: 3, category: catRead, run: cmdGetRange,
+			summary: "Get the bytes of a value from start to end inclusive"},
+		{name: "MGET", minArgs: 1, maxArgs: -1, category: catRead, run: cmdMGet,
+			summary: "Get the values of several keys, NIL for each missing one"},
+		{name: "MSET", minArgs: 2, maxArgs: -1, write: true, category: catWrite, run: cmdMSet,
+			summary: "Set several single-word values at once"},
+		{name: "GETNOBUMP", minArgs: 1, maxArgs: 1, category: catRead, run: cmdGetNoBump,
+			summary: "Get the value of a key without refreshing its LRU recency"},
+		{name: "EXISTS", minArgs: 1, maxArgs: 1, category: catRead, run: cmdExists,
+			summary: "Reply 1 if a key exists and 0 if not, without sending its value"},
+		{name: "EXPIRE", minArgs: 2, maxArgs: 2, write: true, category: catWrite, run: cmdExpire,
+			summary: "Delete a key after the given number of seconds"},
+		{name: "TTL", minArgs: 1, maxArgs: 1, category: catRead, run: cmdTTL,
+			summary: "Seconds until a key expires, -1 if it does not, -2 if it does not exist"},
+		{name: "EXPIRING", minArgs: 1, maxArgs: 1, category: catRead, run: cmdExpiring,
+			summary: "List the n keys closest to expiring, with their seconds left"},
+		{name: "DEL", minArgs: 1, maxArgs: 1, write: true, category: catWrite, run: cmdDel,
+			summary: "Delete a key"},
+		{name: "DELTOKEN", minArgs: 2, maxArgs: -1, write: true, category: catWrite, run: cmdDelToken,
+			summary: "Delete a key only if its value equals a token: 1 deleted, 0 mismatch, -1 absent"},
+		{name: "SCHEMA", minArgs: 1, maxArgs: 3, write: true, category: catAdmin, run: cmdSchema,
+			summary: "SET, DEL or LIST the value types required of keys under a prefix"},
+		{name: "RENAME", minArgs: 2, maxArgs: 2, write: true, category: catWrite, run: cmdRename,
+			summary: "Move the value of a key to another key, replacing it"},
+		{name: "INCR", minArgs: 1, maxArgs: 1, write: true, category: catWrite, run: cmdIncr,
+			summary: "Add 1 to the integer stored at a key"},
+		{name: "DECR", minArgs: 1, maxArgs: 1, write: true, category: catWrite, run: cmdDecr,
+			summary: "Subtract 1 from the integer stored at a key"},
+		{name: "EVAL", minArgs: 2, maxArgs: -1, write: true, category: catWrite, run: cmdEval,
+			summary: "Apply an expression such as 'incr 5 | append x' to a value and return the result"},
+		{name: "NEXTID", minArgs: 1, maxArgs: 1, write: true, category: catWrite, run: cmdNextID,
+			summary: "Increment a counter and return its new value"},
+		{name: "KEYS", minArgs: 1, maxArgs: 3, category: catRead, run: cmdKeys,
+			summary: "List keys matching a glob pattern"},
+		{name: "SCAN", minArgs: 1, maxArgs: 5, category: catRead, run: cmdScan,
+			summary: "Iterate over keys in pages: SCAN cursor [MATCH pattern] [COUNT n]"},
+		{name: "SAVE", minArgs: 2, maxArgs: 2, category: catAdmin, run: cmdSave,
+			summary: "Write an encrypted snapshot to a file"},
+		{name: "LOAD", minArgs: 2, maxArgs: 4, write: true, category: catAdmin, run: cmdLoad,
+			summary: "Replace the data set with an encrypted snapshot"},
+		{name: "REWRITEAOF", minArgs: 0, maxArgs: 0, category: catAdmin, run: cmdRewriteAOF,
+			summary: "Compact the append-only log to a snapshot of database 0"},
+		{name: "JSONCOMPACT", minArgs: 1, maxArgs: 1, write: true, category: catWrite, run: cmdJSONCompact,
+			summary: "Rewrite a JSON value in compact form"},
+		{name: "JSONPATCH", minArgs: 2, maxArgs: -1, write: true, category: catWrite, run: cmdJSONPatch,
+			summary: "Apply a JSON merge patch to a value"},
+		{name: "JSONGET", minArgs: 2, maxArgs: 2, category: catRead, run: cmdJSONGet,
+			summary: "Get part of a JSON value by path"},
+		{name: "SETFROMFILE", minArgs: 2, maxArgs: 2, write: true, category: catWrite, run: cmdSetFromFile,
+			summary: "Set a key from a file in the server directory"},
+		{name: "GETTOFILE", minArgs: 2, maxArgs: 2, category: catRead, run: cmdGetToFile,
+			summary: "Write a value to a file in the server directory"},
+		{name: "OBJECT", minArgs: 2, maxArgs: -1, category: catRead, run: cmdObject,
+			summary: "Show how a key is stored: OBJECT ENCODING|SIZE|REFCOUNT key"},
+		{name: "DEBUG", minArgs: 1, maxArgs: -1, category: catAdmin, run: cmdDebug,
+			summary: "Debugging helpers, enabled with -debug"},
+		{name: "CLIENT", minArgs: 1, maxArgs: -1, category: catAdmin, run: cmdClient,
+			summary: "Inspect client connections and pause commands"},
+		{name: "READY", minArgs: 0, maxArgs: 0, category: catAdmin, run: cmdReady,
+			summary: "Report whether the data set is fully loaded: ready, loading or degraded"},
+		{name: "INFO", minArgs: 0, maxArgs: 1, category: catAdmin, run: cmdInfo,
+			summary: "Report server statistics"},
+		{name: "LATENCY", minArgs: 0, maxArgs: 1, category: catAdmin, run: cmdLatency,
+			summary: "Report per-command latency percentiles, or RESET them"},
+		{name: "MEMPEAK", minArgs: 0, maxArgs: 1, category: catAdmin, run: cmdMemPeak,
+			summary: "Report the most logical memory used since startup, or RESET the mark"},
+		{name: "STATS", minArgs: 0, maxArgs: 1, category: catAdmin, run: cmdStats,
+			summary: "Report uptime, connections, keys and command counts, or RESET every cumulative counter"},
+		{name: "FEATURES", minArgs: 0, maxArgs: 0, category: catAdmin, run: cmdFeatures,
+			summary: "List the optional features this server has enabled"},
+		{name: "COMMAND", minArgs: 1, maxArgs: -1, category: catAdmin, run: cmdCommand,
+			summary: "Describe the available commands"},
+		{name: "PUBLISH", minArgs: 2, maxArgs: -1, category: catPubsub, run: cmdPublish,
+			summary: "Post a message to a channel"},
+		{name: "SUBSCRIBE", minArgs: 1, maxArgs: -1, category: catPubsub, run: cmdSubscribe,
+			summary: "Receive messages posted to channels"},
+		{name: "PSUBSCRIBE", minArgs: 1, maxArgs: -1, category: catPubsub, run: cmdPSubscribe,
+			summary: "Receive messages posted to channels matching patterns"},
+		{name: "UNSUBSCRIBE", minArgs: 0, maxArgs: -1, category: catPubsub, run: cmdUnsubscribe,
+			summary: "Stop receiving messages from channels"},
+		{name: "PUNSUBSCRIBE", minArgs: 0, maxArgs: -1, category: catPubsub, run: cmdPUnsubscribe,
+			summary: "Stop receiving messages from patterns"},
+		{name: "PFADD", minArgs: 1, maxArgs: -1, write: true, category: catWrite, run: cmdPFAdd,
+			summary: "Add elements to a HyperLogLog"},
+		{name: "PFCOUNT", minArgs: 1, maxArgs: -1, category: catRead, run: cmdPFCount,
+			summary: "Estimate the number of distinct elements in the union of HyperLogLogs"},
+		{name: "PFMERGE", minArgs: 2, maxArgs: -1, write: true, category: catWrite, run: cmdPFMerge,
+			summary: "Store the union of HyperLogLogs at a key"},
+		{name: "GEOADD", minArgs: 4, maxArgs: -1, write: true, category: catWrite, run: cmdGeoAdd,
+			summary: "Add members with positions to a geo set"},
+		{name: "GEOSEARCH", minArgs: 7, maxArgs: -1, category: catRead, run: cmdGeoSearch,
+			summary: "List the members of a geo set within a radius of a position"},
+		{name: "XADD", minArgs: 4, maxArgs: -1, write: true, category: catWrite, run: cmdXAdd,
+			summary: "Append an entry to a stream"},
+		{name: "XTRIM", minArgs: 3, maxArgs: 4, write: true, category: catWrite, run: cmdXTrim,
+			summary: "Drop the oldest entries of a stream"},
+		{name: "XRANGE", minArgs: 3, maxArgs: 5, category: catRead, run: cmdXRange,
+			summary: "List stream entries between two IDs"},
+		{name: "XREAD", minArgs: 3, maxArgs: -1, category: catRead, run: cmdXRead,
+			summary: "Read stream entries newer than an ID"},
+		{name: "XGROUP", minArgs: 1, maxArgs: -1, write: true, category: catWrite, run: cmdXGroup,
+			summary: "Create or destroy stream consumer groups"},
+		{name: "XREADGROUP", minArgs: 6, maxArgs: -1, write: true, category: catWrite, run: cmdXReadGroup,
+			summary: "Read stream entries as a consumer group member"},
+		{name: "XACK", minArgs: 3, maxArgs: -1, write: true, category: catWrite, run: cmdXAck,
+			summary: "Acknowledge pending stream entries"},
+		{name: "XPENDING", minArgs: 2, maxArgs: 3, category: catRead, run: cmdXPending,
+			summary: "List a consumer group's pending entries"},
+	}
+}
+
+func commandTable() map[string]*command {
+	t := make(map[string]*command)
+	for _, c := range builtinCommands() {
+		t[c.name] = c
+	}
+	for name, c := range customCommands {
+		t[name] = customCommand(name, c)
+	}
+	return t
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, strings.ToUpper(f))
+		}
+	}
+	return out
+}
+
+// restrictCommands disables the named commands, or with enableOnly every
+// command not named. Commands marked always stay enabled either way.
+func (s *server) restrictCommands(disable, enableOnly []string) error {
+	if len(disable) > 0 && len(enableOnly) > 0 {
+		return fmt.Errorf("-disable-commands and -enable-only are mutually exclusive")
+	}
+	for _, name := range append(disable, enableOnly...) {
+		if _, ok := s.commands[name]; !ok {
+			return fmt.Errorf("unknown command %q", name)
+		}
+	}
+	for _, name := range disable {
+		s.commands[name].disabled = true
+	}
+	if len(enableOnly) > 0 {
+		keep := make(map[string]bool)
+		for _, name := range enableOnly {
+			keep[name] = true
+		}
+		for name, c := range s.commands {
+			c.disabled = !keep[name]
+		}
+	}
+	for _, c := range s.commands {
+		c.disabled = c.disabled && !c.always
+	}
+	return nil
+}
+
+// renameCommands applies FROM=TO renames. The command is then only
+// reachable as TO; an empty TO removes it from the table.
+func (s *server) renameCommands(renames []string) error {
+	moved := make(map[string]*command)
+	for _, r := range renames {
+		from, to, ok := strings.Cut(r, "=")
+		if !ok {
+			return fmt.Errorf("invalid rename %q, want FROM=TO", r)
+		}
+		from, to = strings.ToUpper(strings.TrimSpace(from)), strings.ToUpper(strings.TrimSpace(to))
+		c, ok := s.commands[from]
+		if !ok {
+			return fmt.Errorf("unknown command %q", from)
+		}
+		delete(s.commands, from)
+		if to != "" {
+			moved[to] = c
+		}
+	}
+	for to, c := range moved {
+		if _, taken := s.commands[to]; taken {
+			return fmt.Errorf("cannot rename to %q: command exists", to)
+		}
+		s.commands[to] = c
+	}
+	return nil
+}
+
+func wrongArgs(name string) reply {
+	return errReply(fmt.Sprintf("wrong number of arguments for '%s'", strings.ToLower(name)))
+}
+
+// dispatch looks up cmd[0], validates its arity and runs it.
+func (s *server) dispatch(cl *client, cmd []string) reply {
+	name := strings.ToUpper(cmd[0])
+	c, ok := s.commands[name]
+	if !ok {
+		return errReply(fmt.Sprintf("unknown command '%s'", cmd[0]))
+	}
+	if c.disabled {
+		return errReply("command disabled")
+	}
+	args := cmd[1:]
+	if len(args) < c.minArgs || (c.maxArgs >= 0 && len(args) > c.maxArgs) {
+		return wrongArgs(name)
+	}
+	if c.write && s.mapped {
+		return errReply(errReadOnly.Error())
+	}
+	if c.name != "CLIENT" && c.name != "READY" {
+		s.pause.wait(cl.context(), c.write)
+	}
+	start := time.Now()
+	r := c.run(s, cl, args)
+	if keys := aofKeys[c.name]; keys != nil {
+		if db := s.db(cl); db.aof != nil {
+			db.logKeys(keys(args))
+		}
+	}
+	took := time.Since(start)
+	c.latency.record(took)
+	cl.commands.Add(1)
+	cl.cmdNanos.Add(int64(took))
+	if r.kind == kindErr {
+		// Only the command is logged: error messages can quote
+		// arguments, and so keys, values or passwords.
+		slog.Debug("command failed", "client", cl.id, "command", c.name)
+	}
+	return r
+}
+
+// cmdCommand handles COMMAND DOCS [name...], which describes the commands
+// as currently configured: renamed commands appear under their new name
+// and disabled ones are flagged.
+func cmdCommand(s *server, cl *client, args []string) reply {
+	if strings.ToUpper(args[0]) != "DOCS" {
+		return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+	}
+	names := args[1:]
+	if len(names) == 0 {
+		for name := range s.commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var lines []string
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		c, ok := s.commands[name]
+		if !ok {
+			continue
+		}
+		lines = append(lines, describeCommand(name, c))
+	}
+	return arrayReply(lines)
+}
+
+// describeCommand renders one COMMAND DOCS line, e.g.
+// "SET args=2.. category=write flags=write summary=Set a key to a value".
+func describeCommand(name string, c *command) string {
+	arity := strconv.Itoa(c.minArgs) + ".."
+	if c.maxArgs >= 0 {
+		arity += strconv.Itoa(c.maxArgs)
+	}
+	var flags []string
+	if c.write {
+		flags = append(flags, "write")
+	}
+	if c.disabled {
+		flags = append(flags, "disabled")
+	}
+	if len(flags) == 0 {
+		flags = append(flags, "-")
+	}
+	return fmt.Sprintf("%s args=%s category=%s flags=%s summary=%s",
+		name, arity, c.category, strings.Join(flags, ","), c.summary)
+}
+
+// cmdHello handles HELLO [TEXT|BINARY] [STRICT|LAX]. Every option is
+// checked before any takes effect. The reply describes the server and is
+// already encoded in the chosen protocol.
+func cmdHello(s *server, cl *client, args []string) reply {
+	binary, strict := cl.binary, cl.strict
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "TEXT":
+			binary = false
+		case "BINARY":
+			binary = true
+		case "STRICT":
+			strict = true
+		case "LAX":
+			strict = false
+		default:
+			return errReply(fmt.Sprintf("unknown protocol '%s'", arg))
+		}
+	}
+	cl.setBinary(binary)
+	cl.strict = strict
+	proto := "text"
+	if cl.binary {
+		proto = "binary"
+	}
+	return arrayReply([]string{"server=bos", "proto=" + proto, "run_id=" + s.runID})
+}
+
+// dbIndex parses a database number and checks it is in range.
+func (s *server) dbIndex(arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 || n >= len(s.dbs) {
+		return 0, fmt.Errorf("invalid database index '%s'", arg)
+	}
+	return n, nil
+}
+
+func cmdSelect(s *server, cl *client, args []string) reply {
+	if cl.pinned {
+		return errReply(errPinned.Error())
+	}
+	n, err := s.dbIndex(args[0])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	cl.db = n
+	return okReply
+}
+
+// cmdSwapDB handles SWAPDB i j. Connections keep their database index,
+// so clients on i see j's former contents immediately.
+func cmdSwapDB(s *server, cl *client, args []string) reply {
+	if cl.pinned {
+		return errReply(errPinned.Error())
+	}
+	i, err := s.dbIndex(args[0])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	j, err := s.dbIndex(args[1])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	if i == j {
+		return okReply
+	}
+	if i > j {
+		i, j = j, i
+	}
+	swapKV(s.dbs[i], s.dbs[j])
+	return okReply
+}
+
+// cmdPing handles PING [message]. It replies PONG, or the message, its
+// words joined by single spaces, if one is given.
+func cmdPing(s *server, cl *client, args []string) reply {
+	if len(args) > 0 {
+		return strReply(strings.Join(args, " "))
+	}
+	return strReply("PONG")
+}
+
+// emptyValue is the value argument that stores an empty string; the line
+// protocol cannot otherwise express one.
+const emptyValue = `""`
+
+func cmdSet(s *server, cl *client, args []string) reply {
+	key, val := args[0], strings.Join(args[1:], " ")
+	if val == emptyValue {
+		val = ""
+	}
+	if s.cfg.maxValueBytes > 0 && len(val) > s.cfg.maxValueBytes {
+		return errReply(errValueTooLarge.Error())
+	}
+	b := []byte(val)
+	if r, ok := s.controlChars(cl, "SET", key, b); !ok {
+		return r
+	}
+	db := s.db(cl)
+	if err := db.checkSchema(key, b); err != nil {
+		return errReply(err.Error())
+	}
+	db.setBytes(key, b)
+	return okReply
+}
+
+func cmdGet(s *server, cl *client, args []string) reply {
+	return getReply(s.db(cl), args[0], true)
+}
+
+// cmdGetNoBump handles GETNOBUMP key: GET without updating the key's LRU
+// recency.
+func cmdGetNoBump(s *server, cl *client, args []string) reply {
+	return getReply(s.db(cl), args[0], false)
+}
+
+func getReply(db *kv, key string, bump bool) reply {
+	if v, ok := db.read(key, bump); ok {
+		return strReply(v)
+	}
+	if t := db.typeOf(key); t == "stream" || t == "geo" {
+		return errReply(errWrongType.Error())
+	}
+	return nilReply
+}
+
+func cmdExists(s *server, cl *client, args []string) reply {
+	if s.db(cl).exists(args[0]) {
+		return intReply(1)
+	}
+	return intReply(0)
+}
+
+func cmdDel(s *server, cl *client, args []string) reply {
+	if r, ok := s.controlChars(cl, "DEL", args[0], nil); !ok {
+		return r
+	}
+	if s.db(cl).del(args[0]) {
+		return okReply
+	}
+	return nilReply
+}
+
+// cmdKeys handles KEYS pattern [COUNT n]. COUNT caps the reply at the
+// first n matches found; which keys those are is unspecified.
+func cmdKeys(s *server, cl *client, args []string) reply {
+	limit := 0
+	if len(args) > 1 {
+		if len(args) != 3 || strings.ToUpper(args[1]) != "COUNT" {
+			return errReply("syntax error")
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n <= 0 {
+			return errReply("COUNT must be a positive integer")
+		}
+		limit = n
+	}
+	return arrayReply(s.db(cl).matchKeys(args[0], limit))
+}
+
+// cmdSave handles SAVE file pass. A failure replies a bare ERR, and its
+// cause is logged for the operator.
+func cmdSave(s *server, cl *client, args []string) reply {
+	db := s.db(cl)
+	if err := s.save(db, args[0], args[1]); err != nil {
+		slog.Warn("SAVE failed", "client", cl.id, "file", args[0], "err", err)
+		return errReply("")
+	}
+	slog.Info("saved snapshot", "client", cl.id, "file", args[0], "keys", db.len())
+	return okReply
+}
+
+// cmdLoad handles LOAD file pass [EXPECT n]. With EXPECT the snapshot must
+// hold exactly n keys, or the store is left untouched.
+func cmdLoad(s *server, cl *client, args []string) reply {
+	expect := -1
+	if len(args) > 2 {
+		if len(args) != 4 || strings.ToUpper(args[2]) != "EXPECT" {
+			return errReply("syntax error")
+		}
+		n, err := strconv.Atoi(args[3])
+		if err != nil || n < 0 {
+			return errReply("EXPECT must be a non-negative integer")
+		}
+		expect = n
+	}
+	end := s.ready.beginLoad()
+	d, err := readSnapshot(args[0], args[1])
+	if err != nil {
+		end(false)
+		slog.Warn("LOAD failed", "client", cl.id, "file", args[0], "err", err)
+		return errReply("")
+	}
+	if expect >= 0 && d.len() != expect {
+		end(false)
+		slog.Warn("LOAD refused: key count mismatch", "client", cl.id, "file", args[0], "keys", d.len(), "expected", expect)
+		return errReply("key count mismatch")
+	}
+	if err := s.db(cl).replace(d); err != nil {
+		end(false)
+		slog.Warn("LOAD failed", "client", cl.id, "file", args[0], "err", err)
+		return errReply("")
+	}
+	end(true)
+	slog.Info("loaded snapshot", "client", cl.id, "file", args[0], "keys", d.len())
+	return okReply
+}
+
+func cmdClient(s *server, cl *client, args []string) reply {
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "LIST":
+		if len(args) != 1 {
+			return wrongArgs("client list")
+		}
+		return arrayReply(s.clientList(time.Now()))
+	case "INFO":
+		if len(args) != 1 {
+			return wrongArgs("client info")
+		}
+		return strReply(cl.info(time.Now()))
+	case "SETNAME":
+		if len(args) != 2 {
+			return wrongArgs("client setname")
+		}
+		cl.name = args[1]
+		return okReply
+	case "UNBLOCK":
+		return clientUnblock(s, args[1:])
+	case "PAUSE":
+		return clientPause(s, args[1:])
+	case "UNPAUSE":
+		if len(args) != 1 {
+			return wrongArgs("client unpause")
+		}
+		s.pause.lift()
+		return okReply
+	default:
+		return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArityRejected(t *testing.T) {
+	srv := newServer(config{})
+	for name, c := range srv.commands {
+		want := errReply(fmt.Sprintf("wrong number of arguments for '%s'", strings.ToLower(name)))
+		if c.minArgs > 0 {
+			cmd := append([]string{name}, make([]string, c.minArgs-1)...)
+			if got := srv.dispatch(&client{}, cmd); got.kind != want.kind || got.text != want.text {
+				t.Errorf("%s with %d args = %+v, want %+v", name, c.minArgs-1, got, want)
+			}
+		}
+		if c.maxArgs >= 0 {
+			cmd := append([]string{name}, strings.Fields(strings.Repeat("x ", c.maxArgs+1))...)
+			if got := srv.dispatch(&client{}, cmd); got.kind != want.kind || got.text != want.text {
+				t.Errorf("%s with %d args = %+v, want %+v", name, c.maxArgs+1, got, want)
+			}
+		}
+	}
+}
+
+func TestDispatchReplies(t *testing.T) {
+	c, r := connect(t, newServer(config{}))
+	for _, tc := range []struct{ req, want string }{
+		{"get a b", "ERR wrong number of arguments for 'get'\n"},
+		{"DEL a b", "ERR wrong number of arguments for 'del'\n"},
+		{"NOPE", "ERR unknown command 'NOPE'\n"},
+		{"set a hello world", "OK\n"},
+		{"GET a", "hello world\n"},
+	} {
+		if got := roundTrip(t, c, r, tc.req); got != tc.want {
+			t.Errorf("%q = %q, want %q", tc.req, got, tc.want)
+		}
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	srv := newServer(config{})
+	c, r := connect(t, srv)
+	if got := roundTrip(t, c, r, `SET k ""`); got != "OK\n" {
+		t.Fatalf("SET empty = %q", got)
+	}
+	if got := roundTrip(t, c, r, "GET k"); got != "\n" {
+		t.Fatalf("GET empty = %q", got)
+	}
+	if got := roundTrip(t, c, r, "GET missing"); got != "NIL\n" {
+		t.Fatalf("GET missing = %q", got)
+	}
+	if got := roundTrip(t, c, r, `SET k2 "" x`); got != "OK\n" {
+		t.Fatalf("SET = %q", got)
+	}
+	if got := roundTrip(t, c, r, "GET k2"); got != "\"\" x\n" {
+		t.Fatalf(`"" inside a longer value was rewritten: %q`, got)
+	}
+	file := filepath.Join(t.TempDir(), "db.bin")
+	if err := saveToFile(srv.dbs[0], file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	s2 := newKV()
+	if err := loadFromFile(s2, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s2.get("k"); !ok || v != "" {
+		t.Fatalf("empty value after load = %q, %v", v, ok)
+	}
+}
+
+func TestRestrictCommands(t *testing.T) {
+	srv := newServer(config{})
+	if err := srv.restrictCommands([]string{"SAVE", "LOAD"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.dispatch(&client{}, []string{"save", "f", "p"}); got.text != "command disabled" {
+		t.Fatalf("disabled SAVE = %+v", got)
+	}
+	if got := srv.dispatch(&client{}, []string{"GET", "k"}); got.kind != kindNil {
+		t.Fatalf("GET = %+v", got)
+	}
+
+	srv = newServer(config{})
+	if err := srv.restrictCommands(nil, []string{"GET"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.dispatch(&client{}, []string{"SET", "k", "v"}); got.text != "command disabled" {
+		t.Fatalf("SET outside -enable-only = %+v", got)
+	}
+	if got := srv.dispatch(&client{}, []string{"PING"}); got.text != "PONG" {
+		t.Fatalf("PING = %+v", got)
+	}
+	if err := newServer(config{}).restrictCommands([]string{"NOSUCH"}, nil); err == nil {
+		t.Fatal("unknown command name accepted")
+	}
+}
+
+func TestRenameCommands(t *testing.T) {
+	srv := newServer(config{})
+	if err := srv.renameCommands([]string{"save=SAVE_7x9", "LOAD="}); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.dispatch(&client{}, []string{"SAVE", "f", "p"}); got.text != "unknown command 'SAVE'" {
+		t.Fatalf("original name = %+v", got)
+	}
+	if got := srv.dispatch(&client{}, []string{"LOAD", "f", "p"}); got.text != "unknown command 'LOAD'" {
+		t.Fatalf("removed command = %+v", got)
+	}
+	if got := srv.dispatch(&client{}, []string{"save_7x9"}); got.text != "wrong number of arguments for 'save_7x9'" {
+		t.Fatalf("renamed command = %+v", got)
+	}
+	if err := newServer(config{}).renameCommands([]string{"SET=GET"}); err == nil {
+		t.Fatal("rename onto an existing command accepted")
+	}
+}
+
+func TestKeysCount(t *testing.T) {
+	srv := newServer(config{})
+	for i := 0; i < 10; i++ {
+		srv.dbs[0].set(fmt.Sprintf("session:%d", i), "x")
+	}
+	srv.dbs[0].set("other", "x")
+	if got := srv.dbs[0].keys("session:*"); len(got) != 10 {
+		t.Fatalf("keys = %v", got)
+	}
+	got := srv.dispatch(&client{}, []string{"KEYS", "session:*", "COUNT", "3"})
+	if got.kind != kindArray || len(got.items) != 3 {
+		t.Fatalf("KEYS COUNT 3 = %+v", got)
+	}
+	for _, it := range got.items {
+		if !strings.HasPrefix(it.text, "session:") {
+			t.Fatalf("unexpected key %q", it.text)
+		}
+	}
+	if got := srv.dispatch(&client{}, []string{"KEYS", "*", "COUNT", "0"}); got.kind != kindErr {
+		t.Fatalf("COUNT 0 = %+v", got)
+	}
+	if got := srv.dispatch(&client{}, []string{"KEYS", "nomatch*"}); got.kind != kindArray || len(got.items) != 0 {
+		t.Fatalf("empty KEYS = %+v", got)
+	}
+}
+
+func TestCommandDocs(t *testing.T) {
+	srv := newServer(config{})
+	if err := srv.restrictCommands([]string{"DEL"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.renameCommands([]string{"SAVE=BACKUP"}); err != nil {
+		t.Fatal(err)
+	}
+	got := srv.dispatch(&client{}, []string{"COMMAND", "DOCS", "set", "del", "backup", "save"})
+	want := []string{
+		"SET args=2.. category=write flags=write summary=Set a key to a value",
+		"DEL args=1..1 category=write flags=write,disabled summary=Delete a key",
+		"BACKUP args=2..2 category=admin flags=- summary=Write an encrypted snapshot to a file",
+	}
+	if got.kind != kindArray || len(got.items) != len(want) {
+		t.Fatalf("COMMAND DOCS = %+v", got)
+	}
+	for i, w := range want {
+		if got.items[i].text != w {
+			t.Errorf("line %d = %q, want %q", i, got.items[i].text, w)
+		}
+	}
+	for name, c := range srv.commands {
+		if c.category == "" || c.summary == "" {
+			t.Errorf("%s has no category or summary", name)
+		}
+	}
+}
+
+func TestHelloBinary(t *testing.T) {
+	srv := newServer(config{})
+	c, r := connect(t, srv)
+	if _, err := c.Write([]byte("HELLO BINARY\nSET k abc\nGET k\nGET nope\nGET\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		3, 0, 0, 0, 1, '3',
+		3, 0, 0, 0, 10, 's', 'e', 'r', 'v', 'e', 'r', '=', 'b', 'o', 's',
+		3, 0, 0, 0, 12, 'p', 'r', 'o', 't', 'o', '=', 'b', 'i', 'n', 'a', 'r', 'y',
+		3, 0, 0, 0, 47,
+	}
+	want = append(want, "run_id="+srv.runID...)
+	want = append(want,
+		0,
+		3, 0, 0, 0, 3, 'a', 'b', 'c',
+		1,
+		2,
+	)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("binary replies\n got %v\nwant %v", got, want)
+	}
+	if _, err := c.Write([]byte("HELLO TEXT\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := r.ReadString('\n'); line != "3\n" {
+		t.Fatalf("HELLO TEXT reply starts %q", line)
+	}
+}
+
+// TestHelloStrict checks that in strict mode every request line gets one
+// reply, blank ones included, so a client counting replies stays in step.
+func TestHelloStrict(t *testing.T) {
+	srv := newServer(config{})
+	c, r := connect(t, srv)
+	if got := roundTrip(t, c, r, "HELLO STRICT"); got != "3\n" {
+		t.Fatalf("HELLO STRICT reply starts %q", got)
+	}
+	for range 3 {
+		r.ReadString('\n')
+	}
+	// SETB's payload and the newline after it are part of one request.
+	reqs := []string{"SET a 1", "", "   ", "SETB b 2\nxy", "GET b", "", "PING"}
+	if _, err := c.Write([]byte(strings.Join(reqs, "\n") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"OK", "NOOP", "NOOP", "OK", "xy", "NOOP", "PONG"}
+	for i, w := range want {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != w+"\n" {
+			t.Fatalf("reply %d = %q, want %q", i, line, w)
+		}
+	}
+	// Out of strict mode blank lines get no reply.
+	if got := roundTrip(t, c, r, "HELLO LAX"); got != "3\n" {
+		t.Fatalf("HELLO LAX reply starts %q", got)
+	}
+	for range 3 {
+		r.ReadString('\n')
+	}
+	if got := roundTrip(t, c, r, "\n\nPING"); got != "PONG\n" {
+		t.Fatalf("lax blank lines then PING = %q", got)
+	}
+	if got := roundTrip(t, c, r, "HELLO BINARY NOPE"); !strings.HasPrefix(got, "ERR") {
+		t.Fatalf("HELLO BINARY NOPE = %q", got)
+	}
+	// The rejected HELLO changed nothing.
+	if got := roundTrip(t, c, r, "PING"); got != "PONG\n" {
+		t.Fatalf("PING after a rejected HELLO = %q", got)
+	}
+}
+
+func TestSelectAndSwapDB(t *testing.T) {
+	srv := newServer(config{databases: 4})
+	prod, pr := connect(t, srv)
+	staging, sr := connect(t, srv)
+	if got := roundTrip(t, staging, sr, "SELECT 1"); got != "OK\n" {
+		t.Fatalf("SELECT = %q", got)
+	}
+	roundTrip(t, staging, sr, "SET color blue")
+	roundTrip(t, prod, pr, "SET color green")
+	if got := roundTrip(t, prod, pr, "SWAPDB 1 0"); got != "OK\n" {
+		t.Fatalf("SWAPDB = %q", got)
+	}
+	if got := roundTrip(t, prod, pr, "GET color"); got != "blue\n" {
+		t.Fatalf("db 0 after swap = %q", got)
+	}
+	if got := roundTrip(t, staging, sr, "GET color"); got != "green\n" {
+		t.Fatalf("db 1 after swap = %q", got)
+	}
+	for _, req := range []string{"SELECT 4", "SELECT -1", "SWAPDB 0 9", "SWAPDB x 1"} {
+		if got := roundTrip(t, prod, pr, req); !strings.HasPrefix(got, "ERR invalid database index") {
+			t.Errorf("%s = %q", req, got)
+		}
+	}
+}
+
+func TestLoadExpect(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.bin")
+	src := newKV()
+	src.set("a", "1")
+	src.set("b", "2")
+	if err := saveToFile(src, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(config{})
+	srv.dbs[0].set("keep", "me")
+	if got := srv.dispatch(&client{}, []string{"LOAD", file, "pw", "EXPECT", "3"}); got.text != "key count mismatch" {
+		t.Fatalf("LOAD EXPECT 3 = %+v", got)
+	}
+	if v, ok := srv.dbs[0].get("keep"); !ok || v != "me" {
+		t.Fatal("store changed by a failed LOAD")
+	}
+	if got := srv.dispatch(&client{}, []string{"LOAD", file, "pw", "EXPECT", "2"}); got.kind != kindOK {
+		t.Fatalf("LOAD EXPECT 2 = %+v", got)
+	}
+	if _, ok := srv.dbs[0].get("keep"); ok || srv.dbs[0].len() != 2 {
+		t.Fatal("LOAD EXPECT 2 did not replace the store")
+	}
+	if got := srv.dispatch(&client{}, []string{"LOAD", file, "pw", "EXPECT"}); got.kind != kindErr {
+		t.Fatalf("LOAD EXPECT without count = %+v", got)
+	}
+}
+
+func TestExists(t *testing.T) {
+	c, r := connect(t, newServer(config{}))
+	for _, tc := range []struct{ req, want string }{
+		{"EXISTS a", "0\n"},
+		{"SET a 1", "OK\n"},
+		{"EXISTS a", "1\n"},
+		{"XADD s * f v", ""},
+		{"EXISTS s", "1\n"},
+		{"DEL a", "OK\n"},
+		{"EXISTS a", "0\n"},
+		{"EXISTS", "ERR wrong number of arguments for 'exists'\n"},
+		{"EXISTS a b", "ERR wrong number of arguments for 'exists'\n"},
+	} {
+		if got := roundTrip(t, c, r, tc.req); tc.want != "" && got != tc.want {
+			t.Errorf("%q = %q, want %q", tc.req, got, tc.want)
+		}
+	}
+}
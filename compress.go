@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// flateWriters reuses compressors; each one holds several hundred KB of
+// state.
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// deflate compresses val.
+func deflate(val []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(val)
+	w.Close()
+	flateWriters.Put(w)
+	return buf.Bytes()
+}
+
+// inflate expands a value compressed by deflate into a buffer of its raw
+// length n.
+func inflate(c []byte, n int) []byte {
+	out := make([]byte, n)
+	r := flate.NewReader(bytes.NewReader(c))
+	defer r.Close()
+	if _, err := io.ReadFull(r, out); err != nil {
+		panic("corrupt compressed value: " + err.Error())
+	}
+	return out
+}
+
+// setCompressAbove makes values longer than n bytes be kept compressed;
+// 0 turns compression off. Like setMaxBytes it is meant to be called
+// before the store is used, and does not touch values already stored.
+func (k *kvShard) setCompressAbove(n int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.compressAbove = n
+}
+
+// compressLocked returns the form in which val is kept at key: deflated,
+// if compression is on, val is over the threshold and deflating saves
+// space, and val itself otherwise. It records which it chose. k.mu must
+// be held.
+func (k *kvShard) compressLocked(key string, val []byte) []byte {
+	delete(k.compressed, key)
+	if k.compressAbove <= 0 || len(val) <= k.compressAbove {
+		return val
+	}
+	c := deflate(val)
+	if len(c) >= len(val) {
+		return val
+	}
+	k.compressed[key] = len(val)
+	zero(val)
+	return c
+}
+
+// valueLocked returns the string value at key, decompressed. fresh is
+// true when the value had to be inflated into a new buffer, which the
+// caller owns; otherwise v is the stored slice and must not outlive the
+// lock. k.mu must be held.
+func (k *kvShard) valueLocked(key string) (v []byte, ok, fresh bool) {
+	if k.mapped != nil {
+		if v, ok := k.mapped.lookup(key); ok {
+			return v, true, false
+		}
+	}
+	v, ok = k.data[key]
+	if n, isCompressed := k.compressed[key]; isCompressed {
+		return inflate(v, n), true, true
+	}
+	return v, ok, false
+}
+
+// encoding describes how the value at key is held: "raw" or "deflate" for
+// a string, or the type name for anything else.
+func (k *kvShard) encoding(key string) (string, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	switch t := k.typeLocked(key); {
+	case t == "none":
+		return "", false
+	case t != "string":
+		return t, true
+	}
+	if _, ok := k.compressed[key]; ok {
+		return "deflate", true
+	}
+	return "raw", true
+}
+
+// valueSizes returns the length of the string value at key and the number
+// of bytes it takes in memory, which is smaller when it is compressed.
+func (k *kvShard) valueSizes(key string) (rawLen, stored int, found bool, err error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	v, ok := k.data[key]
+	if k.mapped != nil && !ok {
+		v, ok = k.mapped.lookup(key)
+	}
+	if !ok {
+		if k.typeLocked(key) != "none" {
+			return 0, 0, true, errWrongType
+		}
+		return 0, 0, false, nil
+	}
+	rawLen = len(v)
+	if n, isCompressed := k.compressed[key]; isCompressed {
+		rawLen = n
+	}
+	return rawLen, len(v), true, nil
+}
+
+// cmdObject inspects how a key is stored. OBJECT ENCODING key replies with
+// its encoding; OBJECT SIZE key with the raw and stored sizes of a string;
+// OBJECT REFCOUNT key with how many keys share its value's buffer. Values
+// are never interned, so that is always 1.
+func cmdObject(s *server, cl *client, args []string) reply {
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "ENCODING":
+		if len(args) != 2 {
+			return wrongArgs("object encoding")
+		}
+		enc, ok := s.db(cl).encoding(args[1])
+		if !ok {
+			return nilReply
+		}
+		return strReply(enc)
+	case "SIZE":
+		if len(args) != 2 {
+			return wrongArgs("object size")
+		}
+		rawLen, stored, found, err := s.db(cl).valueSizes(args[1])
+		switch {
+		case err != nil:
+			return errReply(err.Error())
+		case !found:
+			return nilReply
+		}
+		return arrayReply([]string{fmt.Sprintf("raw:%d", rawLen), fmt.Sprintf("stored:%d", stored)})
+	case "REFCOUNT":
+		if len(args) != 2 {
+			return wrongArgs("object refcount")
+		}
+		if !s.db(cl).exists(args[1]) {
+			return nilReply
+		}
+		return intReply(1)
+	default:
+		return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+	}
+}
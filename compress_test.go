@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressAbove(t *testing.T) {
+	srv := newServer(config{compressAbove: 100})
+	cl := &client{}
+	big := strings.Repeat("compressible ", 100)
+	srv.dispatch(cl, []string{"SET", "big", big})
+	srv.dispatch(cl, []string{"SET", "small", "tiny"})
+
+	if got := srv.dispatch(cl, []string{"GET", "big"}); got.text != big {
+		t.Fatalf("GET big = %d bytes, want %d", len(got.text), len(big))
+	}
+	for key, want := range map[string]string{"big": "deflate", "small": "raw"} {
+		if got := srv.dispatch(cl, []string{"OBJECT", "ENCODING", key}); got.text != want {
+			t.Errorf("OBJECT ENCODING %s = %+v, want %s", key, got, want)
+		}
+	}
+	got := srv.dispatch(cl, []string{"OBJECT", "SIZE", "big"})
+	if got.kind != kindArray || len(got.items) != 2 || got.items[0].text != "raw:1300" {
+		t.Fatalf("OBJECT SIZE big = %+v", got)
+	}
+	var stored int
+	if _, err := fmt.Sscanf(got.items[1].text, "stored:%d", &stored); err != nil || stored >= 100 {
+		t.Fatalf("stored size %q, want well under the raw size", got.items[1].text)
+	}
+	if used, _ := srv.dbs[0].memory(); used != int64(len("big")+stored+len("small")+len("tiny")) {
+		t.Errorf("used = %d, want compressed sizes", used)
+	}
+
+	// Overwriting with a short value stores it raw again.
+	srv.dispatch(cl, []string{"SET", "big", "short"})
+	if got := srv.dispatch(cl, []string{"OBJECT", "ENCODING", "big"}); got.text != "raw" {
+		t.Errorf("OBJECT ENCODING after overwrite = %+v", got)
+	}
+	srv.dispatch(cl, []string{"SET", "big", big})
+	if got := srv.dispatch(cl, []string{"JSONCOMPACT", "big"}); got.kind != kindErr {
+		t.Errorf("JSONCOMPACT on compressed non-JSON = %+v", got)
+	}
+
+	// Saves hold the raw values.
+	file := filepath.Join(t.TempDir(), "db.bin")
+	if err := saveToFile(srv.dbs[0], file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	plain := newKV()
+	if err := loadFromFile(plain, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := plain.get("big"); v != big {
+		t.Errorf("loaded big = %d bytes, want %d", len(v), len(big))
+	}
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	k := newKV()
+	k.setCompressAbove(8)
+	// Deflate cannot shrink a short, unrepetitive value, so it stays raw.
+	k.set("k2", "q8Zp2xLw1")
+	if enc, _ := k.encoding("k2"); enc != "raw" {
+		t.Errorf("encoding = %q, want raw", enc)
+	}
+}
+
+func TestObjectErrors(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"XADD", "s", "*", "f", "v"})
+	if got := srv.dispatch(cl, []string{"OBJECT", "ENCODING", "s"}); got.text != "stream" {
+		t.Errorf("OBJECT ENCODING stream = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"OBJECT", "SIZE", "s"}); got.text != errWrongType.Error() {
+		t.Errorf("OBJECT SIZE stream = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"OBJECT", "SIZE", "missing"}); got.kind != kindNil {
+		t.Errorf("OBJECT SIZE missing = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"OBJECT", "REFCOUNT", "s"}); got.text != "1" {
+		t.Errorf("OBJECT REFCOUNT stream = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"OBJECT", "REFCOUNT", "missing"}); got.kind != kindNil {
+		t.Errorf("OBJECT REFCOUNT missing = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"OBJECT", "FREQ", "s"}); got.kind != kindErr {
+		t.Errorf("OBJECT FREQ = %+v", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var errInvalidChars = errors.New("invalid characters")
+
+// rejectControl says which arguments -reject-control-chars checks.
+type rejectControl struct {
+	keys, values bool
+}
+
+// parseRejectControl parses the -reject-control-chars mode: "off",
+// "keys", or "all" for keys and values.
+func parseRejectControl(mode string) (rejectControl, error) {
+	switch mode {
+	case "", "off":
+		return rejectControl{}, nil
+	case "keys":
+		return rejectControl{keys: true}, nil
+	case "all":
+		return rejectControl{keys: true, values: true}, nil
+	}
+	return rejectControl{}, fmt.Errorf("invalid -reject-control-chars %q, want off, keys or all", mode)
+}
+
+// hasControlChars reports whether s holds a byte below 0x20 other than
+// tab, line feed and carriage return. Bytes from 0x20 up, including DEL
+// and non-ASCII, are allowed.
+func hasControlChars[T string | []byte](s T) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			return true
+		}
+	}
+	return false
+}
+
+// controlChars checks a key and its value, nil for commands without one,
+// against -reject-control-chars. A rejected command is logged and the
+// returned reply is its error; ok is true when the command may go ahead.
+func (s *server) controlChars(cl *client, cmd, key string, value []byte) (r reply, ok bool) {
+	rc := s.cfg.rejectControl
+	badKey := rc.keys && hasControlChars(key)
+	if !badKey && !(rc.values && hasControlChars(value)) {
+		return reply{}, true
+	}
+	slog.Warn("rejected command with control characters", "client", cl.id, "command", cmd, "in-key", badKey)
+	return errReply(errInvalidChars.Error()), false
+}
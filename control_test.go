@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"testing"
+)
+
+func TestRejectControlChars(t *testing.T) {
+	for _, tc := range []struct {
+		mode           string
+		keyOK, valueOK bool
+	}{
+		{"off", true, true},
+		{"keys", false, true},
+		{"all", false, false},
+	} {
+		rc, err := parseRejectControl(tc.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := newServer(config{rejectControl: rc})
+		cl := &client{}
+		ok := func(r reply) bool { return r.kind != kindErr }
+		if got := srv.dispatch(cl, []string{"SET", "a\x00b", "v"}); ok(got) != tc.keyOK {
+			t.Errorf("%s: SET with NUL in key = %+v", tc.mode, got)
+		}
+		if got := srv.dispatch(cl, []string{"DEL", "a\x1bb"}); ok(got) != tc.keyOK {
+			t.Errorf("%s: DEL with ESC in key = %+v", tc.mode, got)
+		}
+		if got := srv.dispatch(cl, []string{"SET", "k", "v\x01"}); ok(got) != tc.valueOK {
+			t.Errorf("%s: SET with SOH in value = %+v", tc.mode, got)
+		}
+		if got := srv.dispatch(cl, []string{"SET", "k", "tab\tcr\rlf\n\x7fé"}); !ok(got) {
+			t.Errorf("%s: SET with allowed bytes = %+v", tc.mode, got)
+		}
+		if !tc.keyOK {
+			if got := srv.dispatch(cl, []string{"SET", "a\x00b", "v"}); got.text != "invalid characters" {
+				t.Errorf("%s: rejection = %+v", tc.mode, got)
+			}
+		}
+	}
+	if _, err := parseRejectControl("values"); err == nil {
+		t.Error("parseRejectControl accepted an unknown mode")
+	}
+}
+
+func TestBulkSetRejectsControlChars(t *testing.T) {
+	srv := newServer(config{rejectControl: rejectControl{keys: true, values: true}})
+	c, _ := pipelineConn(t, srv)
+	c.Write(append([]byte("BULKSET 2\n"), bulkFrame("a", "1", "b", "\x00")...))
+	r := bufio.NewReader(c)
+	if got, _ := r.ReadString('\n'); got != "ERR invalid characters\n" {
+		t.Fatalf("BULKSET with NUL value = %q", got)
+	}
+	if srv.dbs[0].len() != 0 {
+		t.Error("rejected batch stored keys")
+	}
+}
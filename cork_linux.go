@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+const corkSupported = true
+
+// setCork sets TCP_CORK. While corked the kernel only sends full packets,
+// so the writes of a reply larger than the write buffer are coalesced;
+// uncorking sends whatever is left.
+func setCork(c *net.TCPConn, on bool) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v := 0
+	if on {
+		v = 1
+	}
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		optErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK, v)
+	}); err != nil {
+		return err
+	}
+	return optErr
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func corkValue(t *testing.T, c *net.TCPConn) int {
+	t.Helper()
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCorkLargeReplies(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			defer c.Close()
+			buf := make([]byte, 64<<10)
+			for {
+				if _, err := c.Read(buf); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(config{cork: true})
+	cl, err := s.register(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	cl.wmu.Lock()
+	cl.writeLocked(strReply("small"))
+	corked := cl.corked
+	cl.wmu.Unlock()
+	if corked {
+		t.Fatal("corked for a reply that fits the buffer")
+	}
+	cl.wmu.Lock()
+	cl.writeLocked(strReply(strings.Repeat("x", 2*ioBufferSize)))
+	corked = cl.corked
+	cl.wmu.Unlock()
+	if !corked || corkValue(t, cl.tcp) == 0 {
+		t.Fatal("not corked for a reply larger than the buffer")
+	}
+	if err := cl.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cl.corked || corkValue(t, cl.tcp) != 0 {
+		t.Fatal("still corked after flush")
+	}
+}
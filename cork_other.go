@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const corkSupported = false
+
+func setCork(c *net.TCPConn, on bool) error {
+	return errors.New("TCP_CORK not supported")
+}
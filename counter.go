@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	errCounterOverflow = errors.New("counter would overflow")
+	errNotInteger      = errors.New("not an integer")
+)
+
+// counterSize is the logical size of a counter: its key and an int64.
+func counterSize(key string) int64 {
+	return int64(len(key)) + 8
+}
+
+// nextID increments the counter at key, creating it at 0 first, and
+// returns the new value. Other commands see a counter as a read-only
+// string of its decimal value; SET or DEL replace or remove it.
+func (k *kvShard) nextID(key string) (int64, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	n, ok := k.counters[key]
+	if !ok {
+		if k.typeLocked(key) != "none" {
+			return 0, errWrongType
+		}
+		k.addUsed(counterSize(key))
+		k.notePeakLocked()
+	}
+	if n == math.MaxInt64 {
+		return 0, errCounterOverflow
+	}
+	n++
+	k.counters[key] = n
+	if k.lru != nil {
+		k.lru.touch(key)
+		k.evictLocked(key)
+	}
+	return n, nil
+}
+
+// cmdNextID handles NEXTID key, a sequence generator: each call replies
+// with the previous value plus one, starting from 1.
+func cmdNextID(s *server, cl *client, args []string) reply {
+	n, err := s.db(cl).nextID(args[0])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(n)
+}
+
+// incrBy adds delta to the base-10 integer stored as a string at key, a
+// missing key counting as 0, and stores and returns the result. The key
+// keeps any timeout. NEXTID counters are refused, so INCR and DECR cannot
+// move a sequence backwards, and so is a result check refuses when it is
+// not nil.
+func (k *kvShard) incrBy(key string, delta int64, check func([]byte) error) (int64, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.incrByLocked(key, delta, check)
+}
+
+// incrByLocked is incrBy for a caller holding k.mu.
+func (k *kvShard) incrByLocked(key string, delta int64, check func([]byte) error) (int64, error) {
+	k.reapLocked(key)
+	var n int64
+	if v, ok, fresh := k.valueLocked(key); ok {
+		var err error
+		n, err = strconv.ParseInt(string(v), 10, 64)
+		if fresh {
+			zero(v)
+		}
+		if err != nil {
+			return 0, errNotInteger
+		}
+	} else if k.typeLocked(key) != "none" {
+		return 0, errWrongType
+	}
+	if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+		return 0, errCounterOverflow
+	}
+	n += delta
+	v := strconv.AppendInt(nil, n, 10)
+	if check != nil {
+		if err := check(v); err != nil {
+			return 0, err
+		}
+	}
+	k.storeLocked(key, v)
+	return n, nil
+}
+
+func cmdIncr(s *server, cl *client, args []string) reply {
+	return incrReply(s.db(cl).incrBy(args[0], 1))
+}
+
+func cmdDecr(s *server, cl *client, args []string) reply {
+	return incrReply(s.db(cl).incrBy(args[0], -1))
+}
+
+func incrReply(n int64, err error) reply {
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(n)
+}
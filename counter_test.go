@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestNextID(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for want := 1; want <= 3; want++ {
+		if got := srv.dispatch(cl, []string{"NEXTID", "seq"}); got.text != strconv.Itoa(want) {
+			t.Fatalf("NEXTID = %+v, want %d", got, want)
+		}
+	}
+	if got := srv.dispatch(cl, []string{"GET", "seq"}); got.text != "3" {
+		t.Errorf("GET of a counter = %+v", got)
+	}
+	srv.dispatch(cl, []string{"SET", "str", "abc"})
+	if got := srv.dispatch(cl, []string{"NEXTID", "str"}); got.text != errWrongType.Error() {
+		t.Errorf("NEXTID on a string = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"XADD", "seq", "*", "f", "v"}); got.text != errWrongType.Error() {
+		t.Errorf("XADD on a counter = %+v", got)
+	}
+	srv.dispatch(cl, []string{"DEL", "seq"})
+	if got := srv.dispatch(cl, []string{"NEXTID", "seq"}); got.text != "1" {
+		t.Errorf("NEXTID after DEL = %+v", got)
+	}
+	if used, _ := srv.dbs[0].memory(); used != int64(len("str")+len("abc"))+counterSize("seq") {
+		t.Errorf("used = %d", used)
+	}
+
+	srv.dbs[0].shardOf("max").counters["max"] = math.MaxInt64
+	if got := srv.dispatch(cl, []string{"NEXTID", "max"}); got.text != errCounterOverflow.Error() {
+		t.Errorf("NEXTID at MaxInt64 = %+v", got)
+	}
+}
+
+func TestNextIDSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+	src := newKV()
+	src.shardOf("big").counters["big"] = math.MaxInt64 - 1
+	if _, err := src.nextID("small"); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveToFile(src, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	dst := newKV()
+	if err := loadFromFile(dst, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := dst.nextID("big"); err != nil || n != math.MaxInt64 {
+		t.Errorf("NEXTID big after LOAD = %d, %v", n, err)
+	}
+	if n, _ := dst.nextID("small"); n != 2 {
+		t.Errorf("NEXTID small after LOAD = %d, want 2", n)
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	do := func(args ...string) reply { return srv.dispatch(cl, args) }
+	if got := do("INCR", "n"); got.text != "1" {
+		t.Fatalf("INCR on a missing key = %+v", got)
+	}
+	if got := do("DECR", "n"); got.text != "0" {
+		t.Fatalf("DECR = %+v", got)
+	}
+	do("DECR", "n")
+	if got := do("GET", "n"); got.text != "-1" {
+		t.Errorf("GET after DECR = %+v", got)
+	}
+	do("SET", "big", strconv.FormatInt(math.MaxInt64, 10))
+	if got := do("INCR", "big"); got.text != errCounterOverflow.Error() {
+		t.Errorf("INCR past MaxInt64 = %+v", got)
+	}
+	do("SET", "small", strconv.FormatInt(math.MinInt64, 10))
+	if got := do("DECR", "small"); got.text != errCounterOverflow.Error() {
+		t.Errorf("DECR past MinInt64 = %+v", got)
+	}
+	for _, v := range []string{"abc", "1.5", "12a", `""`} {
+		do("SET", "s", v)
+		if got := do("INCR", "s"); got.kind != kindErr || got.text != "not an integer" {
+			t.Errorf("INCR on %q = %+v", v, got)
+		}
+	}
+	do("NEXTID", "seq")
+	do("XADD", "st", "*", "f", "v")
+	for _, key := range []string{"seq", "st"} {
+		if got := do("DECR", key); got.text != errWrongType.Error() {
+			t.Errorf("DECR on %s = %+v", key, got)
+		}
+	}
+	do("SET", "ttl", "5")
+	do("EXPIRE", "ttl", "100")
+	do("INCR", "ttl")
+	if got := do("TTL", "ttl"); got.text != "100" {
+		t.Errorf("TTL after INCR = %+v; INCR must keep the timeout", got)
+	}
+}
+
+func TestIncrConcurrent(t *testing.T) {
+	k := newKV()
+	const workers, each = 8, 500
+	done := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := 0; i < each; i++ {
+				k.incrBy("n", 1)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+	if v, _ := k.get("n"); v != strconv.Itoa(workers*each) {
+		t.Fatalf("n = %s after %d concurrent INCRs", v, workers*each)
+	}
+}
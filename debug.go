@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// debugCommands are the DEBUG subcommands, each with its exact argument
+// count after the subcommand name.
+var debugCommands = map[string]struct {
+	args int
+	run  func(s *server, cl *client, args []string) reply
+}{
+	"CORRUPT":   {1, debugCorrupt},
+	"ROUNDTRIP": {1, debugRoundtrip},
+	"SIZEHIST":  {0, debugSizeHist},
+	"STACKS":    {0, debugStacks},
+	"STREAM":    {1, debugStream},
+}
+
+// cmdDebug runs a DEBUG subcommand. DEBUG is only available when the
+// server was started with -debug.
+func cmdDebug(s *server, cl *client, args []string) reply {
+	if !s.cfg.debug {
+		return errReply("DEBUG is disabled; start the server with -debug")
+	}
+	sub, ok := debugCommands[strings.ToUpper(args[0])]
+	if !ok {
+		return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+	}
+	if len(args)-1 != sub.args {
+		return wrongArgs("debug " + strings.ToLower(args[0]))
+	}
+	return sub.run(s, cl, args[1:])
+}
+
+// debugCorrupt flips the last byte of a save file. That byte belongs to
+// the GCM tag, so a later LOAD of the file fails authentication.
+func debugCorrupt(s *server, cl *client, args []string) reply {
+	if err := corruptFile(args[0]); err != nil {
+		return errReply(err.Error())
+	}
+	return okReply
+}
+
+func corruptFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() <= 28 {
+		return fmt.Errorf("%s is not a save file", name)
+	}
+	b := make([]byte, 1)
+	off := fi.Size() - 1
+	if _, err := f.ReadAt(b, off); err != nil {
+		return err
+	}
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	return err
+}
+
+// sizeBuckets are the upper bounds (exclusive) of the DEBUG SIZEHIST
+// buckets; values at least as large as the last bound fall in a final one.
+var sizeBuckets = []struct {
+	label string
+	limit int
+}{
+	{"<64B", 64},
+	{"<1K", 1 << 10},
+	{"<16K", 16 << 10},
+	{"<1M", 1 << 20},
+}
+
+// sizeHistogram counts values per size bucket under the read lock.
+func (k *kvShard) sizeHistogram() []int {
+	counts := make([]int, len(sizeBuckets)+1)
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for key, v := range k.data {
+		n, ok := k.compressed[key]
+		if !ok {
+			n = len(v)
+		}
+		i := 0
+		for i < len(sizeBuckets) && n >= sizeBuckets[i].limit {
+			i++
+		}
+		counts[i]++
+	}
+	return counts
+}
+
+func debugSizeHist(s *server, cl *client, args []string) reply {
+	counts := s.db(cl).sizeHistogram()
+	lines := make([]string, len(counts))
+	for i, n := range counts {
+		label := ">=1M"
+		if i < len(sizeBuckets) {
+			label = sizeBuckets[i].label
+		}
+		lines[i] = fmt.Sprintf("%s:%d", label, n)
+	}
+	return arrayReply(lines)
+}
+
+// maxStackDump bounds the buffer DEBUG STACKS grows to; a dump that does
+// not fit is cut short.
+const maxStackDump = 64 << 20
+
+// allStacks returns the stack traces of every goroutine, as a panic prints
+// them.
+func allStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackDump {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// debugStacks replies with one line per line of the goroutine dump. The
+// dump shows what every connection is doing, so a connection pinned to a
+// tenant's database may not take it.
+func debugStacks(s *server, cl *client, args []string) reply {
+	if cl.pinned {
+		return errReply("DEBUG STACKS is not allowed on a tenant connection")
+	}
+	return arrayReply(strings.Split(strings.TrimRight(string(allStacks()), "\n"), "\n"))
+}
+
+// streamStats describes the stream at key without copying any field or
+// value: its length and logical size, first, last and last generated IDs,
+// and for each consumer group its last delivered ID, pending count and lag
+// (entries not yet delivered to the group).
+func (k *kvShard) streamStats(key string) ([]string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	st, err := k.streamLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	if st == nil {
+		return nil, errors.New("no such key")
+	}
+	first, last := "-", "-"
+	if n := len(st.entries); n > 0 {
+		first, last = st.entries[0].id.String(), st.entries[n-1].id.String()
+	}
+	lines := []string{
+		fmt.Sprintf("length:%d", len(st.entries)),
+		fmt.Sprintf("bytes:%d", st.size(key)),
+		"first-entry:" + first,
+		"last-entry:" + last,
+		"last-generated:" + st.last.String(),
+		fmt.Sprintf("groups:%d", len(st.groups)),
+	}
+	names := make([]string, 0, len(st.groups))
+	for name := range st.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := st.groups[name]
+		lines = append(lines, fmt.Sprintf("group:%s last-delivered=%s pending=%d lag=%d",
+			name, g.lastDelivered, len(g.pending), len(st.entries)-st.after(g.lastDelivered)))
+	}
+	return lines, nil
+}
+
+func debugStream(s *server, cl *client, args []string) reply {
+	lines, err := s.db(cl).streamStats(args[0])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return arrayReply(lines)
+}
+
+// roundtripPass encrypts the scratch files of DEBUG ROUNDTRIP.
+const roundtripPass = "bos-roundtrip"
+
+// roundtrip loads doc, a snapshot document in any supported version, into
+// a scratch store, saves that with saveToFile, loads the file into a
+// second store with loadFromFile, and compares the two stores' snapshots
+// byte for byte. It returns nil when they match. The scratch directory is
+// removed before it returns.
+func roundtrip(doc []byte) error {
+	d, err := decodeSnapshot(doc)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	if d.KeysHashed {
+		d.mac = keyNameKey(roundtripPass)
+	}
+	before := newKV()
+	if err := before.replace(d); err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	want, err := json.Marshal(before.snapshot())
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "bos-roundtrip-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dump")
+	if err := saveToFile(before, file, roundtripPass); err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+	after := newKV()
+	if err := loadFromFile(after, file, roundtripPass); err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+	got, err := json.Marshal(after.snapshot())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		i := 0
+		for i < len(got) && i < len(want) && got[i] == want[i] {
+			i++
+		}
+		return fmt.Errorf("mismatch at byte %d of %d", i, len(want))
+	}
+	return nil
+}
+
+// debugRoundtrip runs roundtrip on a base64-encoded JSON document. The
+// encoding keeps whitespace and newlines in the document intact through
+// the line protocol.
+func debugRoundtrip(s *server, cl *client, args []string) reply {
+	doc, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil {
+		return errReply("invalid base64: " + err.Error())
+	}
+	if err := roundtrip(doc); err != nil {
+		return errReply("roundtrip failed: " + err.Error())
+	}
+	return okReply
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDebugCorrupt(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db.bin")
+	srv := newServer(config{})
+	srv.dbs[0].set("k", "v")
+	if err := saveToFile(srv.dbs[0], file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.dispatch(&client{}, []string{"DEBUG", "CORRUPT", file}); got.kind != kindErr {
+		t.Fatalf("DEBUG without -debug = %+v", got)
+	}
+	srv.cfg.debug = true
+	if got := srv.dispatch(&client{}, []string{"DEBUG", "CORRUPT", file}); got.kind != kindOK {
+		t.Fatalf("DEBUG CORRUPT = %+v", got)
+	}
+	if err := loadFromFile(newKV(), file, "pw"); err == nil {
+		t.Fatal("corrupted file loaded")
+	}
+	if got := srv.dispatch(&client{}, []string{"DEBUG", "CORRUPT"}); got.text != "wrong number of arguments for 'debug corrupt'" {
+		t.Fatalf("DEBUG CORRUPT without file = %+v", got)
+	}
+}
+
+func TestDebugSizeHist(t *testing.T) {
+	srv := newServer(config{debug: true})
+	srv.dbs[0].set("a", "x")
+	srv.dbs[0].set("b", strings.Repeat("x", 64))
+	srv.dbs[0].set("c", strings.Repeat("x", 2000))
+	srv.dbs[0].set("d", strings.Repeat("x", 1<<20))
+	got := srv.dispatch(&client{}, []string{"DEBUG", "SIZEHIST"})
+	want := []string{"<64B:1", "<1K:1", "<16K:1", "<1M:0", ">=1M:1"}
+	if got.kind != kindArray || len(got.items) != len(want) {
+		t.Fatalf("DEBUG SIZEHIST = %+v", got)
+	}
+	for i, w := range want {
+		if got.items[i].text != w {
+			t.Errorf("bucket %d = %q, want %q", i, got.items[i].text, w)
+		}
+	}
+}
+
+func TestDebugStacks(t *testing.T) {
+	srv := newServer(config{debug: true})
+	parked := make(chan struct{})
+	defer close(parked)
+	go func() { <-parked }()
+	got := srv.dispatch(&client{}, []string{"DEBUG", "STACKS"})
+	if got.kind != kindArray || !strings.HasPrefix(got.items[0].text, "goroutine ") {
+		t.Fatalf("DEBUG STACKS = %+v", got)
+	}
+	dump := strings.Join(lineTexts(got), "\n")
+	// The dump covers other goroutines, not just the caller.
+	if !strings.Contains(dump, "TestDebugStacks.func") {
+		t.Errorf("dump is missing the parked goroutine:\n%s", dump)
+	}
+	if got := srv.dispatch(&client{pinned: true}, []string{"DEBUG", "STACKS"}); got.kind != kindErr {
+		t.Errorf("DEBUG STACKS on a pinned connection = %+v", got)
+	}
+}
+
+func TestDebugStream(t *testing.T) {
+	srv := newServer(config{debug: true})
+	cl := &client{}
+	srv.dispatch(cl, []string{"XADD", "s", "1-0", "f", "secret"})
+	srv.dispatch(cl, []string{"XADD", "s", "2-0", "f", "secret"})
+	srv.dispatch(cl, []string{"XADD", "s", "3-0", "f", "secret"})
+	srv.dispatch(cl, []string{"XGROUP", "CREATE", "s", "b", "$"})
+	srv.dispatch(cl, []string{"XGROUP", "CREATE", "s", "a", "0"})
+	srv.dispatch(cl, []string{"XREADGROUP", "GROUP", "a", "w", "COUNT", "1", "STREAMS", "s", ">"})
+	got := srv.dispatch(cl, []string{"DEBUG", "STREAM", "s"})
+	want := []string{
+		"length:3",
+		"bytes:" + strconv.Itoa(1+3*(16+len("f")+len("secret"))),
+		"first-entry:1-0",
+		"last-entry:3-0",
+		"last-generated:3-0",
+		"groups:2",
+		"group:a last-delivered=1-0 pending=1 lag=2",
+		"group:b last-delivered=3-0 pending=0 lag=0",
+	}
+	if got.kind != kindArray || len(got.items) != len(want) {
+		t.Fatalf("DEBUG STREAM = %+v", got)
+	}
+	for i, w := range want {
+		if got.items[i].text != w {
+			t.Errorf("line %d = %q, want %q", i, got.items[i].text, w)
+		}
+		if strings.Contains(got.items[i].text, "secret") {
+			t.Errorf("line %d leaks a value: %q", i, got.items[i].text)
+		}
+	}
+	srv.dispatch(cl, []string{"SET", "str", "v"})
+	if got := srv.dispatch(cl, []string{"DEBUG", "STREAM", "str"}); got.text != errWrongType.Error() {
+		t.Errorf("DEBUG STREAM on a string = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"DEBUG", "STREAM", "missing"}); got.kind != kindErr {
+		t.Errorf("DEBUG STREAM on a missing key = %+v", got)
+	}
+}
+
+func TestDebugRoundtrip(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	srv := newServer(config{debug: true})
+	roundtrip := func(doc string) reply {
+		return srv.dispatch(&client{}, []string{"DEBUG", "ROUNDTRIP", base64.StdEncoding.EncodeToString([]byte(doc))})
+	}
+	for _, doc := range []string{
+		`{}`,
+		`{"kéy ☃": "line\nbreak\u0000\u001f", "": "empty key"}`,
+		`{"version": 2, "data": {"a": "1"}, "counters": {"n": 9223372036854775807},
+		  "streams": {"s": {"last": [5, 1], "entries": [{"id": [5, 1], "fields": ["Zg==", "dg=="]}]}}}`,
+		`{"version": 2, "data": {"h": "v"}, "keys_hashed": true}`,
+	} {
+		if got := roundtrip(doc); got.kind != kindOK {
+			t.Errorf("DEBUG ROUNDTRIP %s = %+v", doc, got)
+		}
+	}
+	for _, doc := range []string{`[1, 2]`, `{"version": 99}`, `{"version": 2, "data": {"a": ""}, "counters": {"a": 1}}`} {
+		if got := roundtrip(doc); got.kind != kindErr {
+			t.Errorf("DEBUG ROUNDTRIP %s = %+v, want an error", doc, got)
+		}
+	}
+	if got := srv.dispatch(&client{}, []string{"DEBUG", "ROUNDTRIP", "%%%"}); got.kind != kindErr {
+		t.Errorf("DEBUG ROUNDTRIP with bad base64 = %+v", got)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("scratch files left behind: %v", left)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "strings"
+
+// Results of delToken, which DELTOKEN replies with.
+const (
+	tokenDeleted  = 1
+	tokenMismatch = 0
+	tokenAbsent   = -1
+)
+
+// delToken deletes key only if it holds the string token, so a retried
+// delete cannot remove a value written since the first attempt. A key of
+// another type never matches.
+func (k *kvShard) delToken(key, token string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	if k.typeLocked(key) == "none" {
+		return tokenAbsent
+	}
+	v, ok, fresh := k.valueLocked(key)
+	match := ok && string(v) == token
+	if fresh {
+		zero(v)
+	}
+	if !match {
+		return tokenMismatch
+	}
+	k.deleteLocked(key)
+	return tokenDeleted
+}
+
+// cmdDelToken handles DELTOKEN key token. It replies 1 if the key held
+// token and was deleted, 0 if it holds something else, and -1 if it does
+// not exist.
+func cmdDelToken(s *server, cl *client, args []string) reply {
+	token := strings.Join(args[1:], " ")
+	if token == emptyValue {
+		token = ""
+	}
+	if r, ok := s.controlChars(cl, "DELTOKEN", args[0], nil); !ok {
+		return r
+	}
+	return intReply(int64(s.db(cl).delToken(args[0], token)))
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestDelToken(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "lock", "owner", "42"})
+	srv.dispatch(cl, []string{"SET", "empty", `""`})
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"DELTOKEN", "lock", "owner", "7"}, "0"},
+		{[]string{"GET", "lock"}, "owner 42"},
+		{[]string{"DELTOKEN", "lock", "owner", "42"}, "1"},
+		{[]string{"EXISTS", "lock"}, "0"},
+		{[]string{"DELTOKEN", "lock", "owner", "42"}, "-1"},
+		{[]string{"DELTOKEN", "empty", `""`}, "1"},
+		{[]string{"NEXTID", "seq"}, "1"},
+		{[]string{"DELTOKEN", "seq", "1"}, "0"},
+	} {
+		if got := srv.dispatch(cl, tc.args); got.text != tc.want {
+			t.Errorf("%v = %+v, want %q", tc.args, got, tc.want)
+		}
+	}
+	if used, _ := srv.dbs[0].memory(); used != counterSize("seq") {
+		t.Errorf("used = %d", used)
+	}
+}
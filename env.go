@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix begins the environment variable that stands in for each flag:
+// -max-value-bytes is read from BOS_MAX_VALUE_BYTES.
+const envPrefix = "BOS_"
+
+// secretFlags are removed from the environment once read, so they are
+// not inherited by child processes or shown in /proc/<pid>/environ.
+var secretFlags = map[string]bool{"requirepass": true}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// flagsFromEnv sets each flag of fs that the command line left unset from
+// its environment variable, if that is set. Values go through the flag's
+// own Set, so they are parsed and validated as on the command line, and a
+// repeatable flag takes one value. Flags given on the command line win,
+// so fs must already be parsed.
+func flagsFromEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envName(f.Name)
+		v, ok := os.LookupEnv(env)
+		if ok && secretFlags[f.Name] {
+			os.Unsetenv(env)
+		}
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("invalid value for %s: %v", env, e)
+		}
+	})
+	return err
+}
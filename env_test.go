@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("bos", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addr := fs.String("addr", ":4000", "")
+	maxValue := fs.Int("max-value-bytes", 0, "")
+	idle := fs.Duration("idle-timeout", time.Minute, "")
+	pass := fs.String("requirepass", "", "")
+	var cidrs listFlag
+	fs.Var(&cidrs, "allow-cidr", "")
+
+	t.Setenv("BOS_ADDR", ":5000")
+	t.Setenv("BOS_MAX_VALUE_BYTES", "64")
+	t.Setenv("BOS_REQUIREPASS", "secret")
+	t.Setenv("BOS_ALLOW_CIDR", "10.0.0.0/8")
+	if err := fs.Parse([]string{"-addr", ":6000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := flagsFromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *addr != ":6000" {
+		t.Errorf("addr = %q; the flag should win over BOS_ADDR", *addr)
+	}
+	if *maxValue != 64 || *pass != "secret" || len(cidrs) != 1 {
+		t.Errorf("from env: max-value-bytes %d, requirepass %q, allow-cidr %q", *maxValue, *pass, cidrs)
+	}
+	if *idle != time.Minute {
+		t.Errorf("idle-timeout = %v, want the default", *idle)
+	}
+	if _, ok := os.LookupEnv("BOS_REQUIREPASS"); ok {
+		t.Error("BOS_REQUIREPASS left in the environment")
+	}
+
+	t.Setenv("BOS_IDLE_TIMEOUT", "soon")
+	if err := flagsFromEnv(fs); err == nil {
+		t.Error("accepted BOS_IDLE_TIMEOUT=soon")
+	}
+}
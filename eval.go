@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxEvalSteps bounds the length of an EVAL expression.
+const maxEvalSteps = 16
+
+var errEmptyExpr = errors.New("empty expression")
+
+// evalStep is one operation of an EVAL expression. It returns the new
+// value in a new array, leaving v, which may be the stored slice, as it
+// was.
+type evalStep func(v []byte) ([]byte, error)
+
+// parseExpr compiles an EVAL expression: steps separated by "|", each an
+// operation name and its argument, applied left to right.
+//
+//	incr [n]     add n, 1 by default, to an integer value
+//	append text  add text to the end
+//	upper        upper-case the value
+//	lower        lower-case the value
+//
+// There are no variables, loops or calls, so every expression finishes in
+// time linear in its length and the value's; it cannot touch other keys.
+func parseExpr(expr string) ([]evalStep, error) {
+	parts := strings.Split(expr, "|")
+	if len(parts) > maxEvalSteps {
+		return nil, fmt.Errorf("expression has more than %d steps", maxEvalSteps)
+	}
+	steps := make([]evalStep, 0, len(parts))
+	for _, part := range parts {
+		op, arg, _ := strings.Cut(strings.TrimLeft(part, " "), " ")
+		switch strings.ToLower(op) {
+		case "incr":
+			delta := int64(1)
+			if arg = strings.TrimSpace(arg); arg != "" {
+				n, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("incr: %q is not an integer", arg)
+				}
+				delta = n
+			}
+			steps = append(steps, func(v []byte) ([]byte, error) {
+				n := int64(0)
+				if len(v) > 0 {
+					var err error
+					if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+						return nil, errNotInteger
+					}
+				}
+				if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+					return nil, errCounterOverflow
+				}
+				return strconv.AppendInt(nil, n+delta, 10), nil
+			})
+		case "append":
+			if arg == "" {
+				return nil, errors.New("append needs text")
+			}
+			text := strings.TrimRight(arg, " ")
+			steps = append(steps, func(v []byte) ([]byte, error) {
+				return append(v[:len(v):len(v)], text...), nil
+			})
+		case "upper", "lower":
+			if strings.TrimSpace(arg) != "" {
+				return nil, fmt.Errorf("%s takes no argument", op)
+			}
+			f := bytes.ToUpper
+			if strings.EqualFold(op, "lower") {
+				f = bytes.ToLower
+			}
+			steps = append(steps, func(v []byte) ([]byte, error) { return f(v), nil })
+		case "":
+			return nil, errEmptyExpr
+		default:
+			return nil, fmt.Errorf("unknown operation '%s'", op)
+		}
+	}
+	return steps, nil
+}
+
+// eval applies steps to the string at key under the write lock and stores
+// the result, or nothing if a step fails or check, when not nil, refuses
+// the result. A missing key starts empty. The key keeps its TTL.
+func (k *kvShard) eval(key string, steps []evalStep, limit int, check func([]byte) error) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	v, ok, fresh := k.valueLocked(key)
+	if !ok && k.typeLocked(key) != "none" {
+		return "", errWrongType
+	}
+	if fresh {
+		defer zero(v)
+	}
+	cur := v
+	for i, step := range steps {
+		next, err := step(cur)
+		if i > 0 {
+			zero(cur) // an intermediate result no one else holds
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(next) > maxValueLen || limit > 0 && len(next) > limit {
+			zero(next)
+			return "", errValueTooLarge
+		}
+		cur = next
+	}
+	if check != nil {
+		if err := check(cur); err != nil {
+			if len(steps) > 0 {
+				zero(cur)
+			}
+			return "", err
+		}
+	}
+	out := string(cur)
+	k.storeLocked(key, cur)
+	return out, nil
+}
+
+// cmdEval handles EVAL key expr and replies with the new value.
+func cmdEval(s *server, cl *client, args []string) reply {
+	expr := strings.Join(args[1:], " ")
+	steps, err := parseExpr(expr)
+	if err != nil {
+		return errReply("invalid expression: " + err.Error())
+	}
+	if r, ok := s.controlChars(cl, "EVAL", args[0], []byte(expr)); !ok {
+		return r
+	}
+	v, err := s.db(cl).eval(args[0], steps, s.cfg.maxValueBytes)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return strReply(v)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "name", "Ada"})
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"EVAL", "name", "upper"}, "ADA"},
+		{[]string{"EVAL", "name", "lower", "|", "append", " lovelace"}, "ada lovelace"},
+		{[]string{"EVAL", "n", "incr"}, "1"},
+		{[]string{"EVAL", "n", "incr", "41"}, "42"},
+		{[]string{"EVAL", "n", "incr -2|append", "!"}, "40!"},
+		{[]string{"GET", "n"}, "40!"},
+		{[]string{"EVAL", "n", "incr"}, errNotInteger.Error()},
+		{[]string{"GET", "n"}, "40!"},
+		{[]string{"EVAL", "n", "shell", "rm"}, "invalid expression: unknown operation 'shell'"},
+		{[]string{"EVAL", "n", "upper|"}, "invalid expression: " + errEmptyExpr.Error()},
+		{[]string{"EVAL", "n", "incr", "x"}, `invalid expression: incr: "x" is not an integer`},
+		{[]string{"EVAL", "n", "upper", "now"}, "invalid expression: upper takes no argument"},
+		{[]string{"EVAL", "n", strings.Repeat("upper|", maxEvalSteps) + "upper"}, "invalid expression: expression has more than 16 steps"},
+	} {
+		if got := srv.dispatch(cl, tc.args); got.text != tc.want {
+			t.Errorf("%v = %+v, want %q", tc.args, got, tc.want)
+		}
+	}
+
+	srv.dispatch(cl, []string{"NEXTID", "seq"})
+	if got := srv.dispatch(cl, []string{"EVAL", "seq", "upper"}); got.text != errWrongType.Error() {
+		t.Errorf("EVAL on a counter = %+v", got)
+	}
+	if used, _ := srv.dbs[0].memory(); used != int64(len("name")+len("ada lovelace")+len("n")+len("40!"))+counterSize("seq") {
+		t.Errorf("used = %d", used)
+	}
+}
+
+func TestEvalKeepsTTL(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "k", "v"})
+	srv.dispatch(cl, []string{"EXPIRE", "k", "100"})
+	srv.dispatch(cl, []string{"EVAL", "k", "upper"})
+	if got := srv.dispatch(cl, []string{"TTL", "k"}); got.text != "100" {
+		t.Errorf("TTL after EVAL = %+v", got)
+	}
+}
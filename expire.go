@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expireSweepInterval is how often the background sweep deletes expired
+// keys. Reads of a single key notice expiry at once; see reapLocked.
+const expireSweepInterval = time.Second
+
+// expiredLocked reports whether key has a deadline at or before now.
+// k.mu must be held.
+func (k *kvShard) expiredLocked(key string, now time.Time) bool {
+	t, ok := k.expiry[key]
+	return ok && !now.Before(t)
+}
+
+// reapLocked deletes key if it has expired, so a write finds it absent.
+// k.mu must be held for writing.
+func (k *kvShard) reapLocked(key string) {
+	if k.expiredLocked(key, time.Now()) {
+		k.dropLocked(key)
+	}
+}
+
+// reap is reapLocked for readers, which notice an expired key under the
+// read lock and delete it afterwards. key is the stored name.
+func (k *kvShard) reap(key string) {
+	k.mu.Lock()
+	k.reapLocked(key)
+	k.mu.Unlock()
+}
+
+// expire sets key to expire after d, or deletes it right away if d is not
+// positive. It reports whether the key exists.
+func (k *kvShard) expire(key string, d time.Duration) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	if k.typeLocked(key) == "none" {
+		return false
+	}
+	if d <= 0 {
+		k.deleteLocked(key)
+	} else {
+		k.expiry[key] = time.Now().Add(d)
+	}
+	return true
+}
+
+// ttl returns the time key has left. found is false for a missing or
+// expired key, and hasTTL is false for a key that never expires.
+func (k *kvShard) ttl(key string) (left time.Duration, found, hasTTL bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	if k.typeLocked(key) == "none" || k.expiredLocked(key, now) {
+		return 0, false, false
+	}
+	t, ok := k.expiry[key]
+	return t.Sub(now), true, ok
+}
+
+// deleteExpired deletes every key whose deadline has passed and returns
+// how many there were.
+func (k *kvShard) deleteExpired(now time.Time) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	n := 0
+	for key := range k.expiry {
+		if k.expiredLocked(key, now) {
+			k.dropLocked(key)
+			n++
+		}
+	}
+	return n
+}
+
+// expiringKey is a key with a timeout and the time it has left.
+type expiringKey struct {
+	key  string
+	left time.Duration
+}
+
+// expiring returns the n live keys with the soonest deadlines, soonest
+// first; keys without a timeout are left out. Each shard's deadlines are
+// scanned under its read lock, keeping only the n soonest so far.
+func (k *kv) expiring(n int) []expiringKey {
+	type deadline struct {
+		key string
+		at  time.Time
+	}
+	cmp := func(a, b deadline) int {
+		if c := a.at.Compare(b.at); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	}
+	best := make([]deadline, 0, min(n, 1024)+1)
+	now := time.Now()
+	consider := func(d deadline) {
+		if !now.Before(d.at) || len(best) == n && cmp(d, best[n-1]) >= 0 {
+			return
+		}
+		i, _ := slices.BinarySearchFunc(best, d, cmp)
+		best = slices.Insert(best, i, d)
+		if len(best) > n {
+			best = best[:n]
+		}
+	}
+	for _, sh := range k.shards {
+		sh.mu.RLock()
+		for key, at := range sh.expiry {
+			consider(deadline{key, at})
+		}
+		if sh.mapped != nil {
+			sh.mapped.each(func(key string, _ []byte, expiry int64) bool {
+				if expiry != 0 {
+					consider(deadline{key, time.UnixMilli(expiry)})
+				}
+				return true
+			})
+		}
+		sh.mu.RUnlock()
+	}
+	out := make([]expiringKey, len(best))
+	for i, d := range best {
+		out[i] = expiringKey{d.key, d.at.Sub(now)}
+	}
+	return out
+}
+
+// sweepExpired deletes expired keys from every database each interval.
+func (s *server) sweepExpired(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		for _, db := range s.dbs {
+			db.deleteExpired(now)
+		}
+	}
+}
+
+// cmdExpire handles EXPIRE key seconds. It replies 1 if the key exists and
+// 0 if not; a timeout of zero or less deletes the key.
+func cmdExpire(s *server, cl *client, args []string) reply {
+	secs, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || secs > int64(math.MaxInt64/time.Second) {
+		return errReply("timeout must be an integer number of seconds")
+	}
+	d := time.Duration(max(secs, 0)) * time.Second
+	if s.db(cl).expire(args[0], d) {
+		return intReply(1)
+	}
+	return intReply(0)
+}
+
+// cmdTTL handles TTL key: the seconds left, rounded to the nearest, -1 for
+// a key without a timeout and -2 for a missing key.
+func cmdTTL(s *server, cl *client, args []string) reply {
+	left, found, hasTTL := s.db(cl).ttl(args[0])
+	switch {
+	case !found:
+		return intReply(-2)
+	case !hasTTL:
+		return intReply(-1)
+	}
+	return intReply(int64((left + time.Second/2) / time.Second))
+}
+
+// cmdExpiring handles EXPIRING n: up to n "key seconds" lines for the keys
+// closest to expiring, soonest first, with the seconds left rounded as by
+// TTL.
+func cmdExpiring(s *server, cl *client, args []string) reply {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return errReply("count must be a positive integer")
+	}
+	keys := s.db(cl).expiring(n)
+	lines := make([]string, len(keys))
+	for i, e := range keys {
+		lines[i] = fmt.Sprintf("%s %d", e.key, int64((e.left+time.Second/2)/time.Second))
+	}
+	return arrayReply(lines)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backdate moves key's deadline into the past, as if its timeout had run
+// out.
+func backdate(k *kv, key string) {
+	sh := k.shardOf(key)
+	sh.mu.Lock()
+	sh.expiry[key] = time.Now().Add(-time.Millisecond)
+	sh.mu.Unlock()
+}
+
+func TestExpireAndTTL(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	db := srv.dbs[0]
+	do := func(args ...string) string { return srv.dispatch(cl, args).text }
+
+	if got := do("TTL", "k"); got != "-2" {
+		t.Errorf("TTL missing = %s", got)
+	}
+	if got := do("EXPIRE", "k", "10"); got != "0" {
+		t.Errorf("EXPIRE missing = %s", got)
+	}
+	do("SET", "k", "v")
+	if got := do("TTL", "k"); got != "-1" {
+		t.Errorf("TTL without timeout = %s", got)
+	}
+	if got := do("EXPIRE", "k", "100"); got != "1" {
+		t.Fatalf("EXPIRE = %s", got)
+	}
+	if got := do("TTL", "k"); got != "100" {
+		t.Errorf("TTL = %s, want 100", got)
+	}
+	do("SET", "k", "v2")
+	if got := do("TTL", "k"); got != "-1" {
+		t.Errorf("TTL after SET = %s; SET must clear the timeout", got)
+	}
+
+	do("EXPIRE", "k", "100")
+	backdate(db, "k")
+	if got := srv.dispatch(cl, []string{"GET", "k"}); got.kind != kindNil {
+		t.Errorf("GET expired = %+v", got)
+	}
+	sh := db.shardOf("k")
+	sh.mu.RLock()
+	_, stored := sh.data["k"]
+	sh.mu.RUnlock()
+	if stored {
+		t.Error("GET left the expired key in the store")
+	}
+
+	do("SET", "e", "v")
+	do("EXPIRE", "e", "100")
+	backdate(db, "e")
+	if got := do("EXISTS", "e"); got != "0" {
+		t.Errorf("EXISTS expired = %s", got)
+	}
+	if got := do("TTL", "e"); got != "-2" {
+		t.Errorf("TTL expired = %s", got)
+	}
+
+	do("SET", "gone", "v")
+	if got := do("EXPIRE", "gone", "-1"); got != "1" || db.exists("gone") {
+		t.Errorf("EXPIRE with a negative timeout = %s, key exists %v", got, db.exists("gone"))
+	}
+	if got := srv.dispatch(cl, []string{"EXPIRE", "k", "soon"}); got.kind != kindErr {
+		t.Errorf("EXPIRE with a bad timeout = %+v", got)
+	}
+}
+
+func TestExpireSweep(t *testing.T) {
+	k := newKV()
+	for _, key := range []string{"a", "b", "c"} {
+		k.set(key, "v")
+	}
+	k.nextID("n")
+	k.expire("a", time.Hour)
+	k.expire("b", time.Hour)
+	k.expire("n", time.Hour)
+	backdate(k, "b")
+	backdate(k, "n")
+	if got := len(k.keys("*")); got != 2 {
+		t.Errorf("KEYS with expired keys = %d keys, want 2", got)
+	}
+	if n := k.deleteExpired(time.Now()); n != 2 {
+		t.Errorf("deleteExpired = %d, want 2", n)
+	}
+	deadlines := 0
+	for _, sh := range k.shards {
+		deadlines += len(sh.expiry)
+	}
+	if k.len() != 2 || deadlines != 1 {
+		t.Errorf("after sweep: %d keys, %d deadlines", k.len(), deadlines)
+	}
+	if used, _ := k.memory(); used != 4 {
+		t.Errorf("used = %d after sweep, want 4", used)
+	}
+}
+
+func TestExpirySaved(t *testing.T) {
+	k := newKV()
+	k.set("a", "1")
+	k.set("b", "2")
+	k.set("gone", "3")
+	k.expire("a", time.Hour)
+	k.expire("gone", time.Hour)
+	backdate(k, "gone")
+	file := filepath.Join(t.TempDir(), "db.bin")
+	if err := saveToFile(k, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newKV()
+	if err := loadFromFile(loaded, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.len() != 2 {
+		t.Errorf("loaded %d keys, want 2", loaded.len())
+	}
+	if left, found, hasTTL := loaded.ttl("a"); !found || !hasTTL || left < 59*time.Minute {
+		t.Errorf("loaded TTL of a = %v, %v, %v", left, found, hasTTL)
+	}
+	if _, _, hasTTL := loaded.ttl("b"); hasTTL {
+		t.Error("b gained a timeout")
+	}
+	if err := newKV().replace(&dump{Data: map[string]string{}, Expiry: map[string]int64{"x": 1}}); err == nil {
+		t.Error("replace accepted an expiry for a missing key")
+	}
+}
+
+func TestExpiring(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for i, key := range []string{"c", "a", "b", "d"} {
+		srv.dispatch(cl, []string{"SET", key, "v"})
+		srv.dispatch(cl, []string{"EXPIRE", key, strconv.Itoa((i + 1) * 100)})
+	}
+	srv.dispatch(cl, []string{"SET", "forever", "v"})
+	srv.dispatch(cl, []string{"SET", "gone", "v"})
+	srv.dispatch(cl, []string{"EXPIRE", "gone", "100"})
+	backdate(srv.dbs[0], "gone")
+
+	if got := strings.Join(lineTexts(srv.dispatch(cl, []string{"EXPIRING", "3"})), ","); got != "c 100,a 200,b 300" {
+		t.Errorf("EXPIRING 3 = %q", got)
+	}
+	if got := lineTexts(srv.dispatch(cl, []string{"EXPIRING", "10"})); len(got) != 4 {
+		t.Errorf("EXPIRING 10 = %q, want the 4 keys with a live timeout", got)
+	}
+	for _, n := range []string{"0", "-1", "x"} {
+		if got := srv.dispatch(cl, []string{"EXPIRING", n}); got.kind != kindErr {
+			t.Errorf("EXPIRING %s = %+v", n, got)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+// features are the optional capabilities FEATURES can report, in output
+// order. A feature backed by commands is only on while those commands are
+// enabled, under whatever name they were renamed to.
+var features = []struct {
+	name    string
+	enabled func(s *server) bool
+}{
+	{"tls", func(s *server) bool { return s.tls != nil }},
+	{"binary-protocol", func(s *server) bool { return s.commandEnabled("HELLO") }},
+	{"multi-db", func(s *server) bool { return len(s.dbs) > 1 && s.commandEnabled("SELECT") }},
+	{"pubsub", func(s *server) bool { return s.commandEnabled("PUBLISH") }},
+	{"streams", func(s *server) bool { return s.commandEnabled("XADD") }},
+	{"stream-groups", func(s *server) bool { return s.commandEnabled("XREADGROUP") }},
+	{"server-files", func(s *server) bool { return s.commandEnabled("SETFROMFILE") || s.commandEnabled("GETTOFILE") }},
+	{"eviction", func(s *server) bool { return s.cfg.maxMemory > 0 }},
+	{"compression", func(s *server) bool { return s.cfg.compressAbove > 0 }},
+	{"debug", func(s *server) bool { return s.cfg.debug && s.commandEnabled("DEBUG") }},
+	{"peer-credentials", func(s *server) bool { return peerCredSupported }},
+}
+
+// commandEnabled reports whether the built-in command name is in the
+// table and not disabled.
+func (s *server) commandEnabled(name string) bool {
+	for _, c := range s.commands {
+		if c.name == name && !c.disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdFeatures lists the enabled features, one name per line.
+func cmdFeatures(s *server, cl *client, args []string) reply {
+	var names []string
+	for _, f := range features {
+		if f.enabled(s) {
+			names = append(names, f.name)
+		}
+	}
+	return arrayReply(names)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	list := func(srv *server) string {
+		return strings.Join(lineTexts(srv.dispatch(&client{}, []string{"FEATURES"})), ",")
+	}
+	srv := newServer(config{})
+	got := list(srv)
+	for _, want := range []string{"binary-protocol", "multi-db", "pubsub", "streams"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("FEATURES = %q, missing %s", got, want)
+		}
+	}
+	if strings.Contains(got, "eviction") || strings.Contains(got, "debug") {
+		t.Errorf("FEATURES = %q, lists features that are off", got)
+	}
+
+	srv = newServer(config{databases: 1, maxMemory: 1 << 20, debug: true})
+	if err := srv.restrictCommands([]string{"PUBLISH"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.renameCommands([]string{"XADD=STREAMADD"}); err != nil {
+		t.Fatal(err)
+	}
+	got = list(srv)
+	for _, want := range []string{"streams", "eviction", "debug"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("FEATURES = %q, missing %s", got, want)
+		}
+	}
+	if strings.Contains(got, "multi-db") || strings.Contains(got, "pubsub") {
+		t.Errorf("FEATURES = %q, lists a single database or disabled PUBLISH", got)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var errValueTooLarge = errors.New("value too large")
+
+// openRoot opens the directory that SETFROMFILE and friends are confined
+// to. Paths are resolved by os.Root, so "..", absolute paths and symlinks
+// leading outside the directory are rejected.
+func (s *server) openRoot() (*os.Root, error) {
+	dir := s.cfg.dir
+	if dir == "" {
+		dir = "."
+	}
+	return os.OpenRoot(dir)
+}
+
+// readSandboxed reads a file below the configured directory, refusing
+// files larger than the value size limit.
+func (s *server) readSandboxed(name string) ([]byte, error) {
+	root, err := s.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	f, err := root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+	limit := int64(s.cfg.maxValueBytes)
+	if limit > 0 && fi.Size() > limit {
+		return nil, errValueTooLarge
+	}
+	r := io.Reader(f)
+	if limit > 0 {
+		r = io.LimitReader(f, limit+1)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		zero(b)
+		return nil, err
+	}
+	if limit > 0 && int64(len(b)) > limit {
+		zero(b)
+		return nil, errValueTooLarge
+	}
+	return b, nil
+}
+
+// writeSandboxed replaces a file below the configured directory with data.
+// It writes a temporary file next to the target and renames it into place,
+// so readers never see a partially written file.
+func (s *server) writeSandboxed(name string, data string) error {
+	root, err := s.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := name + ".tmp-" + hex.EncodeToString(suffix)
+	f, err := root.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = root.Rename(tmp, name)
+	}
+	if err != nil {
+		root.Remove(tmp)
+	}
+	return err
+}
+
+func cmdSetFromFile(s *server, cl *client, args []string) reply {
+	val, err := s.readSandboxed(args[1])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	db := s.db(cl)
+	if err := db.checkSchema(args[0], val); err != nil {
+		zero(val)
+		return errReply(err.Error())
+	}
+	db.setBytes(args[0], val)
+	return intReply(int64(len(val)))
+}
+
+func cmdGetToFile(s *server, cl *client, args []string) reply {
+	v, ok := s.db(cl).get(args[0])
+	if !ok {
+		return nilReply
+	}
+	if err := s.writeSandboxed(args[1], v); err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(int64(len(v)))
+}
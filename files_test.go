@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetFromFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "blob"), []byte("line1\nline2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(config{dir: dir, maxValueBytes: 64})
+	c, r := connect(t, srv)
+	if got := roundTrip(t, c, r, "SETFROMFILE k blob"); got != "11\n" {
+		t.Fatalf("SETFROMFILE reply = %q", got)
+	}
+	if v, _ := srv.dbs[0].get("k"); v != "line1\nline2" {
+		t.Fatalf("stored %q", v)
+	}
+	for _, path := range []string{"../blob", "/etc/passwd", "missing"} {
+		if got := roundTrip(t, c, r, "SETFROMFILE k "+path); got[:3] != "ERR" {
+			t.Fatalf("SETFROMFILE %s = %q, want error", path, got)
+		}
+	}
+	srv.cfg.maxValueBytes = 4
+	if got := roundTrip(t, c, r, "SETFROMFILE k blob"); got != "ERR value too large\n" {
+		t.Fatalf("oversized SETFROMFILE = %q", got)
+	}
+}
+
+func TestGetToFile(t *testing.T) {
+	dir := t.TempDir()
+	srv := newServer(config{dir: dir})
+	srv.dbs[0].set("k", "hello world")
+	c, r := connect(t, srv)
+	if got := roundTrip(t, c, r, "GETTOFILE k out.txt"); got != "11\n" {
+		t.Fatalf("GETTOFILE reply = %q", got)
+	}
+	path := filepath.Join(dir, "out.txt")
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != "hello world" {
+		t.Fatalf("file contents %q, %v", b, err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Fatalf("file mode %v", fi.Mode())
+	}
+	if got := roundTrip(t, c, r, "GETTOFILE missing out.txt"); got != "NIL\n" {
+		t.Fatalf("GETTOFILE of missing key = %q", got)
+	}
+	if got := roundTrip(t, c, r, "GETTOFILE k ../escape.txt"); got[:3] != "ERR" {
+		t.Fatalf("GETTOFILE outside dir = %q", got)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("leftover files in dir: %v", entries)
+	}
+}
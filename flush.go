@@ -0,0 +1,48 @@
+package main
+
+// flush deletes every key with every shard locked. Each value is zeroed as
+// deleteLocked zeroes it before the shard starts again on fresh maps, so
+// neither the values nor the maps' old buckets outlive the flush. A store
+// with hashed key names keeps hashing them.
+func (k *kv) flush() {
+	k.lockAll()
+	defer k.unlockAll()
+	for _, sh := range k.shards {
+		sh.flushLocked()
+	}
+	if k.aof != nil {
+		k.aof.append(fullRecord(k.snapshotLocked(), k.hashedWith()))
+	}
+}
+
+// flushLocked deletes every key of the shard. k.mu must be held.
+func (k *kvShard) flushLocked() {
+	for key := range k.data {
+		k.deleteLocked(key)
+	}
+	for key := range k.streams {
+		k.deleteLocked(key)
+	}
+	for key := range k.counters {
+		k.deleteLocked(key)
+	}
+	for key := range k.geos {
+		k.deleteLocked(key)
+	}
+	fresh := newShard()
+	k.data, k.streams, k.counters, k.geos = fresh.data, fresh.streams, fresh.counters, fresh.geos
+	k.compressed, k.hll, k.expiry = fresh.compressed, fresh.hll, fresh.expiry
+	k.addUsed(-k.used) // already 0 once every key is deleted
+}
+
+// cmdFlushAll handles FLUSHALL, which deletes every key in every database.
+// A connection pinned to one database may not touch the others.
+func cmdFlushAll(s *server, cl *client, args []string) reply {
+	if cl.pinned {
+		return errReply(errPinned.Error())
+	}
+	for _, db := range s.dbs {
+		db.flush()
+	}
+	return okReply
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestFlushAll(t *testing.T) {
+	srv := newServer(config{maxMemory: 1 << 20})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "a", "secret"})
+	srv.dispatch(cl, []string{"EXPIRE", "a", "100"})
+	srv.dispatch(cl, []string{"NEXTID", "n"})
+	srv.dispatch(cl, []string{"XADD", "s", "*", "f", "v"})
+	srv.dispatch(&client{db: 2}, []string{"SET", "b", "2"})
+	sh := srv.dbs[0].shardOf("a")
+	old := sh.data["a"]
+
+	if got := srv.dispatch(&client{pinned: true}, []string{"FLUSHALL"}); got.kind != kindErr {
+		t.Errorf("FLUSHALL from a pinned connection = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"FLUSHALL"}); got.kind != kindOK {
+		t.Fatalf("FLUSHALL = %+v", got)
+	}
+	for i, db := range srv.dbs {
+		if n := db.len(); n != 0 {
+			t.Errorf("database %d has %d keys", i, n)
+		}
+		if used, _ := db.memory(); used != 0 {
+			t.Errorf("database %d uses %d bytes", i, used)
+		}
+	}
+	for _, c := range old {
+		if c != 0 {
+			t.Fatalf("flushed value not zeroed: %q", old)
+		}
+	}
+	if _, ok := sh.lru.oldest(); ok || len(sh.expiry) != 0 {
+		t.Errorf("LRU or expiry entries left: %d expiries", len(sh.expiry))
+	}
+	srv.dispatch(cl, []string{"SET", "a", "1"})
+	if v, _ := srv.dbs[0].get("a"); v != "1" {
+		t.Errorf("a = %q after FLUSHALL and SET", v)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A geo key holds members with a position each, stored as a 52-bit
+// geohash score: 26 bits of longitude and 26 of latitude, interleaved with
+// longitude in the odd bits. Members are kept sorted by score, so the
+// points in one geohash cell are a contiguous run that a radius search can
+// find by binary search. Latitudes are limited to the Web Mercator range,
+// as in Redis, and a position reads back as the center of its cell, within
+// about 0.6 m of where it was added.
+const (
+	geoStep    = 26
+	geoLatMax  = 85.05112878
+	geoLonMax  = 180.0
+	geoMaxHash = 1 << (2 * geoStep)
+
+	// earthRadius is the radius in meters the haversine formula uses.
+	earthRadius = 6372797.560856
+)
+
+var (
+	errGeoCoords = errors.New("invalid longitude,latitude pair")
+	errGeoUnit   = errors.New("unsupported unit provided. please use m, km, ft, mi")
+	errGeoRadius = errors.New("radius must be a non-negative number")
+)
+
+// geoUnits are the meters in each distance unit GEOSEARCH accepts.
+var geoUnits = map[string]float64{"m": 1, "km": 1000, "mi": 1609.34, "ft": 0.3048}
+
+type geoPoint struct {
+	hash   uint64
+	member string
+}
+
+func (p geoPoint) compare(q geoPoint) int {
+	if c := cmp.Compare(p.hash, q.hash); c != 0 {
+		return c
+	}
+	return strings.Compare(p.member, q.member)
+}
+
+// geoSet is the value of a geo key.
+type geoSet struct {
+	hashes map[string]uint64
+	sorted []geoPoint // by hash, then member
+}
+
+func newGeoSet() *geoSet {
+	return &geoSet{hashes: make(map[string]uint64)}
+}
+
+// size is the logical size of a geo key: its key and each member with its
+// 8-byte score.
+func (g *geoSet) size(key string) int64 {
+	n := int64(len(key))
+	for _, p := range g.sorted {
+		n += int64(len(p.member)) + 8
+	}
+	return n
+}
+
+// add sets member's score to hash and reports whether member is new.
+func (g *geoSet) add(member string, hash uint64) bool {
+	old, exists := g.hashes[member]
+	if exists {
+		if old == hash {
+			return false
+		}
+		i, _ := slices.BinarySearchFunc(g.sorted, geoPoint{old, member}, geoPoint.compare)
+		g.sorted = slices.Delete(g.sorted, i, i+1)
+	}
+	p := geoPoint{hash, member}
+	i, _ := slices.BinarySearchFunc(g.sorted, p, geoPoint.compare)
+	g.sorted = slices.Insert(g.sorted, i, p)
+	g.hashes[member] = hash
+	return !exists
+}
+
+// spread moves the low 32 bits of x to the even bits of the result.
+func spread(x uint64) uint64 {
+	x &= 0xffffffff
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// squash is the inverse of spread.
+func squash(x uint64) uint64 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x>>4) & 0x00ff00ff00ff00ff
+	x = (x | x>>8) & 0x0000ffff0000ffff
+	x = (x | x>>16) & 0x00000000ffffffff
+	return x
+}
+
+// geoCell returns the cell indexes of a position at full precision.
+func geoCell(lon, lat float64) (ilon, ilat uint64) {
+	cell := func(v, limit float64) uint64 {
+		i := uint64((v + limit) / (2 * limit) * (1 << geoStep))
+		return min(i, 1<<geoStep-1)
+	}
+	return cell(lon, geoLonMax), cell(lat, geoLatMax)
+}
+
+// geoEncode returns the score of a position, which must be valid.
+func geoEncode(lon, lat float64) uint64 {
+	ilon, ilat := geoCell(lon, lat)
+	return spread(ilon)<<1 | spread(ilat)
+}
+
+// geoDecode returns the center of the cell a score stands for.
+func geoDecode(hash uint64) (lon, lat float64) {
+	center := func(i uint64, limit float64) float64 {
+		return (float64(i)+0.5)/(1<<geoStep)*2*limit - limit
+	}
+	return center(squash(hash>>1), geoLonMax), center(squash(hash), geoLatMax)
+}
+
+// parseGeoCoords parses a longitude and latitude.
+func parseGeoCoords(lonArg, latArg string) (lon, lat float64, err error) {
+	lon, err1 := strconv.ParseFloat(lonArg, 64)
+	lat, err2 := strconv.ParseFloat(latArg, 64)
+	if err1 != nil || err2 != nil || math.Abs(lon) > geoLonMax || math.Abs(lat) > geoLatMax {
+		return 0, 0, errGeoCoords
+	}
+	return lon, lat, nil
+}
+
+// haversine returns the distance in meters between two positions.
+func haversine(lon1, lat1, lon2, lat2 float64) float64 {
+	rad := math.Pi / 180
+	sinLat := math.Sin((lat2 - lat1) * rad / 2)
+	sinLon := math.Sin((lon2 - lon1) * rad / 2)
+	a := sinLat*sinLat + math.Cos(lat1*rad)*math.Cos(lat2*rad)*sinLon*sinLon
+	return 2 * earthRadius * math.Asin(math.Sqrt(min(a, 1)))
+}
+
+// geoSearchStep returns the coarsest precision, in bits per coordinate,
+// whose cells are still at least radius meters high and wide everywhere
+// within radius of lat, so that a circle around a point in one cell lies
+// within that cell and its eight neighbours. It returns 0 when no step
+// does, near a pole or for a radius on the scale of the planet.
+func geoSearchStep(lat, radius float64) int {
+	deg := radius / earthRadius * 180 / math.Pi
+	farLat := math.Abs(lat) + deg
+	if farLat >= 90 {
+		return 0
+	}
+	widthScale := math.Cos(farLat * math.Pi / 180)
+	for step := geoStep; step > 0; step-- {
+		cells := float64(uint64(1) << step)
+		height := 2 * geoLatMax / cells
+		width := 2 * geoLonMax / cells * widthScale
+		if height >= deg && width >= deg {
+			return step
+		}
+	}
+	return 0
+}
+
+// geoRanges returns the score ranges [lo, hi) of the cell holding a
+// position at the given step and of its neighbours, without duplicates.
+// Longitude wraps around; cells past the latitude limits are left out.
+func geoRanges(lon, lat float64, step int) [][2]uint64 {
+	if step == 0 {
+		return [][2]uint64{{0, geoMaxHash}}
+	}
+	shift := uint(geoStep - step)
+	ilon, ilat := geoCell(lon, lat)
+	ilon, ilat = ilon>>shift, ilat>>shift
+	cells := uint64(1) << step
+	var out [][2]uint64
+	for dlat := -1; dlat <= 1; dlat++ {
+		y := int64(ilat) + int64(dlat)
+		if y < 0 || y >= int64(cells) {
+			continue
+		}
+		for dlon := -1; dlon <= 1; dlon++ {
+			x := (ilon + cells + uint64(dlon)) % cells
+			lo := (spread(x)<<1 | spread(uint64(y))) << (2 * shift)
+			r := [2]uint64{lo, lo + 1<<(2*shift)}
+			if !slices.Contains(out, r) {
+				out = append(out, r)
+			}
+		}
+	}
+	return out
+}
+
+// geoLocked returns the geo set at key, or nil if there is none. k.mu
+// must be held.
+func (k *kvShard) geoLocked(key string) (*geoSet, error) {
+	if t := k.typeLocked(key); t != "geo" && t != "none" {
+		return nil, errWrongType
+	}
+	return k.geos[key], nil
+}
+
+// geoAdd adds or moves members of the geo set at key, creating it if
+// needed, and returns how many were new. Each item is a longitude,
+// latitude and member.
+func (k *kvShard) geoAdd(key string, items [][3]string) (int64, error) {
+	hashes := make([]uint64, len(items))
+	for i, it := range items {
+		lon, lat, err := parseGeoCoords(it[0], it[1])
+		if err != nil {
+			return 0, err
+		}
+		hashes[i] = geoEncode(lon, lat)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	g, err := k.geoLocked(key)
+	if err != nil {
+		return 0, err
+	}
+	if g == nil {
+		g = newGeoSet()
+		k.geos[key] = g
+		k.addUsed(int64(len(key)))
+	}
+	var added int64
+	for i, it := range items {
+		if g.add(it[2], hashes[i]) {
+			added++
+			k.addUsed(int64(len(it[2])) + 8)
+		}
+	}
+	if k.lru != nil {
+		k.lru.touch(key)
+		k.evictLocked(key)
+	}
+	k.notePeakLocked()
+	return added, nil
+}
+
+// geoMatch is a member found by geoSearch, with its distance in meters.
+type geoMatch struct {
+	member string
+	dist   float64
+}
+
+// geoSearch returns the members of the geo set at key within radius
+// meters of a position, nearest first.
+func (k *kvShard) geoSearch(key string, lon, lat, radius float64) ([]geoMatch, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	g, err := k.geoLocked(key)
+	if err != nil || g == nil || k.expiredLocked(key, time.Now()) {
+		return nil, err
+	}
+	var out []geoMatch
+	for _, r := range geoRanges(lon, lat, geoSearchStep(lat, radius)) {
+		i, _ := slices.BinarySearchFunc(g.sorted, r[0], func(p geoPoint, h uint64) int {
+			return cmp.Compare(p.hash, h)
+		})
+		for ; i < len(g.sorted) && g.sorted[i].hash < r[1]; i++ {
+			plon, plat := geoDecode(g.sorted[i].hash)
+			if d := haversine(lon, lat, plon, plat); d <= radius {
+				out = append(out, geoMatch{g.sorted[i].member, d})
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b geoMatch) int {
+		if c := cmp.Compare(a.dist, b.dist); c != 0 {
+			return c
+		}
+		return strings.Compare(a.member, b.member)
+	})
+	if k.lru != nil {
+		k.lru.touch(key)
+	}
+	return out, nil
+}
+
+// cmdGeoAdd handles GEOADD key lon lat member [lon lat member ...]. It
+// replies with the number of members added; members already in the set
+// are moved.
+func cmdGeoAdd(s *server, cl *client, args []string) reply {
+	if (len(args)-1)%3 != 0 {
+		return wrongArgs("geoadd")
+	}
+	items := make([][3]string, 0, (len(args)-1)/3)
+	for i := 1; i < len(args); i += 3 {
+		items = append(items, [3]string{args[i], args[i+1], args[i+2]})
+	}
+	n, err := s.db(cl).geoAdd(args[0], items)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(n)
+}
+
+// cmdGeoSearch handles GEOSEARCH key FROMLONLAT lon lat BYRADIUS radius
+// unit [ASC|DESC] [COUNT n] [WITHDIST]. It replies with the members within
+// the radius, nearest first unless DESC is given; with WITHDIST each line
+// is the member and its distance in the given unit.
+func cmdGeoSearch(s *server, cl *client, args []string) reply {
+	if !strings.EqualFold(args[1], "FROMLONLAT") || !strings.EqualFold(args[4], "BYRADIUS") {
+		return errReply("syntax error")
+	}
+	lon, lat, err := parseGeoCoords(args[2], args[3])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	radius, err := strconv.ParseFloat(args[5], 64)
+	if err != nil || radius < 0 || math.IsInf(radius, 0) {
+		return errReply(errGeoRadius.Error())
+	}
+	unit, ok := geoUnits[strings.ToLower(args[6])]
+	if !ok {
+		return errReply(errGeoUnit.Error())
+	}
+	desc, withDist, count := false, false, 0
+	for opts := args[7:]; len(opts) > 0; opts = opts[1:] {
+		switch strings.ToUpper(opts[0]) {
+		case "ASC":
+			desc = false
+		case "DESC":
+			desc = true
+		case "WITHDIST":
+			withDist = true
+		case "COUNT":
+			if len(opts) < 2 {
+				return errReply("syntax error")
+			}
+			if count, err = parseCount(opts[:2]); err != nil {
+				return errReply(err.Error())
+			}
+			opts = opts[1:]
+		default:
+			return errReply("syntax error")
+		}
+	}
+	matches, err := s.db(cl).geoSearch(args[0], lon, lat, radius*unit)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	if desc {
+		slices.Reverse(matches)
+	}
+	if count > 0 && len(matches) > count {
+		matches = matches[:count]
+	}
+	lines := make([]string, len(matches))
+	for i, m := range matches {
+		lines[i] = m.member
+		if withDist {
+			lines[i] = fmt.Sprintf("%s %.4f", m.member, m.dist/unit)
+		}
+	}
+	return arrayReply(lines)
+}
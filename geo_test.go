@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGeo(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	add := []string{"GEOADD", "sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}
+	if got := srv.dispatch(cl, add); got.text != "2" {
+		t.Fatalf("GEOADD = %+v", got)
+	}
+	if got := srv.dispatch(cl, add); got.text != "0" {
+		t.Errorf("GEOADD of existing members = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"OBJECT", "ENCODING", "sicily"}); got.text != "geo" {
+		t.Errorf("OBJECT ENCODING = %+v", got)
+	}
+
+	// Redis replies Catania 56.4413 and Palermo 190.4424.
+	got := srv.dispatch(cl, []string{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "WITHDIST"})
+	want := []struct {
+		member string
+		dist   float64
+	}{{"Catania", 56.4413}, {"Palermo", 190.4424}}
+	if len(got.items) != len(want) {
+		t.Fatalf("GEOSEARCH WITHDIST = %+v", got)
+	}
+	for i, w := range want {
+		member, dist, _ := strings.Cut(got.items[i].text, " ")
+		d, err := strconv.ParseFloat(dist, 64)
+		if member != w.member || err != nil || math.Abs(d-w.dist) > 0.01 {
+			t.Errorf("GEOSEARCH item %d = %q, want %s %.4f", i, got.items[i].text, w.member, w.dist)
+		}
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"100", "km"}, "Catania"},
+		{[]string{"200", "km", "DESC"}, "Palermo Catania"},
+		{[]string{"200", "km", "DESC", "COUNT", "1"}, "Palermo"},
+		{[]string{"124274", "mi"}, "Catania Palermo"},
+		{[]string{"10", "m"}, ""},
+	} {
+		got := srv.dispatch(cl, append([]string{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS"}, tc.args...))
+		if s := strings.Join(lineTexts(got), " "); s != tc.want {
+			t.Errorf("GEOSEARCH BYRADIUS %v = %q, want %q", tc.args, s, tc.want)
+		}
+	}
+	if got := srv.dispatch(cl, []string{"GEOSEARCH", "missing", "FROMLONLAT", "15", "37", "BYRADIUS", "1", "km"}); got.kind != kindArray || len(got.items) != 0 {
+		t.Errorf("GEOSEARCH of a missing key = %+v", got)
+	}
+
+	for _, args := range [][]string{
+		{"GEOADD", "sicily", "181", "0", "x"},
+		{"GEOADD", "sicily", "0", "86", "x"},
+		{"GEOADD", "sicily", "0", "0"},
+		{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "1", "yd"},
+		{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "-1", "km"},
+		{"GEOSEARCH", "sicily", "FROMMEMBER", "15", "37", "BYRADIUS", "1", "km"},
+		{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "1", "km", "COUNT"},
+	} {
+		if got := srv.dispatch(cl, args); got.kind != kindErr {
+			t.Errorf("%v = %+v", args, got)
+		}
+	}
+
+	srv.dispatch(cl, []string{"SET", "s", "v"})
+	for _, args := range [][]string{{"GEOADD", "s", "0", "0", "x"}, {"GEOSEARCH", "s", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "m"}, {"GET", "sicily"}} {
+		if got := srv.dispatch(cl, args); got.text != errWrongType.Error() {
+			t.Errorf("%v = %+v", args, got)
+		}
+	}
+}
+
+// TestGeoSearchCoverage checks that searching the neighbouring cells finds
+// everything a full scan does, including near the poles and across the
+// antimeridian.
+func TestGeoSearchCoverage(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	k := newKV()
+	var items [][3]string
+	for i := 0; i < 5000; i++ {
+		lon := rng.Float64()*360 - 180
+		lat := rng.Float64()*2*geoLatMax - geoLatMax
+		f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+		items = append(items, [3]string{f(lon), f(lat), strconv.Itoa(i)})
+	}
+	if _, err := k.geoAdd("g", items); err != nil {
+		t.Fatal(err)
+	}
+	g := k.shardOf("g").geos["g"]
+	for i := 0; i < 300; i++ {
+		lon := rng.Float64()*360 - 180
+		lat := rng.Float64()*2*geoLatMax - geoLatMax
+		if i%3 == 0 {
+			lon = 179.9 * float64(1-2*(i/3%2))
+		}
+		radius := math.Pow(10, 3+rng.Float64()*4)
+		got, err := k.geoSearch("g", lon, lat, radius)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		for _, p := range g.sorted {
+			plon, plat := geoDecode(p.hash)
+			if haversine(lon, lat, plon, plat) <= radius {
+				want++
+			}
+		}
+		if len(got) != want {
+			t.Errorf("search of %.0f m around %f,%f found %d members, want %d", radius, lon, lat, len(got), want)
+		}
+	}
+}
+
+func TestGeoCodec(t *testing.T) {
+	for _, p := range [][2]float64{{0, 0}, {-180, -geoLatMax}, {180, geoLatMax}, {13.361389, 38.115556}} {
+		lon, lat := geoDecode(geoEncode(p[0], p[1]))
+		if d := haversine(p[0], p[1], lon, lat); d > 1 {
+			t.Errorf("%v decodes %.2f m away", p, d)
+		}
+	}
+}
+
+func TestGeoSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+	src := newKV()
+	src.geoAdd("g", [][3]string{{"13.361389", "38.115556", "Palermo"}})
+	if err := saveToFile(src, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	dst := newKV()
+	if err := loadFromFile(dst, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if typ := dst.typeOf("g"); typ != "geo" {
+		t.Errorf("type after LOAD = %s", typ)
+	}
+	if m, _ := dst.geoSearch("g", 13.361389, 38.115556, 1); len(m) != 1 || m[0].member != "Palermo" {
+		t.Errorf("GEOSEARCH after LOAD = %v", m)
+	}
+	if used, _ := dst.memory(); used != src.shardOf("g").geos["g"].size("g") {
+		t.Errorf("used after LOAD = %d", used)
+	}
+	bad := []*dump{
+		{Data: map[string]string{"g": "v"}, Geo: map[string]map[string]uint64{"g": {"m": 1}}},
+		{Geo: map[string]map[string]uint64{"g": {"m": geoMaxHash}}},
+	}
+	for _, d := range bad {
+		if err := newKV().replace(d); err == nil {
+			t.Errorf("replace accepted %+v", d.Geo)
+		}
+	}
+}
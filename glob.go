@@ -0,0 +1,76 @@
+package main
+
+// globMatch reports whether s matches pattern. Besides literal bytes the
+// pattern supports '*' (any run), '?' (any byte), '[abc]', '[a-z]' and
+// '[^abc]' classes, and '\' to escape the next byte.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if s == "" {
+				return false
+			}
+			rest, ok := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			pattern, s = rest, s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
+
+// matchClass matches c against the class body that follows '[' and returns
+// the pattern after the closing ']'. An unterminated class matches nothing.
+func matchClass(p string, c byte) (string, bool) {
+	negate := false
+	if p != "" && p[0] == '^' {
+		negate, p = true, p[1:]
+	}
+	matched := false
+	for i := 0; i < len(p); i++ {
+		switch {
+		case p[i] == ']' && i > 0:
+			return p[i+1:], matched != negate
+		case p[i] == '\\' && i+1 < len(p):
+			i++
+			matched = matched || p[i] == c
+		case i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']':
+			lo, hi := p[i], p[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			i += 2
+		default:
+			matched = matched || p[i] == c
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errBusyGroup = errors.New("BUSYGROUP Consumer Group name already exists")
+
+func errNoGroup(key, group string) error {
+	return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+}
+
+// group is a consumer group on a stream. Entries handed to a consumer stay
+// pending until acknowledged, so a crashed worker's entries can be read
+// again from its history.
+type group struct {
+	lastDelivered streamID
+	pending       map[streamID]*pendingEntry
+}
+
+type pendingEntry struct {
+	consumer   string
+	deliveries int64
+}
+
+// pendingIDs returns the pending IDs above after, in order, limited to
+// consumer unless it is empty.
+func (g *group) pendingIDs(consumer string, after streamID) []streamID {
+	var ids []streamID
+	for id, p := range g.pending {
+		if after.less(id) && (consumer == "" || p.consumer == consumer) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+	return ids
+}
+
+// groupLocked returns the named group of the stream at key. k.mu must be
+// held.
+func (k *kvShard) groupLocked(key, name string) (*stream, *group, error) {
+	st, err := k.streamLocked(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if st == nil || st.groups[name] == nil {
+		return nil, nil, errNoGroup(key, name)
+	}
+	return st, st.groups[name], nil
+}
+
+// xgroupCreate adds a group that delivers entries after id, where "$"
+// means only entries added from now on. mkstream creates a missing stream.
+func (k *kvShard) xgroupCreate(key, name, id string, mkstream bool) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, err := k.streamLocked(key)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		if !mkstream {
+			return errors.New("the key does not exist; use MKSTREAM to create it")
+		}
+		st = &stream{}
+		k.streams[key] = st
+		k.addUsed(int64(len(key)))
+		k.notePeakLocked()
+		if k.lru != nil {
+			k.lru.touch(key)
+			k.evictLocked(key)
+		}
+	}
+	if st.groups[name] != nil {
+		return errBusyGroup
+	}
+	start := st.last
+	if id != "$" {
+		if start, err = parseStreamID(id, 0); err != nil {
+			return err
+		}
+	}
+	if st.groups == nil {
+		st.groups = make(map[string]*group)
+	}
+	st.groups[name] = &group{lastDelivered: start, pending: make(map[streamID]*pendingEntry)}
+	return nil
+}
+
+func (k *kvShard) xgroupDestroy(key, name string) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, err := k.streamLocked(key)
+	if err != nil || st == nil || st.groups[name] == nil {
+		return false, err
+	}
+	delete(st.groups, name)
+	return true, nil
+}
+
+// xreadGroup reads for consumer. With id ">" it delivers entries no
+// consumer in the group has seen yet and marks them pending; otherwise it
+// replays the consumer's own pending entries after id. A pending entry that
+// has since been removed from the stream is replayed as a bare ID.
+func (k *kvShard) xreadGroup(key, name, consumer, id string, count int) ([]string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, g, err := k.groupLocked(key, name)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	if id == ">" {
+		for _, e := range st.entries[st.after(g.lastDelivered):] {
+			if count > 0 && len(out) == count {
+				break
+			}
+			g.lastDelivered = e.id
+			g.pending[e.id] = &pendingEntry{consumer: consumer, deliveries: 1}
+			out = append(out, e.line())
+		}
+		return out, nil
+	}
+	after, err := parseStreamID(id, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, pid := range g.pendingIDs(consumer, after) {
+		if count > 0 && len(out) == count {
+			break
+		}
+		if i := st.from(pid); i < len(st.entries) && st.entries[i].id == pid {
+			out = append(out, st.entries[i].line())
+		} else {
+			out = append(out, pid.String())
+		}
+	}
+	return out, nil
+}
+
+// xack clears pending IDs and reports how many were pending.
+func (k *kvShard) xack(key, name string, ids []streamID) (int64, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, err := k.streamLocked(key)
+	if err != nil || st == nil || st.groups[name] == nil {
+		return 0, err
+	}
+	g := st.groups[name]
+	var n int64
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// xpending lists a group's pending entries as "id consumer deliveries"
+// lines, in ID order.
+func (k *kvShard) xpending(key, name, consumer string) ([]string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, g, err := k.groupLocked(key, name)
+	if err != nil {
+		return nil, err
+	}
+	ids := g.pendingIDs(consumer, streamID{})
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		p := g.pending[id]
+		out[i] = id.String() + " " + p.consumer + " " + strconv.FormatInt(p.deliveries, 10)
+	}
+	return out, nil
+}
+
+// cmdXGroup handles XGROUP CREATE key group id|$ [MKSTREAM] and
+// XGROUP DESTROY key group.
+func cmdXGroup(s *server, cl *client, args []string) reply {
+	db := s.db(cl)
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "CREATE":
+		if len(args) < 4 || len(args) > 5 {
+			return wrongArgs("xgroup create")
+		}
+		mkstream := false
+		if len(args) == 5 {
+			if !strings.EqualFold(args[4], "MKSTREAM") {
+				return errReply("syntax error")
+			}
+			mkstream = true
+		}
+		if err := db.xgroupCreate(args[1], args[2], args[3], mkstream); err != nil {
+			return errReply(err.Error())
+		}
+		return okReply
+	case "DESTROY":
+		if len(args) != 3 {
+			return wrongArgs("xgroup destroy")
+		}
+		ok, err := db.xgroupDestroy(args[1], args[2])
+		if err != nil {
+			return errReply(err.Error())
+		}
+		if !ok {
+			return intReply(0)
+		}
+		return intReply(1)
+	default:
+		return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+	}
+}
+
+// cmdXReadGroup handles XREADGROUP GROUP group consumer [COUNT n]
+// [BLOCK ms] STREAMS key [key ...] id [id ...], replying and blocking like
+// XREAD.
+func cmdXReadGroup(s *server, cl *client, args []string) reply {
+	if !strings.EqualFold(args[0], "GROUP") {
+		return errReply("syntax error")
+	}
+	name, consumer := args[1], args[2]
+	sa, err := parseStreamsArgs(args[3:])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	db := s.db(cl)
+	return linesOrBlock(cl, db, "XREADGROUP", sa, func() ([]string, error) {
+		var out []string
+		for i, key := range sa.keys {
+			lines, err := db.xreadGroup(key, name, consumer, sa.ids[i], sa.count)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range lines {
+				out = append(out, key+" "+l)
+			}
+		}
+		return out, nil
+	})
+}
+
+// cmdXAck handles XACK key group id [id ...], replying with the number of
+// entries that were pending.
+func cmdXAck(s *server, cl *client, args []string) reply {
+	ids := make([]streamID, len(args)-2)
+	for i, raw := range args[2:] {
+		id, err := parseStreamID(raw, 0)
+		if err != nil {
+			return errReply(err.Error())
+		}
+		ids[i] = id
+	}
+	n, err := s.db(cl).xack(args[0], args[1], ids)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(n)
+}
+
+// cmdXPending handles XPENDING key group [consumer].
+func cmdXPending(s *server, cl *client, args []string) reply {
+	consumer := ""
+	if len(args) == 3 {
+		consumer = args[2]
+	}
+	lines, err := s.db(cl).xpending(args[0], args[1], consumer)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return arrayReply(lines)
+}
+
+// groupDump and pendingDump are the snapshot form of a consumer group.
+type pendingDump struct {
+	ID         [2]uint64 `json:"id"`
+	Consumer   string    `json:"consumer"`
+	Deliveries int64     `json:"deliveries"`
+}
+
+type groupDump struct {
+	LastDelivered [2]uint64     `json:"last_delivered"`
+	Pending       []pendingDump `json:"pending,omitempty"`
+}
+
+func (g *group) dump() *groupDump {
+	d := &groupDump{LastDelivered: [2]uint64{g.lastDelivered.ms, g.lastDelivered.seq}}
+	for _, id := range g.pendingIDs("", streamID{}) {
+		p := g.pending[id]
+		d.Pending = append(d.Pending, pendingDump{ID: [2]uint64{id.ms, id.seq}, Consumer: p.consumer, Deliveries: p.deliveries})
+	}
+	return d
+}
+
+func (d *groupDump) restore() *group {
+	g := &group{
+		lastDelivered: streamID{d.LastDelivered[0], d.LastDelivered[1]},
+		pending:       make(map[streamID]*pendingEntry, len(d.Pending)),
+	}
+	for _, p := range d.Pending {
+		g.pending[streamID{p.ID[0], p.ID[1]}] = &pendingEntry{consumer: p.Consumer, deliveries: p.Deliveries}
+	}
+	return g
+}
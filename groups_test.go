@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lineTexts(r reply) []string {
+	var out []string
+	for _, it := range r.items {
+		out = append(out, it.text)
+	}
+	return out
+}
+
+func TestConsumerGroups(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for i, id := range []string{"1-0", "2-0", "3-0"} {
+		srv.dispatch(cl, []string{"XADD", "q", id, "job", string(rune('a' + i))})
+	}
+	if got := srv.dispatch(cl, []string{"XGROUP", "CREATE", "q", "workers", "0"}); got.kind != kindOK {
+		t.Fatalf("XGROUP CREATE = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"XGROUP", "CREATE", "q", "workers", "0"}); got.text != errBusyGroup.Error() {
+		t.Errorf("second XGROUP CREATE = %+v", got)
+	}
+
+	// Two workers share the stream: each entry goes to exactly one.
+	a := srv.dispatch(cl, []string{"XREADGROUP", "GROUP", "workers", "w1", "COUNT", "2", "STREAMS", "q", ">"})
+	b := srv.dispatch(cl, []string{"XREADGROUP", "GROUP", "workers", "w2", "STREAMS", "q", ">"})
+	if got := strings.Join(lineTexts(a), "|"); got != "q 1-0 job a|q 2-0 job b" {
+		t.Errorf("w1 read %q", got)
+	}
+	if got := strings.Join(lineTexts(b), "|"); got != "q 3-0 job c" {
+		t.Errorf("w2 read %q", got)
+	}
+	if got := srv.dispatch(cl, []string{"XREADGROUP", "GROUP", "workers", "w2", "STREAMS", "q", ">"}); got.kind != kindNil {
+		t.Errorf("read with nothing new = %+v", got)
+	}
+
+	if got := srv.dispatch(cl, []string{"XACK", "q", "workers", "1-0", "1-0", "9-0"}); got.text != "1" {
+		t.Errorf("XACK = %+v, want 1", got)
+	}
+	pending := srv.dispatch(cl, []string{"XPENDING", "q", "workers"})
+	if got := strings.Join(lineTexts(pending), "|"); got != "2-0 w1 1|3-0 w2 1" {
+		t.Errorf("XPENDING = %q", got)
+	}
+
+	// w1 restarts and replays its unacknowledged history.
+	hist := srv.dispatch(cl, []string{"XREADGROUP", "GROUP", "workers", "w1", "STREAMS", "q", "0"})
+	if got := strings.Join(lineTexts(hist), "|"); got != "q 2-0 job b" {
+		t.Errorf("w1 history = %q", got)
+	}
+
+	if got := srv.dispatch(cl, []string{"XREADGROUP", "GROUP", "nope", "w1", "STREAMS", "q", ">"}); !strings.HasPrefix(got.text, "NOGROUP") {
+		t.Errorf("unknown group = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"XGROUP", "CREATE", "missing", "g", "$"}); got.kind != kindErr {
+		t.Errorf("XGROUP CREATE on a missing key = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"XGROUP", "CREATE", "missing", "g", "$", "MKSTREAM"}); got.kind != kindOK {
+		t.Errorf("XGROUP CREATE MKSTREAM = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"XGROUP", "DESTROY", "missing", "g"}); got.text != "1" {
+		t.Errorf("XGROUP DESTROY = %+v", got)
+	}
+}
+
+func TestConsumerGroupSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+	src := newServer(config{})
+	cl := &client{}
+	src.dispatch(cl, []string{"XADD", "q", "1-0", "job", "a"})
+	src.dispatch(cl, []string{"XADD", "q", "2-0", "job", "b"})
+	src.dispatch(cl, []string{"XGROUP", "CREATE", "q", "g", "0"})
+	src.dispatch(cl, []string{"XREADGROUP", "GROUP", "g", "w", "COUNT", "1", "STREAMS", "q", ">"})
+	if got := src.dispatch(cl, []string{"SAVE", file, "pw"}); got.kind != kindOK {
+		t.Fatalf("SAVE = %+v", got)
+	}
+
+	dst := newServer(config{})
+	if got := dst.dispatch(cl, []string{"LOAD", file, "pw"}); got.kind != kindOK {
+		t.Fatalf("LOAD = %+v", got)
+	}
+	if got := strings.Join(lineTexts(dst.dispatch(cl, []string{"XPENDING", "q", "g"})), "|"); got != "1-0 w 1" {
+		t.Errorf("XPENDING after LOAD = %q", got)
+	}
+	next := dst.dispatch(cl, []string{"XREADGROUP", "GROUP", "g", "w", "STREAMS", "q", ">"})
+	if got := strings.Join(lineTexts(next), "|"); got != "q 2-0 job b" {
+		t.Errorf("read after LOAD = %q, want only the undelivered entry", got)
+	}
+}
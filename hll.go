@@ -0,0 +1,212 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// A HyperLogLog is kept in data as its registers, one byte each, and
+// marked in k.hll so it reports type "hll". Any other write to the key
+// goes through storeLocked, which drops the mark. hllPrecision = 14 gives
+// 16384 registers, a 16 KiB value and a standard error of about 0.81%.
+const (
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+// hllHash hashes an element for a HyperLogLog. It must not change between
+// releases, as saved registers depend on it, so it is FNV-1a with
+// MurmurHash3's finalizer to spread FNV's weak high bits.
+func hllHash(elem string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(elem))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hllAdd records elem in regs and reports whether a register changed.
+func hllAdd(regs []byte, elem string) bool {
+	x := hllHash(elem)
+	i := x >> (64 - hllPrecision)
+	// The rank is the position of the first 1 bit after the index bits;
+	// the guard bit caps it when they are all 0.
+	rank := byte(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > regs[i] {
+		regs[i] = rank
+		return true
+	}
+	return false
+}
+
+// hllEstimate returns the estimated number of distinct elements recorded
+// in regs, using linear counting while many registers are still empty.
+func hllEstimate(regs []byte) int64 {
+	m := float64(hllRegisters)
+	var sum float64
+	empty := 0
+	for _, r := range regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			empty++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && empty > 0 {
+		e = m * math.Log(m/float64(empty))
+	}
+	return int64(e + 0.5)
+}
+
+// hllLocked returns a copy of the registers of the HyperLogLog at key, or
+// nil if key does not exist. k.mu must be held.
+func (k *kvShard) hllLocked(key string) ([]byte, error) {
+	switch k.typeLocked(key) {
+	case "none":
+		return nil, nil
+	case "hll":
+	default:
+		return nil, errWrongType
+	}
+	v, _, fresh := k.valueLocked(key)
+	if fresh {
+		return v, nil
+	}
+	return append([]byte(nil), v...), nil
+}
+
+// storeHLLLocked stores regs as the HyperLogLog at key, keeping its TTL.
+// k.mu must be held for writing.
+func (k *kvShard) storeHLLLocked(key string, regs []byte) {
+	k.storeLocked(key, regs)
+	k.hll[key] = true
+}
+
+// pfAdd adds elems to the HyperLogLog at key, creating it if needed, and
+// reports whether its estimate may have changed. check, when not nil, may
+// refuse the new registers.
+func (k *kvShard) pfAdd(key string, elems []string, check func([]byte) error) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	regs, err := k.hllLocked(key)
+	if err != nil {
+		return false, err
+	}
+	changed := regs == nil
+	if regs == nil {
+		regs = make([]byte, hllRegisters)
+	}
+	for _, e := range elems {
+		if hllAdd(regs, e) {
+			changed = true
+		}
+	}
+	if !changed {
+		zero(regs)
+		return false, nil
+	}
+	if check != nil {
+		if err := check(regs); err != nil {
+			zero(regs)
+			return false, err
+		}
+	}
+	k.storeHLLLocked(key, regs)
+	return true, nil
+}
+
+// unionLocked returns the register-wise maximum of the HyperLogLogs at
+// names, which are stored names. Missing keys count as empty. The shards
+// holding names must be locked.
+func (k *kv) unionLocked(names []string) ([]byte, error) {
+	out := make([]byte, hllRegisters)
+	now := time.Now()
+	for _, name := range names {
+		sh := k.shardOf(name)
+		if sh.expiredLocked(name, now) {
+			continue
+		}
+		regs, err := sh.hllLocked(name)
+		if err != nil {
+			return nil, err
+		}
+		for i, r := range regs {
+			out[i] = max(out[i], r)
+		}
+		zero(regs)
+	}
+	return out, nil
+}
+
+// pfCount estimates the number of distinct elements in the union of the
+// HyperLogLogs at keys.
+func (k *kv) pfCount(keys []string) (int64, error) {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = k.name(key)
+	}
+	defer k.lockNames(names, false)()
+	regs, err := k.unionLocked(names)
+	if err != nil {
+		return 0, err
+	}
+	return hllEstimate(regs), nil
+}
+
+// pfMerge stores the union of dst and srcs at dst.
+func (k *kv) pfMerge(dst string, srcs []string) error {
+	names := []string{k.name(dst)}
+	for _, key := range srcs {
+		names = append(names, k.name(key))
+	}
+	defer k.lockNames(names, true)()
+	sh := k.shardOf(names[0])
+	sh.reapLocked(names[0])
+	regs, err := k.unionLocked(names)
+	if err != nil {
+		return err
+	}
+	if err := k.checkSchema(dst, regs); err != nil {
+		zero(regs)
+		return err
+	}
+	sh.storeHLLLocked(names[0], regs)
+	return nil
+}
+
+// cmdPFAdd handles PFADD key element [element ...]. It replies 1 if the
+// HyperLogLog was created or changed and 0 otherwise.
+func cmdPFAdd(s *server, cl *client, args []string) reply {
+	changed, err := s.db(cl).pfAdd(args[0], args[1:])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	if changed {
+		return intReply(1)
+	}
+	return intReply(0)
+}
+
+// cmdPFCount handles PFCOUNT key [key ...].
+func cmdPFCount(s *server, cl *client, args []string) reply {
+	n, err := s.db(cl).pfCount(args)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(n)
+}
+
+// cmdPFMerge handles PFMERGE dst src [src ...].
+func cmdPFMerge(s *server, cl *client, args []string) reply {
+	if err := s.db(cl).pfMerge(args[0], args[1:]); err != nil {
+		return errReply(err.Error())
+	}
+	return okReply
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	if got := srv.dispatch(cl, []string{"PFADD", "h", "a", "b", "c"}); got.text != "1" {
+		t.Fatalf("PFADD = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"PFADD", "h", "b"}); got.text != "0" {
+		t.Errorf("PFADD of a seen element = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"PFCOUNT", "h"}); got.text != "3" {
+		t.Errorf("PFCOUNT = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"OBJECT", "ENCODING", "h"}); got.text != "hll" {
+		t.Errorf("OBJECT ENCODING = %+v", got)
+	}
+	srv.dispatch(cl, []string{"PFADD", "g", "c", "d"})
+	if got := srv.dispatch(cl, []string{"PFCOUNT", "h", "g", "missing"}); got.text != "4" {
+		t.Errorf("PFCOUNT of a union = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"PFMERGE", "u", "h", "g"}); got.kind != kindOK {
+		t.Fatalf("PFMERGE = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"PFCOUNT", "u"}); got.text != "4" {
+		t.Errorf("PFCOUNT after PFMERGE = %+v", got)
+	}
+
+	srv.dispatch(cl, []string{"SET", "s", "v"})
+	for _, args := range [][]string{{"PFADD", "s", "x"}, {"PFCOUNT", "h", "s"}, {"PFMERGE", "s", "h"}, {"PFMERGE", "h", "s"}} {
+		if got := srv.dispatch(cl, args); got.text != errWrongType.Error() {
+			t.Errorf("%v = %+v", args, got)
+		}
+	}
+	srv.dispatch(cl, []string{"SET", "h", "v"})
+	if got := srv.dispatch(cl, []string{"OBJECT", "ENCODING", "h"}); got.text != "raw" {
+		t.Errorf("OBJECT ENCODING after SET over a HyperLogLog = %+v", got)
+	}
+}
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	k := newKV()
+	const n = 100000
+	elems := make([]string, 0, 1000)
+	for i := 0; i < n; i++ {
+		elems = append(elems, "user:"+strconv.Itoa(i))
+		if len(elems) == cap(elems) {
+			k.pfAdd("h", elems)
+			elems = elems[:0]
+		}
+	}
+	got, err := k.pfCount([]string{"h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Five standard errors of 0.81%.
+	if d := float64(got-n) / n; d < -0.04 || d > 0.04 {
+		t.Errorf("PFCOUNT = %d for %d elements", got, n)
+	}
+	// Linear counting is close to exact while most registers are empty.
+	for _, small := range []int{1, 10, 100} {
+		h := "small" + strconv.Itoa(small)
+		for i := 0; i < small; i++ {
+			k.pfAdd(h, []string{strconv.Itoa(i)})
+		}
+		if got, _ := k.pfCount([]string{h}); got < int64(small)*97/100 || got > int64(small)*103/100 {
+			t.Errorf("PFCOUNT = %d for %d elements", got, small)
+		}
+	}
+}
+
+func TestHyperLogLogSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+	src := newKV()
+	src.pfAdd("h", []string{"a", "b"})
+	if err := saveToFile(src, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	dst := newKV()
+	if err := loadFromFile(dst, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if typ := dst.typeOf("h"); typ != "hll" {
+		t.Errorf("type after LOAD = %s", typ)
+	}
+	if n, _ := dst.pfCount([]string{"h"}); n != 2 {
+		t.Errorf("PFCOUNT after LOAD = %d", n)
+	}
+	if err := newKV().replace(&dump{Data: map[string]string{"h": "short"}, HLL: map[string]bool{"h": true}}); err == nil {
+		t.Error("replace accepted a HyperLogLog of the wrong size")
+	}
+}
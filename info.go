@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// infoSections are the INFO sections in output order. Each one renders
+// "field:value" lines computed when INFO runs.
+var infoSections = []struct {
+	name   string
+	render func(s *server) []string
+}{
+	{"server", infoServer},
+	{"memory", infoMemory},
+}
+
+// cmdInfo handles INFO [section]. Without a section every section is
+// returned, each introduced by a "# name" line.
+func cmdInfo(s *server, cl *client, args []string) reply {
+	var lines []string
+	found := false
+	for _, sec := range infoSections {
+		if len(args) == 1 && !strings.EqualFold(args[0], sec.name) {
+			continue
+		}
+		found = true
+		lines = append(lines, "# "+sec.name)
+		lines = append(lines, sec.render(s)...)
+	}
+	if !found {
+		return errReply(fmt.Sprintf("unknown section '%s'", args[0]))
+	}
+	return arrayReply(lines)
+}
+
+func infoServer(s *server) []string {
+	return []string{"run_id:" + s.runID}
+}
+
+// newRunID returns 20 random bytes in hex.
+func newRunID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func infoMemory(s *server) []string {
+	var used, evicted int64
+	for _, db := range s.dbs {
+		u, e := db.memory()
+		used += u
+		evicted += e
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return []string{
+		fmt.Sprintf("used_logical:%d", used),
+		fmt.Sprintf("peak_logical:%d", s.peakBytes()),
+		fmt.Sprintf("heap_alloc:%d", ms.HeapAlloc),
+		fmt.Sprintf("heap_sys:%d", ms.HeapSys),
+		fmt.Sprintf("num_gc:%d", ms.NumGC),
+		fmt.Sprintf("evicted_keys:%d", evicted),
+	}
+}
+
+// cmdStats handles STATS and STATS RESET. STATS replies with one
+// "name: value" line per counter: the uptime in seconds, the open
+// connections, the keys in every database, the commands processed and the
+// calls of each command that has run, all counted since startup or the
+// last STATS RESET. STATS RESET zeroes the cumulative counters: every
+// command's latency histogram and call count, each database's eviction
+// count and each connection's command count and time.
+func cmdStats(s *server, cl *client, args []string) reply {
+	if len(args) == 0 {
+		return arrayReply(s.statsLines())
+	}
+	if !strings.EqualFold(args[0], "RESET") {
+		return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+	}
+	s.resetStats()
+	return okReply
+}
+
+func (s *server) statsLines() []string {
+	keys := 0
+	for _, db := range s.dbs {
+		keys += db.len()
+	}
+	s.mu.Lock()
+	conns := len(s.clients)
+	s.mu.Unlock()
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var total uint64
+	var perCommand []string
+	for _, name := range names {
+		if n := s.commands[name].latency.count(); n > 0 {
+			total += n
+			perCommand = append(perCommand, fmt.Sprintf("cmd_%s: %d", strings.ToLower(name), n))
+		}
+	}
+	return append([]string{
+		fmt.Sprintf("uptime_seconds: %d", int64(time.Since(s.started).Seconds())),
+		fmt.Sprintf("connections: %d", conns),
+		fmt.Sprintf("keys: %d", keys),
+		fmt.Sprintf("commands_processed: %d", total),
+	}, perCommand...)
+}
+
+// resetStats resets the latency histograms together, holding all their
+// locks, so LATENCY never shows some commands reset and others not. The
+// other counters are zeroed right after.
+func (s *server) resetStats() {
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.commands[name].latency.mu.Lock()
+	}
+	now := time.Now()
+	for _, name := range names {
+		h := &s.commands[name].latency
+		h.resetLocked(now)
+		h.mu.Unlock()
+	}
+	for _, db := range s.dbs {
+		db.resetEvicted()
+	}
+	s.mu.Lock()
+	s.statsReset = now
+	for _, c := range s.clients {
+		c.commands.Store(0)
+		c.cmdNanos.Store(0)
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestInfoMemory(t *testing.T) {
+	srv := newServer(config{})
+	srv.dbs[0].set("abc", "12345")
+	srv.dbs[1].set("k", "v")
+	got := srv.dispatch(&client{}, []string{"INFO", "MEMORY"})
+	if got.kind != kindArray || len(got.items) == 0 || got.items[0].text != "# memory" {
+		t.Fatalf("INFO memory = %+v", got)
+	}
+	fields := make(map[string]string)
+	for _, it := range got.items[1:] {
+		k, v, _ := strings.Cut(it.text, ":")
+		fields[k] = v
+	}
+	if fields["used_logical"] != "10" {
+		t.Errorf("used_logical = %q, want 10", fields["used_logical"])
+	}
+	for _, k := range []string{"heap_alloc", "heap_sys", "num_gc"} {
+		if fields[k] == "" {
+			t.Errorf("missing %s", k)
+		}
+	}
+	if got := srv.dispatch(&client{}, []string{"INFO", "nope"}); got.kind != kindErr {
+		t.Fatalf("unknown section = %+v", got)
+	}
+}
+
+func TestRunID(t *testing.T) {
+	srv := newServer(config{})
+	got := lineTexts(srv.dispatch(&client{}, []string{"INFO", "server"}))
+	if len(got) != 2 || got[1] != "run_id:"+srv.runID {
+		t.Fatalf("INFO server = %q", got)
+	}
+	if len(srv.runID) != 40 || strings.Trim(srv.runID, "0123456789abcdef") != "" {
+		t.Errorf("run id %q is not 40 hex digits", srv.runID)
+	}
+	if hello := lineTexts(cmdHello(srv, &client{}, nil)); !slices.Contains(hello, "run_id="+srv.runID) {
+		t.Errorf("HELLO = %q", hello)
+	}
+	if other := newServer(config{}); other.runID == srv.runID {
+		t.Error("two servers share a run id")
+	}
+}
+
+func TestStats(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "a", "1"})
+	srv.dispatch(cl, []string{"SET", "b", "2"})
+	srv.dispatch(cl, []string{"GET", "a"})
+	srv.dispatch(&client{db: 3}, []string{"SET", "c", "3"})
+	c, r := connect(t, srv)
+	roundTrip(t, c, r, "PING")
+	got := lineTexts(srv.dispatch(cl, []string{"STATS"}))
+	want := []string{"connections: 1", "keys: 3", "commands_processed: 5", "cmd_get: 1", "cmd_ping: 1", "cmd_set: 3"}
+	if len(got) == 0 || !strings.HasPrefix(got[0], "uptime_seconds: ") || !slices.Equal(got[1:], want) {
+		t.Errorf("STATS = %q, want uptime_seconds then %q", got, want)
+	}
+}
+
+func TestStatsReset(t *testing.T) {
+	srv := newServer(config{maxMemory: 10})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "a", "12345"})
+	srv.dispatch(cl, []string{"SET", "b", "12345"})
+	c, r := connect(t, srv)
+	roundTrip(t, c, r, "PING")
+	if _, evicted := srv.dbs[0].memory(); evicted != 1 {
+		t.Fatalf("evicted = %d, want 1", evicted)
+	}
+
+	if got := srv.dispatch(cl, []string{"STATS", "RESET"}); got.kind != kindOK {
+		t.Fatalf("STATS RESET = %+v", got)
+	}
+	if _, evicted := srv.dbs[0].memory(); evicted != 0 {
+		t.Errorf("evicted after reset = %d", evicted)
+	}
+	// STATS itself is timed after it has run.
+	if got := lineTexts(srv.dispatch(cl, []string{"LATENCY"})); len(got) != 1 || !strings.HasPrefix(got[0], "STATS calls=1 ") {
+		t.Errorf("LATENCY after reset = %q", got)
+	}
+	srv.mu.Lock()
+	for _, c := range srv.clients {
+		if n := c.commands.Load(); n != 0 {
+			t.Errorf("client %d commands after reset = %d", c.id, n)
+		}
+	}
+	srv.mu.Unlock()
+	if v, _ := srv.dbs[0].get("b"); v != "12345" {
+		t.Errorf("STATS RESET changed the data: b = %q", v)
+	}
+	if got := srv.dispatch(cl, []string{"STATS", "nope"}); got.kind != kindErr {
+		t.Errorf("STATS nope = %+v", got)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNotJSON      = errors.New("value is not valid JSON")
+	errPatchNotJSON = errors.New("patch is not valid JSON")
+	errJSONPath     = errors.New("invalid JSON path")
+)
+
+// compactJSON rewrites the value at key in compact JSON form and returns
+// its new length. found is false if the key does not exist. A value that
+// is not valid JSON, or whose compact form check refuses when it is not
+// nil, is left unchanged.
+func (k *kvShard) compactJSON(key string, check func([]byte) error) (n int, found bool, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	v, ok, fresh := k.valueLocked(key)
+	if !ok {
+		return 0, false, nil
+	}
+	if fresh {
+		defer zero(v)
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, v); err != nil {
+		return 0, true, errNotJSON
+	}
+	if check != nil {
+		if err := check(buf.Bytes()); err != nil {
+			zero(buf.Bytes())
+			return 0, true, err
+		}
+	}
+	k.storeLocked(key, buf.Bytes())
+	return buf.Len(), true, nil
+}
+
+func cmdJSONCompact(s *server, cl *client, args []string) reply {
+	n, found, err := s.db(cl).compactJSON(args[0])
+	switch {
+	case err != nil:
+		return errReply(err.Error())
+	case !found:
+		return nilReply
+	}
+	return intReply(int64(n))
+}
+
+// decodeJSON parses one JSON value, keeping numbers as written.
+func decodeJSON(b []byte) (any, bool) {
+	if !json.Valid(b) {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	return v, dec.Decode(&v) == nil
+}
+
+// mergePatch applies an RFC 7386 merge patch to target, which is nil for
+// a missing value: objects in the patch are merged member by member, a
+// null member removes that member, and anything else replaces the target.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for name, v := range p {
+		if v == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], v)
+		}
+	}
+	return t
+}
+
+// jsonPatch applies a merge patch to the JSON value at key, which is
+// created if it does not exist, and returns the new value. Object members
+// come out sorted by name. limit is the largest value the result may be,
+// or 0 for no limit beyond maxValueLen, and check, when not nil, may
+// refuse it.
+func (k *kvShard) jsonPatch(key string, patch []byte, limit int, check func([]byte) error) (string, error) {
+	p, ok := decodeJSON(patch)
+	if !ok {
+		return "", errPatchNotJSON
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	if t := k.typeLocked(key); t != "string" && t != "none" {
+		return "", errWrongType
+	}
+	var doc any
+	if v, ok, fresh := k.valueLocked(key); ok {
+		doc, ok = decodeJSON(v)
+		if fresh {
+			zero(v)
+		}
+		if !ok {
+			return "", errNotJSON
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(mergePatch(doc, p)); err != nil {
+		return "", err
+	}
+	out := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	if len(out) > maxValueLen || limit > 0 && len(out) > limit {
+		return "", errValueTooLarge
+	}
+	if check != nil {
+		if err := check(out); err != nil {
+			zero(out)
+			return "", err
+		}
+	}
+	s := string(out)
+	k.storeLocked(key, out)
+	return s, nil
+}
+
+// cmdJSONPatch handles JSONPATCH key patch and replies with the patched
+// value.
+func cmdJSONPatch(s *server, cl *client, args []string) reply {
+	patch := []byte(strings.Join(args[1:], " "))
+	if r, ok := s.controlChars(cl, "JSONPATCH", args[0], patch); !ok {
+		return r
+	}
+	v, err := s.db(cl).jsonPatch(args[0], patch, s.cfg.maxValueBytes)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return strReply(v)
+}
+
+// jsonStep is one step of a JSON path: an object member, or an array
+// index when index >= 0.
+type jsonStep struct {
+	name  string
+	index int
+}
+
+// parseJSONPath parses a path such as user.name, items[0] or ["a.b"].c.
+// A quoted member name in brackets may hold any character.
+func parseJSONPath(path string) ([]jsonStep, error) {
+	var steps []jsonStep
+	for rest := path; rest != ""; {
+		switch {
+		case strings.HasPrefix(rest, `["`):
+			dec := json.NewDecoder(strings.NewReader(rest[1:]))
+			tok, err := dec.Token()
+			name, ok := tok.(string)
+			end := 1 + int(dec.InputOffset())
+			if err != nil || !ok || end >= len(rest) || rest[end] != ']' {
+				return nil, errJSONPath
+			}
+			steps = append(steps, jsonStep{name: name, index: -1})
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errJSONPath
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 || rest[1] == '+' {
+				return nil, errJSONPath
+			}
+			steps = append(steps, jsonStep{index: n})
+			rest = rest[end+1:]
+		default:
+			// A member name follows a dot, except at the start.
+			if len(steps) > 0 {
+				if rest[0] != '.' {
+					return nil, errJSONPath
+				}
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, errJSONPath
+			}
+			steps = append(steps, jsonStep{name: rest[:end], index: -1})
+			rest = rest[end:]
+		}
+	}
+	if len(steps) == 0 {
+		return nil, errJSONPath
+	}
+	return steps, nil
+}
+
+// jsonGet returns the part of the JSON value at key that path selects,
+// encoded as JSON. found is false if the key does not exist or the path
+// leads nowhere.
+func (k *kvShard) jsonGet(key string, path []jsonStep) (v string, found bool, err error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.expiredLocked(key, time.Now()) {
+		return "", false, nil
+	}
+	switch k.typeLocked(key) {
+	case "none":
+		return "", false, nil
+	case "string":
+	default:
+		return "", false, errWrongType
+	}
+	raw, _, fresh := k.valueLocked(key)
+	doc, ok := decodeJSON(raw)
+	if fresh {
+		zero(raw)
+	}
+	if !ok {
+		return "", false, errNotJSON
+	}
+	for _, st := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			if doc, ok = node[st.name]; !ok || st.index >= 0 {
+				return "", false, nil
+			}
+		case []any:
+			if st.index < 0 || st.index >= len(node) {
+				return "", false, nil
+			}
+			doc = node[st.index]
+		default:
+			return "", false, nil
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return "", false, err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), true, nil
+}
+
+// cmdJSONGet handles JSONGET key path and replies with the selected part
+// of the value as JSON, or NIL if there is none.
+func cmdJSONGet(s *server, cl *client, args []string) reply {
+	path, err := parseJSONPath(args[1])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	v, found, err := s.db(cl).jsonGet(args[0], path)
+	switch {
+	case err != nil:
+		return errReply(err.Error())
+	case !found:
+		return nilReply
+	}
+	return strReply(v)
+}
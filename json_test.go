@@ -0,0 +1,124 @@
+package main
+
+import "testing"
+
+func TestCompactJSON(t *testing.T) {
+	s := newKV()
+	s.set("doc", `{ "a" : [1, 2],  "b": "x y" }`)
+	n, found, err := s.compactJSON("doc")
+	if err != nil || !found {
+		t.Fatalf("compactJSON: found=%v err=%v", found, err)
+	}
+	want := `{"a":[1,2],"b":"x y"}`
+	if v, _ := s.get("doc"); v != want || n != len(want) {
+		t.Fatalf("compacted to %q (%d)", v, n)
+	}
+	s.set("bad", `{"a":`)
+	if _, _, err := s.compactJSON("bad"); err == nil {
+		t.Fatal("expected error for invalid JSON")
+	}
+	if v, _ := s.get("bad"); v != `{"a":` {
+		t.Fatalf("invalid value changed to %q", v)
+	}
+	if _, found, _ := s.compactJSON("missing"); found {
+		t.Fatal("missing key reported as found")
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	// The examples of RFC 7386 appendix A, with members sorted.
+	for _, tc := range []struct{ doc, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// Numbers keep their text, and HTML characters are not escaped.
+		{`{"n":12345678901234567890}`, `{"s":"<&>"}`, `{"n":12345678901234567890,"s":"<&>"}`},
+	} {
+		s := newKV()
+		s.set("doc", tc.doc)
+		got, err := s.jsonPatch("doc", []byte(tc.patch), 0)
+		if err != nil || got != tc.want {
+			t.Errorf("patch %s with %s = %q, %v, want %q", tc.doc, tc.patch, got, err, tc.want)
+		}
+		if v, _ := s.get("doc"); v != tc.want {
+			t.Errorf("stored %q after patching %s", v, tc.doc)
+		}
+	}
+
+	srv := newServer(config{maxValueBytes: 20})
+	cl := &client{}
+	if got := srv.dispatch(cl, []string{"JSONPATCH", "new", `{"a":`, `1}`}); got.text != `{"a":1}` {
+		t.Errorf("JSONPATCH of a missing key = %+v", got)
+	}
+	srv.dispatch(cl, []string{"SET", "bad", `{"a":`})
+	srv.dispatch(cl, []string{"NEXTID", "n"})
+	for _, tc := range []struct {
+		args []string
+		want error
+	}{
+		{[]string{"JSONPATCH", "bad", `{}`}, errNotJSON},
+		{[]string{"JSONPATCH", "new", `{"a":`}, errPatchNotJSON},
+		{[]string{"JSONPATCH", "n", `{}`}, errWrongType},
+		{[]string{"JSONPATCH", "new", `{"b":"0123456789"}`}, errValueTooLarge},
+	} {
+		if got := srv.dispatch(cl, tc.args); got.text != tc.want.Error() {
+			t.Errorf("%v = %+v, want %v", tc.args, got, tc.want)
+		}
+	}
+	if v, _ := srv.dbs[0].get("new"); v != `{"a":1}` {
+		t.Errorf("failed patches changed the value to %q", v)
+	}
+}
+
+func TestJSONGet(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "doc", `{"user":{"name":"ann","tags":["a","b"]},"items":[{"id":1},{"id":2}],"a.b":{"":true},"n":1.50}`})
+	for _, tc := range []struct{ path, want string }{
+		{"user.name", `"ann"`},
+		{"user", `{"name":"ann","tags":["a","b"]}`},
+		{"user.tags[1]", `"b"`},
+		{"items[0]", `{"id":1}`},
+		{"items[1].id", `2`},
+		{`["a.b"][""]`, `true`},
+		{`["user"].name`, `"ann"`},
+		{"n", `1.50`},
+	} {
+		if got := srv.dispatch(cl, []string{"JSONGET", "doc", tc.path}); got.text != tc.want || got.kind != kindValue {
+			t.Errorf("JSONGET %s = %+v, want %s", tc.path, got, tc.want)
+		}
+	}
+	for _, path := range []string{"missing", "user.name.first", "items[2]", "items.id", "user[0]", "user.tags[9]"} {
+		if got := srv.dispatch(cl, []string{"JSONGET", "doc", path}); got.kind != kindNil {
+			t.Errorf("JSONGET %s = %+v, want NIL", path, got)
+		}
+	}
+	if got := srv.dispatch(cl, []string{"JSONGET", "missing", "a"}); got.kind != kindNil {
+		t.Errorf("JSONGET of a missing key = %+v", got)
+	}
+	for _, path := range []string{".a", "a.", "a..b", "a[", "a[-1]", "a[+1]", "a[x]", `["a`, `["a"`, "[0]x"} {
+		if got := srv.dispatch(cl, []string{"JSONGET", "doc", path}); got.text != errJSONPath.Error() {
+			t.Errorf("JSONGET %q = %+v, want a path error", path, got)
+		}
+	}
+	srv.dispatch(cl, []string{"SET", "bad", `{"a":`})
+	if got := srv.dispatch(cl, []string{"JSONGET", "bad", "a"}); got.text != errNotJSON.Error() {
+		t.Errorf("JSONGET of invalid JSON = %+v", got)
+	}
+	srv.dispatch(cl, []string{"NEXTID", "c"})
+	if got := srv.dispatch(cl, []string{"JSONGET", "c", "a"}); got.text != errWrongType.Error() {
+		t.Errorf("JSONGET of a counter = %+v", got)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// A save file starts with fileMagic and a format byte, followed by the
+// format's key derivation parameters and then the salt, nonce and
+// ciphertext. Format 2, which saves write, holds a KDF id, the time cost
+// as a big-endian uint32, the Argon2id memory in KiB as a big-endian
+// uint32 and the Argon2id lanes as one byte; format 1 held just a PBKDF2
+// iteration count. The header is authenticated as GCM additional data, so
+// it cannot be changed without failing decryption.
+//
+// Files written before the header existed are just salt, nonce and
+// ciphertext, and always used legacyKDF; one whose random salt happens to
+// begin with fileMagic (a 1 in 2^32 chance) would be misread.
+const (
+	fileMagic = "BoSf"
+
+	fileFormatPBKDF2 = 1
+	fileFormat       = 2
+	fileHeaderLenV1  = len(fileMagic) + 1 + 4
+	fileHeaderLen    = len(fileMagic) + 1 + 1 + 4 + 4 + 1
+)
+
+// KDF ids in a format 2 header.
+const (
+	kdfPBKDF2   = 1
+	kdfArgon2id = 2
+)
+
+// Limits on the work a file can ask LOAD to do.
+const (
+	maxIterations   = 100_000_000 // PBKDF2
+	maxArgon2Time   = 1000
+	maxArgon2Memory = 1 << 20 // KiB
+)
+
+// kdfParams says how a snapshot's key is derived from its password.
+type kdfParams struct {
+	id      byte
+	time    uint32 // PBKDF2 iterations or Argon2id passes
+	memory  uint32 // Argon2id memory in KiB
+	threads uint8  // Argon2id lanes
+}
+
+var (
+	legacyKDF       = kdfParams{id: kdfPBKDF2, time: 100000}
+	defaultArgon2id = kdfParams{id: kdfArgon2id, time: 3, memory: 64 << 10, threads: 4}
+
+	// defaultKDF is what new saves use: the second of RFC 9106's
+	// recommended Argon2id settings, which needs 64 MiB per derivation.
+	defaultKDF = defaultArgon2id
+)
+
+func (p kdfParams) derive(pass, salt []byte) []byte {
+	if p.id == kdfArgon2id {
+		return argon2.IDKey(pass, salt, p.time, p.memory, p.threads, 32)
+	}
+	return pbkdf2sha512(pass, salt, int(p.time), 32)
+}
+
+// check rejects parameters that are out of range, whether they come from
+// flags or from a file.
+func (p kdfParams) check() error {
+	switch p.id {
+	case kdfPBKDF2:
+		if p.time < 1 || p.time > maxIterations {
+			return fmt.Errorf("invalid PBKDF2 iteration count %d", p.time)
+		}
+	case kdfArgon2id:
+		if p.time < 1 || p.time > maxArgon2Time {
+			return fmt.Errorf("invalid Argon2id time %d", p.time)
+		}
+		if p.threads < 1 {
+			return fmt.Errorf("invalid Argon2id parallelism %d", p.threads)
+		}
+		if p.memory < 8*uint32(p.threads) || p.memory > maxArgon2Memory {
+			return fmt.Errorf("invalid Argon2id memory %d KiB", p.memory)
+		}
+	default:
+		return fmt.Errorf("unknown KDF %d", p.id)
+	}
+	return nil
+}
+
+// header returns the format 2 header for a file keyed with p.
+func (p kdfParams) header() []byte {
+	h := append([]byte(fileMagic), fileFormat, p.id)
+	h = binary.BigEndian.AppendUint32(h, p.time)
+	h = binary.BigEndian.AppendUint32(h, p.memory)
+	return append(h, p.threads)
+}
+
+// parseFileHeader splits a save file into its header, which is empty for
+// a legacy file, the key derivation it asks for and the rest.
+func parseFileHeader(data []byte) (header []byte, p kdfParams, rest []byte, err error) {
+	if !bytes.HasPrefix(data, []byte(fileMagic)) || len(data) <= len(fileMagic) {
+		return nil, legacyKDF, data, nil
+	}
+	var n int
+	switch f := data[len(fileMagic)]; f {
+	case fileFormatPBKDF2:
+		if n = fileHeaderLenV1; len(data) < n {
+			return nil, p, nil, fmt.Errorf("invalid file")
+		}
+		p = kdfParams{id: kdfPBKDF2, time: binary.BigEndian.Uint32(data[n-4:])}
+	case fileFormat:
+		if n = fileHeaderLen; len(data) < n {
+			return nil, p, nil, fmt.Errorf("invalid file")
+		}
+		h := data[len(fileMagic)+1:]
+		p = kdfParams{
+			id:      h[0],
+			time:    binary.BigEndian.Uint32(h[1:]),
+			memory:  binary.BigEndian.Uint32(h[5:]),
+			threads: h[9],
+		}
+	default:
+		return nil, p, nil, fmt.Errorf("unsupported file format %d", f)
+	}
+	if err := p.check(); err != nil {
+		return nil, p, nil, err
+	}
+	return data[:n], p, data[n:], nil
+}
+
+// parseKDF builds the parameters for new saves from -save-kdf,
+// -save-kdf-iterations (0 keeps the default) and -save-kdf-memory in MiB.
+func parseKDF(name string, time, memoryMiB int) (kdfParams, error) {
+	var p kdfParams
+	switch name {
+	case "argon2id":
+		p = defaultArgon2id
+		if memoryMiB < 1 || memoryMiB > maxArgon2Memory>>10 {
+			return p, fmt.Errorf("-save-kdf-memory must be from 1 to %d", maxArgon2Memory>>10)
+		}
+		p.memory = uint32(memoryMiB) << 10
+	case "pbkdf2":
+		p = legacyKDF
+	default:
+		return p, fmt.Errorf("-save-kdf must be argon2id or pbkdf2, not %q", name)
+	}
+	if time < 0 || time > maxIterations {
+		return p, fmt.Errorf("invalid -save-kdf-iterations %d", time)
+	}
+	if time > 0 {
+		p.time = uint32(time)
+	}
+	return p, p.check()
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestDeriveArgon2id pins the key Argon2id derives, so files saved by
+// earlier builds keep opening.
+func TestDeriveArgon2id(t *testing.T) {
+	p := kdfParams{id: kdfArgon2id, time: 3, memory: 64, threads: 4}
+	got := hex.EncodeToString(p.derive([]byte("password"), []byte("somesalt12345678")))
+	if want := "468dc531814fa156f43b0aa7666f2d97e814842fa6d6367c1ce8f2b94b118c6c"; got != want {
+		t.Errorf("derived key = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+)
+
+// Snapshots saved with hashed key names store HMAC(name) instead of each
+// key name, so the names stay unreadable even to someone who gets past the
+// encryption. The HMAC key comes from the password. A store loaded from
+// such a snapshot keeps the names hashed: commands that take a key hash it
+// before the lookup, so they still work, but KEYS and every other listing
+// show only the hashes.
+
+var errKeyNamePass = errors.New("key names are hashed under a different password")
+
+// keyNameKey derives the HMAC key for key names from a snapshot password.
+// It is kept apart from the encryption key by its fixed salt.
+func keyNameKey(pass string) []byte {
+	return pbkdf2sha512([]byte(pass), []byte("bos-key-names"), 100000, 32)
+}
+
+func hashKeyName(mac []byte, key string) string {
+	return hex.EncodeToString(hmacSHA512(mac, []byte(key))[:32])
+}
+
+// name maps a key to the name it is stored under: the key itself, or its
+// hash in a store loaded from a snapshot with hashed key names. kv maps
+// every key it takes from a client before it picks the shard.
+func (k *kv) name(key string) string {
+	mac := k.hashedWith()
+	if mac == nil {
+		return key
+	}
+	return hashKeyName(mac, key)
+}
+
+// hashedWith returns the key-name HMAC key of a store with hashed names,
+// or nil.
+func (k *kv) hashedWith() []byte {
+	if p := k.mac.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// hashNames returns a copy of d with every key name replaced by its hash.
+func (d *dump) hashNames(mac []byte) *dump {
+	h := &dump{Version: d.Version, KeysHashed: true, Data: make(map[string]string, len(d.Data))}
+	for key, v := range d.Data {
+		h.Data[hashKeyName(mac, key)] = v
+	}
+	if d.Streams != nil {
+		h.Streams = make(map[string]*streamDump, len(d.Streams))
+		for key, st := range d.Streams {
+			h.Streams[hashKeyName(mac, key)] = st
+		}
+	}
+	if d.Counters != nil {
+		h.Counters = make(map[string]int64, len(d.Counters))
+		for key, n := range d.Counters {
+			h.Counters[hashKeyName(mac, key)] = n
+		}
+	}
+	if d.Geo != nil {
+		h.Geo = make(map[string]map[string]uint64, len(d.Geo))
+		for key, members := range d.Geo {
+			h.Geo[hashKeyName(mac, key)] = members
+		}
+	}
+	if d.HLL != nil {
+		h.HLL = make(map[string]bool, len(d.HLL))
+		for key := range d.HLL {
+			h.HLL[hashKeyName(mac, key)] = true
+		}
+	}
+	if d.Expiry != nil {
+		h.Expiry = make(map[string]int64, len(d.Expiry))
+		for key, ms := range d.Expiry {
+			h.Expiry[hashKeyName(mac, key)] = ms
+		}
+	}
+	return h
+}
+
+// prepareNames hashes d's key names for saving under pass when opts or the
+// store ask for it. A store whose names are already hashed can only be
+// saved under the password they were hashed with, or they would no longer
+// match the password used to load them.
+func prepareNames(d *dump, storeMAC []byte, pass string, opts saveOptions) (*dump, error) {
+	if storeMAC == nil && !opts.hashKeys {
+		return d, nil
+	}
+	mac := keyNameKey(pass)
+	defer zero(mac)
+	if storeMAC != nil {
+		if !hmac.Equal(mac, storeMAC) {
+			return nil, errKeyNamePass
+		}
+		return d, nil
+	}
+	return d.hashNames(mac), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashedKeyNames(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "db.bin")
+	src := newKV()
+	src.set("user:42", "alice")
+	src.nextID("seq:user:42")
+	if err := saveWithOptions(src, file, "pw", saveOptions{hashKeys: true}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := readSnapshot(file, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.KeysHashed || d.len() != 2 {
+		t.Fatalf("dump = %+v", d)
+	}
+	for key := range d.Data {
+		if strings.Contains(key, "user") {
+			t.Errorf("key name %q stored in the clear", key)
+		}
+	}
+
+	srv := newServer(config{})
+	cl := &client{}
+	if got := srv.dispatch(cl, []string{"LOAD", file, "pw"}); got.kind != kindOK {
+		t.Fatalf("LOAD = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"GET", "user:42"}); got.text != "alice" {
+		t.Errorf("GET user:42 = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"NEXTID", "seq:user:42"}); got.text != "2" {
+		t.Errorf("NEXTID after LOAD = %+v", got)
+	}
+	keys := lineTexts(srv.dispatch(cl, []string{"KEYS", "*"}))
+	if len(keys) != 2 || strings.Contains(strings.Join(keys, " "), "user") {
+		t.Errorf("KEYS * = %q, want only hashes", keys)
+	}
+	srv.dispatch(cl, []string{"SET", "user:7", "bob"})
+
+	// Saving again keeps the names hashed even without the option, and
+	// only under the same password.
+	again := filepath.Join(dir, "again.bin")
+	if err := saveToFile(srv.dbs[0], again, "other"); err != errKeyNamePass {
+		t.Errorf("save under another password = %v, want %v", err, errKeyNamePass)
+	}
+	if err := saveToFile(srv.dbs[0], again, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newKV()
+	if err := loadFromFile(reloaded, again, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"user:42": "alice", "user:7": "bob"} {
+		if v, _ := reloaded.get(key); v != want {
+			t.Errorf("%s = %q after a second save, want %q", key, v, want)
+		}
+	}
+
+	// Loading a plain snapshot leaves hashed mode.
+	plain := filepath.Join(dir, "plain.bin")
+	if err := saveToFile(src, plain, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFromFile(reloaded, plain, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := reloaded.keys("user:*"); len(keys) != 1 || keys[0] != "user:42" {
+		t.Errorf("KEYS after a plain LOAD = %q", keys)
+	}
+}
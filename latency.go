@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencySubBits sets the histogram resolution: each power of two of
+// nanoseconds is split into 1<<latencySubBits buckets, so a reported
+// percentile is at most 12.5% above the true value. The bucket count is
+// fixed, bounding memory per command whatever the traffic: durations are
+// below 2^63 ns, which takes 63-latencySubBits powers of two above the
+// first linear group.
+const (
+	latencySubBits = 3
+	latencySub     = 1 << latencySubBits
+	latencyBuckets = (64 - latencySubBits) * latencySub
+)
+
+// latencyHist is a streaming log-linear histogram of command latencies.
+type latencyHist struct {
+	mu     sync.Mutex
+	counts [latencyBuckets]uint64
+	calls  uint64
+	total  time.Duration
+	max    time.Duration
+	since  time.Time // last reset; zero if never reset
+}
+
+func latencyBucket(d time.Duration) int {
+	v := uint64(max(d, 0))
+	if v < latencySub {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 1 - latencySubBits
+	return (shift+1)<<latencySubBits + int(v>>shift)&(latencySub-1)
+}
+
+// latencyBucketMax is the largest latency falling in bucket i.
+func latencyBucketMax(i int) time.Duration {
+	if i < latencySub {
+		return time.Duration(i)
+	}
+	shift := i>>latencySubBits - 1
+	low := uint64(latencySub+i&(latencySub-1)) << shift
+	return time.Duration(low + 1<<shift - 1)
+}
+
+func (h *latencyHist) record(d time.Duration) {
+	h.mu.Lock()
+	h.counts[latencyBucket(d)]++
+	h.calls++
+	h.total += d
+	h.max = max(h.max, d)
+	h.mu.Unlock()
+}
+
+func (h *latencyHist) reset() {
+	h.mu.Lock()
+	h.resetLocked(time.Now())
+	h.mu.Unlock()
+}
+
+func (h *latencyHist) resetLocked(now time.Time) {
+	h.counts = [latencyBuckets]uint64{}
+	h.calls, h.total, h.max = 0, 0, 0
+	h.since = now
+}
+
+// count returns the call count.
+func (h *latencyHist) count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+// stats returns the call count and the p50, p99 and max latencies.
+func (h *latencyHist) stats() (calls uint64, p50, p99, maxLat time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls, h.percentileLocked(0.50), h.percentileLocked(0.99), h.max
+}
+
+// summary returns the call count and total latency, the p50, p99 and max
+// latencies, and when the counts were last reset.
+func (h *latencyHist) summary() (calls uint64, total time.Duration, quantiles [3]time.Duration, since time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls, h.total, [3]time.Duration{h.percentileLocked(0.50), h.percentileLocked(0.99), h.max}, h.since
+}
+
+func (h *latencyHist) percentileLocked(q float64) time.Duration {
+	if h.calls == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.calls) + 0.5)
+	rank = max(rank, 1)
+	var seen uint64
+	for i, n := range h.counts {
+		if seen += n; seen >= rank {
+			return min(latencyBucketMax(i), h.max)
+		}
+	}
+	return h.max
+}
+
+// cmdLatency handles LATENCY, which reports "NAME calls=n p50=d p99=d
+// max=d" for every command called since start or the last LATENCY RESET,
+// and LATENCY RESET.
+func cmdLatency(s *server, cl *client, args []string) reply {
+	if len(args) == 1 {
+		if !strings.EqualFold(args[0], "RESET") {
+			return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+		}
+		for _, c := range s.commands {
+			c.latency.reset()
+		}
+		return okReply
+	}
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		calls, p50, p99, maxLat := s.commands[name].latency.stats()
+		if calls == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s calls=%d p50=%s p99=%s max=%s", name, calls, p50, p99, maxLat))
+	}
+	return arrayReply(lines)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyBuckets(t *testing.T) {
+	for i := 0; i < latencyBuckets; i++ {
+		if got := latencyBucket(latencyBucketMax(i)); got != i {
+			t.Fatalf("bucket of bucket %d's max = %d", i, got)
+		}
+	}
+	for _, d := range []time.Duration{0, 1, 7, 8, 9, 1000, 123456, time.Second, time.Hour, 1<<63 - 1} {
+		hi := latencyBucketMax(latencyBucket(d))
+		if hi < d || float64(hi-d) > float64(d)/latencySub {
+			t.Errorf("%d falls in a bucket up to %d", d, hi)
+		}
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	var h latencyHist
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	calls, p50, p99, maxLat := h.stats()
+	if calls != 100 || maxLat != 100*time.Millisecond {
+		t.Fatalf("calls=%d max=%v", calls, maxLat)
+	}
+	within := func(got, want time.Duration) bool { return got >= want && got <= want+want/latencySub }
+	if !within(p50, 50*time.Millisecond) || !within(p99, 99*time.Millisecond) {
+		t.Errorf("p50=%v p99=%v", p50, p99)
+	}
+}
+
+func TestLatencyCommand(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "k", "v"})
+	srv.dispatch(cl, []string{"GET", "k"})
+	srv.dispatch(cl, []string{"GET", "k"})
+	got := lineTexts(srv.dispatch(cl, []string{"LATENCY"}))
+	if len(got) != 2 || !strings.HasPrefix(got[0], "GET calls=2 p50=") || !strings.HasPrefix(got[1], "SET calls=1 p50=") {
+		t.Fatalf("LATENCY = %q", got)
+	}
+	if r := srv.dispatch(cl, []string{"LATENCY", "RESET"}); r.kind != kindOK {
+		t.Fatalf("LATENCY RESET = %+v", r)
+	}
+	// Only the first LATENCY itself has been timed since the reset.
+	if got := lineTexts(srv.dispatch(cl, []string{"LATENCY"})); len(got) != 1 || !strings.HasPrefix(got[0], "LATENCY calls=1 ") {
+		t.Errorf("LATENCY after RESET = %q", got)
+	}
+}
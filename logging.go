@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// parseLogLevel parses -log-level.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid -log-level %q; want debug, info, warn or error", s)
+}
+
+// Bounds of the pause after a failed Accept.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// acceptBackoff spaces out Accept retries after errors, so a lasting one,
+// such as running out of file descriptors, neither spins the loop nor
+// floods the log.
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+// failed logs err and sleeps, twice as long as after the previous failure
+// in a row.
+func (b *acceptBackoff) failed(ln net.Listener, err error) {
+	b.delay = min(max(2*b.delay, minAcceptDelay), maxAcceptDelay)
+	slog.Warn("accept failed", "addr", ln.Addr().String(), "err", err, "retry-in", b.delay)
+	time.Sleep(b.delay)
+}
+
+// ok resets the delay after a successful Accept.
+func (b *acceptBackoff) ok() {
+	b.delay = 0
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for in, want := range map[string]slog.Level{
+		"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError,
+	} {
+		if got, err := parseLogLevel(in); err != nil || got != want {
+			t.Errorf("parseLogLevel(%q) = %v, %v", in, got, err)
+		}
+	}
+	if _, err := parseLogLevel("loud"); err == nil {
+		t.Error("accepted -log-level loud")
+	}
+}
+
+// captureLog sends slog output at every level to a buffer for the rest of
+// the test.
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := new(syncBuffer)
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return buf
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestLogging(t *testing.T) {
+	logs := captureLog(t)
+	srv := newServer(config{})
+	c, r := connect(t, srv)
+	roundTrip(t, c, r, "SET k secretvalue")
+	roundTrip(t, c, r, "INCR k")
+	missing := filepath.Join(t.TempDir(), "missing")
+	roundTrip(t, c, r, "LOAD "+missing+" hunter2")
+	roundTrip(t, c, r, "SAVE "+filepath.Join(t.TempDir(), "db")+" hunter2")
+	got := logs.String()
+	for _, want := range []string{"client connected", `msg="command failed"`, "command=INCR", `msg="LOAD failed"`, `msg="saved snapshot"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log is missing %s:\n%s", want, got)
+		}
+	}
+	for _, secret := range []string{"secretvalue", "hunter2"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("log holds %q:\n%s", secret, got)
+		}
+	}
+}
+
+// failingListener fails Accept a few times and then reports itself closed.
+type failingListener struct {
+	net.Listener
+	fails int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.fails == 0 {
+		return nil, net.ErrClosed
+	}
+	l.fails--
+	return nil, errors.New("too many open files")
+}
+
+func TestAcceptFailuresLogged(t *testing.T) {
+	logs := captureLog(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	newServer(config{}).serve(&failingListener{Listener: ln, fails: 3})
+	if n := strings.Count(logs.String(), "accept failed"); n != 3 {
+		t.Errorf("logged %d accept failures, want 3:\n%s", n, logs.String())
+	}
+	if !strings.Contains(logs.String(), "retry-in=20ms") {
+		t.Errorf("retries did not back off:\n%s", logs.String())
+	}
+}
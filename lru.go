@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+// lru orders keys by recency of use. touch, remove and oldest are O(1):
+// keys sit in a doubly linked list, most recent at the front, with a map
+// from key to list node. It has its own lock so reads holding only the
+// store's read lock can still record an access.
+type lru struct {
+	mu    sync.Mutex
+	nodes map[string]*lruNode
+	root  lruNode // sentinel; root.next is the newest, root.prev the oldest
+}
+
+type lruNode struct {
+	key        string
+	prev, next *lruNode
+}
+
+func newLRU() *lru {
+	l := &lru{nodes: make(map[string]*lruNode)}
+	l.root.next, l.root.prev = &l.root, &l.root
+	return l
+}
+
+func (l *lru) unlink(n *lruNode) {
+	n.prev.next, n.next.prev = n.next, n.prev
+}
+
+func (l *lru) pushFront(n *lruNode) {
+	n.prev, n.next = &l.root, l.root.next
+	l.root.next.prev = n
+	l.root.next = n
+}
+
+// touch marks key as the most recently used, adding it if needed.
+func (l *lru) touch(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.nodes[key]
+	if n == nil {
+		n = &lruNode{key: key}
+		l.nodes[key] = n
+	} else {
+		l.unlink(n)
+	}
+	l.pushFront(n)
+}
+
+func (l *lru) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := l.nodes[key]; n != nil {
+		l.unlink(n)
+		delete(l.nodes, key)
+	}
+}
+
+// oldest returns the least recently used key.
+func (l *lru) oldest() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.root.prev == &l.root {
+		return "", false
+	}
+	return l.root.prev.key, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLRUEviction(t *testing.T) {
+	s := newKV()
+	s.setMaxBytes(30) // three 10-byte entries
+	s.set("k1", "12345678")
+	s.set("k2", "12345678")
+	s.set("k3", "12345678")
+	s.get("k1") // k2 is now the least recently used
+	s.set("k4", "12345678")
+	if _, ok := s.get("k2"); ok {
+		t.Fatal("k2 should have been evicted")
+	}
+	for _, k := range []string{"k1", "k3", "k4"} {
+		if _, ok := s.get(k); !ok {
+			t.Fatalf("%s evicted", k)
+		}
+	}
+	if used, evicted := s.memory(); used != 30 || evicted != 1 {
+		t.Fatalf("used=%d evicted=%d", used, evicted)
+	}
+	s.del("k1")
+	if used, _ := s.memory(); used != 20 {
+		t.Fatalf("used after del = %d", used)
+	}
+	s.set("big", string(make([]byte, 100)))
+	if _, ok := s.get("big"); !ok || s.len() != 1 {
+		t.Fatalf("oversized value: present=%v len=%d", ok, s.len())
+	}
+}
+
+func TestGetNoBump(t *testing.T) {
+	srv := newServer(config{maxMemory: 30}) // three 10-byte entries
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "k1", "12345678"})
+	srv.dispatch(cl, []string{"SET", "k2", "12345678"})
+	srv.dispatch(cl, []string{"SET", "k3", "12345678"})
+	if got := srv.dispatch(cl, []string{"GETNOBUMP", "k1"}); got.text != "12345678" {
+		t.Fatalf("GETNOBUMP = %+v", got)
+	}
+	srv.dispatch(cl, []string{"SET", "k4", "12345678"})
+	if got := srv.dispatch(cl, []string{"GETNOBUMP", "k1"}); got.kind != kindNil {
+		t.Errorf("k1 survived eviction after GETNOBUMP: %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"GETNOBUMP", "k2"}); got.kind != kindValue {
+		t.Errorf("k2 = %+v, want it kept", got)
+	}
+}
+
+// BenchmarkLRUEviction measures SET on a full store of a million keys,
+// where every write evicts the least recently used key.
+func BenchmarkLRUEviction(b *testing.B) {
+	const n = 1000000
+	s := newKV()
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%09d", i)
+	}
+	val := "0123456789abcdef"
+	for _, k := range keys {
+		s.set(k, val)
+	}
+	used, _ := s.memory()
+	s.setMaxBytes(used)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.set(fmt.Sprintf("new:%09d", i), val)
+	}
+	b.StopTimer()
+	if _, evicted := s.memory(); evicted < int64(b.N) {
+		b.Fatalf("evicted %d keys for %d writes", evicted, b.N)
+	}
+}
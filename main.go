@@ -1,270 +1,1391 @@
-package main
-
-import (
-	"bufio"
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha512"
-	"encoding/json"
-	"fmt"
-	"net"
-	"os"
-	"strings"
-	"sync"
-)
-
-type kv struct {
-	mu   sync.RWMutex
-	data map[string][]byte
-}
-
-func newKV() *kv {
-	return &kv{data: make(map[string][]byte)}
-}
-
-func (k *kv) set(key, val string) {
-	k.mu.Lock()
-	k.data[key] = []byte(val)
-	k.mu.Unlock()
-}
-
-func (k *kv) get(key string) (string, bool) {
-	k.mu.RLock()
-	v, ok := k.data[key]
-	k.mu.RUnlock()
-	return string(v), ok
-}
-
-func zero(b []byte) {
-	for i := range b {
-		b[i] = 0
-	}
-}
-
-func (k *kv) del(key string) bool {
-	k.mu.Lock()
-	defer k.mu.Unlock()
-	v, ok := k.data[key]
-	if !ok {
-		return false
-	}
-	zero(v)
-	delete(k.data, key)
-	return true
-}
-
-func (k *kv) snapshot() map[string]string {
-	k.mu.RLock()
-	defer k.mu.RUnlock()
-	out := make(map[string]string, len(k.data))
-	for key, v := range k.data {
-		out[key] = string(v)
-	}
-	return out
-}
-
-func (k *kv) replace(in map[string]string) {
-	k.mu.Lock()
-	for key, v := range k.data {
-		zero(v)
-		delete(k.data, key)
-	}
-	for key, val := range in {
-		k.data[key] = []byte(val)
-	}
-	k.mu.Unlock()
-}
-
-func hmacSHA512(key, data []byte) []byte {
-	m := hmac.New(sha512.New, key)
-	m.Write(data)
-	return m.Sum(nil)
-}
-
-func pbkdf2sha512(password, salt []byte, iter, dkLen int) []byte {
-	hLen := sha512.Size
-	l := (dkLen + hLen - 1) / hLen
-	var dk []byte
-	for i := 1; i <= l; i++ {
-		var block bytes.Buffer
-		block.Write(salt)
-		block.Write([]byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)})
-		u := hmacSHA512(password, block.Bytes())
-		t := make([]byte, hLen)
-		copy(t, u)
-		for j := 1; j < iter; j++ {
-			u = hmacSHA512(password, u)
-			for k := range t {
-				t[k] ^= u[k]
-			}
-		}
-		dk = append(dk, t...)
-	}
-	return dk[:dkLen]
-}
-
-func deriveKey(pass, salt []byte) []byte {
-	return pbkdf2sha512(pass, salt, 100000, 32)
-}
-
-func saveToFile(store *kv, file, pass string) error {
-	state := store.snapshot()
-	blob, err := json.Marshal(state)
-	if err != nil {
-		return err
-	}
-	salt := make([]byte, 16)
-	if _, err := rand.Read(salt); err != nil {
-		return err
-	}
-	key := deriveKey([]byte(pass), salt)
-	c, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-	g, err := cipher.NewGCM(c)
-	if err != nil {
-		return err
-	}
-	nonce := make([]byte, g.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return err
-	}
-	ct := g.Seal(nil, nonce, blob, nil)
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if _, err := f.Write(salt); err != nil {
-		return err
-	}
-	if _, err := f.Write(nonce); err != nil {
-		return err
-	}
-	if _, err := f.Write(ct); err != nil {
-		return err
-	}
-	zero(blob)
-	zero(key)
-	return nil
-}
-
-func loadFromFile(store *kv, file, pass string) error {
-	data, err := os.ReadFile(file)
-	if err != nil {
-		return err
-	}
-	if len(data) < 28 {
-		return fmt.Errorf("invalid file")
-	}
-	salt := data[:16]
-	nonce := data[16:28]
-	ct := data[28:]
-	key := deriveKey([]byte(pass), salt)
-	c, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-	g, err := cipher.NewGCM(c)
-	if err != nil {
-		return err
-	}
-	pt, err := g.Open(nil, nonce, ct, nil)
-	if err != nil {
-		return err
-	}
-	var m map[string]string
-	if err := json.Unmarshal(pt, &m); err != nil {
-		return err
-	}
-	store.replace(m)
-	zero(pt)
-	zero(key)
-	return nil
-}
-
-func handle(c net.Conn, store *kv) {
-	defer c.Close()
-	r := bufio.NewReader(c)
-	for {
-		line, err := r.ReadString('\n')
-		if err != nil {
-			return
-		}
-		cmd := strings.Fields(strings.TrimSpace(line))
-		if len(cmd) == 0 {
-			continue
-		}
-		switch strings.ToUpper(cmd[0]) {
-		case "SET":
-			if len(cmd) < 3 {
-				fmt.Fprintln(c, "ERR")
-				continue
-			}
-			key, val := cmd[1], strings.Join(cmd[2:], " ")
-			store.set(key, val)
-			fmt.Fprintln(c, "OK")
-		case "GET":
-			if len(cmd) != 2 {
-				fmt.Fprintln(c, "ERR")
-				continue
-			}
-			if v, ok := store.get(cmd[1]); ok {
-				fmt.Fprintln(c, v)
-			} else {
-				fmt.Fprintln(c, "NIL")
-			}
-		case "DEL":
-			if len(cmd) != 2 {
-				fmt.Fprintln(c, "ERR")
-				continue
-			}
-			if store.del(cmd[1]) {
-				fmt.Fprintln(c, "OK")
-			} else {
-				fmt.Fprintln(c, "NIL")
-			}
-		case "SAVE":
-			if len(cmd) != 3 {
-				fmt.Fprintln(c, "ERR")
-				continue
-			}
-			if err := saveToFile(store, cmd[1], cmd[2]); err != nil {
-				fmt.Fprintln(c, "ERR")
-			} else {
-				fmt.Fprintln(c, "OK")
-			}
-		case "LOAD":
-			if len(cmd) != 3 {
-				fmt.Fprintln(c, "ERR")
-				continue
-			}
-			if err := loadFromFile(store, cmd[1], cmd[2]); err != nil {
-				fmt.Fprintln(c, "ERR")
-			} else {
-				fmt.Fprintln(c, "OK")
-			}
-		default:
-			fmt.Fprintln(c, "ERR")
-		}
-	}
-}
-
-func main() {
-	store := newKV()
-	ln, err := net.Listen("tcp", ":4000")
-	if err != nil {
-		panic(err)
-	}
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			continue
-		}
-		go handle(conn, store)
-	}
-}
\ No newline at end of file
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// kvShard holds the keys of one shard of a kv; see shard.go. Its methods
+// take stored key names, which kv has already hashed if the store's names
+// are hashed.
+type kvShard struct {
+	mu sync.RWMutex
+	// A key is in at most one of data, streams, counters (NEXTID
+	// sequences) and geos (see geo.go).
+	data     map[string][]byte
+	streams  map[string]*stream
+	counters map[string]int64
+	geos     map[string]*geoSet
+
+	// compressed holds the raw length of each value in data that is kept
+	// deflated, which values longer than compressAbove are (if that saves
+	// space); see compress.go.
+	compressed    map[string]int
+	compressAbove int
+
+	// hll marks the values in data that are HyperLogLog registers; see
+	// hll.go.
+	hll map[string]bool
+
+	// expiry holds the deadline of each key set with EXPIRE; see
+	// expire.go. Writes that replace a value with SET clear it.
+	expiry map[string]time.Time
+
+	// used is the logical size of the data set: the sum of key and value
+	// lengths, with compressed values counted at their compressed length
+	// and stream entries by their fields. When maxBytes
+	// is set, writes evict least recently used keys until used fits again.
+	used     int64
+	maxBytes int64
+	lru      *lru // nil unless maxBytes > 0
+	evicted  int64
+
+	// mem is the store-wide total that every change to used is added
+	// to; see mempeak.go.
+	mem *memUsage
+
+	// mapped serves read-only string values from a memory-mapped image
+	// with -mmap-file; see mmap.go.
+	mapped *mappedFile
+
+	// aof is the store's append-only log, if it has one, to which the
+	// shard logs the keys it drops by itself; see dropLocked.
+	aof *aofLog
+}
+
+func newShard() *kvShard {
+	return &kvShard{
+		data:       make(map[string][]byte),
+		streams:    make(map[string]*stream),
+		counters:   make(map[string]int64),
+		geos:       make(map[string]*geoSet),
+		compressed: make(map[string]int),
+		hll:        make(map[string]bool),
+		expiry:     make(map[string]time.Time),
+	}
+}
+
+// eachKeyLocked calls fn for every key of every type until fn returns
+// false. k.mu must be held.
+func (k *kvShard) eachKeyLocked(fn func(key string) bool) {
+	for key := range k.data {
+		if !fn(key) {
+			return
+		}
+	}
+	for key := range k.streams {
+		if !fn(key) {
+			return
+		}
+	}
+	for key := range k.counters {
+		if !fn(key) {
+			return
+		}
+	}
+	for key := range k.geos {
+		if !fn(key) {
+			return
+		}
+	}
+	if k.mapped != nil {
+		k.mapped.each(func(key string, _ []byte, _ int64) bool { return fn(key) })
+	}
+}
+
+// setMaxBytes bounds the logical size of the store; 0 removes the bound.
+// It is meant to be called before the store is used.
+func (k *kvShard) setMaxBytes(n int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.maxBytes = n
+	if n <= 0 {
+		k.lru = nil
+		return
+	}
+	k.lru = newLRU()
+	k.eachKeyLocked(func(key string) bool {
+		k.lru.touch(key)
+		return true
+	})
+	k.evictLocked("")
+}
+
+// storeLocked sets key to val, zeroing any value it replaces, and keeps
+// the size accounting and LRU order up to date. k.mu must be held.
+func (k *kvShard) storeLocked(key string, val []byte) {
+	if _, ok := k.data[key]; !ok {
+		k.deleteLocked(key) // a value of another type
+	}
+	if old, ok := k.data[key]; ok {
+		k.addUsed(-int64(len(key) + len(old)))
+		zero(old)
+	}
+	delete(k.hll, key)
+	val = k.compressLocked(key, val)
+	k.data[key] = val
+	k.addUsed(int64(len(key) + len(val)))
+	if k.lru != nil {
+		k.lru.touch(key)
+		k.evictLocked(key)
+	}
+	k.notePeakLocked()
+}
+
+// deleteLocked removes key, zeroing its value. k.mu must be held.
+func (k *kvShard) deleteLocked(key string) bool {
+	if st, ok := k.streams[key]; ok {
+		k.addUsed(-st.size(key))
+		for _, e := range st.entries {
+			e.zero()
+		}
+		delete(k.streams, key)
+	} else if _, ok := k.counters[key]; ok {
+		k.addUsed(-counterSize(key))
+		delete(k.counters, key)
+	} else if g, ok := k.geos[key]; ok {
+		k.addUsed(-g.size(key))
+		delete(k.geos, key)
+	} else if v, ok := k.data[key]; ok {
+		k.addUsed(-int64(len(key) + len(v)))
+		zero(v)
+		delete(k.data, key)
+		delete(k.compressed, key)
+		delete(k.hll, key)
+	} else {
+		return false
+	}
+	delete(k.expiry, key)
+	if k.lru != nil {
+		k.lru.remove(key)
+	}
+	return true
+}
+
+// evictLocked drops least recently used keys until the store fits in
+// maxBytes. keep is never evicted, so a single oversized value stays.
+func (k *kvShard) evictLocked(keep string) {
+	for k.maxBytes > 0 && k.used > k.maxBytes {
+		victim, ok := k.lru.oldest()
+		if !ok || victim == keep {
+			return
+		}
+		k.dropLocked(victim)
+		k.evicted++
+	}
+}
+
+func (k *kvShard) set(key, val string) {
+	k.mu.Lock()
+	delete(k.expiry, key)
+	k.storeLocked(key, []byte(val))
+	k.mu.Unlock()
+}
+
+// setBytes stores val without copying; the store takes ownership of it.
+func (k *kvShard) setBytes(key string, val []byte) {
+	k.mu.Lock()
+	delete(k.expiry, key)
+	k.storeLocked(key, val)
+	k.mu.Unlock()
+}
+
+func (k *kvShard) get(key string) (string, bool) {
+	return k.read(key, true)
+}
+
+// read returns the value at key. bump marks the key as recently used;
+// readers such as scanners pass false so they do not keep keys from being
+// evicted.
+func (k *kvShard) read(key string, bump bool) (string, bool) {
+	k.mu.RLock()
+	if k.expiredLocked(key, time.Now()) {
+		k.mu.RUnlock()
+		k.reap(key)
+		return "", false
+	}
+	v, ok, fresh := k.valueLocked(key)
+	s := string(v)
+	if fresh {
+		zero(v)
+	}
+	if n, isCounter := k.counters[key]; isCounter {
+		s, ok = strconv.FormatInt(n, 10), true
+	}
+	if ok && bump && k.lru != nil {
+		k.lru.touch(key)
+	}
+	k.mu.RUnlock()
+	return s, ok
+}
+
+// exists reports whether key holds a value of any type. It does not touch
+// the key's LRU recency or copy its value.
+func (k *kvShard) exists(key string) bool {
+	k.mu.RLock()
+	expired := k.expiredLocked(key, time.Now())
+	found := !expired && k.typeLocked(key) != "none"
+	k.mu.RUnlock()
+	if expired {
+		k.reap(key)
+	}
+	return found
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func (k *kvShard) del(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	return k.deleteLocked(key)
+}
+
+// memory reports the logical size of the store and how many keys have
+// been evicted to respect maxBytes.
+func (k *kvShard) memory() (used, evicted int64) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.used, k.evicted
+}
+
+// resetEvicted zeroes the eviction count memory reports.
+func (k *kvShard) resetEvicted() {
+	k.mu.Lock()
+	k.evicted = 0
+	k.mu.Unlock()
+}
+
+func (k *kvShard) len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	n := len(k.data) + len(k.streams) + len(k.counters) + len(k.geos)
+	if k.mapped != nil {
+		n += k.mapped.n
+	}
+	return n
+}
+
+// keys returns the keys matching a glob pattern, in no particular order.
+func (k *kv) keys(pattern string) []string {
+	return k.matchKeys(pattern, 0)
+}
+
+// matchKeys is keys with a cap on the number of results; limit <= 0 means
+// no cap. Each shard is walked under its own read lock, and only key names
+// are copied under it.
+func (k *kv) matchKeys(pattern string, limit int) []string {
+	var out []string
+	now := time.Now()
+	for _, sh := range k.shards {
+		sh.mu.RLock()
+		sh.eachKeyLocked(func(key string) bool {
+			if limit > 0 && len(out) == limit {
+				return false
+			}
+			if globMatch(pattern, key) && !sh.expiredLocked(key, now) {
+				out = append(out, key)
+			}
+			return true
+		})
+		sh.mu.RUnlock()
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out
+}
+
+// snapshotVersion is the current dump format. Version 1 files are a bare
+// JSON object of string keys and values, with no version field.
+const snapshotVersion = 2
+
+// dump is the decoded contents of a save file. Numbers in it, such as
+// stream IDs, must use explicit integer fields: encoding/json decodes
+// those exactly, where a float64 or interface{} field would round
+// anything above 2^53.
+type dump struct {
+	Version  int                    `json:"version"`
+	Data     map[string]string      `json:"data"`
+	Streams  map[string]*streamDump `json:"streams,omitempty"`
+	Counters map[string]int64       `json:"counters,omitempty"`
+
+	// Geo holds each geo key's members and their geohash scores.
+	Geo map[string]map[string]uint64 `json:"geo,omitempty"`
+
+	// HLL marks the keys in Data that hold HyperLogLog registers.
+	HLL map[string]bool `json:"hll,omitempty"`
+
+	// Expiry holds key deadlines as Unix milliseconds.
+	Expiry map[string]int64 `json:"expiry,omitempty"`
+
+	// Schemas maps each SCHEMA SET prefix to its type; see schema.go.
+	Schemas map[string]string `json:"schemas,omitempty"`
+
+	// KeysHashed marks key names stored as HMACs; see keyhash.go. mac is
+	// the HMAC key, derived from the password when such a dump is read.
+	KeysHashed bool   `json:"keys_hashed,omitempty"`
+	mac        []byte `json:"-"`
+}
+
+// len is the number of keys in the dump, of any type.
+func (d *dump) len() int {
+	return len(d.Data) + len(d.Streams) + len(d.Counters) + len(d.Geo)
+}
+
+// snapshot copies the store with every shard read-locked, so the copy is
+// of a single moment.
+func (k *kv) snapshot() *dump {
+	k.rlockAll()
+	defer k.runlockAll()
+	return k.snapshotLocked()
+}
+
+// snapshotLocked is snapshot for a caller that holds every shard's lock.
+func (k *kv) snapshotLocked() *dump {
+	n := 0
+	for _, sh := range k.shards {
+		n += len(sh.data)
+	}
+	d := &dump{Version: snapshotVersion, Data: make(map[string]string, n), KeysHashed: k.hashedWith() != nil}
+	d.Schemas = k.loadSchemas().dump()
+	now := time.Now()
+	for _, sh := range k.shards {
+		sh.snapshotLocked(d, now)
+	}
+	return d
+}
+
+// snapshotLocked adds the shard's live keys to d. k.mu must be held.
+func (k *kvShard) snapshotLocked(d *dump, now time.Time) {
+	for key := range k.data {
+		if k.expiredLocked(key, now) {
+			continue
+		}
+		v, _, fresh := k.valueLocked(key)
+		d.Data[key] = string(v)
+		if fresh {
+			zero(v)
+		}
+		if k.hll[key] {
+			if d.HLL == nil {
+				d.HLL = make(map[string]bool)
+			}
+			d.HLL[key] = true
+		}
+	}
+	if k.mapped != nil {
+		k.mapped.each(func(key string, val []byte, expiry int64) bool {
+			d.Data[key] = string(val)
+			if expiry != 0 {
+				if d.Expiry == nil {
+					d.Expiry = make(map[string]int64)
+				}
+				d.Expiry[key] = expiry
+			}
+			return true
+		})
+	}
+	if len(k.streams) > 0 && d.Streams == nil {
+		d.Streams = make(map[string]*streamDump)
+	}
+	for key, st := range k.streams {
+		if !k.expiredLocked(key, now) {
+			d.Streams[key] = st.dump()
+		}
+	}
+	if len(k.counters) > 0 && d.Counters == nil {
+		d.Counters = make(map[string]int64)
+	}
+	for key, n := range k.counters {
+		if !k.expiredLocked(key, now) {
+			d.Counters[key] = n
+		}
+	}
+	if len(k.geos) > 0 && d.Geo == nil {
+		d.Geo = make(map[string]map[string]uint64)
+	}
+	for key, g := range k.geos {
+		if !k.expiredLocked(key, now) {
+			d.Geo[key] = maps.Clone(g.hashes)
+		}
+	}
+	for key, t := range k.expiry {
+		if !k.expiredLocked(key, now) {
+			if d.Expiry == nil {
+				d.Expiry = make(map[string]int64)
+			}
+			d.Expiry[key] = t.UnixMilli()
+		}
+	}
+}
+
+// replace swaps the store's contents for d's. Streams in d are taken over,
+// not copied.
+func (k *kv) replace(d *dump) error {
+	streams, err := d.restoreStreams()
+	if err != nil {
+		return err
+	}
+	ss, err := parseSchemas(d.Schemas)
+	if err != nil {
+		return err
+	}
+	k.lockAll()
+	defer k.unlockAll()
+	k.schemaMu.Lock()
+	k.schemas.Store(&ss)
+	k.schemaMu.Unlock()
+	for _, sh := range k.shards {
+		for key := range sh.data {
+			sh.deleteLocked(key)
+		}
+		for key := range sh.streams {
+			sh.deleteLocked(key)
+		}
+		for key := range sh.counters {
+			sh.deleteLocked(key)
+		}
+		for key := range sh.geos {
+			sh.deleteLocked(key)
+		}
+	}
+	k.storeDumpLocked(d, streams)
+	k.mac.Store(&d.mac)
+	for _, sh := range k.shards {
+		sh.evictLocked("")
+		sh.notePeakLocked()
+	}
+	if k.aof != nil {
+		k.aof.append(fullRecord(d, d.mac))
+	}
+	k.signal()
+	return nil
+}
+
+// restoreStreams checks that d's keys each hold one value of a valid type
+// and that every deadline is for one of them, and rebuilds its streams.
+func (d *dump) restoreStreams() (map[string]*stream, error) {
+	streams := make(map[string]*stream, len(d.Streams))
+	for key, sd := range d.Streams {
+		if _, ok := d.Data[key]; ok {
+			return nil, fmt.Errorf("key %q holds both a string and a stream", key)
+		}
+		st, err := sd.restore()
+		if err != nil {
+			return nil, fmt.Errorf("stream %q: %w", key, err)
+		}
+		streams[key] = st
+	}
+	for key := range d.Counters {
+		_, isString := d.Data[key]
+		if _, isStream := d.Streams[key]; isString || isStream {
+			return nil, fmt.Errorf("key %q holds a counter and another value", key)
+		}
+	}
+	for key, members := range d.Geo {
+		_, isString := d.Data[key]
+		_, isStream := d.Streams[key]
+		if _, isCounter := d.Counters[key]; isString || isStream || isCounter {
+			return nil, fmt.Errorf("key %q holds a geo set and another value", key)
+		}
+		for _, h := range members {
+			if h >= geoMaxHash {
+				return nil, fmt.Errorf("geo set %q: invalid score %d", key, h)
+			}
+		}
+	}
+	for key := range d.HLL {
+		if v, ok := d.Data[key]; !ok || len(v) != hllRegisters {
+			return nil, fmt.Errorf("key %q is not a valid HyperLogLog", key)
+		}
+	}
+	for key := range d.Expiry {
+		if !d.has(key) {
+			return nil, fmt.Errorf("expiry for missing key %q", key)
+		}
+	}
+	return streams, nil
+}
+
+// has reports whether key holds a value of any type in d.
+func (d *dump) has(key string) bool {
+	_, isString := d.Data[key]
+	_, isStream := d.Streams[key]
+	_, isCounter := d.Counters[key]
+	_, isGeo := d.Geo[key]
+	return isString || isStream || isCounter || isGeo
+}
+
+// storeDumpLocked stores d's keys, none of which may hold a value, with
+// streams from d.restoreStreams. The locks of their shards must be held.
+func (k *kv) storeDumpLocked(d *dump, streams map[string]*stream) {
+	for key, val := range d.Data {
+		sh := k.shardOf(key)
+		sh.storeLocked(key, []byte(val))
+		if d.HLL[key] {
+			sh.hll[key] = true
+		}
+	}
+	for key, st := range streams {
+		sh := k.shardOf(key)
+		sh.streams[key] = st
+		sh.addUsed(st.size(key))
+		if sh.lru != nil {
+			sh.lru.touch(key)
+		}
+	}
+	for key, n := range d.Counters {
+		sh := k.shardOf(key)
+		sh.counters[key] = n
+		sh.addUsed(counterSize(key))
+		if sh.lru != nil {
+			sh.lru.touch(key)
+		}
+	}
+	for key, members := range d.Geo {
+		g := newGeoSet()
+		for member, h := range members {
+			g.add(member, h)
+		}
+		sh := k.shardOf(key)
+		sh.geos[key] = g
+		sh.addUsed(g.size(key))
+		if sh.lru != nil {
+			sh.lru.touch(key)
+		}
+	}
+	for key, ms := range d.Expiry {
+		k.shardOf(key).expiry[key] = time.UnixMilli(ms)
+	}
+}
+
+// swapKV exchanges the contents of two stores with every shard of both
+// locked. Locks are taken in argument order; callers pass the
+// lower-numbered database first so concurrent swaps cannot deadlock. Both
+// stores have the same number of shards, as every database is configured
+// alike.
+func swapKV(a, b *kv) {
+	a.lockAll()
+	defer a.unlockAll()
+	b.lockAll()
+	defer b.unlockAll()
+	for i := range a.shards {
+		swapShards(a.shards[i], b.shards[i])
+	}
+	amac, bmac := a.mac.Load(), b.mac.Load()
+	a.mac.Store(bmac)
+	b.mac.Store(amac)
+	a.schemaMu.Lock()
+	b.schemaMu.Lock()
+	as, bs := a.schemas.Load(), b.schemas.Load()
+	a.schemas.Store(bs)
+	b.schemas.Store(as)
+	b.schemaMu.Unlock()
+	a.schemaMu.Unlock()
+	for _, k := range []*kv{a, b} {
+		if k.aof != nil {
+			k.aof.append(fullRecord(k.snapshotLocked(), k.hashedWith()))
+		}
+	}
+	a.signal()
+	b.signal()
+}
+
+func hmacSHA512(key, data []byte) []byte {
+	m := hmac.New(sha512.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+func pbkdf2sha512(password, salt []byte, iter, dkLen int) []byte {
+	hLen := sha512.Size
+	l := (dkLen + hLen - 1) / hLen
+	var dk []byte
+	for i := 1; i <= l; i++ {
+		var block bytes.Buffer
+		block.Write(salt)
+		block.Write([]byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)})
+		u := hmacSHA512(password, block.Bytes())
+		t := make([]byte, hLen)
+		copy(t, u)
+		for j := 1; j < iter; j++ {
+			u = hmacSHA512(password, u)
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:dkLen]
+}
+
+// saveOptions tweaks how a snapshot is written; the zero value is the
+// default format.
+type saveOptions struct {
+	// deterministic derives the salt and nonce from the plaintext instead
+	// of drawing them at random, so identical data saved with the same
+	// password produces an identical file. WARNING: this reveals to anyone
+	// holding two files whether they contain the same data, and reuses a
+	// nonce for every save of the same content. Only use it where
+	// deduplicating encrypted blobs matters more than that.
+	deterministic bool
+
+	// hashKeys stores HMACs of the key names instead of the names; see
+	// keyhash.go. A store loaded from such a file cannot list its keys.
+	hashKeys bool
+
+	// kdf derives the encryption key; the zero value means defaultKDF.
+	// It is recorded in the file, so changing it does not affect loading
+	// files saved before.
+	kdf kdfParams
+}
+
+func saveToFile(store *kv, file, pass string) error {
+	return saveWithOptions(store, file, pass, saveOptions{})
+}
+
+func saveWithOptions(store *kv, file, pass string, opts saveOptions) error {
+	state, err := prepareNames(store.snapshot(), store.hashedWith(), pass, opts)
+	if err != nil {
+		return err
+	}
+	blob, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if opts.deterministic {
+		copy(salt, hmacSHA512([]byte(pass), append([]byte("bos-salt"), blob...)))
+	} else if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	kdf := opts.kdf
+	if kdf == (kdfParams{}) {
+		kdf = defaultKDF
+	}
+	if err := kdf.check(); err != nil {
+		return err
+	}
+	header := kdf.header()
+	key := kdf.derive([]byte(pass), salt)
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	g, err := cipher.NewGCM(c)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, g.NonceSize())
+	if opts.deterministic {
+		copy(nonce, hmacSHA512(key, blob))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ct := g.Seal(nil, nonce, blob, header)
+	zero(blob)
+	zero(key)
+	return writeDurable(file, header, salt, nonce, ct)
+}
+
+// writeDurable replaces file with the concatenation of parts. It writes a
+// temporary file in the same directory, fsyncs it, renames it into place
+// and fsyncs the directory, so after a crash or power loss the file is
+// either the old one or the complete new one.
+func writeDurable(file string, parts ...[]byte) error {
+	dir := filepath.Dir(file)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	for _, p := range parts {
+		if _, err = f.Write(p); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory, making renames and creations in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func loadFromFile(store *kv, file, pass string) error {
+	d, err := readSnapshot(file, pass)
+	if err != nil {
+		return err
+	}
+	return store.replace(d)
+}
+
+// readSnapshot decrypts and decodes a save file without touching any store.
+func readSnapshot(file, pass string) (*dump, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	header, kdf, data, err := parseFileHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 28 {
+		return nil, fmt.Errorf("invalid file")
+	}
+	salt := data[:16]
+	nonce := data[16:28]
+	ct := data[28:]
+	key := kdf.derive([]byte(pass), salt)
+	defer zero(key)
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	g, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := g.Open(nil, nonce, ct, header)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(pt)
+	d, err := decodeSnapshot(pt)
+	if err != nil {
+		return nil, err
+	}
+	if d.KeysHashed {
+		d.mac = keyNameKey(pass)
+	}
+	return d, nil
+}
+
+// decodeSnapshot parses a decrypted save file. Version 1 values are always
+// strings, so a numeric "version" field can only come from a later format.
+func decodeSnapshot(pt []byte) (*dump, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	if json.Unmarshal(pt, &probe) != nil || probe.Version == 0 {
+		var m map[string]string
+		if err := json.Unmarshal(pt, &m); err != nil {
+			return nil, err
+		}
+		return &dump{Version: 1, Data: m}, nil
+	}
+	if probe.Version > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", probe.Version)
+	}
+	var d dump
+	if err := json.Unmarshal(pt, &d); err != nil {
+		return nil, err
+	}
+	if d.Data == nil {
+		d.Data = map[string]string{}
+	}
+	return &d, nil
+}
+
+type config struct {
+	crlf          bool
+	maxIdle       time.Duration
+	idleTimeout   time.Duration
+	dir           string // root for server-side file commands
+	maxValueBytes int    // 0 means unlimited
+	debug         bool   // enables the DEBUG command
+	maxMemory     int64  // logical bytes per database before LRU eviction; 0 is unlimited
+	compressAbove int    // keep values longer than this compressed; 0 is off
+	rejectControl rejectControl
+	workers       int // handle connections on this many pooled goroutines; 0 is one goroutine each
+	databases     int // number of databases; 0 means defaultDatabases
+	save          saveOptions
+	nagle         bool // leave Nagle's algorithm on for TCP clients (no TCP_NODELAY)
+	cork          bool // cork TCP clients around replies larger than the write buffer (Linux)
+	maxConns      int  // refuse clients beyond this many at once; 0 is unlimited
+
+	// requirePass, if set, must be given to AUTH before other commands run.
+	requirePass string
+
+	// shutdownTimeout is how long shutdown waits for handlers before it
+	// closes the connections that remain.
+	shutdownTimeout time.Duration
+}
+
+const defaultDatabases = 16
+
+type server struct {
+	cfg    config
+	dbs    []*kv // numbered databases; connections start on 0
+	pubsub *pubsub
+
+	// commands maps upper-case command names to their descriptors.
+	commands map[string]*command
+
+	// saveLocks serializes saves to the same file.
+	saveLocks *pathLocks
+
+	// mapped is set when database 0 is served from -mmap-file. Write
+	// commands are then refused.
+	mapped bool
+
+	// tls routes TLS clients to tenants; nil unless -tls-addr is set.
+	tls *tenantRouter
+
+	pause pauseState
+	ready readiness
+
+	// work feeds connections to the handler pool; nil without -workers.
+	work chan func()
+
+	// started is when the server was created, the start of its cumulative
+	// metrics.
+	started time.Time
+
+	// runID identifies this process: 40 random hex digits drawn when the
+	// server is created, so a client that sees it change knows the server
+	// restarted. INFO and HELLO report it.
+	runID string
+
+	// draining is set by shutdown. From then on register refuses new
+	// connections and handlers exit after their current command.
+	// handlers counts the registered connections it waits for.
+	draining atomic.Bool
+	handlers sync.WaitGroup
+
+	mu      sync.Mutex
+	clients map[int64]*client
+	nextID  int64
+
+	// statsReset is when STATS RESET last ran, or zero. It is guarded by
+	// mu.
+	statsReset time.Time
+}
+
+func newServer(cfg config) *server {
+	if cfg.databases <= 0 {
+		cfg.databases = defaultDatabases
+	}
+	dbs := make([]*kv, cfg.databases)
+	mem := new(memUsage)
+	for i := range dbs {
+		dbs[i] = newKV()
+		dbs[i].setMaxBytes(cfg.maxMemory)
+		dbs[i].setCompressAbove(cfg.compressAbove)
+		dbs[i].setMem(mem)
+	}
+	s := &server{
+		cfg:       cfg,
+		dbs:       dbs,
+		pubsub:    newPubsub(),
+		commands:  commandTable(),
+		saveLocks: newPathLocks(),
+		clients:   make(map[int64]*client),
+		started:   time.Now(),
+		runID:     newRunID(),
+	}
+	if cfg.workers > 0 {
+		s.startWorkers(cfg.workers)
+	}
+	return s
+}
+
+// db returns the database selected by cl.
+func (s *server) db(cl *client) *kv {
+	return s.dbs[cl.db]
+}
+
+// save writes store to file. Saves to the same path are serialized; saves
+// to different paths proceed in parallel.
+func (s *server) save(store *kv, file, pass string) error {
+	unlock := s.saveLocks.lock(file)
+	defer unlock()
+	return saveWithOptions(store, file, pass, s.cfg.save)
+}
+
+func (s *server) handle(c net.Conn) {
+	cl, err := s.register(c)
+	if err != nil {
+		if errors.Is(err, errMaxClients) {
+			s.refuse(c, err)
+		}
+		c.Close()
+		return
+	}
+	slog.Debug("client connected", "client", cl.id, "addr", c.RemoteAddr().String())
+	defer slog.Debug("client disconnected", "client", cl.id)
+	defer s.unregister(cl)
+	defer s.pubsub.drop(cl)
+	defer cl.Close()
+	r := bufio.NewReaderSize(c, ioBufferSize)
+	cl.r = r
+	// With -requirepass nothing but AUTH runs until it succeeds.
+	authed := s.cfg.requirePass == ""
+	for {
+		// Replies are flushed only once every command already buffered has
+		// been answered, so a pipelined batch costs few writes.
+		if r.Buffered() == 0 {
+			if err := cl.flush(); err != nil {
+				slog.Debug("write to client failed, closing connection", "client", cl.id, "err", err)
+				return
+			}
+			if s.cfg.idleTimeout > 0 {
+				// Subscribers only listen, so they are never idle. The
+				// deadline is set before draining is checked so that it
+				// cannot replace the one shutdown sets.
+				var deadline time.Time
+				if len(cl.subs)+len(cl.psubs) == 0 {
+					deadline = time.Now().Add(s.cfg.idleTimeout)
+				}
+				cl.SetReadDeadline(deadline)
+			}
+		}
+		if s.draining.Load() {
+			cl.flush()
+			return
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && !s.draining.Load() {
+				slog.Debug("closing idle connection", "client", cl.id, "timeout", s.cfg.idleTimeout)
+			}
+			return
+		}
+		cl.touch()
+		cmd := strings.Fields(strings.TrimSpace(line))
+		afterPayload := cl.afterPayload
+		cl.afterPayload = false
+		var rep reply
+		switch {
+		case len(cmd) == 0:
+			// A blank line is not a command and normally gets no reply.
+			// A strict client counts one reply per line, so it gets
+			// noopReply, except for the newline that may end a SETB
+			// payload.
+			if !cl.strict || afterPayload {
+				continue
+			}
+			rep = noopReply
+		case strings.EqualFold(cmd[0], "AUTH"):
+			var ok bool
+			rep, ok = s.auth(cmd[1:])
+			authed = authed || ok
+		case !authed && !s.beforeAuth(cmd[0]):
+			rep = errReply(errNoAuth.Error())
+		default:
+			rep = s.dispatch(cl, cmd)
+		}
+		if err := cl.send(rep); err != nil {
+			slog.Debug("write to client failed, closing connection", "client", cl.id, "err", err)
+			return
+		}
+		if cl.hangup {
+			cl.flush()
+			return
+		}
+	}
+}
+
+// readPassFile reads a password file, dropping a trailing newline. The
+// caller should zero the result.
+func readPassFile(file string) ([]byte, error) {
+	pass, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(pass, "\r\n"), nil
+}
+
+// loadOnStart loads the startup snapshot. With bestEffort a missing or
+// undecryptable file leaves the store empty and is only logged; degraded
+// reports that.
+func loadOnStart(store *kv, file, passFile string, bestEffort bool) (degraded bool, err error) {
+	pass, err := readPassFile(passFile)
+	if err != nil {
+		return false, fmt.Errorf("read -load-pass-file: %w", err)
+	}
+	defer zero(pass)
+	err = loadFromFile(store, file, string(pass))
+	switch {
+	case err == nil:
+		slog.Info("loaded snapshot", "file", file, "keys", store.len())
+		return false, nil
+	case !bestEffort:
+		return false, fmt.Errorf("load %s: %w", file, err)
+	case errors.Is(err, fs.ErrNotExist):
+		slog.Warn("snapshot not found, starting empty", "file", file)
+	default:
+		slog.Warn("snapshot could not be decrypted or parsed, starting empty", "file", file, "err", err)
+	}
+	return true, nil
+}
+
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
+
+func (f *listFlag) String() string     { return strings.Join(*f, ",") }
+func (f *listFlag) Set(v string) error { *f = append(*f, v); return nil }
+
+// peerCredListener drops unix socket connections whose peer UID is not in
+// allow. The check happens in Accept, before a handler is started.
+type peerCredListener struct {
+	net.Listener
+	allow map[uint32]bool
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if uid, err := peerUID(c); err == nil && l.allow[uid] {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func parseUIDs(s string) (map[uint32]bool, error) {
+	out := make(map[uint32]bool)
+	for _, f := range strings.Split(s, ",") {
+		uid, err := strconv.ParseUint(strings.TrimSpace(f), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q", f)
+		}
+		out[uint32(uid)] = true
+	}
+	return out, nil
+}
+
+func (s *server) serve(ln net.Listener) {
+	var backoff acceptBackoff
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			backoff.failed(ln, err)
+			continue
+		}
+		backoff.ok()
+		s.spawn(func() { s.handle(conn) })
+	}
+}
+
+func main() {
+	addr := flag.String("addr", ":4000", "listen for clients on this TCP address, as host:port")
+	unixSocket := flag.String("unixsocket", "", "also listen on this unix socket path")
+	allowUIDs := flag.String("unix-allow-uids", "", "comma-separated peer UIDs allowed on the unix socket")
+	var cfg config
+	flag.BoolVar(&cfg.crlf, "crlf", false, "terminate replies with CRLF instead of LF")
+	flag.DurationVar(&cfg.idleTimeout, "idle-timeout", 5*time.Minute, "close connections that send no complete command for this long, other than subscribers and blocked readers (0 disables)")
+	flag.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 10*time.Second, "on shutdown, wait this long for connections to finish their commands before closing them")
+	flag.DurationVar(&cfg.maxIdle, "max-idle", 0, "close connections idle for longer than this (0 disables)")
+	flag.StringVar(&cfg.dir, "dir", ".", "directory that server-side file commands are confined to")
+	flag.IntVar(&cfg.maxValueBytes, "max-value-bytes", 0, "reject values larger than this many bytes (0 is unlimited)")
+	flag.BoolVar(&cfg.debug, "debug", false, "enable the DEBUG command")
+	logLevel := flag.String("log-level", "info", "log messages at this level and above: debug, info, warn or error")
+	flag.Int64Var(&cfg.maxMemory, "maxmemory", 0, "per database, evict least recently used keys beyond this many bytes of keys and values (0 is unlimited)")
+	flag.IntVar(&cfg.compressAbove, "compress-above", 0, "keep values longer than this many bytes deflated in memory (0 is off)")
+	rejectCtl := flag.String("reject-control-chars", "off",
+		"reject SET, DEL and BULKSET with control characters other than tab, LF and CR: in keys with \"keys\", in keys and values with \"all\"")
+	flag.StringVar(&cfg.requirePass, "requirepass", "", "require clients to AUTH with this password before running other commands")
+	flag.IntVar(&cfg.maxConns, "maxconns", 0, "refuse clients beyond this many connected at once (0 is unlimited)")
+	flag.IntVar(&cfg.workers, "workers", 0, "serve connections from a fixed pool of this many goroutines, at most that many at once (0 is one goroutine per connection)")
+	flag.IntVar(&cfg.databases, "databases", defaultDatabases, "number of databases")
+	flag.BoolVar(&cfg.save.deterministic, "deterministic-save", false,
+		"INSECURE: derive salt and nonce from the data so identical data encrypts identically")
+	saveKDF := flag.String("save-kdf", "argon2id", "derive keys of new snapshots with \"argon2id\" or \"pbkdf2\"; each file records its own, so older files still load")
+	kdfTime := flag.Int("save-kdf-iterations", 0, "Argon2id passes or PBKDF2 iterations for new snapshots (0 is the default: 3 or 100000)")
+	kdfMemory := flag.Int("save-kdf-memory", 64, "MiB of memory for each Argon2id key derivation")
+	flag.BoolVar(&cfg.save.hashKeys, "save-hash-keys", false,
+		"store HMACs of key names in snapshots; a store loaded from one cannot list its keys")
+	disable := flag.String("disable-commands", "", "comma-separated commands to disable")
+	enableOnly := flag.String("enable-only", "", "comma-separated commands to allow; all others are disabled")
+	var renames listFlag
+	flag.Var(&renames, "rename-command", "rename a command, as FROM=TO; an empty TO removes it (repeatable)")
+	loadFile := flag.String("load-file", "", "snapshot to load at startup")
+	loadPassFile := flag.String("load-pass-file", "", "file holding the password for -load-file")
+	mmapSnap := flag.String("mmap-file", "", "serve database 0 read-only from this snapshot, decrypted to a memory-mapped temp file instead of loaded into memory")
+	mmapPassFile := flag.String("mmap-pass-file", "", "file holding the password for -mmap-file")
+	exitSaveFile := flag.String("save-on-exit", "", "on SIGINT or SIGTERM, save database 0 to this file before exiting")
+	exitSavePassFile := flag.String("save-on-exit-pass-file", "", "file holding the password for -save-on-exit")
+	aofFile := flag.String("aof", "", "log writes to database 0 to this encrypted append-only file, and replay it at startup")
+	aofPassFile := flag.String("aof-pass-file", "", "file holding the password for -aof")
+	loadBestEffort := flag.Bool("load-best-effort", false, "start empty if -load-file is missing or cannot be decrypted")
+	noDelay := flag.Bool("tcp-nodelay", true, "set TCP_NODELAY on client connections, sending small replies without delay")
+	flag.BoolVar(&cfg.cork, "tcp-cork", false, "on Linux, cork client connections while writing replies larger than the write buffer")
+	readyAddr := flag.String("ready-addr", "", "serve an HTTP readiness probe at /ready on this address")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "push metrics to this OpenTelemetry collector over OTLP/HTTP, e.g. http://localhost:4318")
+	otlpInterval := flag.Duration("otlp-interval", 10*time.Second, "how often to push metrics to -otlp-endpoint")
+	tlsCert := flag.String("tls-cert", "", "serve -addr over TLS with this certificate file; needs -tls-key")
+	tlsKey := flag.String("tls-key", "", "private key file for -tls-cert")
+	tlsAddr := flag.String("tls-addr", "", "also listen for TLS on this address, routing clients by SNI to -tls-tenant databases")
+	var allowCIDRs listFlag
+	flag.Var(&allowCIDRs, "allow-cidr", "accept TCP and TLS clients only from this IP range, e.g. 10.0.0.0/8 (repeatable; default allows all)")
+	var tenantSpecs listFlag
+	flag.Var(&tenantSpecs, "tls-tenant", "serve an SNI host on -tls-addr, as host=db,certfile,keyfile (repeatable)")
+	flag.Parse()
+	if err := flagsFromEnv(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetLogLoggerLevel(level)
+	cfg.nagle = !*noDelay
+	kdf, err := parseKDF(*saveKDF, *kdfTime, *kdfMemory)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cfg.save.kdf = kdf
+	rc, err := parseRejectControl(*rejectCtl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cfg.rejectControl = rc
+	if _, _, err := net.SplitHostPort(*addr); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -addr %q: %v\n", *addr, err)
+		os.Exit(2)
+	}
+	if cfg.maxConns < 0 {
+		fmt.Fprintln(os.Stderr, "-maxconns must not be negative")
+		os.Exit(2)
+	}
+	if cfg.shutdownTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "-shutdown-timeout must not be negative")
+		os.Exit(2)
+	}
+	tlsConfig, err := serverTLS(*tlsCert, *tlsKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.cork && !corkSupported {
+		slog.Warn("-tcp-cork is not supported on this platform; ignoring it")
+	}
+	srv := newServer(cfg)
+	if *readyAddr != "" {
+		go srv.serveReady(*readyAddr)
+	}
+	if *loadFile != "" {
+		end := srv.ready.beginLoad()
+		degraded, err := loadOnStart(srv.dbs[0], *loadFile, *loadPassFile, *loadBestEffort)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if degraded {
+			srv.ready.degrade()
+		}
+		end(!degraded)
+	}
+	if (*mmapSnap == "") != (*mmapPassFile == "") {
+		fmt.Fprintln(os.Stderr, "-mmap-file and -mmap-pass-file must be given together")
+		os.Exit(2)
+	}
+	if *mmapSnap != "" {
+		if *loadFile != "" {
+			fmt.Fprintln(os.Stderr, "-mmap-file and -load-file cannot be used together")
+			os.Exit(2)
+		}
+		if !mmapSupported {
+			fmt.Fprintln(os.Stderr, "-mmap-file is not supported on this platform")
+			os.Exit(2)
+		}
+		end := srv.ready.beginLoad()
+		if err := srv.mapSnapshot(*mmapSnap, *mmapPassFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		end(true)
+	}
+	if (*aofFile == "") != (*aofPassFile == "") {
+		fmt.Fprintln(os.Stderr, "-aof and -aof-pass-file must be given together")
+		os.Exit(2)
+	}
+	if *aofFile != "" {
+		if *mmapSnap != "" {
+			fmt.Fprintln(os.Stderr, "-aof and -mmap-file cannot be used together")
+			os.Exit(2)
+		}
+		end := srv.ready.beginLoad()
+		replayed, err := srv.openAOF(*aofFile, *aofPassFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		end(replayed)
+	}
+	if err := srv.restrictCommands(splitList(*disable), splitList(*enableOnly)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := srv.renameCommands(renames); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.maxIdle > 0 {
+		go srv.sweepIdle(cfg.maxIdle)
+	}
+	go srv.sweepExpired(expireSweepInterval)
+	if *otlpEndpoint != "" {
+		u, err := otlpURL(*otlpEndpoint)
+		if err == nil && *otlpInterval <= 0 {
+			err = fmt.Errorf("-otlp-interval must be positive")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		go srv.exportOTLP(u, *otlpInterval)
+	}
+	allow, err := parseCIDRs(allowCIDRs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// restrict applies -allow-cidr to a TCP listener.
+	restrict := func(l net.Listener) net.Listener {
+		if len(allow) == 0 {
+			return l
+		}
+		return &cidrListener{Listener: l, allow: allow}
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ln = restrict(ln)
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	lns := []net.Listener{ln}
+	if (*exitSaveFile == "") != (*exitSavePassFile == "") {
+		fmt.Fprintln(os.Stderr, "-save-on-exit and -save-on-exit-pass-file must be given together")
+		os.Exit(2)
+	}
+	if *allowUIDs != "" && *unixSocket == "" {
+		fmt.Fprintln(os.Stderr, "-unix-allow-uids requires -unixsocket")
+		os.Exit(2)
+	}
+	if *unixSocket != "" {
+		// Every check that can refuse to start comes before the socket
+		// file is created, so a bad flag does not leave one behind.
+		var uids map[uint32]bool
+		if *allowUIDs != "" {
+			var err error
+			if uids, err = parseUIDs(*allowUIDs); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			if !peerCredSupported {
+				fmt.Fprintln(os.Stderr, "-unix-allow-uids is not supported on this platform")
+				os.Exit(2)
+			}
+		}
+		ul, err := listenUnix(*unixSocket)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if uids != nil {
+			ul = &peerCredListener{Listener: ul, allow: uids}
+		}
+		lns = append(lns, ul)
+		go srv.serve(ul)
+	}
+	if (*tlsAddr == "") != (len(tenantSpecs) == 0) {
+		fmt.Fprintln(os.Stderr, "-tls-addr and -tls-tenant must be given together")
+		os.Exit(2)
+	}
+	if *tlsAddr != "" {
+		var tenants []tlsTenant
+		for _, spec := range tenantSpecs {
+			t, err := parseTenant(spec, len(srv.dbs))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			tenants = append(tenants, t)
+		}
+		rt, err := newTenantRouter(tenants)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		tl, err := net.Listen("tcp", *tlsAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		srv.tls = rt
+		tl = restrict(tl)
+		lns = append(lns, tl)
+		go srv.serveTLS(tl, rt)
+	}
+	go srv.serve(ln)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	slog.Info("shutting down", "signal", sig)
+	if err := srv.stop(lns, *exitSaveFile, *exitSavePassFile); err != nil {
+		fmt.Fprintln(os.Stderr, "save on exit:", err)
+		os.Exit(1)
+	}
+}
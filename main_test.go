@@ -1,71 +1,489 @@
-package main
-
-import (
-	"os"
-	"path/filepath"
-	"testing"
-)
-
-func TestSetGetDel(t *testing.T) {
-	s := newKV()
-	s.set("a", "1")
-	if v, ok := s.get("a"); !ok || v != "1" {
-		t.Fatal("get failed")
-	}
-	if !s.del("a") {
-		t.Fatal("del failed")
-	}
-	if _, ok := s.get("a"); ok {
-		t.Fatal("key should be gone")
-	}
-}
-
-func TestSaveLoad(t *testing.T) {
-	dir := t.TempDir()
-	file := filepath.Join(dir, "db.bin")
-	pass := "secret"
-	s1 := newKV()
-	s1.set("x", "42")
-	if err := saveToFile(s1, file, pass); err != nil {
-		t.Fatalf("save: %v", err)
-	}
-	s2 := newKV()
-	if err := loadFromFile(s2, file, pass); err != nil {
-		t.Fatalf("load: %v", err)
-	}
-	if v, ok := s2.get("x"); !ok || v != "42" {
-		t.Fatal("data mismatch after load")
-	}
-}
-
-func TestLoadWrongPassword(t *testing.T) {
-	dir := t.TempDir()
-	file := filepath.Join(dir, "db.bin")
-	s := newKV()
-	s.set("k", "v")
-	if err := saveToFile(s, file, "good"); err != nil {
-		t.Fatalf("save: %v", err)
-	}
-	if err := loadFromFile(newKV(), file, "bad"); err == nil {
-		t.Fatal("expected auth error")
-	}
-}
-
-func TestLoadInvalidFile(t *testing.T) {
-	dir := t.TempDir()
-	file := filepath.Join(dir, "bad.bin")
-	if err := os.WriteFile(file, []byte("short"), 0600); err != nil {
-		t.Fatalf("write: %v", err)
-	}
-	if err := loadFromFile(newKV(), file, "123"); err == nil {
-		t.Fatal("should fail on malformed file")
-	}
-}
-
-func TestSaveToDirPath(t *testing.T) {
-	dir := t.TempDir()
-	pass := "pwd"
-	if err := saveToFile(newKV(), dir, pass); err == nil {
-		t.Fatal("saving into directory must fail")
-	}
-}
\ No newline at end of file
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Tests save many snapshots; the real Argon2id cost would dominate
+	// the run, especially under -race. TestSaveKDF covers the KDFs.
+	defaultKDF = kdfParams{id: kdfArgon2id, time: 1, memory: 64, threads: 1}
+	os.Exit(m.Run())
+}
+
+// connect runs a handler for srv on one end of an in-memory pipe and
+// returns the other end.
+func connect(t *testing.T, srv *server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, sc := net.Pipe()
+	go srv.handle(sc)
+	t.Cleanup(func() { c.Close() })
+	return c, bufio.NewReader(c)
+}
+
+// roundTrip sends one request line and returns the raw reply line.
+func roundTrip(t *testing.T, c net.Conn, r *bufio.Reader, req string) string {
+	t.Helper()
+	if _, err := c.Write([]byte(req + "\n")); err != nil {
+		t.Fatalf("write %q: %v", req, err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read reply to %q: %v", req, err)
+	}
+	return line
+}
+
+func TestSetGetDel(t *testing.T) {
+	s := newKV()
+	s.set("a", "1")
+	if v, ok := s.get("a"); !ok || v != "1" {
+		t.Fatal("get failed")
+	}
+	if !s.del("a") {
+		t.Fatal("del failed")
+	}
+	if _, ok := s.get("a"); ok {
+		t.Fatal("key should be gone")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "db.bin")
+	pass := "secret"
+	s1 := newKV()
+	s1.set("x", "42")
+	if err := saveToFile(s1, file, pass); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	s2 := newKV()
+	if err := loadFromFile(s2, file, pass); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if v, ok := s2.get("x"); !ok || v != "42" {
+		t.Fatal("data mismatch after load")
+	}
+}
+
+func TestLoadWrongPassword(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "db.bin")
+	s := newKV()
+	s.set("k", "v")
+	if err := saveToFile(s, file, "good"); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := loadFromFile(newKV(), file, "bad"); err == nil {
+		t.Fatal("expected auth error")
+	}
+}
+
+func TestLoadInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bad.bin")
+	if err := os.WriteFile(file, []byte("short"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := loadFromFile(newKV(), file, "123"); err == nil {
+		t.Fatal("should fail on malformed file")
+	}
+}
+
+func TestSaveToDirPath(t *testing.T) {
+	dir := t.TempDir()
+	pass := "pwd"
+	if err := saveToFile(newKV(), dir, pass); err == nil {
+		t.Fatal("saving into directory must fail")
+	}
+	if left, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), ".*.tmp-*")); len(left) != 0 {
+		t.Fatalf("failed save left temporary files: %v", left)
+	}
+}
+
+func TestSaveReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "db.bin")
+	s := newKV()
+	s.set("k", "old")
+	if err := saveToFile(s, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	s.set("k", "new")
+	if err := saveToFile(s, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "db.bin" {
+		t.Fatalf("directory holds %v, want only db.bin", entries)
+	}
+	if fi, _ := entries[0].Info(); fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+	loaded := newKV()
+	if err := loadFromFile(loaded, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := loaded.get("k"); v != "new" {
+		t.Errorf("k = %q after the second save", v)
+	}
+}
+
+func TestCRLFReplies(t *testing.T) {
+	c, r := connect(t, newServer(config{crlf: true}))
+	if got := roundTrip(t, c, r, "SET k v"); got != "OK\r\n" {
+		t.Fatalf("SET reply = %q", got)
+	}
+	if got := roundTrip(t, c, r, "GET k\r"); got != "v\r\n" {
+		t.Fatalf("GET reply = %q", got)
+	}
+	c2, r2 := connect(t, newServer(config{}))
+	if got := roundTrip(t, c2, r2, "GET k"); got != "NIL\n" {
+		t.Fatalf("default reply = %q", got)
+	}
+}
+
+func TestClientListAndIdleSweep(t *testing.T) {
+	srv := newServer(config{})
+	c, r := connect(t, srv)
+	if got := roundTrip(t, c, r, "CLIENT LIST"); got != "1\n" {
+		t.Fatalf("CLIENT LIST count = %q", got)
+	}
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "id=1 ") {
+		t.Fatalf("CLIENT LIST entry = %q", line)
+	}
+	if n := srv.closeIdle(time.Minute, time.Now()); n != 0 {
+		t.Fatalf("closed %d active connections", n)
+	}
+	if n := srv.closeIdle(time.Minute, time.Now().Add(2*time.Minute)); n != 1 {
+		t.Fatalf("closed %d idle connections, want 1", n)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("idle connection still open")
+	}
+}
+
+func TestIdleSweepSkipsSubscribers(t *testing.T) {
+	srv := newServer(config{})
+	sub, sr := connect(t, srv)
+	roundTrip(t, sub, sr, "SUBSCRIBE ch")
+	psub, pr := connect(t, srv)
+	roundTrip(t, psub, pr, "PSUBSCRIBE ev.*")
+	if n := srv.closeIdle(time.Minute, time.Now().Add(time.Hour)); n != 0 {
+		t.Fatalf("idle sweep closed %d subscribers", n)
+	}
+	if got := roundTrip(t, sub, sr, "UNSUBSCRIBE"); got != "unsubscribe ch 0\n" {
+		t.Fatalf("UNSUBSCRIBE = %q", got)
+	}
+	if n := srv.closeIdle(time.Minute, time.Now().Add(time.Hour)); n != 1 {
+		t.Fatalf("closed %d connections after UNSUBSCRIBE, want 1", n)
+	}
+	if _, err := sr.ReadString('\n'); err == nil {
+		t.Fatal("unsubscribed idle connection still open")
+	}
+	if got := roundTrip(t, psub, pr, "PING"); got != "PONG\n" {
+		t.Fatalf("pattern subscriber after the sweep = %q", got)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	srv := newServer(config{maxConns: 1})
+	c, r := connect(t, srv)
+	roundTrip(t, c, r, "PING")
+	c2, r2 := connect(t, srv)
+	if got, _ := r2.ReadString('\n'); got != "ERR max number of clients reached\n" {
+		t.Errorf("connection over -maxconns got %q", got)
+	}
+	if _, err := r2.ReadString('\n'); err == nil {
+		t.Error("connection over -maxconns still open")
+	}
+	c2.Close()
+	c.Close()
+	waitFor(t, "the first client to leave", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.clients) == 0
+	})
+	c3, r3 := connect(t, srv)
+	if got := roundTrip(t, c3, r3, "PING"); got != "PONG\n" {
+		t.Errorf("PING after a slot freed = %q", got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := newServer(config{idleTimeout: 50 * time.Millisecond})
+
+	// A partial line does not count as activity.
+	c, r := connect(t, srv)
+	c.Write([]byte("GET"))
+	start := time.Now()
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("connection with a partial line still open")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("idle connection closed after %v", took)
+	}
+
+	active, ar := connect(t, srv)
+	sub, sr := connect(t, srv)
+	roundTrip(t, sub, sr, "SUBSCRIBE ch")
+	blocked, br := connect(t, srv)
+	blocked.Write([]byte("XREAD BLOCK 200 STREAMS s $\n"))
+	for i := 0; i < 6; i++ {
+		time.Sleep(25 * time.Millisecond)
+		if got := roundTrip(t, active, ar, "PING"); got != "PONG\n" {
+			t.Fatalf("PING %d = %q", i, got)
+		}
+	}
+	if got, err := br.ReadString('\n'); got != "NIL\n" {
+		t.Errorf("XREAD BLOCK past the idle timeout = %q, %v", got, err)
+	}
+	msg := make(chan string, 1)
+	go func() {
+		line, _ := sr.ReadString('\n')
+		msg <- line
+	}()
+	if got := roundTrip(t, active, ar, "PUBLISH ch hi"); got != "1\n" {
+		t.Errorf("PUBLISH to a subscriber past the idle timeout = %q", got)
+	}
+	if got := <-msg; !strings.Contains(got, "hi") {
+		t.Errorf("subscriber got %q", got)
+	}
+}
+
+func TestClientInfo(t *testing.T) {
+	c, r := connect(t, newServer(config{}))
+	roundTrip(t, c, r, "SET a 1")
+	roundTrip(t, c, r, "GET a")
+	if got := roundTrip(t, c, r, "CLIENT SETNAME loader"); got != "OK\n" {
+		t.Fatalf("CLIENT SETNAME = %q", got)
+	}
+	got := roundTrip(t, c, r, "CLIENT INFO")
+	// CLIENT INFO itself is not counted until it has run.
+	if !strings.HasPrefix(got, "id=1 name=loader addr=pipe db=0 commands=3 cmd-time=") {
+		t.Fatalf("CLIENT INFO = %q", got)
+	}
+	if !strings.Contains(roundTrip(t, c, r, "CLIENT INFO"), " commands=4 ") {
+		t.Error("CLIENT INFO did not count the previous CLIENT INFO")
+	}
+	if got := roundTrip(t, c, r, "CLIENT SETNAME"); got != "ERR wrong number of arguments for 'client setname'\n" {
+		t.Errorf("CLIENT SETNAME without a name = %q", got)
+	}
+}
+
+func TestPatternSubscribe(t *testing.T) {
+	srv := newServer(config{})
+	sub, sr := connect(t, srv)
+	if got := roundTrip(t, sub, sr, "PSUBSCRIBE events.*"); got != "psubscribe events.* 1\n" {
+		t.Fatalf("PSUBSCRIBE reply = %q", got)
+	}
+	pub, pr := connect(t, srv)
+	done := make(chan string)
+	go func() {
+		line, _ := sr.ReadString('\n')
+		done <- line
+	}()
+	if got := roundTrip(t, pub, pr, "PUBLISH events.login alice logged in"); got != "1\n" {
+		t.Fatalf("PUBLISH reply = %q", got)
+	}
+	if got := <-done; got != "pmessage events.* events.login alice logged in\n" {
+		t.Fatalf("delivered %q", got)
+	}
+	if got := roundTrip(t, pub, pr, "PUBLISH other x"); got != "0\n" {
+		t.Fatalf("PUBLISH to unmatched channel = %q", got)
+	}
+	sub.Close()
+	for {
+		srv.pubsub.mu.RLock()
+		n := len(srv.pubsub.patterns)
+		srv.pubsub.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoadOnStart(t *testing.T) {
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "pass")
+	if err := os.WriteFile(passFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "db.bin")
+	src := newKV()
+	src.set("a", "1")
+	if err := saveToFile(src, file, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	s := newKV()
+	if _, err := loadOnStart(s, file, passFile, false); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if v, _ := s.get("a"); v != "1" {
+		t.Fatalf("loaded %q", v)
+	}
+
+	missing := filepath.Join(dir, "missing.bin")
+	if _, err := loadOnStart(newKV(), missing, passFile, false); err == nil {
+		t.Fatal("missing file must fail without best effort")
+	}
+	if degraded, err := loadOnStart(newKV(), missing, passFile, true); err != nil || !degraded {
+		t.Fatalf("best effort on missing file: %v, degraded %v", err, degraded)
+	}
+	if err := os.WriteFile(passFile, []byte("wrong"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOnStart(newKV(), file, passFile, false); err == nil {
+		t.Fatal("wrong password must fail without best effort")
+	}
+	s = newKV()
+	if degraded, err := loadOnStart(s, file, passFile, true); err != nil || !degraded || s.len() != 0 {
+		t.Fatalf("best effort on bad password: %v, degraded %v, %d keys", err, degraded, s.len())
+	}
+}
+
+func TestDeterministicSave(t *testing.T) {
+	dir := t.TempDir()
+	s := newKV()
+	s.set("a", "1")
+	s.set("b", "2")
+	read := func(name string, opts saveOptions) []byte {
+		file := filepath.Join(dir, name)
+		if err := saveWithOptions(s, file, "pw", opts); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	det := saveOptions{deterministic: true}
+	if !bytes.Equal(read("d1", det), read("d2", det)) {
+		t.Fatal("deterministic saves differ")
+	}
+	if bytes.Equal(read("r1", saveOptions{}), read("r2", saveOptions{})) {
+		t.Fatal("random saves are identical")
+	}
+	loaded := newKV()
+	if err := loadFromFile(loaded, filepath.Join(dir, "d1"), "pw"); err != nil {
+		t.Fatalf("load deterministic save: %v", err)
+	}
+	if v, _ := loaded.get("b"); v != "2" {
+		t.Fatalf("loaded %q", v)
+	}
+}
+
+func TestSaveKDF(t *testing.T) {
+	dir := t.TempDir()
+	s := newKV()
+	s.set("a", "1")
+	for _, kdf := range []kdfParams{
+		{id: kdfArgon2id, time: 1, memory: 64, threads: 2},
+		{id: kdfPBKDF2, time: 1000},
+	} {
+		file := filepath.Join(dir, "db")
+		if err := saveWithOptions(s, file, "pw", saveOptions{kdf: kdf}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[:fileHeaderLen], kdf.header()) {
+			t.Fatalf("header = %x", data[:fileHeaderLen])
+		}
+		loaded := newKV()
+		if err := loadFromFile(loaded, file, "pw"); err != nil {
+			t.Fatalf("load with %+v: %v", kdf, err)
+		}
+		if v, _ := loaded.get("a"); v != "1" {
+			t.Fatalf("loaded %q", v)
+		}
+
+		// The header is authenticated: a lowered work factor fails to
+		// decrypt.
+		weaker := kdf
+		weaker.time--
+		if weaker.time == 0 {
+			weaker.memory /= 2
+		}
+		tampered := append(weaker.header(), data[fileHeaderLen:]...)
+		if err := os.WriteFile(file, tampered, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadFromFile(newKV(), file, "pw"); err == nil {
+			t.Fatalf("loaded a file with the KDF changed to %+v", weaker)
+		}
+	}
+
+	file := filepath.Join(dir, "db")
+	for _, bad := range [][]byte{
+		append([]byte(fileMagic), fileFormat+1, 0, 0, 0, 1),
+		append([]byte(fileMagic), fileFormat, 9, 0, 0, 0, 1, 0, 0, 0, 0, 0),
+		(kdfParams{id: kdfArgon2id, time: 1, memory: maxArgon2Memory + 1, threads: 1}).header(),
+	} {
+		if err := os.WriteFile(file, append(bad, make([]byte, 64)...), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadFromFile(newKV(), file, "pw"); err == nil {
+			t.Errorf("loaded a file with header %x", bad)
+		}
+	}
+}
+
+// sealFile writes a file as saves did before format 2: optional header,
+// salt, nonce and ciphertext of pt keyed with kdf and authenticating the
+// header.
+func sealFile(t *testing.T, file string, header []byte, kdf kdfParams, pt string) {
+	t.Helper()
+	salt := make([]byte, 16)
+	nonce := make([]byte, 12)
+	c, err := aes.NewCipher(kdf.derive([]byte("pw"), salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := cipher.NewGCM(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := g.Seal(nil, nonce, []byte(pt), header)
+	data := append(append(append(header, salt...), nonce...), ct...)
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadOlderFormats(t *testing.T) {
+	dir := t.TempDir()
+	v1 := append([]byte(fileMagic), fileFormatPBKDF2, 0, 0, 0x03, 0xe8) // 1000 iterations
+	for name, seal := range map[string]func(file string){
+		// No header at all, keyed with legacyKDF.
+		"legacy": func(file string) { sealFile(t, file, nil, legacyKDF, `{"a":"1"}`) },
+		// Format 1: a PBKDF2 iteration count.
+		"v1": func(file string) { sealFile(t, file, v1, kdfParams{id: kdfPBKDF2, time: 1000}, `{"a":"1"}`) },
+	} {
+		file := filepath.Join(dir, name)
+		seal(file)
+		loaded := newKV()
+		if err := loadFromFile(loaded, file, "pw"); err != nil {
+			t.Fatalf("load %s file: %v", name, err)
+		}
+		if v, _ := loaded.get("a"); v != "1" {
+			t.Fatalf("loaded %q from %s file", v, name)
+		}
+	}
+}
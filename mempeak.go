@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// memUsage is the logical size of a server's data set, every database
+// included, and the most it has been. Shards add each change to their own
+// size to used as they make it, so the peak is of the whole data set at
+// one moment.
+type memUsage struct {
+	used atomic.Int64
+	peak atomic.Int64
+}
+
+// notePeak raises peak to used if used has grown past it.
+func (m *memUsage) notePeak() {
+	for {
+		peak, used := m.peak.Load(), m.used.Load()
+		if used <= peak || m.peak.CompareAndSwap(peak, used) {
+			return
+		}
+	}
+}
+
+// addUsed changes the shard's logical size, and the store-wide one, by n.
+// k.mu must be held.
+func (k *kvShard) addUsed(n int64) {
+	k.used += n
+	k.mem.used.Add(n)
+}
+
+// notePeakLocked raises the store-wide peak to the current size. Every
+// write that adds to used calls it once the write, and any eviction it
+// caused, is done. k.mu must be held.
+func (k *kvShard) notePeakLocked() {
+	k.mem.notePeak()
+}
+
+// setMem makes the store count its size in m, which it shares with the
+// other databases of a server. It is meant to be called before the store
+// is used.
+func (k *kv) setMem(m *memUsage) {
+	m.used.Add(k.mem.used.Load())
+	k.mem = m
+	for _, sh := range k.shards {
+		sh.mem = m
+	}
+	m.notePeak()
+}
+
+// peakBytes reports the high-water mark of the logical size of the
+// server's databases together.
+func (s *server) peakBytes() int64 {
+	return s.dbs[0].mem.peak.Load()
+}
+
+// cmdMemPeak handles MEMPEAK and MEMPEAK RESET. MEMPEAK replies with the
+// most logical memory, in the bytes INFO reports as used_logical, held
+// since startup or the last MEMPEAK RESET. MEMPEAK RESET restarts the mark
+// from the current usage.
+func cmdMemPeak(s *server, cl *client, args []string) reply {
+	if len(args) == 0 {
+		return intReply(s.peakBytes())
+	}
+	if !strings.EqualFold(args[0], "RESET") {
+		return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+	}
+	mem := s.dbs[0].mem
+	mem.peak.Store(mem.used.Load())
+	return okReply
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemPeak(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	peak := func() int64 {
+		t.Helper()
+		got := srv.dispatch(cl, []string{"MEMPEAK"})
+		if got.kind != kindValue {
+			t.Fatalf("MEMPEAK = %+v", got)
+		}
+		n, _ := strconv.ParseInt(got.text, 10, 64)
+		return n
+	}
+
+	srv.dispatch(cl, []string{"SET", "a", strings.Repeat("x", 100)})
+	srv.dispatch(cl, []string{"XADD", "s", "*", "f", "v"})
+	srv.dispatch(&client{db: 1}, []string{"SET", "b", "1"})
+	high, _ := srv.dbs[0].memory()
+	high += 2 // b in database 1
+	srv.dispatch(cl, []string{"DEL", "a"})
+	if got := peak(); got != high {
+		t.Errorf("MEMPEAK after DEL = %d, want %d", got, high)
+	}
+
+	if got := srv.dispatch(cl, []string{"MEMPEAK", "RESET"}); got.kind != kindOK {
+		t.Fatalf("MEMPEAK RESET = %+v", got)
+	}
+	used, _ := srv.dbs[0].memory()
+	if got := peak(); got != used+2 {
+		t.Errorf("MEMPEAK after RESET = %d, want the current %d", got, used+2)
+	}
+	srv.dispatch(cl, []string{"INCR", "n"})
+	srv.dispatch(cl, []string{"SETRANGE", "b2", "10", "tail"})
+	if now, _ := srv.dbs[0].memory(); peak() != now+2 {
+		t.Errorf("MEMPEAK = %d after growth, want %d", peak(), now+2)
+	}
+	if got := srv.dispatch(cl, []string{"MEMPEAK", "nope"}); got.kind != kindErr {
+		t.Errorf("MEMPEAK nope = %+v", got)
+	}
+}
+
+// TestMemPeakIsOneMoment checks that MEMPEAK is the most the data set held
+// at once, not a sum of marks shards and databases reached at different
+// times.
+func TestMemPeakIsOneMoment(t *testing.T) {
+	srv := newServer(config{})
+	val := strings.Repeat("x", 100)
+	write := func(db int, prefix string) {
+		cl := &client{db: db}
+		for i := range 100 {
+			srv.dispatch(cl, []string{"SET", prefix + strconv.Itoa(i), val})
+		}
+	}
+	drop := func(db int, prefix string) {
+		cl := &client{db: db}
+		for i := range 100 {
+			srv.dispatch(cl, []string{"DEL", prefix + strconv.Itoa(i)})
+		}
+	}
+	write(0, "a")
+	want, _ := srv.dbs[0].memory()
+	drop(0, "a")
+	write(0, "b")
+	drop(0, "b")
+	write(1, "c")
+	drop(1, "c")
+	if got := srv.peakBytes(); got != want {
+		t.Errorf("MEMPEAK = %d after three batches of %d bytes, one at a time", got, want)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -mmap-file the server does not load a snapshot into the map.
+// Instead it decrypts the snapshot once into an image file in the temp
+// directory, maps that file into memory and serves database 0 from it, so
+// the values live in the page cache rather than on the heap. The image is
+// unlinked as soon as it is mapped. Every write command is refused.
+//
+// An image is mmapMagic, the number of keys as a big-endian uint64 and
+// one index record per key, sorted by key name, followed by the keys and
+// values. A record is the offset of its key, the key and value lengths as
+// big-endian uint32s and the expiry as Unix milliseconds (0 for none);
+// the value follows its key.
+const (
+	mmapMagic     = "BoSm"
+	mmapHeaderLen = len(mmapMagic) + 8
+	mmapRecordLen = 8 + 4 + 4 + 8
+)
+
+var errReadOnly = errors.New("READONLY the data set is a read-only memory-mapped snapshot")
+
+// mappedFile is a mapped image. data is read-only: writing to it faults.
+type mappedFile struct {
+	data []byte
+	n    int
+}
+
+// writeImage writes d's strings and counters as an image. Streams and geo
+// sets cannot be served from one; HyperLogLogs read back as their
+// registers, as plain strings.
+func writeImage(f *os.File, d *dump) error {
+	if len(d.Streams) > 0 || len(d.Geo) > 0 {
+		return errors.New("snapshot holds streams or geo sets, which cannot be memory-mapped")
+	}
+	type entry struct {
+		key, val string
+		expiry   int64
+	}
+	nowMs := time.Now().UnixMilli()
+	entries := make([]entry, 0, d.len())
+	add := func(key, val string) error {
+		if len(key) > 1<<32-1 || len(val) > 1<<32-1 {
+			return fmt.Errorf("key %q is too large to map", key)
+		}
+		ms := d.Expiry[key]
+		if ms == 0 || ms > nowMs {
+			entries = append(entries, entry{key, val, ms})
+		}
+		return nil
+	}
+	for key, val := range d.Data {
+		if err := add(key, val); err != nil {
+			return err
+		}
+	}
+	for key, n := range d.Counters {
+		if err := add(key, strconv.FormatInt(n, 10)); err != nil {
+			return err
+		}
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return strings.Compare(a.key, b.key)
+	})
+	w := bufio.NewWriter(f)
+	w.WriteString(mmapMagic)
+	var rec [mmapRecordLen]byte
+	binary.BigEndian.PutUint64(rec[:8], uint64(len(entries)))
+	w.Write(rec[:8])
+	off := uint64(mmapHeaderLen + len(entries)*mmapRecordLen)
+	for _, e := range entries {
+		binary.BigEndian.PutUint64(rec[0:], off)
+		binary.BigEndian.PutUint32(rec[8:], uint32(len(e.key)))
+		binary.BigEndian.PutUint32(rec[12:], uint32(len(e.val)))
+		binary.BigEndian.PutUint64(rec[16:], uint64(e.expiry))
+		w.Write(rec[:])
+		off += uint64(len(e.key) + len(e.val))
+	}
+	for _, e := range entries {
+		w.WriteString(e.key)
+		w.WriteString(e.val)
+	}
+	return w.Flush()
+}
+
+// parseImage checks that data is a well-formed image.
+func parseImage(data []byte) (*mappedFile, error) {
+	if len(data) < mmapHeaderLen || !bytes.HasPrefix(data, []byte(mmapMagic)) {
+		return nil, errors.New("not a BoS image")
+	}
+	n := binary.BigEndian.Uint64(data[len(mmapMagic):])
+	if n > uint64(len(data)-mmapHeaderLen)/mmapRecordLen {
+		return nil, errors.New("truncated image index")
+	}
+	m := &mappedFile{data: data, n: int(n)}
+	for i := range m.n {
+		off, klen, vlen, _ := m.record(i)
+		if off > uint64(len(data)) || uint64(klen)+uint64(vlen) > uint64(len(data))-off {
+			return nil, fmt.Errorf("image record %d is out of bounds", i)
+		}
+		if i > 0 && bytes.Compare(m.keyAt(i-1), m.keyAt(i)) >= 0 {
+			return nil, errors.New("image index is not sorted")
+		}
+	}
+	return m, nil
+}
+
+func (m *mappedFile) record(i int) (off uint64, klen, vlen uint32, expiry int64) {
+	r := m.data[mmapHeaderLen+i*mmapRecordLen:]
+	return binary.BigEndian.Uint64(r), binary.BigEndian.Uint32(r[8:]),
+		binary.BigEndian.Uint32(r[12:]), int64(binary.BigEndian.Uint64(r[16:]))
+}
+
+func (m *mappedFile) keyAt(i int) []byte {
+	off, klen, _, _ := m.record(i)
+	return m.data[off : off+uint64(klen)]
+}
+
+// live reports whether the key at i has not expired.
+func (m *mappedFile) live(i int, now time.Time) bool {
+	_, _, _, expiry := m.record(i)
+	return expiry == 0 || now.UnixMilli() < expiry
+}
+
+// lookup returns the value mapped for key, which aliases the mapping.
+func (m *mappedFile) lookup(key string) ([]byte, bool) {
+	k := []byte(key)
+	i := sort.Search(m.n, func(i int) bool { return bytes.Compare(m.keyAt(i), k) >= 0 })
+	if i == m.n || !bytes.Equal(m.keyAt(i), k) || !m.live(i, time.Now()) {
+		return nil, false
+	}
+	off, klen, vlen, _ := m.record(i)
+	start := off + uint64(klen)
+	end := start + uint64(vlen)
+	return m.data[start:end:end], true
+}
+
+// each calls fn with every key that has not expired, its value and its
+// expiry, until fn returns false.
+func (m *mappedFile) each(fn func(key string, val []byte, expiry int64) bool) {
+	now := time.Now()
+	for i := range m.n {
+		if !m.live(i, now) {
+			continue
+		}
+		off, klen, vlen, expiry := m.record(i)
+		start := off + uint64(klen)
+		if !fn(string(m.data[off:start]), m.data[start:start+uint64(vlen)], expiry) {
+			return
+		}
+	}
+}
+
+// mapSaveFile decrypts a save file into an image and maps it. It also
+// returns the key-name HMAC key if the snapshot's names are hashed.
+func mapSaveFile(file, pass string) (*mappedFile, []byte, error) {
+	d, err := readSnapshot(file, pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.CreateTemp("", "bos-image-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	// The name is only needed until the file is mapped.
+	defer os.Remove(f.Name())
+	if err := writeImage(f, d); err != nil {
+		return nil, nil, err
+	}
+	data, err := mmapFile(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := parseImage(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, d.mac, nil
+}
+
+// mapSnapshot serves database 0 from the snapshot in file, whose password
+// is in passFile, and makes the server read-only.
+func (s *server) mapSnapshot(file, passFile string) error {
+	pass, err := readPassFile(passFile)
+	if err != nil {
+		return fmt.Errorf("read -mmap-pass-file: %w", err)
+	}
+	defer zero(pass)
+	m, mac, err := mapSaveFile(file, string(pass))
+	if err != nil {
+		return fmt.Errorf("map %s: %w", file, err)
+	}
+	s.dbs[0].attachMapped(m, mac)
+	s.mapped = true
+	slog.Info("mapped snapshot", "file", file, "keys", m.n)
+	return nil
+}
+
+// attachMapped serves the store from m, whose key names are hashed with
+// mac unless it is nil. The store must be empty; it is kept in one shard.
+func (k *kv) attachMapped(m *mappedFile, mac []byte) {
+	k.unshard()
+	sh := k.shards[0]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.mapped = m
+	k.mac.Store(&mac)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMappedSnapshot(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap not supported")
+	}
+	dir := t.TempDir()
+	file, passFile := filepath.Join(dir, "db"), filepath.Join(dir, "pass")
+	if err := os.WriteFile(passFile, []byte("pw\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src := newKV()
+	src.set("a", "1")
+	src.set("b", "")
+	src.set("gone", "x")
+	src.set("later", "y")
+	src.nextID("n")
+	src.expire("gone", time.Millisecond)
+	src.expire("later", time.Hour)
+	time.Sleep(2 * time.Millisecond)
+	if err := saveToFile(src, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newServer(config{})
+	if err := srv.mapSnapshot(file, passFile); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.dbs[0].shards) != 1 || len(srv.dbs[0].shards[0].data) != 0 {
+		t.Error("mapped values were loaded into the map")
+	}
+	cl := &client{}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "a"}, "1"},
+		{[]string{"GET", "n"}, "1"},
+		{[]string{"EXISTS", "b"}, "1"},
+		{[]string{"EXISTS", "gone"}, "0"},
+		{[]string{"EXISTS", "missing"}, "0"},
+		{[]string{"OBJECT", "ENCODING", "a"}, "raw"},
+		{[]string{"GETRANGE", "later", "0", "-1"}, "y"},
+	} {
+		if got := srv.dispatch(cl, tc.args); got.text != tc.want {
+			t.Errorf("%v = %+v, want %q", tc.args, got, tc.want)
+		}
+	}
+	if got := srv.dispatch(cl, []string{"GET", "gone"}); got.kind != kindNil {
+		t.Errorf("GET of an expired key = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"KEYS", "*"}); len(got.items) != 4 {
+		t.Errorf("KEYS = %v", lineTexts(got))
+	}
+	for _, args := range [][]string{{"SET", "a", "2"}, {"DEL", "a"}, {"APPEND", "a", "x"}, {"NEXTID", "n"}} {
+		if got := srv.dispatch(cl, args); got.text != errReadOnly.Error() {
+			t.Errorf("%v = %+v", args, got)
+		}
+	}
+	if v, _ := srv.dbs[0].get("a"); v != "1" {
+		t.Errorf("a = %q after refused writes", v)
+	}
+
+	// SAVE writes the mapped keys back out as a normal snapshot.
+	out := filepath.Join(dir, "out")
+	if err := saveToFile(srv.dbs[0], out, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	dst := newKV()
+	if err := loadFromFile(dst, out, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := dst.get("later"); v != "y" {
+		t.Errorf("later = %q after saving a mapped store", v)
+	}
+	if _, _, hasTTL := dst.ttl("later"); !hasTTL {
+		t.Error("saving a mapped store dropped a TTL")
+	}
+}
+
+func TestMappedSnapshotRejects(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap not supported")
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "db")
+	src := newKV()
+	src.xadd("s", "*", []string{"f", "v"}, streamTrim{})
+	if err := saveToFile(src, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mapSaveFile(file, "pw"); err == nil {
+		t.Error("mapped a snapshot holding a stream")
+	}
+	if _, _, err := mapSaveFile(file, "wrong"); err == nil {
+		t.Error("mapped a snapshot with the wrong password")
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := writeImage(f, &dump{Data: map[string]string{"k": "v", "j": "w"}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := m.lookup("k"); !ok || string(v) != "v" {
+		t.Errorf("lookup(k) = %q, %v", v, ok)
+	}
+	if _, ok := m.lookup("l"); ok {
+		t.Error("lookup of a missing key succeeded")
+	}
+	for _, bad := range [][]byte{data[:len(data)-1], data[:mmapHeaderLen+1], []byte("BoSx00000000")} {
+		if _, err := parseImage(bad); err == nil {
+			t.Errorf("parseImage accepted %d bytes", len(bad))
+		}
+	}
+}
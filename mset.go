@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// mget reads every key with the read locks of all their shards held, so
+// the values are consistent with each other. ok[i] is false where keys[i]
+// has no string value.
+func (k *kv) mget(keys []string) (vals []string, ok []bool) {
+	vals, ok = make([]string, len(keys)), make([]bool, len(keys))
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = k.name(key)
+	}
+	var expired []string
+	unlock := k.lockNames(names, false)
+	now := time.Now()
+	for i, name := range names {
+		sh := k.shardOf(name)
+		if sh.expiredLocked(name, now) {
+			expired = append(expired, name)
+			continue
+		}
+		v, found, fresh := sh.valueLocked(name)
+		vals[i], ok[i] = string(v), found
+		if fresh {
+			zero(v)
+		}
+		if n, isCounter := sh.counters[name]; isCounter {
+			vals[i], ok[i] = strconv.FormatInt(n, 10), true
+		}
+		if ok[i] && sh.lru != nil {
+			sh.lru.touch(name)
+		}
+	}
+	unlock()
+	for _, name := range expired {
+		k.shardOf(name).reap(name)
+	}
+	return vals, ok
+}
+
+// mset stores every pair as setMany does, clearing their TTLs as SET
+// does.
+func (k *kv) mset(pairs map[string]string) {
+	keys := make([]string, 0, len(pairs))
+	vals := make([][]byte, 0, len(pairs))
+	for key, val := range pairs {
+		keys = append(keys, key)
+		vals = append(vals, []byte(val))
+	}
+	k.setMany(keys, vals)
+}
+
+// cmdMGet handles MGET key [key ...] and replies with one line per key:
+// its value, or NIL.
+func cmdMGet(s *server, cl *client, args []string) reply {
+	vals, ok := s.db(cl).mget(args)
+	r := reply{kind: kindArray, items: make([]reply, len(args))}
+	for i := range args {
+		r.items[i] = nilReply
+		if ok[i] {
+			r.items[i] = strReply(vals[i])
+		}
+	}
+	return r
+}
+
+// cmdMSet handles MSET key value [key value ...]. Each value is a single
+// word, or "" for an empty string. Every pair is checked before any is
+// stored; a later pair for the same key wins.
+func cmdMSet(s *server, cl *client, args []string) reply {
+	if len(args)%2 != 0 {
+		return wrongArgs("mset")
+	}
+	pairs := make(map[string]string, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		key, val := args[i], args[i+1]
+		if val == emptyValue {
+			val = ""
+		}
+		if s.cfg.maxValueBytes > 0 && len(val) > s.cfg.maxValueBytes {
+			return errReply(errValueTooLarge.Error())
+		}
+		if r, ok := s.controlChars(cl, "MSET", key, []byte(val)); !ok {
+			return r
+		}
+		if err := s.db(cl).checkSchema(key, []byte(val)); err != nil {
+			return errReply(err.Error())
+		}
+		pairs[key] = val
+	}
+	s.db(cl).mset(pairs)
+	return okReply
+}
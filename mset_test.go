@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMGetMSet(t *testing.T) {
+	srv := newServer(config{maxValueBytes: 8})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "a", "old"})
+	srv.dispatch(cl, []string{"EXPIRE", "a", "100"})
+	if got := srv.dispatch(cl, []string{"MSET", "a", "1", "b", `""`, "a", "2"}); got.kind != kindOK {
+		t.Fatalf("MSET = %+v", got)
+	}
+	if _, _, hasTTL := srv.dbs[0].ttl("a"); hasTTL {
+		t.Error("MSET kept the old TTL")
+	}
+	srv.dispatch(cl, []string{"INCR", "n"})
+	srv.dispatch(cl, []string{"XADD", "st", "*", "f", "v"})
+	got := srv.dispatch(cl, []string{"MGET", "a", "b", "missing", "n", "st"})
+	want := []reply{strReply("2"), strReply(""), nilReply, strReply("1"), nilReply}
+	if len(got.items) != len(want) {
+		t.Fatalf("MGET = %+v", got)
+	}
+	for i, w := range want {
+		if got.items[i].kind != w.kind || got.items[i].text != w.text {
+			t.Errorf("MGET item %d = %+v, want %+v", i, got.items[i], w)
+		}
+	}
+
+	srv.dbs[0].expire("b", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if got := srv.dispatch(cl, []string{"MGET", "b"}); got.items[0].kind != kindNil {
+		t.Errorf("MGET of an expired key = %+v", got)
+	}
+	if _, ok := srv.dbs[0].shardOf("b").data["b"]; ok {
+		t.Error("MGET left an expired key")
+	}
+
+	for _, args := range [][]string{
+		{"MSET", "a", "1", "b"},
+		{"MSET", "a", "1", "b", "123456789"},
+	} {
+		if got := srv.dispatch(cl, args); got.kind != kindErr {
+			t.Errorf("%v = %+v", args, got)
+		}
+	}
+	if v, _ := srv.dbs[0].get("a"); v != "2" {
+		t.Errorf("a rejected MSET stored a = %q", v)
+	}
+}
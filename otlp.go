@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The OTLP exporter pushes metrics to an OpenTelemetry collector using
+// OTLP/HTTP with the JSON encoding, which needs nothing beyond the
+// standard library. The types below are the subset of the
+// ExportMetricsServiceRequest message that BoS fills in. In the protobuf
+// JSON mapping, 64-bit integers are strings.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpMetric struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Unit        string       `json:"unit,omitempty"`
+	Sum         *otlpSum     `json:"sum,omitempty"`
+	Gauge       *otlpGauge   `json:"gauge,omitempty"`
+	Summary     *otlpSummary `json:"summary,omitempty"`
+}
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+type otlpSum struct {
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsInt             string     `json:"asInt"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryPoint `json:"dataPoints"`
+}
+
+type otlpSummaryPoint struct {
+	Attributes        []otlpAttr     `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	QuantileValues    []otlpQuantile `json:"quantileValues"`
+}
+
+type otlpQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+func otlpAttrs(kv ...string) []otlpAttr {
+	attrs := make([]otlpAttr, len(kv)/2)
+	for i := range attrs {
+		attrs[i].Key = kv[2*i]
+		attrs[i].Value.StringValue = kv[2*i+1]
+	}
+	return attrs
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpMetrics collects the metrics for one export at now: per-command
+// call counts and latency summaries, read from the same histograms as
+// LATENCY, and the connection count and memory figures of INFO.
+func (s *server) otlpMetrics(now time.Time) *otlpRequest {
+	ts := otlpTime(now)
+	calls := otlpMetric{Name: "bos.commands", Unit: "{call}", Description: "Commands executed",
+		Sum: &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}}
+	duration := otlpMetric{Name: "bos.command.duration", Unit: "s", Description: "Command execution time",
+		Summary: &otlpSummary{}}
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n, total, q, since := s.commands[name].latency.summary()
+		if n == 0 {
+			continue
+		}
+		if since.IsZero() {
+			since = s.started
+		}
+		attrs := otlpAttrs("command", name)
+		calls.Sum.DataPoints = append(calls.Sum.DataPoints, otlpNumberPoint{
+			Attributes: attrs, StartTimeUnixNano: otlpTime(since), TimeUnixNano: ts,
+			AsInt: strconv.FormatUint(n, 10)})
+		duration.Summary.DataPoints = append(duration.Summary.DataPoints, otlpSummaryPoint{
+			Attributes: attrs, StartTimeUnixNano: otlpTime(since), TimeUnixNano: ts,
+			Count: strconv.FormatUint(n, 10), Sum: total.Seconds(),
+			QuantileValues: []otlpQuantile{{0.5, q[0].Seconds()}, {0.99, q[1].Seconds()}, {1, q[2].Seconds()}}})
+	}
+
+	var used, evicted int64
+	for _, db := range s.dbs {
+		u, e := db.memory()
+		used += u
+		evicted += e
+	}
+	s.mu.Lock()
+	conns := len(s.clients)
+	evictedSince := s.statsReset
+	s.mu.Unlock()
+	if evictedSince.IsZero() {
+		evictedSince = s.started
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gauge := func(name, unit, desc string, v int64) otlpMetric {
+		return otlpMetric{Name: name, Unit: unit, Description: desc, Gauge: &otlpGauge{
+			DataPoints: []otlpNumberPoint{{TimeUnixNano: ts, AsInt: strconv.FormatInt(v, 10)}}}}
+	}
+	metrics := []otlpMetric{
+		calls,
+		duration,
+		gauge("bos.connections", "{connection}", "Open client connections", int64(conns)),
+		gauge("bos.memory.used", "By", "Logical size of keys and values", used),
+		gauge("bos.memory.heap", "By", "Go heap bytes allocated", int64(ms.HeapAlloc)),
+		{Name: "bos.keys.evicted", Unit: "{key}", Description: "Keys evicted by -maxmemory",
+			Sum: &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true, DataPoints: []otlpNumberPoint{{
+				StartTimeUnixNano: otlpTime(evictedSince), TimeUnixNano: ts, AsInt: strconv.FormatInt(evicted, 10)}}}},
+	}
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: otlpAttrs("service.name", "bos")},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "bos"}, Metrics: metrics}},
+	}}}
+}
+
+// otlpURL turns -otlp-endpoint into the metrics URL. A bare collector
+// address such as http://localhost:4318 gets the standard /v1/metrics
+// path; a URL with a path is used as given.
+func otlpURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid -otlp-endpoint %q, want an http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	return u.String(), nil
+}
+
+// exportOTLP posts the metrics to url every interval, until the process
+// exits. A failed export is logged and retried at the next tick.
+func (s *server) exportOTLP(url string, interval time.Duration) {
+	client := &http.Client{Timeout: interval}
+	for now := range time.Tick(interval) {
+		if err := s.pushOTLP(client, url, now); err != nil {
+			slog.Warn("OTLP export failed", "endpoint", url, "err", err)
+		}
+	}
+}
+
+func (s *server) pushOTLP(client *http.Client, url string, now time.Time) error {
+	body, err := json.Marshal(s.otlpMetrics(now))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied %s", resp.Status)
+	}
+	return nil
+}
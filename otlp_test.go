@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPExport(t *testing.T) {
+	var got otlpRequest
+	var contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		contentType = r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+	}))
+	defer collector.Close()
+
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "k", "v"})
+	srv.dispatch(cl, []string{"GET", "k"})
+	srv.dispatch(cl, []string{"GET", "k"})
+	url, err := otlpURL(collector.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.pushOTLP(collector.Client(), url, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	if len(got.ResourceMetrics) != 1 || len(got.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("export = %+v", got)
+	}
+	metrics := make(map[string]otlpMetric)
+	for _, m := range got.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	calls := make(map[string]string)
+	for _, p := range metrics["bos.commands"].Sum.DataPoints {
+		calls[p.Attributes[0].Value.StringValue] = p.AsInt
+	}
+	if calls["GET"] != "2" || calls["SET"] != "1" || len(calls) != 2 {
+		t.Errorf("command counts = %v", calls)
+	}
+	if pts := metrics["bos.command.duration"].Summary.DataPoints; len(pts) != 2 || len(pts[0].QuantileValues) != 3 {
+		t.Errorf("duration summary = %+v", pts)
+	}
+	if pts := metrics["bos.memory.used"].Gauge.DataPoints; len(pts) != 1 || pts[0].AsInt != "2" {
+		t.Errorf("bos.memory.used = %+v", pts)
+	}
+	for _, name := range []string{"bos.connections", "bos.memory.heap", "bos.keys.evicted"} {
+		if _, ok := metrics[name]; !ok {
+			t.Errorf("%s not exported", name)
+		}
+	}
+}
+
+func TestOTLPURL(t *testing.T) {
+	for in, want := range map[string]string{
+		"http://collector:4318":      "http://collector:4318/v1/metrics",
+		"https://collector:4318/":    "https://collector:4318/v1/metrics",
+		"http://collector/otlp/push": "http://collector/otlp/push",
+	} {
+		if got, err := otlpURL(in); err != nil || got != want {
+			t.Errorf("otlpURL(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := otlpURL("collector:4318"); err == nil {
+		t.Error("otlpURL accepted an address without a scheme")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// pathLocks hands out one mutex per file path, so writers of the same file
+// are serialized while writers of different files run in parallel. Entries
+// are dropped once nobody holds or waits for them.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: make(map[string]*pathLock)}
+}
+
+// lock blocks until the caller holds the lock for path and returns the
+// function that releases it.
+func (p *pathLocks) lock(path string) (unlock func()) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	p.mu.Lock()
+	l := p.locks[path]
+	if l == nil {
+		l = &pathLock{}
+		p.locks[path] = l
+	}
+	l.refs++
+	p.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		p.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(p.locks, path)
+		}
+		p.mu.Unlock()
+	}
+}
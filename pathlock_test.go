@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathLocks(t *testing.T) {
+	p := newPathLocks()
+	unlockA := p.lock("a.bin")
+
+	done := make(chan struct{})
+	go func() {
+		p.lock("b.bin")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock on a different path blocked")
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		p.lock("./a.bin")()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second lock on the same path did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	<-acquired
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.locks) != 0 {
+		t.Fatalf("%d path locks left behind", len(p.locks))
+	}
+}
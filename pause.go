@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pauseState is the CLIENT PAUSE timer. While a pause is in effect,
+// commands it covers wait in dispatch until it ends.
+type pauseState struct {
+	mu    sync.Mutex
+	until time.Time
+	all   bool          // every command waits, not just writes
+	ended chan struct{} // closed when the pause is lifted or replaced
+}
+
+func (p *pauseState) set(d time.Duration, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wakeLocked()
+	p.until, p.all = time.Now().Add(d), all
+}
+
+func (p *pauseState) lift() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wakeLocked()
+	p.until = time.Time{}
+}
+
+func (p *pauseState) wakeLocked() {
+	if p.ended != nil {
+		close(p.ended)
+		p.ended = nil
+	}
+}
+
+// wait blocks while a pause covering a command (write or not) is in
+// effect, or until ctx is done.
+func (p *pauseState) wait(ctx context.Context, write bool) {
+	for {
+		p.mu.Lock()
+		left := time.Until(p.until)
+		if left <= 0 || (!write && !p.all) {
+			p.mu.Unlock()
+			return
+		}
+		if p.ended == nil {
+			p.ended = make(chan struct{})
+		}
+		ended := p.ended
+		p.mu.Unlock()
+		t := time.NewTimer(left)
+		select {
+		case <-t.C:
+		case <-ended:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		t.Stop()
+	}
+}
+
+// clientPause handles CLIENT PAUSE ms [WRITE|ALL]. With WRITE only write
+// commands wait; ALL, the default, holds every command. CLIENT commands
+// are never held, so CLIENT UNPAUSE can end the pause early.
+func clientPause(s *server, args []string) reply {
+	if len(args) < 1 || len(args) > 2 {
+		return wrongArgs("client pause")
+	}
+	ms, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || ms < 0 || ms > int64(math.MaxInt64/time.Millisecond) {
+		return errReply("timeout is not an integer or out of range")
+	}
+	all := true
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "WRITE":
+			all = false
+		case "ALL":
+		default:
+			return errReply("syntax error")
+		}
+	}
+	s.pause.set(time.Duration(ms)*time.Millisecond, all)
+	return okReply
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClientPauseWrite(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	if got := srv.dispatch(cl, []string{"CLIENT", "PAUSE", "10000", "WRITE"}); got.kind != kindOK {
+		t.Fatalf("CLIENT PAUSE = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"GET", "k"}); got.kind != kindNil {
+		t.Fatalf("GET during a WRITE pause = %+v", got)
+	}
+	done := make(chan reply)
+	go func() { done <- srv.dispatch(&client{}, []string{"SET", "k", "v"}) }()
+	select {
+	case r := <-done:
+		t.Fatalf("SET ran during a WRITE pause: %+v", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if got := srv.dispatch(cl, []string{"CLIENT", "UNPAUSE"}); got.kind != kindOK {
+		t.Fatalf("CLIENT UNPAUSE = %+v", got)
+	}
+	select {
+	case r := <-done:
+		if r.kind != kindOK {
+			t.Errorf("SET after UNPAUSE = %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SET still held after CLIENT UNPAUSE")
+	}
+}
+
+func TestClientPauseAll(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"CLIENT", "PAUSE", "30"})
+	start := time.Now()
+	if got := srv.dispatch(cl, []string{"GET", "k"}); got.kind != kindNil {
+		t.Fatalf("GET = %+v", got)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("GET ran after %v, during an ALL pause", d)
+	}
+	if got := srv.dispatch(cl, []string{"CLIENT", "PAUSE", "x"}); got.kind != kindErr {
+		t.Errorf("CLIENT PAUSE x = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"CLIENT", "PAUSE", "1", "READ"}); got.kind != kindErr {
+		t.Errorf("CLIENT PAUSE 1 READ = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"CLIENT", "PAUSE", strconv.FormatInt(math.MaxInt64, 10)}); got.kind != kindErr {
+		t.Errorf("CLIENT PAUSE MaxInt64 = %+v, want an error", got)
+	}
+}
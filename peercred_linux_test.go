@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCredListener(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		allow map[uint32]bool
+		want  bool
+	}{
+		{"allowed", map[uint32]bool{uint32(os.Getuid()): true}, true},
+		{"rejected", map[uint32]bool{uint32(os.Getuid()) + 1: true}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bos.sock")
+			ul, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			ln := &peerCredListener{Listener: ul, allow: tc.allow}
+			defer ln.Close()
+			go newServer(config{}).serve(ln)
+			c, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer c.Close()
+			c.Write([]byte("SET a 1\n"))
+			line, err := bufio.NewReader(c).ReadString('\n')
+			if got := err == nil && line == "OK\n"; got != tc.want {
+				t.Fatalf("served = %v (%q, %v), want %v", got, line, err, tc.want)
+			}
+		})
+	}
+}
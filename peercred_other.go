@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredSupported = false
+
+func peerUID(c net.Conn) (uint32, error) {
+	return 0, errors.New("peer credentials not supported")
+}
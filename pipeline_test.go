@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// countingConn counts the Write calls a handler makes, each of which is
+// one write syscall on a TCP connection.
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+// pipelineConn serves one loopback TCP connection with srv and returns the
+// client end and the server's write counter.
+func pipelineConn(tb testing.TB, srv *server) (net.Conn, *atomic.Int64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	writes := new(atomic.Int64)
+	go func() {
+		// The listener stays open until the dialed connection is
+		// accepted; closing it first may reset the connection.
+		c, err := ln.Accept()
+		ln.Close()
+		if err == nil {
+			srv.handle(countingConn{c, writes})
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c, writes
+}
+
+const pipelineDepth = 1000
+
+var pipelineBatch = strings.Repeat("SET k v\n", pipelineDepth/2) + strings.Repeat("GET k\n", pipelineDepth/2)
+
+// readReplies reads one batch worth of replies.
+func readReplies(tb testing.TB, r *bufio.Reader) {
+	for i := 0; i < pipelineDepth; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			tb.Fatalf("reply %d: %v", i, err)
+		}
+	}
+}
+
+func TestPipelineCoalescesWrites(t *testing.T) {
+	c, writes := pipelineConn(t, newServer(config{}))
+	if _, err := io.WriteString(c, pipelineBatch); err != nil {
+		t.Fatal(err)
+	}
+	readReplies(t, bufio.NewReader(c))
+	// The batch may arrive in more than one segment, but it must not cost
+	// anything close to one write per command.
+	if n := writes.Load(); n > 10 {
+		t.Fatalf("%d writes for %d pipelined commands", n, pipelineDepth)
+	}
+}
+
+// BenchmarkPipeline sends 1000 commands in one write and waits for all
+// replies. It reports the server's write syscalls per batch.
+func BenchmarkPipeline(b *testing.B) {
+	c, writes := pipelineConn(b, newServer(config{}))
+	r := bufio.NewReader(c)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.WriteString(c, pipelineBatch); err != nil {
+			b.Fatal(err)
+		}
+		readReplies(b, r)
+	}
+	b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/batch")
+}
+
+// brokenConn fails every write, like a socket whose peer has gone away.
+type brokenConn struct{ net.Conn }
+
+func (brokenConn) Write([]byte) (int, error) { return 0, syscall.EPIPE }
+
+func TestBrokenPipeStopsBatch(t *testing.T) {
+	srv := newServer(config{})
+	srv.dbs[0].set("big", strings.Repeat("x", 2*ioBufferSize))
+	c, sc := net.Pipe()
+	defer c.Close()
+	go srv.handle(brokenConn{sc})
+	// GET big overflows the write buffer, so its reply is written, and
+	// fails, while SET is still buffered unread.
+	if _, err := c.Write([]byte("GET big\nSET after x\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the handler to exit", func() bool { return len(srv.clientsByID()) == 0 })
+	if _, ok := srv.dbs[0].get("after"); ok {
+		t.Error("handler kept running commands after a failed write")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Command is a custom command compiled into the server. To add one, put a
+// file in package main that calls RegisterCommand from an init function;
+// it is dispatched alongside the built-ins and can be disabled or renamed
+// like them.
+//
+// Arity counts the arguments after the command name, as for built-ins,
+// and is checked before Execute runs; max < 0 means no upper bound. A
+// Command may also implement Summary() string for COMMAND DOCS and
+// Writes() bool to mark it as modifying the data set.
+type Command interface {
+	Name() string
+	Arity() (min, max int)
+	Execute(store Store, args []string) Reply
+}
+
+// Store is the database a custom command runs against: the one the
+// calling connection has selected.
+type Store struct {
+	kv *kv
+}
+
+func (s Store) Get(key string) (string, bool) { return s.kv.get(key) }
+func (s Store) Set(key, val string)           { s.kv.set(key, val) }
+func (s Store) Del(key string) bool           { return s.kv.del(key) }
+
+// Keys returns the keys matching a glob pattern, in no particular order.
+func (s Store) Keys(pattern string) []string { return s.kv.keys(pattern) }
+
+// Reply is a custom command's answer.
+type Reply struct {
+	r reply
+}
+
+func OK() Reply                  { return Reply{okReply} }
+func Nil() Reply                 { return Reply{nilReply} }
+func Error(msg string) Reply     { return Reply{errReply(msg)} }
+func Value(s string) Reply       { return Reply{strReply(s)} }
+func Int(n int64) Reply          { return Reply{intReply(n)} }
+func Array(items []string) Reply { return Reply{arrayReply(items)} }
+
+// catCustom is the COMMAND DOCS category of registered commands.
+const catCustom = "custom"
+
+// customCommands holds the registered commands by upper-case name.
+var customCommands = make(map[string]Command)
+
+// RegisterCommand adds c to every server's command table. It panics if
+// the name is empty or taken, so a bad plugin fails at startup.
+func RegisterCommand(c Command) {
+	name := strings.ToUpper(c.Name())
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		panic(fmt.Sprintf("RegisterCommand: invalid name %q", c.Name()))
+	}
+	if _, taken := customCommands[name]; taken {
+		panic(fmt.Sprintf("RegisterCommand: %s registered twice", name))
+	}
+	for _, b := range builtinCommands() {
+		if b.name == name {
+			panic(fmt.Sprintf("RegisterCommand: %s is a built-in command", name))
+		}
+	}
+	customCommands[name] = c
+}
+
+// customCommand adapts a registered Command to the dispatch table.
+func customCommand(name string, c Command) *command {
+	minArgs, maxArgs := c.Arity()
+	cmd := &command{
+		name:     name,
+		minArgs:  minArgs,
+		maxArgs:  maxArgs,
+		category: catCustom,
+		summary:  "Custom command",
+		run: func(s *server, cl *client, args []string) reply {
+			return c.Execute(Store{s.db(cl)}, args).r
+		},
+	}
+	if d, ok := c.(interface{ Summary() string }); ok {
+		cmd.summary = d.Summary()
+	}
+	if w, ok := c.(interface{ Writes() bool }); ok {
+		cmd.write = w.Writes()
+	}
+	return cmd
+}
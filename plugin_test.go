@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// upperCommand is a sample plugin: UPPER key stores the key's value in
+// upper case and replies with it.
+type upperCommand struct{}
+
+func (upperCommand) Name() string      { return "upper" }
+func (upperCommand) Arity() (int, int) { return 1, 1 }
+func (upperCommand) Summary() string   { return "Upper-case a value in place" }
+func (upperCommand) Writes() bool      { return true }
+func (upperCommand) Execute(st Store, args []string) Reply {
+	v, ok := st.Get(args[0])
+	if !ok {
+		return Nil()
+	}
+	v = strings.ToUpper(v)
+	st.Set(args[0], v)
+	return Value(v)
+}
+
+func TestRegisterCommand(t *testing.T) {
+	RegisterCommand(upperCommand{})
+	t.Cleanup(func() { delete(customCommands, "UPPER") })
+
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SELECT", "3"})
+	srv.dispatch(cl, []string{"SET", "k", "hello"})
+	if got := srv.dispatch(cl, []string{"upper", "k"}); got.text != "HELLO" {
+		t.Fatalf("UPPER = %+v", got)
+	}
+	if v, _ := srv.dbs[3].get("k"); v != "HELLO" {
+		t.Errorf("stored value = %q, want the selected database updated", v)
+	}
+	if got := srv.dispatch(cl, []string{"UPPER"}); got.text != "wrong number of arguments for 'upper'" {
+		t.Errorf("UPPER without a key = %+v", got)
+	}
+	docs := srv.dispatch(cl, []string{"COMMAND", "DOCS", "UPPER"})
+	if len(docs.items) != 1 || docs.items[0].text != "UPPER args=1..1 category=custom flags=write summary=Upper-case a value in place" {
+		t.Errorf("COMMAND DOCS UPPER = %+v", docs)
+	}
+	if err := srv.restrictCommands([]string{"UPPER"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.dispatch(cl, []string{"UPPER", "k"}); got.text != "command disabled" {
+		t.Errorf("disabled UPPER = %+v", got)
+	}
+
+	for _, bad := range []Command{upperCommand{}, namedCommand("GET"), namedCommand("")} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterCommand(%q) did not panic", bad.Name())
+				}
+			}()
+			RegisterCommand(bad)
+		}()
+	}
+}
+
+type namedCommand string
+
+func (n namedCommand) Name() string                { return string(n) }
+func (namedCommand) Arity() (int, int)             { return 0, 0 }
+func (namedCommand) Execute(Store, []string) Reply { return OK() }
@@ -0,0 +1,26 @@
+package main
+
+// startWorkers switches the server to a pool of n connection handlers.
+// Accepted connections queue on s.work until a worker is free, so at most
+// n connections are served at once and no goroutine is created per
+// connection; further clients wait in the accept backlog.
+func (s *server) startWorkers(n int) {
+	s.work = make(chan func())
+	for i := 0; i < n; i++ {
+		go func() {
+			for fn := range s.work {
+				fn()
+			}
+		}()
+	}
+}
+
+// spawn runs a connection handler: on a pool worker if the server has a
+// pool, blocking until one is free, and on a new goroutine otherwise.
+func (s *server) spawn(fn func()) {
+	if s.work == nil {
+		go fn()
+		return
+	}
+	s.work <- fn
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// churnServer serves srv on a loopback listener and returns its address.
+func churnServer(tb testing.TB, srv *server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go srv.serve(ln)
+	return ln.Addr().String()
+}
+
+func ping(tb testing.TB, c net.Conn) {
+	tb.Helper()
+	c.Write([]byte("PING\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != "PONG\n" {
+		tb.Fatalf("PING = %q, %v", line, err)
+	}
+}
+
+func TestWorkerPoolBoundsConnections(t *testing.T) {
+	addr := churnServer(t, newServer(config{workers: 2}))
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	ping(t, conns[0])
+	ping(t, conns[1])
+
+	// Both workers are busy, so the third connection is not served yet.
+	conns[2].Write([]byte("PING\n"))
+	conns[2].SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conns[2].Read(make([]byte, 16)); err == nil {
+		t.Fatal("third connection served while both workers were busy")
+	}
+	conns[0].Close()
+	conns[2].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(conns[2]).ReadString('\n'); err != nil || line != "PONG\n" {
+		t.Fatalf("PING after a worker freed up = %q, %v", line, err)
+	}
+}
+
+// benchmarkChurn opens, uses and closes one connection per iteration.
+func benchmarkChurn(b *testing.B, cfg config) {
+	addr := churnServer(b, newServer(cfg))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ping(b, c)
+		c.Close()
+	}
+}
+
+func BenchmarkConnChurnGoroutine(b *testing.B) { benchmarkChurn(b, config{}) }
+func BenchmarkConnChurnPool(b *testing.B)      { benchmarkChurn(b, config{workers: 64}) }
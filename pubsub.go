@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// pubsub tracks channel and pattern subscribers. Messages are written to
+// subscriber connections directly by the publishing handler.
+type pubsub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*client]bool
+	patterns map[string]map[*client]bool
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*client]bool),
+		patterns: make(map[string]map[*client]bool),
+	}
+}
+
+func addSub(reg map[string]map[*client]bool, name string, cl *client) {
+	subs := reg[name]
+	if subs == nil {
+		subs = make(map[*client]bool)
+		reg[name] = subs
+	}
+	subs[cl] = true
+}
+
+func removeSub(reg map[string]map[*client]bool, name string, cl *client) {
+	delete(reg[name], cl)
+	if len(reg[name]) == 0 {
+		delete(reg, name)
+	}
+}
+
+// subscribe adds cl to each channel (or pattern, when pattern is set) and
+// returns the client's subscription count after each one.
+func (p *pubsub) subscribe(cl *client, names []string, pattern bool) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := make([]int, len(names))
+	for i, name := range names {
+		if pattern {
+			addSub(p.patterns, name, cl)
+			cl.psubs[name] = true
+		} else {
+			addSub(p.channels, name, cl)
+			cl.subs[name] = true
+		}
+		counts[i] = len(cl.subs) + len(cl.psubs)
+	}
+	return counts
+}
+
+// unsubscribe removes cl from the named channels or patterns, or from all
+// of them when names is empty. It returns the names removed and the
+// remaining subscription count after each.
+func (p *pubsub) unsubscribe(cl *client, names []string, pattern bool) ([]string, []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reg, own := p.channels, cl.subs
+	if pattern {
+		reg, own = p.patterns, cl.psubs
+	}
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+	counts := make([]int, len(names))
+	for i, name := range names {
+		removeSub(reg, name, cl)
+		delete(own, name)
+		counts[i] = len(cl.subs) + len(cl.psubs)
+	}
+	return names, counts
+}
+
+// subscribed reports whether cl holds any channel or pattern
+// subscription. Unlike cl's own handler, other goroutines need the lock
+// to look.
+func (p *pubsub) subscribed(cl *client) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(cl.subs)+len(cl.psubs) > 0
+}
+
+// drop removes every subscription held by cl. It is called when the
+// connection goes away.
+func (p *pubsub) drop(cl *client) {
+	p.mu.Lock()
+	for name := range cl.subs {
+		removeSub(p.channels, name, cl)
+	}
+	for name := range cl.psubs {
+		removeSub(p.patterns, name, cl)
+	}
+	cl.subs, cl.psubs = nil, nil
+	p.mu.Unlock()
+}
+
+// publish delivers msg to subscribers of channel and of every pattern that
+// matches it, and returns the number of deliveries.
+func (p *pubsub) publish(channel, msg string) int {
+	type delivery struct {
+		cl   *client
+		line string
+	}
+	var out []delivery
+	p.mu.RLock()
+	for cl := range p.channels[channel] {
+		out = append(out, delivery{cl, fmt.Sprintf("message %s %s", channel, msg)})
+	}
+	for pat, subs := range p.patterns {
+		if !globMatch(pat, channel) {
+			continue
+		}
+		for cl := range subs {
+			out = append(out, delivery{cl, fmt.Sprintf("pmessage %s %s %s", pat, channel, msg)})
+		}
+	}
+	p.mu.RUnlock()
+	for _, d := range out {
+		d.cl.push(strReply(d.line))
+	}
+	return len(out)
+}
+
+func cmdPublish(s *server, cl *client, args []string) reply {
+	return intReply(int64(s.pubsub.publish(args[0], strings.Join(args[1:], " "))))
+}
+
+func cmdSubscribe(s *server, cl *client, args []string) reply {
+	return subscribeReply(s, cl, args, false)
+}
+
+func cmdPSubscribe(s *server, cl *client, args []string) reply {
+	return subscribeReply(s, cl, args, true)
+}
+
+func cmdUnsubscribe(s *server, cl *client, args []string) reply {
+	return unsubscribeReply(s, cl, args, false)
+}
+
+func cmdPUnsubscribe(s *server, cl *client, args []string) reply {
+	return unsubscribeReply(s, cl, args, true)
+}
+
+// subscribeReply acknowledges each name with "<kind> <name> <count>".
+func subscribeReply(s *server, cl *client, names []string, pattern bool) reply {
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+	counts := s.pubsub.subscribe(cl, names, pattern)
+	acks := make([]reply, len(names))
+	for i, name := range names {
+		acks[i] = strReply(fmt.Sprintf("%s %s %d", kind, name, counts[i]))
+	}
+	return linesReply(acks)
+}
+
+// unsubscribeReply drops the named subscriptions, or all of that kind if
+// none are named.
+func unsubscribeReply(s *server, cl *client, names []string, pattern bool) reply {
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+	names, counts := s.pubsub.unsubscribe(cl, names, pattern)
+	if len(names) == 0 {
+		return strReply(fmt.Sprintf("%s %d", kind, len(cl.subs)+len(cl.psubs)))
+	}
+	acks := make([]reply, len(names))
+	for i, name := range names {
+		acks[i] = strReply(fmt.Sprintf("%s %s %d", kind, name, counts[i]))
+	}
+	return linesReply(acks)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setRange writes data into the string at key starting at off, padding
+// with zero bytes if off is past the end, and returns the new length. A
+// missing key starts empty; a key of any other type than string is
+// refused. With atEnd set off is ignored and data goes at the end.
+//
+// A value grows in place while its capacity allows and otherwise moves to
+// an array of twice the capacity, so a run of appends costs O(n) in total
+// rather than O(n²). A value that may be kept compressed is rebuilt on
+// every write instead, since it goes back through compressLocked, and so
+// is one check, when not nil, must accept before it is stored.
+func (k *kvShard) setRange(key string, off int, data []byte, atEnd bool, limit int, check func([]byte) error) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	// A HyperLogLog is held as a string too, but writing into its
+	// registers would leave it marked as one with garbage in them.
+	if t := k.typeLocked(key); t != "string" && t != "none" {
+		return 0, errWrongType
+	}
+	v, ok, fresh := k.valueLocked(key)
+	if fresh {
+		defer zero(v)
+	}
+	if atEnd {
+		off = len(v)
+	}
+	if len(data) == 0 {
+		// An empty write changes nothing, as in Redis: not even a
+		// SETRANGE offset past the end pads the value.
+		return len(v), nil
+	}
+	// Checked before adding, so a huge offset cannot overflow end.
+	if off > maxValueLen-len(data) {
+		return 0, errValueTooLarge
+	}
+	end := max(len(v), off+len(data))
+	if end > maxValueLen || limit > 0 && end > limit {
+		return 0, errValueTooLarge
+	}
+	mayCompress := k.compressAbove > 0 && end > k.compressAbove
+	if ok && !fresh && !mayCompress && check == nil && end <= cap(v) {
+		nv := v[:end]
+		if off > len(v) {
+			clear(nv[len(v):off])
+		}
+		copy(nv[off:], data)
+		k.data[key] = nv
+		k.addUsed(int64(end - len(v)))
+		if k.lru != nil {
+			k.lru.touch(key)
+			k.evictLocked(key)
+		}
+		k.notePeakLocked()
+		return end, nil
+	}
+	nv := make([]byte, end, max(end, 2*cap(v)))
+	copy(nv, v)
+	copy(nv[off:], data)
+	if check != nil {
+		if err := check(nv); err != nil {
+			zero(nv)
+			return 0, err
+		}
+	}
+	k.storeLocked(key, nv)
+	return end, nil
+}
+
+// getRange returns the bytes of the string at key from start to end
+// inclusive. Negative offsets count from the end, as in Redis; the range is
+// clamped to the value.
+func (k *kvShard) getRange(key string, start, end int) (string, error) {
+	k.mu.RLock()
+	if k.expiredLocked(key, time.Now()) {
+		k.mu.RUnlock()
+		k.reap(key)
+		return "", nil
+	}
+	defer k.mu.RUnlock()
+	v, ok, fresh := k.valueLocked(key)
+	if !ok {
+		if k.typeLocked(key) != "none" {
+			return "", errWrongType
+		}
+		return "", nil
+	}
+	if fresh {
+		defer zero(v)
+	}
+	if k.lru != nil {
+		k.lru.touch(key)
+	}
+	n := len(v)
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end += n
+	}
+	end = min(end, n-1)
+	if start > end {
+		return "", nil
+	}
+	return string(v[start : end+1]), nil
+}
+
+// cmdAppend handles APPEND key value and replies with the new length.
+func cmdAppend(s *server, cl *client, args []string) reply {
+	val := []byte(strings.Join(args[1:], " "))
+	if r, ok := s.controlChars(cl, "APPEND", args[0], val); !ok {
+		return r
+	}
+	n, err := s.db(cl).setRange(args[0], 0, val, true, s.cfg.maxValueBytes)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(int64(n))
+}
+
+// cmdSetRange handles SETRANGE key offset value and replies with the new
+// length.
+func cmdSetRange(s *server, cl *client, args []string) reply {
+	off, err := strconv.Atoi(args[1])
+	if err != nil || off < 0 {
+		return errReply("offset must be a non-negative integer")
+	}
+	val := []byte(strings.Join(args[2:], " "))
+	if r, ok := s.controlChars(cl, "SETRANGE", args[0], val); !ok {
+		return r
+	}
+	n, err := s.db(cl).setRange(args[0], off, val, false, s.cfg.maxValueBytes)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(int64(n))
+}
+
+// cmdGetRange handles GETRANGE key start end.
+func cmdGetRange(s *server, cl *client, args []string) reply {
+	start, err1 := strconv.Atoi(args[1])
+	end, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return errReply("start and end must be integers")
+	}
+	v, err := s.db(cl).getRange(args[0], start, end)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return strReply(v)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAppendSetRangeGetRange(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"APPEND", "k", "Hello"}, "5"},
+		{[]string{"APPEND", "k", "World"}, "10"},
+		{[]string{"GET", "k"}, "HelloWorld"},
+		{[]string{"SETRANGE", "k", "5", "Redis"}, "10"},
+		{[]string{"GET", "k"}, "HelloRedis"},
+		{[]string{"GETRANGE", "k", "0", "4"}, "Hello"},
+		{[]string{"GETRANGE", "k", "-5", "-1"}, "Redis"},
+		{[]string{"GETRANGE", "k", "0", "100"}, "HelloRedis"},
+		{[]string{"GETRANGE", "k", "7", "3"}, ""},
+		{[]string{"GETRANGE", "missing", "0", "-1"}, ""},
+		{[]string{"SETRANGE", "pad", "3", "x"}, "4"},
+		{[]string{"GET", "pad"}, "\x00\x00\x00x"},
+		{[]string{"SETRANGE", "k", "-1", "x"}, "offset must be a non-negative integer"},
+		{[]string{"GETRANGE", "k", "a", "1"}, "start and end must be integers"},
+	} {
+		if got := srv.dispatch(cl, tc.args); got.text != tc.want {
+			t.Errorf("%v = %+v, want %q", tc.args, got, tc.want)
+		}
+	}
+	if used, _ := srv.dbs[0].memory(); used != int64(len("k")+10+len("pad")+4) {
+		t.Errorf("used = %d", used)
+	}
+
+	srv.dispatch(cl, []string{"NEXTID", "seq"})
+	if got := srv.dispatch(cl, []string{"APPEND", "seq", "x"}); got.text != errWrongType.Error() {
+		t.Errorf("APPEND on a counter = %+v", got)
+	}
+	srv.dispatch(cl, []string{"PFADD", "h", "a", "b"})
+	for _, args := range [][]string{{"APPEND", "h", "x"}, {"SETRANGE", "h", "0", "x"}} {
+		if got := srv.dispatch(cl, args); got.text != errWrongType.Error() {
+			t.Errorf("%v on a HyperLogLog = %+v", args, got)
+		}
+	}
+	if got := srv.dispatch(cl, []string{"PFCOUNT", "h"}); got.text != "2" {
+		t.Errorf("PFCOUNT after refused writes = %+v", got)
+	}
+}
+
+func TestAppendGrowsInPlace(t *testing.T) {
+	k := newKV()
+	sh := k.shardOf("k")
+	if _, err := k.setRange("k", 0, []byte("ab"), true, 0); err != nil {
+		t.Fatal(err)
+	}
+	grows := 0
+	last := cap(sh.data["k"])
+	for i := 0; i < 1000; i++ {
+		k.setRange("k", 0, []byte("x"), true, 0)
+		if c := cap(sh.data["k"]); c != last {
+			grows, last = grows+1, c
+		}
+	}
+	if v := sh.data["k"]; len(v) != 1002 || string(v[:3]) != "abx" {
+		t.Fatalf("len = %d, prefix %q", len(v), v[:3])
+	}
+	if grows > 12 {
+		t.Errorf("%d reallocations for 1000 appends", grows)
+	}
+}
+
+func TestAppendLimits(t *testing.T) {
+	srv := newServer(config{maxValueBytes: 4})
+	cl := &client{}
+	srv.dispatch(cl, []string{"APPEND", "k", "abc"})
+	if got := srv.dispatch(cl, []string{"APPEND", "k", "de"}); got.text != errValueTooLarge.Error() {
+		t.Errorf("APPEND past -max-value-bytes = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"SETRANGE", "k", "4", "x"}); got.text != errValueTooLarge.Error() {
+		t.Errorf("SETRANGE past -max-value-bytes = %+v", got)
+	}
+	// An offset near the int limit must not overflow the new length.
+	big := strconv.Itoa(math.MaxInt)
+	if got := srv.dispatch(cl, []string{"SETRANGE", "k", big, "x"}); got.text != errValueTooLarge.Error() {
+		t.Errorf("SETRANGE at offset %s = %+v", big, got)
+	}
+	if got := newServer(config{}).dispatch(cl, []string{"SETRANGE", "k", big, "x"}); got.text != errValueTooLarge.Error() {
+		t.Errorf("SETRANGE at offset %s without a limit = %+v", big, got)
+	}
+	if got := srv.dispatch(cl, []string{"GET", "k"}); got.text != "abc" {
+		t.Errorf("GET after rejected writes = %+v", got)
+	}
+}
+
+func TestAppendCompressed(t *testing.T) {
+	k := newKV()
+	k.setCompressAbove(100)
+	chunk := []byte(strings.Repeat("a", 100))
+	for i := 0; i < 5; i++ {
+		k.setRange("k", 0, chunk, true, 0)
+	}
+	if enc, _ := k.encoding("k"); enc != "deflate" {
+		t.Errorf("encoding = %s", enc)
+	}
+	k.setRange("k", 1, []byte("b"), false, 0)
+	if v, _ := k.get("k"); v != "a"+"b"+strings.Repeat("a", 498) {
+		t.Errorf("value = %q", v)
+	}
+	if got, _ := k.getRange("k", 0, 2); got != "aba" {
+		t.Errorf("GETRANGE = %q", got)
+	}
+}
+
+// BenchmarkAppend and BenchmarkAppendRealloc build a value from b.N
+// sequential appends, the second copying it into an exact-size array on
+// every one, as a store without spare capacity would.
+func BenchmarkAppend(b *testing.B) {
+	k := newKV()
+	chunk := []byte("0123456789")
+	for i := 0; i < b.N; i++ {
+		k.setRange("k", 0, chunk, true, 0)
+	}
+}
+
+func BenchmarkAppendRealloc(b *testing.B) {
+	k := newShard()
+	chunk := []byte("0123456789")
+	for i := 0; i < b.N; i++ {
+		k.mu.Lock()
+		v := k.data["k"]
+		nv := make([]byte, len(v)+len(chunk))
+		copy(nv, v)
+		copy(nv[len(v):], chunk)
+		k.storeLocked("k", nv)
+		k.mu.Unlock()
+	}
+}
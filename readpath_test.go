@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// cowStore is the copy-on-write read path evaluated against kv: readers
+// load an immutable map through an atomic pointer without locking, and
+// writers copy the map under a mutex and swap the pointer. It keeps values
+// as immutable strings, which is what makes the lock-free read safe, and
+// is why it cannot zero replaced or deleted values the way kv does.
+type cowStore struct {
+	mu sync.Mutex
+	m  atomic.Pointer[map[string]string]
+}
+
+func newCOWStore() *cowStore {
+	s := &cowStore{}
+	m := make(map[string]string)
+	s.m.Store(&m)
+	return s
+}
+
+func (s *cowStore) get(key string) (string, bool) {
+	v, ok := (*s.m.Load())[key]
+	return v, ok
+}
+
+func (s *cowStore) update(fn func(map[string]string)) {
+	s.mu.Lock()
+	old := *s.m.Load()
+	m := make(map[string]string, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	fn(m)
+	s.m.Store(&m)
+	s.mu.Unlock()
+}
+
+func (s *cowStore) set(key, val string) { s.update(func(m map[string]string) { m[key] = val }) }
+func (s *cowStore) del(key string)      { s.update(func(m map[string]string) { delete(m, key) }) }
+
+func TestCOWStoreConcurrent(t *testing.T) {
+	s := newCOWStore()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				k := strconv.Itoa(w*1000 + i)
+				s.set(k, k)
+				if v, ok := s.get(k); !ok || v != k {
+					t.Errorf("get(%s) = %q, %v", k, v, ok)
+				}
+				if i%2 == 0 {
+					s.del(k)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if n := len(*s.m.Load()); n != 400 {
+		t.Fatalf("%d keys, want 400", n)
+	}
+}
+
+const readPathKeys = 10000
+
+// benchmarkReadPath runs parallel GETs while one goroutine keeps writing.
+func benchmarkReadPath(b *testing.B, get func(string) (string, bool), set func(string, string)) {
+	keys := make([]string, readPathKeys)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+		set(keys[i], "value")
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				set(keys[i%len(keys)], "value")
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			get(keys[i%len(keys)])
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func BenchmarkReadPathRWMutex(b *testing.B) {
+	s := newKV()
+	benchmarkReadPath(b, s.get, s.set)
+}
+
+func BenchmarkReadPathCOW(b *testing.B) {
+	s := newCOWStore()
+	benchmarkReadPath(b, s.get, s.set)
+}
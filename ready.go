@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness states, as READY and /ready report them.
+const (
+	stateReady    int32 = iota // serving the data it was started or last loaded with
+	stateLoading               // a startup load or a LOAD is in progress
+	stateDegraded              // serving, but the startup snapshot could not be loaded
+)
+
+var stateNames = [...]string{stateReady: "ready", stateLoading: "loading", stateDegraded: "degraded"}
+
+// readiness tracks whether the data set is fully loaded. It is lock-free so
+// a probe never waits behind a load.
+type readiness struct {
+	base  atomic.Int32 // stateReady or stateDegraded
+	loads atomic.Int32 // loads in progress
+}
+
+// beginLoad marks a load as running; the returned func ends it, recording
+// whether it replaced the data set.
+func (r *readiness) beginLoad() (end func(loaded bool)) {
+	r.loads.Add(1)
+	return func(loaded bool) {
+		if loaded {
+			r.base.Store(stateReady)
+		}
+		r.loads.Add(-1)
+	}
+}
+
+func (r *readiness) degrade() {
+	r.base.Store(stateDegraded)
+}
+
+func (r *readiness) state() string {
+	if r.loads.Load() > 0 {
+		return stateNames[stateLoading]
+	}
+	return stateNames[r.base.Load()]
+}
+
+// cmdReady handles READY, which replies "ready", "loading" or "degraded".
+func cmdReady(s *server, cl *client, args []string) reply {
+	return strReply(s.ready.state())
+}
+
+// serveReady serves readyHandler on addr. It is started before the
+// startup load, so probes see "loading" while that runs.
+func (s *server) serveReady(addr string) {
+	if err := http.ListenAndServe(addr, s.readyHandler()); err != nil {
+		slog.Error("readiness endpoint stopped", "addr", addr, "err", err)
+	}
+}
+
+// readyHandler answers GET /ready with 200 when the server is ready and
+// 503 otherwise, the state name being the body.
+func (s *server) readyHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ready", func(w http.ResponseWriter, r *http.Request) {
+		state := s.ready.state()
+		if state != stateNames[stateReady] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(state + "\n"))
+	})
+	return mux
+}
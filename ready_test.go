@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	ready := func() string { return srv.dispatch(cl, []string{"READY"}).text }
+	if got := ready(); got != "ready" {
+		t.Fatalf("READY on a fresh server = %q", got)
+	}
+
+	end := srv.ready.beginLoad()
+	if got := ready(); got != "loading" {
+		t.Errorf("READY during a load = %q", got)
+	}
+	srv.ready.degrade()
+	end(false)
+	if got := ready(); got != "degraded" {
+		t.Errorf("READY after a best-effort fallback = %q", got)
+	}
+
+	// A failed LOAD leaves the state alone; a successful one clears it.
+	file := filepath.Join(t.TempDir(), "db.bin")
+	if r := srv.dispatch(cl, []string{"LOAD", file, "pw"}); r.kind != kindErr {
+		t.Fatalf("LOAD of a missing file = %+v", r)
+	}
+	if got := ready(); got != "degraded" {
+		t.Errorf("READY after a failed LOAD = %q", got)
+	}
+	if err := saveToFile(newKV(), file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if r := srv.dispatch(cl, []string{"LOAD", file, "pw"}); r.kind != kindOK {
+		t.Fatalf("LOAD = %+v", r)
+	}
+	if got := ready(); got != "ready" {
+		t.Errorf("READY after LOAD = %q", got)
+	}
+}
+
+func TestReadyDuringPause(t *testing.T) {
+	srv := newServer(config{})
+	srv.pause.set(time.Minute, true)
+	defer srv.pause.lift()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cl := &client{ctx: ctx}
+	done := make(chan reply, 1)
+	go func() { done <- srv.dispatch(cl, []string{"READY"}) }()
+	select {
+	case r := <-done:
+		if r.text != "ready" {
+			t.Fatalf("READY = %+v", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("READY blocked behind CLIENT PAUSE")
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	srv := newServer(config{})
+	ts := httptest.NewServer(srv.readyHandler())
+	defer ts.Close()
+	get := func() (int, string) {
+		resp, err := http.Get(ts.URL + "/ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, body := get(); code != http.StatusOK || body != "ready\n" {
+		t.Errorf("GET /ready = %d %q", code, body)
+	}
+	end := srv.ready.beginLoad()
+	defer end(true)
+	if code, body := get(); code != http.StatusServiceUnavailable || body != "loading\n" {
+		t.Errorf("GET /ready while loading = %d %q", code, body)
+	}
+}
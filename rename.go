@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoSuchKey = errors.New("no such key")
+
+// takenKey is a key's value of any type, with what the shard knows about
+// it, lifted out of a shard by takeLocked.
+type takenKey struct {
+	data       []byte
+	compressed int // raw length if data is deflated, else 0
+	hll        bool
+	stream     *stream
+	counter    int64
+	isCounter  bool
+	geo        *geoSet
+	expiry     time.Time
+	hasExpiry  bool
+}
+
+// takeLocked removes key and returns its value without zeroing it, so it
+// can be stored again under another name. k.mu must be held.
+func (k *kvShard) takeLocked(key string) (t takenKey, ok bool) {
+	if st, found := k.streams[key]; found {
+		k.addUsed(-st.size(key))
+		t.stream = st
+		delete(k.streams, key)
+	} else if n, found := k.counters[key]; found {
+		k.addUsed(-counterSize(key))
+		t.counter, t.isCounter = n, true
+		delete(k.counters, key)
+	} else if g, found := k.geos[key]; found {
+		k.addUsed(-g.size(key))
+		t.geo = g
+		delete(k.geos, key)
+	} else if v, found := k.data[key]; found {
+		k.addUsed(-int64(len(key) + len(v)))
+		t.data, t.compressed, t.hll = v, k.compressed[key], k.hll[key]
+		delete(k.data, key)
+		delete(k.compressed, key)
+		delete(k.hll, key)
+	} else {
+		return takenKey{}, false
+	}
+	t.expiry, t.hasExpiry = k.expiry[key]
+	delete(k.expiry, key)
+	if k.lru != nil {
+		k.lru.remove(key)
+	}
+	return t, true
+}
+
+// putLocked stores t at key, which must not hold a value. k.mu must be
+// held.
+func (k *kvShard) putLocked(key string, t takenKey) {
+	switch {
+	case t.stream != nil:
+		k.streams[key] = t.stream
+		k.addUsed(t.stream.size(key))
+	case t.isCounter:
+		k.counters[key] = t.counter
+		k.addUsed(counterSize(key))
+	case t.geo != nil:
+		k.geos[key] = t.geo
+		k.addUsed(t.geo.size(key))
+	default:
+		k.data[key] = t.data
+		if t.compressed > 0 {
+			k.compressed[key] = t.compressed
+		}
+		if t.hll {
+			k.hll[key] = true
+		}
+		k.addUsed(int64(len(key) + len(t.data)))
+	}
+	if t.hasExpiry {
+		k.expiry[key] = t.expiry
+	}
+	if k.lru != nil {
+		k.lru.touch(key)
+		k.evictLocked(key)
+	}
+	k.notePeakLocked()
+}
+
+// rename moves the value at src, of any type and with its TTL, to dst,
+// replacing and zeroing whatever dst held, under the write locks of both
+// keys' shards. The value's bytes move with it rather than being copied,
+// so no copy is left behind unzeroed. Renaming a key to itself leaves it
+// as it is. A string value must pass the schema of dst.
+func (k *kv) rename(src, dst string) error {
+	check := k.schemaCheck(dst)
+	src, dst = k.name(src), k.name(dst)
+	unlock := k.lockNames([]string{src, dst}, true)
+	defer unlock()
+	from, to := k.shardOf(src), k.shardOf(dst)
+	from.reapLocked(src)
+	kind := from.typeLocked(src)
+	if kind == "none" {
+		return errNoSuchKey
+	}
+	if src == dst {
+		return nil
+	}
+	if check != nil {
+		if v, ok, fresh := from.valueLocked(src); ok {
+			err := check(v)
+			if fresh {
+				zero(v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	t, ok := from.takeLocked(src)
+	if !ok {
+		return errReadOnly // a value served from a mapped snapshot
+	}
+	to.reapLocked(dst)
+	to.deleteLocked(dst)
+	to.putLocked(dst, t)
+	if kind == "stream" {
+		k.signal()
+	}
+	return nil
+}
+
+// cmdRename handles RENAME src dst.
+func cmdRename(s *server, cl *client, args []string) reply {
+	if r, ok := s.controlChars(cl, "RENAME", args[1], nil); !ok {
+		return r
+	}
+	if err := s.db(cl).rename(args[0], args[1]); err != nil {
+		return errReply(err.Error())
+	}
+	return okReply
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	srv := newServer(config{compressAbove: 100})
+	db := srv.dbs[0]
+	cl := &client{}
+	big := strings.Repeat("a", 1000)
+	db.set("big", big)
+	db.expire("big", 3600e9)
+	db.set("old", "displaced")
+	before, _ := db.memory()
+	if got := srv.dispatch(cl, []string{"RENAME", "big", "old"}); got.kind != kindOK {
+		t.Fatalf("RENAME = %+v", got)
+	}
+	if v, ok := db.get("old"); !ok || v != big {
+		t.Errorf("old = %d bytes, %v after RENAME", len(v), ok)
+	}
+	if db.exists("big") {
+		t.Error("big still exists after RENAME")
+	}
+	if _, _, hasTTL := db.ttl("old"); !hasTTL {
+		t.Error("TTL did not move with the value")
+	}
+	// The displaced value is gone; the moved one keeps its compressed size
+	// under a name of the same length.
+	if after, _ := db.memory(); after != before-int64(len("old")+len("displaced")) {
+		t.Errorf("used %d after RENAME, was %d", after, before)
+	}
+
+	// Other types move whole.
+	srv.dispatch(cl, []string{"XADD", "s", "1-1", "f", "v"})
+	srv.dispatch(cl, []string{"PFADD", "h", "x"})
+	srv.dispatch(cl, []string{"RENAME", "s", "s2"})
+	srv.dispatch(cl, []string{"RENAME", "h", "h2"})
+	if got := db.typeOf("s2"); got != "stream" {
+		t.Errorf("s2 is a %s", got)
+	}
+	if got := srv.dispatch(cl, []string{"PFCOUNT", "h2"}); got.text != "1" {
+		t.Errorf("PFCOUNT h2 = %+v", got)
+	}
+
+	if got := srv.dispatch(cl, []string{"RENAME", "missing", "x"}); got.text != errNoSuchKey.Error() {
+		t.Errorf("RENAME missing = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"RENAME", "old", "old"}); got.kind != kindOK || !db.exists("old") {
+		t.Errorf("RENAME onto itself = %+v", got)
+	}
+	db.set("gone", "v")
+	backdate(db, "gone")
+	if got := srv.dispatch(cl, []string{"RENAME", "gone", "x"}); got.kind != kindErr {
+		t.Errorf("RENAME of an expired key = %+v", got)
+	}
+}
+
+// TestRenameConcurrent checks that a reader finds the value under exactly
+// one of the names at any moment.
+func TestRenameConcurrent(t *testing.T) {
+	db := newKV()
+	db.set("k0", "v")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	stop := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, ok := db.mget([]string{"k0", "k1"})
+			if ok[0] == ok[1] {
+				t.Errorf("mget found k0 %v, k1 %v", ok[0], ok[1])
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		src, dst := "k"+strconv.Itoa(i%2), "k"+strconv.Itoa((i+1)%2)
+		if err := db.rename(src, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRenameAOF(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aof")
+	srv := openAOFServer(t, file, "pw")
+	srv.dbs[0].set("a", "1")
+	srv.dbs[0].set("b", "2")
+	srv.dispatch(&client{}, []string{"RENAME", "a", "b"})
+	got := reopenAOF(t, file, "pw")
+	if v, _ := got.dbs[0].get("b"); v != "1" || got.dbs[0].exists("a") {
+		t.Errorf("replayed %s", snapshotJSON(got.dbs[0]))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+type replyKind int
+
+const (
+	kindOK replyKind = iota
+	kindNil
+	kindErr
+	kindValue
+	kindArray // a count line followed by the items
+	kindLines // the items, without a count
+)
+
+// reply is the result of a command. Handlers build replies; the client
+// renders them onto the connection.
+type reply struct {
+	kind  replyKind
+	text  string
+	items []reply
+}
+
+var (
+	okReply  = reply{kind: kindOK}
+	nilReply = reply{kind: kindNil}
+
+	// noopReply answers a blank line in HELLO STRICT mode.
+	noopReply = strReply("NOOP")
+)
+
+// errReply is "ERR <msg>", or a bare "ERR" when msg is empty.
+func errReply(msg string) reply {
+	return reply{kind: kindErr, text: msg}
+}
+
+func strReply(s string) reply {
+	return reply{kind: kindValue, text: s}
+}
+
+func intReply(n int64) reply {
+	return strReply(strconv.FormatInt(n, 10))
+}
+
+func arrayReply(items []string) reply {
+	r := reply{kind: kindArray, items: make([]reply, len(items))}
+	for i, it := range items {
+		r.items[i] = strReply(it)
+	}
+	return r
+}
+
+func linesReply(items []reply) reply {
+	return reply{kind: kindLines, items: items}
+}
+
+// appendText renders r in the line protocol.
+func (r reply) appendText(b *strings.Builder, eol string) {
+	switch r.kind {
+	case kindOK:
+		b.WriteString("OK")
+	case kindNil:
+		b.WriteString("NIL")
+	case kindErr:
+		b.WriteString("ERR")
+		if r.text != "" {
+			b.WriteString(" " + r.text)
+		}
+	case kindValue:
+		b.WriteString(r.text)
+	case kindArray, kindLines:
+		if r.kind == kindArray {
+			b.WriteString(strconv.Itoa(len(r.items)) + eol)
+		}
+		for _, it := range r.items {
+			it.appendText(b, eol)
+		}
+		return
+	}
+	b.WriteString(eol)
+}
+
+// Status bytes of the binary reply protocol negotiated with HELLO BINARY.
+// Only statusValue is followed by a payload: a 4-byte big-endian length
+// and that many bytes.
+const (
+	statusOK    byte = 0
+	statusNil   byte = 1
+	statusErr   byte = 2
+	statusValue byte = 3
+)
+
+// appendBinary renders r in the binary protocol. Lists become a value
+// holding the count followed by one reply per item, mirroring the text
+// protocol line for line.
+func (r reply) appendBinary(b *bytes.Buffer) {
+	switch r.kind {
+	case kindOK:
+		b.WriteByte(statusOK)
+	case kindNil:
+		b.WriteByte(statusNil)
+	case kindErr:
+		b.WriteByte(statusErr)
+	case kindValue:
+		appendBinaryValue(b, r.text)
+	case kindArray, kindLines:
+		if r.kind == kindArray {
+			appendBinaryValue(b, strconv.Itoa(len(r.items)))
+		}
+		for _, it := range r.items {
+			it.appendBinary(b)
+		}
+	}
+}
+
+func appendBinaryValue(b *bytes.Buffer, s string) {
+	b.WriteByte(statusValue)
+	b.Write(binary.BigEndian.AppendUint32(nil, uint32(len(s))))
+	b.WriteString(s)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// defaultScanCount is the page size of SCAN without COUNT.
+const defaultScanCount = 10
+
+// scanStart is the cursor that begins an iteration and, returned by
+// SCAN, ends one. Any other cursor is scanCursorPrefix followed by the
+// hex-encoded last key returned.
+const (
+	scanStart        = "0"
+	scanCursorPrefix = "x"
+)
+
+// scan returns, in byte order, up to count keys matching pattern that sort
+// after the key after, or from the first key when first is set. more
+// reports whether matching keys remain beyond those returned.
+//
+// Keys are visited in sorted order rather than map order, so the cursor is
+// just the last key returned and the server keeps no iteration state: a
+// key that exists for a whole iteration sorts after every cursor before
+// its turn and is returned exactly once; keys added or removed meanwhile
+// may or may not be. Each call walks every key, one shard at a time under
+// that shard's read lock, keeping only the count+1 smallest candidates.
+func (k *kv) scan(after string, first bool, pattern string, count int) (keys []string, more bool) {
+	count = min(count, math.MaxInt-1) // so count+1 cannot overflow
+	best := make([]string, 0, min(count, 1024)+1)
+	now := time.Now()
+	for _, sh := range k.shards {
+		sh.mu.RLock()
+		sh.eachKeyLocked(func(key string) bool {
+			if !first && key <= after || sh.expiredLocked(key, now) {
+				return true
+			}
+			if len(best) == count+1 && key >= best[count] {
+				return true
+			}
+			if !globMatch(pattern, key) {
+				return true
+			}
+			i, _ := slices.BinarySearch(best, key)
+			best = slices.Insert(best, i, key)
+			if len(best) > count+1 {
+				best = best[:count+1]
+			}
+			return true
+		})
+		sh.mu.RUnlock()
+	}
+	if len(best) > count {
+		return best[:count], true
+	}
+	return best, false
+}
+
+// cmdScan handles SCAN cursor [MATCH pattern] [COUNT n]. The reply is the
+// next cursor, scanStart once the iteration is complete, followed by the
+// keys of this page as an array.
+func cmdScan(s *server, cl *client, args []string) reply {
+	cursor, opts := args[0], args[1:]
+	pattern, count := "*", defaultScanCount
+	for len(opts) > 0 {
+		if len(opts) < 2 {
+			return errReply("syntax error")
+		}
+		switch strings.ToUpper(opts[0]) {
+		case "MATCH":
+			pattern = opts[1]
+		case "COUNT":
+			n, err := strconv.Atoi(opts[1])
+			if err != nil || n <= 0 {
+				return errReply("COUNT must be a positive integer")
+			}
+			count = n
+		default:
+			return errReply("syntax error")
+		}
+		opts = opts[2:]
+	}
+	var after []byte
+	first := cursor == scanStart
+	if !first {
+		var err error
+		hexKey, ok := strings.CutPrefix(cursor, scanCursorPrefix)
+		if after, err = hex.DecodeString(hexKey); !ok || err != nil {
+			return errReply(errInvalidCursor.Error())
+		}
+	}
+	keys, more := s.db(cl).scan(string(after), first, pattern, count)
+	next := scanStart
+	if more {
+		next = scanCursorPrefix + hex.EncodeToString([]byte(keys[len(keys)-1]))
+	}
+	return linesReply([]reply{strReply(next), arrayReply(keys)})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// scanAll runs a SCAN iteration to completion and returns every key it
+// returned, in order.
+func scanAll(t *testing.T, srv *server, cl *client, opts ...string) []string {
+	t.Helper()
+	var keys []string
+	cursor := scanStart
+	for {
+		r := srv.dispatch(cl, append([]string{"SCAN", cursor}, opts...))
+		if r.kind != kindLines || len(r.items) != 2 {
+			t.Fatalf("SCAN %s = %+v", cursor, r)
+		}
+		for _, it := range r.items[1].items {
+			keys = append(keys, it.text)
+		}
+		if cursor = r.items[0].text; cursor == scanStart {
+			return keys
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for _, k := range []string{"b", "a", "", "c:1", "c:2"} {
+		srv.dbs[0].set(k, "v")
+	}
+	srv.dispatch(cl, []string{"XADD", "s", "*", "f", "v"})
+	srv.dispatch(cl, []string{"NEXTID", "n"})
+	got := fmt.Sprint(scanAll(t, srv, cl, "COUNT", "2"))
+	want := fmt.Sprint([]string{"", "a", "b", "c:1", "c:2", "n", "s"})
+	if got != want {
+		t.Errorf("SCAN = %s, want %s", got, want)
+	}
+	if got := fmt.Sprint(scanAll(t, srv, cl, "MATCH", "c:*", "COUNT", "1")); got != "[c:1 c:2]" {
+		t.Errorf("SCAN MATCH c:* = %s", got)
+	}
+	// A huge COUNT is not allocated up front.
+	huge := strconv.Itoa(math.MaxInt)
+	if got := fmt.Sprint(scanAll(t, srv, cl, "COUNT", huge)); got != want {
+		t.Errorf("SCAN COUNT %s = %s, want %s", huge, got, want)
+	}
+	for _, args := range [][]string{
+		{"SCAN", "zz"},
+		{"SCAN", "0", "COUNT", "0"},
+		{"SCAN", "0", "MATCH"},
+		{"SCAN", "0", "LIMIT", "1"},
+	} {
+		if r := srv.dispatch(cl, args); r.kind != kindErr {
+			t.Errorf("%v = %+v, want an error", args, r)
+		}
+	}
+}
+
+// TestScanUnderConcurrentWrites checks the SCAN guarantee: a key present
+// for the whole iteration is returned, and returned once, however other
+// keys come and go meanwhile.
+func TestScanUnderConcurrentWrites(t *testing.T) {
+	srv := newServer(config{})
+	const stable = 2000
+	for i := 0; i < stable; i++ {
+		srv.dbs[0].set(fmt.Sprintf("stable:%04d", i), "v")
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cl := &client{}
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("churn:%d:%d", w, i%500)
+				if i%2 == 0 {
+					srv.dispatch(cl, []string{"SET", key, "v"})
+				} else {
+					srv.dispatch(cl, []string{"DEL", fmt.Sprintf("churn:%d:%d", w, (i*7)%500)})
+				}
+			}
+		}()
+	}
+	keys := scanAll(t, srv, &client{}, "COUNT", "7")
+	close(stop)
+	wg.Wait()
+
+	seen := make(map[string]int)
+	for _, k := range keys {
+		seen[k]++
+	}
+	for i := 0; i < stable; i++ {
+		if k := fmt.Sprintf("stable:%04d", i); seen[k] != 1 {
+			t.Fatalf("%s returned %d times", k, seen[k])
+		}
+	}
+	for k, n := range seen {
+		if n > 1 {
+			t.Errorf("%s returned %d times", k, n)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errSchemaViolation = errors.New("schema violation")
+
+// maxSchemas bounds the rules of one database.
+const maxSchemas = 1024
+
+// schemaRule constrains the values of keys beginning with prefix. kind is
+// the type as given to SCHEMA SET: "json", "int", "float" or
+// "regex:<pattern>".
+type schemaRule struct {
+	prefix string
+	kind   string
+	re     *regexp.Regexp // for a regex rule, anchored to the whole value
+}
+
+// schemas is a database's set of rules, longest prefix first. It is never
+// changed once stored in kv.schemas; SCHEMA SET and DEL store a new one.
+type schemas []schemaRule
+
+// parseSchemaRule checks a rule's type and compiles its pattern.
+func parseSchemaRule(prefix, kind string) (schemaRule, error) {
+	r := schemaRule{prefix: prefix, kind: kind}
+	switch {
+	case kind == "json", kind == "int", kind == "float":
+	case strings.HasPrefix(kind, "regex:"):
+		re, err := regexp.Compile(`^(?:` + strings.TrimPrefix(kind, "regex:") + `)$`)
+		if err != nil {
+			return schemaRule{}, fmt.Errorf("invalid schema pattern: %v", err)
+		}
+		r.re = re
+	default:
+		return schemaRule{}, fmt.Errorf("unknown schema type '%s'; want json, int, float or regex:<pattern>", kind)
+	}
+	return r, nil
+}
+
+func (r schemaRule) allows(val []byte) bool {
+	switch r.kind {
+	case "json":
+		return json.Valid(val)
+	case "int":
+		_, err := strconv.ParseInt(string(val), 10, 64)
+		return err == nil
+	case "float":
+		_, err := strconv.ParseFloat(string(val), 64)
+		return err == nil
+	}
+	return r.re.Match(val)
+}
+
+// with returns a copy of ss with rule r added, replacing any rule for the
+// same prefix.
+func (ss schemas) with(r schemaRule) schemas {
+	out := append(ss.without(r.prefix), r)
+	sort.SliceStable(out, func(i, j int) bool { return len(out[i].prefix) > len(out[j].prefix) })
+	return out
+}
+
+// without returns a copy of ss with no rule for prefix.
+func (ss schemas) without(prefix string) schemas {
+	out := make(schemas, 0, len(ss)+1)
+	for _, r := range ss {
+		if r.prefix != prefix {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// dump returns the rules as the prefix-to-type map a snapshot stores, or
+// nil if there are none.
+func (ss schemas) dump() map[string]string {
+	if len(ss) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(ss))
+	for _, r := range ss {
+		m[r.prefix] = r.kind
+	}
+	return m
+}
+
+// parseSchemas rebuilds the rules a snapshot stored.
+func parseSchemas(m map[string]string) (schemas, error) {
+	var ss schemas
+	for prefix, kind := range m {
+		r, err := parseSchemaRule(prefix, kind)
+		if err != nil {
+			return nil, fmt.Errorf("schema for %q: %w", prefix, err)
+		}
+		ss = ss.with(r)
+	}
+	return ss, nil
+}
+
+// checkSchema checks val, about to be stored at key as given by the
+// client, against the rule with the longest prefix of key. A key no rule
+// covers may hold anything.
+func (k *kv) checkSchema(key string, val []byte) error {
+	if check := k.schemaCheck(key); check != nil {
+		return check(val)
+	}
+	return nil
+}
+
+// schemaCheck returns the check of values about to be stored at key, as
+// given by the client, for a command that computes the value under its
+// shard's lock, or nil if no rule covers key.
+func (k *kv) schemaCheck(key string) func(val []byte) error {
+	for _, r := range k.loadSchemas() {
+		if strings.HasPrefix(key, r.prefix) {
+			return func(val []byte) error {
+				if !r.allows(val) {
+					return errSchemaViolation
+				}
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// cmdSchema handles SCHEMA SET prefix type, SCHEMA DEL prefix and SCHEMA
+// LIST, which manage the rules checkSchema applies to the selected
+// database. Rules only affect later writes: values already stored are not
+// checked.
+func cmdSchema(s *server, cl *client, args []string) reply {
+	db := s.db(cl)
+	sub := strings.ToUpper(args[0])
+	switch {
+	case sub == "SET" && len(args) == 3:
+		r, err := parseSchemaRule(args[1], args[2])
+		if err != nil {
+			return errReply(err.Error())
+		}
+		defer db.lockSchemas()()
+		old := db.loadSchemas()
+		if len(old) >= maxSchemas && len(old.without(r.prefix)) == len(old) {
+			return errReply(fmt.Sprintf("too many schemas; the limit is %d", maxSchemas))
+		}
+		ss := old.with(r)
+		db.storeSchemas(ss)
+		return okReply
+	case sub == "DEL" && len(args) == 2:
+		defer db.lockSchemas()()
+		old := db.loadSchemas()
+		ss := old.without(args[1])
+		if len(ss) == len(old) {
+			return intReply(0)
+		}
+		db.storeSchemas(ss)
+		return intReply(1)
+	case sub == "LIST" && len(args) == 1:
+		ss := db.loadSchemas()
+		lines := make([]string, len(ss))
+		for i, r := range ss {
+			lines[i] = r.prefix + " " + r.kind
+		}
+		sort.Strings(lines)
+		return arrayReply(lines)
+	case sub == "SET", sub == "DEL", sub == "LIST":
+		return wrongArgs("schema " + strings.ToLower(args[0]))
+	}
+	return errReply(fmt.Sprintf("unknown subcommand '%s'", args[0]))
+}
+
+// lockSchemas takes schemaMu for a change to the rules and returns the
+// unlock. With a log it first takes every shard's lock, as the writes that
+// log a full record hold them, so that the rules such a record captures
+// cannot be overtaken by a change logged before it.
+func (k *kv) lockSchemas() (unlock func()) {
+	if k.aof == nil {
+		k.schemaMu.Lock()
+		return k.schemaMu.Unlock
+	}
+	k.lockAll()
+	k.schemaMu.Lock()
+	return func() {
+		k.schemaMu.Unlock()
+		k.unlockAll()
+	}
+}
+
+// storeSchemas replaces the rules, logging them if the store has a log.
+// The caller holds lockSchemas.
+func (k *kv) storeSchemas(ss schemas) {
+	k.schemas.Store(&ss)
+	if k.aof != nil {
+		k.aof.append(schemasRecord(ss))
+	}
+}
+
+// loadSchemas returns the database's rules, or nil.
+func (k *kv) loadSchemas() schemas {
+	if ss := k.schemas.Load(); ss != nil {
+		return *ss
+	}
+	return nil
+}
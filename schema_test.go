@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for _, args := range [][]string{
+		{"SCHEMA", "SET", "doc:", "json"},
+		{"SCHEMA", "SET", "n:", "int"},
+		{"SCHEMA", "SET", "n:f:", "float"},
+		{"SCHEMA", "SET", "id:", "regex:[a-z]{3}-[0-9]+"},
+	} {
+		if got := srv.dispatch(cl, args); got.kind != kindOK {
+			t.Fatalf("%v = %+v", args, got)
+		}
+	}
+	for _, tc := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"SET", "doc:1", `{"a":[1,2]}`}, true},
+		{[]string{"SET", "doc:2", `{"a":`}, false},
+		{[]string{"SET", "n:1", "-42"}, true},
+		{[]string{"SET", "n:2", "4.2"}, false},
+		// The longest prefix decides.
+		{[]string{"SET", "n:f:1", "4.2"}, true},
+		{[]string{"SET", "n:f:2", "many"}, false},
+		{[]string{"SET", "id:1", "abc-17"}, true},
+		{[]string{"SET", "id:2", "abc-17x"}, false},
+		{[]string{"SET", "other", "anything"}, true},
+		{[]string{"SETNX", "n:3", "x"}, false},
+		{[]string{"MSET", "n:4", "1", "n:5", "x"}, false},
+	} {
+		got := srv.dispatch(cl, tc.args)
+		if tc.ok != (got.kind != kindErr) || !tc.ok && got.text != errSchemaViolation.Error() {
+			t.Errorf("%v = %+v", tc.args, got)
+		}
+	}
+	if srv.dbs[0].exists("n:4") {
+		t.Error("MSET stored part of a rejected batch")
+	}
+	// Rules are per database.
+	if got := srv.dispatch(&client{db: 1}, []string{"SET", "n:1", "x"}); got.kind != kindOK {
+		t.Errorf("SET in database 1 = %+v", got)
+	}
+
+	for _, args := range [][]string{
+		{"SCHEMA", "SET", "x:", "date"},
+		{"SCHEMA", "SET", "x:", "regex:("},
+		{"SCHEMA", "SET", "x:"},
+		{"SCHEMA", "NOPE"},
+	} {
+		if got := srv.dispatch(cl, args); got.kind != kindErr {
+			t.Errorf("%v = %+v", args, got)
+		}
+	}
+	list := lineTexts(srv.dispatch(cl, []string{"SCHEMA", "LIST"}))
+	if len(list) != 4 || list[0] != "doc: json" {
+		t.Errorf("SCHEMA LIST = %q", list)
+	}
+
+	// The rules are saved with the data.
+	file := filepath.Join(t.TempDir(), "db")
+	if err := saveToFile(srv.dbs[0], file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.dispatch(cl, []string{"SCHEMA", "DEL", "n:"}); got.text != "1" {
+		t.Errorf("SCHEMA DEL = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"SET", "n:2", "x"}); got.kind != kindOK {
+		t.Errorf("SET after SCHEMA DEL = %+v", got)
+	}
+	if err := loadFromFile(srv.dbs[0], file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.dispatch(cl, []string{"SET", "n:2", "x"}); got.text != errSchemaViolation.Error() {
+		t.Errorf("SET after LOAD = %+v", got)
+	}
+}
+
+// TestSchemaComputedValues checks the commands that work out the value
+// they store from the one already there.
+func TestSchemaComputedValues(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SCHEMA", "SET", "n:", "int"})
+	srv.dispatch(cl, []string{"SCHEMA", "SET", "doc:", "json"})
+	srv.dispatch(cl, []string{"SCHEMA", "SET", "w:", `regex:\{\s.*`})
+	srv.dispatch(cl, []string{"SCHEMA", "SET", "r:", "regex:[a-z]+"})
+	srv.dispatch(cl, []string{"SCHEMA", "SET", "pos:", "regex:[0-9]+"})
+	srv.dispatch(cl, []string{"SET", "n:1", "12"})
+	srv.dispatch(cl, []string{"SET", "doc:1", `{"a":1}`})
+	srv.dispatch(cl, []string{"SET", "w:1", `{ "a": 1 }`})
+	srv.dispatch(cl, []string{"SET", "free", "text"})
+	for _, tc := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"APPEND", "n:1", "3"}, true},
+		{[]string{"APPEND", "n:1", "x"}, false},
+		{[]string{"SETRANGE", "n:1", "0", "-"}, true},
+		{[]string{"SETRANGE", "n:1", "1", "y"}, false},
+		{[]string{"APPEND", "n:new", "x"}, false},
+		{[]string{"EVAL", "n:1", "append 0"}, true},
+		{[]string{"EVAL", "n:1", "upper"}, true},
+		{[]string{"EVAL", "n:1", "append x"}, false},
+		{[]string{"JSONPATCH", "doc:1", `{"b":2}`}, true},
+		{[]string{"JSONPATCH", "n:1", `{"b":2}`}, false},
+		{[]string{"JSONCOMPACT", "w:1"}, false},
+		{[]string{"SET", "free", "{ }"}, true},
+		{[]string{"RENAME", "free", "n:2"}, false},
+		{[]string{"RENAME", "free", "doc:2"}, true},
+		{[]string{"RENAME", "doc:2", "doc:2"}, true},
+		{[]string{"INCR", "r:x"}, false},
+		{[]string{"DECR", "n:1"}, true},
+		{[]string{"INCR", "pos:1"}, true},
+		{[]string{"DECR", "pos:1"}, true},
+		{[]string{"DECR", "pos:1"}, false},
+		{[]string{"PFADD", "r:h", "a"}, false},
+		{[]string{"PFADD", "free:h", "a"}, true},
+		{[]string{"PFMERGE", "r:h", "free:h"}, false},
+	} {
+		got := srv.dispatch(cl, tc.args)
+		if tc.ok != (got.kind != kindErr) || !tc.ok && got.text != errSchemaViolation.Error() {
+			t.Errorf("%v = %+v", tc.args, got)
+		}
+	}
+	db := srv.dbs[0]
+	for key, want := range map[string]string{"n:1": "-231", "pos:1": "0", "doc:1": `{"a":1,"b":2}`, "w:1": `{ "a": 1 }`, "doc:2": "{ }"} {
+		if got, _ := db.get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if db.exists("n:new") || db.exists("n:2") || db.exists("free") || db.exists("r:x") || db.exists("r:h") {
+		t.Error("a refused write stored a value")
+	}
+}
+
+func TestSchemaAtomicIncr(t *testing.T) {
+	srv := newServer(config{})
+	srv.dispatch(&client{}, []string{"SCHEMA", "SET", "r:", "regex:[a-z]+"})
+	c, _ := pipelineConn(t, srv)
+	io.WriteString(c, "ATOMIC 3\nINCR r:x\nDECR r:y\nINCR n\n")
+	r := bufio.NewReader(c)
+	var got []string
+	for range 4 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.TrimSuffix(line, "\n"))
+	}
+	want := "3|ERR schema violation|ERR schema violation|1"
+	if strings.Join(got, "|") != want {
+		t.Errorf("ATOMIC = %q, want %q", strings.Join(got, "|"), want)
+	}
+	if db := srv.dbs[0]; db.exists("r:x") || db.exists("r:y") {
+		t.Error("ATOMIC stored a value its schema refuses")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "strings"
+
+// setNX stores val at key only if the key holds no value of any type, and
+// reports whether it did. The check and the store happen under one hold of
+// the shard's write lock, so of several clients racing to set the same key
+// exactly one succeeds. A stored value is logged like a SET.
+func (k *kv) setNX(key, val string) bool {
+	sh, key := k.route(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return k.setNXLocked(sh, key, []byte(val))
+}
+
+// setNXLocked is setNX for a caller holding the lock of sh, the shard of
+// the stored name key. The store takes ownership of val if it stores it.
+func (k *kv) setNXLocked(sh *kvShard, key string, val []byte) bool {
+	sh.reapLocked(key)
+	if sh.typeLocked(key) != "none" {
+		return false
+	}
+	k.setLocked(sh, key, val)
+	return true
+}
+
+// cmdSetNX handles SETNX key value. The value is taken as SET takes it.
+// It replies 1 if the value was stored and 0 if the key already existed.
+func cmdSetNX(s *server, cl *client, args []string) reply {
+	key, val := args[0], strings.Join(args[1:], " ")
+	if val == emptyValue {
+		val = ""
+	}
+	if s.cfg.maxValueBytes > 0 && len(val) > s.cfg.maxValueBytes {
+		return errReply(errValueTooLarge.Error())
+	}
+	if r, ok := s.controlChars(cl, "SETNX", key, []byte(val)); !ok {
+		return r
+	}
+	db := s.db(cl)
+	if err := db.checkSchema(key, []byte(val)); err != nil {
+		return errReply(err.Error())
+	}
+	if db.setNX(key, val) {
+		return intReply(1)
+	}
+	return intReply(0)
+}
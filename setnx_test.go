@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSetNX(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SETNX", "lock", "owner", "1"}, "1"},
+		{[]string{"SETNX", "lock", "owner", "2"}, "0"},
+		{[]string{"GET", "lock"}, "owner 1"},
+		{[]string{"NEXTID", "seq"}, "1"},
+		{[]string{"SETNX", "seq", "x"}, "0"},
+		{[]string{"SETNX", "empty", `""`}, "1"},
+		{[]string{"GET", "empty"}, ""},
+	} {
+		if got := srv.dispatch(cl, tc.args); got.text != tc.want {
+			t.Errorf("%v = %+v, want %q", tc.args, got, tc.want)
+		}
+	}
+
+	// An expired key no longer exists.
+	backdate(srv.dbs[0], "lock")
+	if got := srv.dispatch(cl, []string{"SETNX", "lock", "owner", "3"}); got.text != "1" {
+		t.Errorf("SETNX over an expired key = %+v", got)
+	}
+
+	// Of many clients racing for one key, exactly one wins.
+	var wins atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if srv.dispatch(&client{}, []string{"SETNX", "race", strconv.Itoa(i)}).text == "1" {
+				wins.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := wins.Load(); n != 1 {
+		t.Errorf("%d clients won the race", n)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A kv spreads its keys over shards by a hash of their stored names. Each
+// shard is a complete store with its own lock and maps, so commands on
+// keys in different shards do not wait for each other. kv routes a call
+// on one key to that key's shard. A call on several keys locks the shards
+// holding them, in index order, and one on the whole store, such as
+// snapshot or replace, locks every shard.
+//
+// Eviction must find the least recently used key of the whole store, and
+// a mapped image is a single index, so a store with a memory bound or a
+// mapped snapshot keeps all its keys in one shard.
+const kvShards = 256
+
+type kv struct {
+	shards []*kvShard
+
+	// mac is the HMAC key of a store whose key names are hashed, or holds
+	// nil; see keyhash.go. It is only replaced with every shard locked,
+	// and is read without a lock to route a key.
+	mac atomic.Pointer[[]byte]
+
+	// streamAdded is closed to wake blocked stream readers; see
+	// streamSignal. It is guarded by sigMu and stays with the store
+	// across SWAPDB.
+	sigMu       sync.Mutex
+	streamAdded chan struct{}
+
+	// mem is the logical size and peak of the store, shared with the
+	// other databases of a server; see mempeak.go.
+	mem *memUsage
+
+	// aof logs the writes of database 0 with -aof, or is nil; see aof.go.
+	// Like shards it is set before the store is used, and it stays with
+	// the database across SWAPDB.
+	aof *aofLog
+
+	// schemas holds the rules SCHEMA SET declared, or nil; see schema.go.
+	// Writers hold schemaMu and store a new set; readers load it without
+	// a lock. The rules go with the data across SWAPDB and LOAD.
+	schemaMu sync.Mutex
+	schemas  atomic.Pointer[schemas]
+}
+
+func newKV() *kv {
+	return newShardedKV(kvShards)
+}
+
+// newShardedKV returns an empty store with n shards.
+func newShardedKV(n int) *kv {
+	k := &kv{shards: make([]*kvShard, n), mem: new(memUsage)}
+	for i := range k.shards {
+		k.shards[i] = newShard()
+		k.shards[i].mem = k.mem
+	}
+	return k
+}
+
+// shardIndex is the index of the shard holding the key stored as name: its
+// 32-bit FNV-1a hash modulo the number of shards.
+func (k *kv) shardIndex(name string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(k.shards)))
+}
+
+func (k *kv) shardOf(name string) *kvShard {
+	return k.shards[k.shardIndex(name)]
+}
+
+// route returns the stored name of a key from a client and the shard that
+// holds it.
+func (k *kv) route(key string) (*kvShard, string) {
+	name := k.name(key)
+	return k.shardOf(name), name
+}
+
+// lockAll takes the write lock of every shard, in index order.
+func (k *kv) lockAll() {
+	for _, sh := range k.shards {
+		sh.mu.Lock()
+	}
+}
+
+func (k *kv) unlockAll() {
+	for _, sh := range k.shards {
+		sh.mu.Unlock()
+	}
+}
+
+// rlockAll takes the read lock of every shard, in index order.
+func (k *kv) rlockAll() {
+	for _, sh := range k.shards {
+		sh.mu.RLock()
+	}
+}
+
+func (k *kv) runlockAll() {
+	for _, sh := range k.shards {
+		sh.mu.RUnlock()
+	}
+}
+
+// lockNames locks each shard holding one of names, which are stored names,
+// once and in index order: for writing if write is set and for reading
+// otherwise. It returns a function that releases them.
+func (k *kv) lockNames(names []string, write bool) (unlock func()) {
+	idx := make([]int, len(names))
+	for i, name := range names {
+		idx[i] = k.shardIndex(name)
+	}
+	slices.Sort(idx)
+	idx = slices.Compact(idx)
+	for _, i := range idx {
+		if write {
+			k.shards[i].mu.Lock()
+		} else {
+			k.shards[i].mu.RLock()
+		}
+	}
+	return func() {
+		for _, i := range idx {
+			if write {
+				k.shards[i].mu.Unlock()
+			} else {
+				k.shards[i].mu.RUnlock()
+			}
+		}
+	}
+}
+
+// unshard moves every key into a single shard. Like setMaxBytes, which
+// calls it, it is meant to be called before the store is used: it
+// replaces k.shards, which callers read without a lock.
+func (k *kv) unshard() {
+	if len(k.shards) == 1 {
+		return
+	}
+	one := newShard()
+	for _, sh := range k.shards {
+		sh.mu.Lock()
+		maps.Copy(one.data, sh.data)
+		maps.Copy(one.streams, sh.streams)
+		maps.Copy(one.counters, sh.counters)
+		maps.Copy(one.geos, sh.geos)
+		maps.Copy(one.compressed, sh.compressed)
+		maps.Copy(one.hll, sh.hll)
+		maps.Copy(one.expiry, sh.expiry)
+		one.used += sh.used // already counted in mem
+		one.evicted += sh.evicted
+		one.mem = sh.mem
+		one.compressAbove = sh.compressAbove
+		sh.mu.Unlock()
+	}
+	k.shards = []*kvShard{one}
+}
+
+// setMaxBytes bounds the logical size of the store; 0 removes the bound.
+// It is meant to be called before the store is used. A bounded store is
+// kept in one shard.
+func (k *kv) setMaxBytes(n int64) {
+	if n > 0 {
+		k.unshard()
+	}
+	for _, sh := range k.shards {
+		sh.setMaxBytes(n)
+	}
+}
+
+// setCompressAbove sets the compression threshold of every shard; see
+// kvShard.setCompressAbove.
+func (k *kv) setCompressAbove(n int) {
+	for _, sh := range k.shards {
+		sh.setCompressAbove(n)
+	}
+}
+
+// memory reports the logical size of the store and how many keys have
+// been evicted to respect maxBytes.
+func (k *kv) memory() (used, evicted int64) {
+	for _, sh := range k.shards {
+		u, e := sh.memory()
+		used += u
+		evicted += e
+	}
+	return used, evicted
+}
+
+// resetEvicted zeroes the eviction count memory reports.
+func (k *kv) resetEvicted() {
+	for _, sh := range k.shards {
+		sh.resetEvicted()
+	}
+}
+
+func (k *kv) len() int {
+	n := 0
+	for _, sh := range k.shards {
+		n += sh.len()
+	}
+	return n
+}
+
+// sizeHistogram counts values per size bucket, one shard at a time.
+func (k *kv) sizeHistogram() []int {
+	counts := make([]int, len(sizeBuckets)+1)
+	for _, sh := range k.shards {
+		for i, n := range sh.sizeHistogram() {
+			counts[i] += n
+		}
+	}
+	return counts
+}
+
+// deleteExpired deletes every key whose deadline has passed and returns
+// how many there were. It takes one shard's lock at a time.
+func (k *kv) deleteExpired(now time.Time) int {
+	n := 0
+	for _, sh := range k.shards {
+		n += sh.deleteExpired(now)
+	}
+	return n
+}
+
+// swapShards exchanges the keys of two shards, whose locks must be held.
+// maxBytes and compressAbove are the same for every database; the eviction
+// counters and peaks stay with the database they were counted in.
+func swapShards(a, b *kvShard) {
+	a.data, b.data = b.data, a.data
+	a.streams, b.streams = b.streams, a.streams
+	a.counters, b.counters = b.counters, a.counters
+	a.geos, b.geos = b.geos, a.geos
+	a.compressed, b.compressed = b.compressed, a.compressed
+	a.hll, b.hll = b.hll, a.hll
+	a.expiry, b.expiry = b.expiry, a.expiry
+	a.used, b.used = b.used, a.used
+	a.lru, b.lru = b.lru, a.lru
+	a.evictLocked("")
+	b.evictLocked("")
+}
+
+// The methods below route a call on one key to the shard holding it. The
+// kvShard methods of the same names document what they do.
+
+func (k *kv) set(key, val string) {
+	k.setBytes(key, []byte(val))
+}
+
+// setBytes and del also append the write to the store's log, if it has
+// one, before they release the shard.
+func (k *kv) setBytes(key string, val []byte) {
+	sh, key := k.route(key)
+	if k.aof == nil {
+		sh.setBytes(key, val)
+		return
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	k.setLocked(sh, key, val)
+}
+
+// setLocked is setBytes for a caller holding the lock of sh, the shard
+// of the stored name key.
+func (k *kv) setLocked(sh *kvShard, key string, val []byte) {
+	if k.aof != nil {
+		k.aof.set(key, val)
+	}
+	delete(sh.expiry, key)
+	sh.storeLocked(key, val)
+}
+
+func (k *kv) get(key string) (string, bool) {
+	sh, key := k.route(key)
+	return sh.get(key)
+}
+
+func (k *kv) read(key string, bump bool) (string, bool) {
+	sh, key := k.route(key)
+	return sh.read(key, bump)
+}
+
+func (k *kv) exists(key string) bool {
+	sh, key := k.route(key)
+	return sh.exists(key)
+}
+
+func (k *kv) del(key string) bool {
+	sh, key := k.route(key)
+	if k.aof == nil {
+		return sh.del(key)
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return k.delLocked(sh, key)
+}
+
+// delLocked is del for a caller holding the lock of sh, the shard of the
+// stored name key.
+func (k *kv) delLocked(sh *kvShard, key string) bool {
+	sh.reapLocked(key)
+	if !sh.deleteLocked(key) {
+		return false
+	}
+	if k.aof != nil {
+		k.aof.del(key)
+	}
+	return true
+}
+
+func (k *kv) typeOf(key string) string {
+	sh, key := k.route(key)
+	return sh.typeOf(key)
+}
+
+func (k *kv) expire(key string, d time.Duration) bool {
+	sh, key := k.route(key)
+	return sh.expire(key, d)
+}
+
+func (k *kv) ttl(key string) (left time.Duration, found, hasTTL bool) {
+	sh, key := k.route(key)
+	return sh.ttl(key)
+}
+
+func (k *kv) encoding(key string) (string, bool) {
+	sh, key := k.route(key)
+	return sh.encoding(key)
+}
+
+func (k *kv) valueSizes(key string) (rawLen, stored int, found bool, err error) {
+	sh, key := k.route(key)
+	return sh.valueSizes(key)
+}
+
+func (k *kv) nextID(key string) (int64, error) {
+	sh, key := k.route(key)
+	return sh.nextID(key)
+}
+
+func (k *kv) incrBy(key string, delta int64) (int64, error) {
+	check := k.schemaCheck(key)
+	sh, key := k.route(key)
+	return sh.incrBy(key, delta, check)
+}
+
+func (k *kv) delToken(key, token string) int {
+	sh, key := k.route(key)
+	return sh.delToken(key, token)
+}
+
+func (k *kv) eval(key string, steps []evalStep, limit int) (string, error) {
+	check := k.schemaCheck(key)
+	sh, key := k.route(key)
+	return sh.eval(key, steps, limit, check)
+}
+
+func (k *kv) setRange(key string, off int, data []byte, atEnd bool, limit int) (int, error) {
+	check := k.schemaCheck(key)
+	sh, key := k.route(key)
+	return sh.setRange(key, off, data, atEnd, limit, check)
+}
+
+func (k *kv) getRange(key string, start, end int) (string, error) {
+	sh, key := k.route(key)
+	return sh.getRange(key, start, end)
+}
+
+func (k *kv) compactJSON(key string) (n int, found bool, err error) {
+	check := k.schemaCheck(key)
+	sh, key := k.route(key)
+	return sh.compactJSON(key, check)
+}
+
+func (k *kv) jsonPatch(key string, patch []byte, limit int) (string, error) {
+	check := k.schemaCheck(key)
+	sh, key := k.route(key)
+	return sh.jsonPatch(key, patch, limit, check)
+}
+
+func (k *kv) jsonGet(key string, path []jsonStep) (v string, found bool, err error) {
+	sh, key := k.route(key)
+	return sh.jsonGet(key, path)
+}
+
+func (k *kv) pfAdd(key string, elems []string) (bool, error) {
+	check := k.schemaCheck(key)
+	sh, key := k.route(key)
+	return sh.pfAdd(key, elems, check)
+}
+
+func (k *kv) geoAdd(key string, items [][3]string) (int64, error) {
+	sh, key := k.route(key)
+	return sh.geoAdd(key, items)
+}
+
+func (k *kv) geoSearch(key string, lon, lat, radius float64) ([]geoMatch, error) {
+	sh, key := k.route(key)
+	return sh.geoSearch(key, lon, lat, radius)
+}
+
+// xadd also wakes blocked readers once the entry is in place.
+func (k *kv) xadd(key, id string, fields []string, trim streamTrim) (streamID, error) {
+	sh, key := k.route(key)
+	next, err := sh.xadd(key, id, fields, trim)
+	if err == nil {
+		k.signal()
+	}
+	return next, err
+}
+
+func (k *kv) xrange(key string, start, end streamID, count int) ([]string, error) {
+	sh, key := k.route(key)
+	return sh.xrange(key, start, end, count)
+}
+
+func (k *kv) xread(key string, after streamID, count int) ([]string, error) {
+	sh, key := k.route(key)
+	return sh.xread(key, after, count)
+}
+
+func (k *kv) lastStreamID(key string) streamID {
+	sh, key := k.route(key)
+	return sh.lastStreamID(key)
+}
+
+func (k *kv) xtrim(key string, t streamTrim) (int, error) {
+	sh, key := k.route(key)
+	return sh.xtrim(key, t)
+}
+
+func (k *kv) streamStats(key string) ([]string, error) {
+	sh, key := k.route(key)
+	return sh.streamStats(key)
+}
+
+func (k *kv) xgroupCreate(key, name, id string, mkstream bool) error {
+	sh, key := k.route(key)
+	return sh.xgroupCreate(key, name, id, mkstream)
+}
+
+func (k *kv) xgroupDestroy(key, name string) (bool, error) {
+	sh, key := k.route(key)
+	return sh.xgroupDestroy(key, name)
+}
+
+func (k *kv) xreadGroup(key, name, consumer, id string, count int) ([]string, error) {
+	sh, key := k.route(key)
+	return sh.xreadGroup(key, name, consumer, id, count)
+}
+
+func (k *kv) xack(key, name string, ids []streamID) (int64, error) {
+	sh, key := k.route(key)
+	return sh.xack(key, name, ids)
+}
+
+func (k *kv) xpending(key, name, consumer string) ([]string, error) {
+	sh, key := k.route(key)
+	return sh.xpending(key, name, consumer)
+}
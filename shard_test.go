@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	k := newKV()
+	var want []string
+	for i := 0; i < 1000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		k.set(key, strconv.Itoa(i))
+		want = append(want, key)
+	}
+	used := 0
+	for _, sh := range k.shards {
+		if len(sh.data) > 0 {
+			used++
+		}
+	}
+	if used < kvShards/2 {
+		t.Errorf("1000 keys landed in %d of %d shards", used, kvShards)
+	}
+	if n := k.len(); n != 1000 {
+		t.Errorf("len = %d", n)
+	}
+	slices.Sort(want)
+
+	// SCAN still visits every key once, in order, across shards.
+	var got []string
+	after, first := "", true
+	for {
+		keys, more := k.scan(after, first, "*", 64)
+		got = append(got, keys...)
+		if !more {
+			break
+		}
+		after, first = keys[len(keys)-1], false
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("SCAN returned %d keys, want %d in order", len(got), len(want))
+	}
+
+	// A bound on memory needs one LRU order, so it gathers every key into
+	// one shard.
+	k.setMaxBytes(1 << 20)
+	if len(k.shards) != 1 || k.len() != 1000 {
+		t.Fatalf("after setMaxBytes: %d shards, %d keys", len(k.shards), k.len())
+	}
+	if v, _ := k.get("key:7"); v != "7" {
+		t.Errorf("key:7 = %q after setMaxBytes", v)
+	}
+}
+
+func TestShardsSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+	src := newKV()
+	for i := 0; i < 100; i++ {
+		src.set("s"+strconv.Itoa(i), "v")
+		src.nextID("n" + strconv.Itoa(i))
+	}
+	src.xadd("st", "*", []string{"f", "v"}, streamTrim{})
+	if err := saveToFile(src, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	// A store with another shard count reads the same file.
+	for _, dst := range []*kv{newKV(), newShardedKV(1)} {
+		if err := loadFromFile(dst, file, "pw"); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.Marshal(src.snapshot())
+		got, _ := json.Marshal(dst.snapshot())
+		if string(got) != string(want) {
+			t.Errorf("%d shards: loaded snapshot differs", len(dst.shards))
+		}
+	}
+}
+
+func TestShardsMultiKey(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for i := 0; i < 20; i++ {
+		srv.dispatch(cl, []string{"PFADD", "h" + strconv.Itoa(i), strconv.Itoa(i)})
+	}
+	args := []string{"PFMERGE", "all"}
+	for i := 0; i < 20; i++ {
+		args = append(args, "h"+strconv.Itoa(i))
+	}
+	if got := srv.dispatch(cl, args); got.kind != kindOK {
+		t.Fatalf("PFMERGE = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"PFCOUNT", "all"}); got.text != "20" {
+		t.Errorf("PFCOUNT after merging across shards = %+v", got)
+	}
+
+	// A concurrent MGET sees all of an MSET or none of it.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			v := strconv.Itoa(i)
+			srv.dispatch(&client{}, []string{"MSET", "a", v, "b", v, "c", v})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		got := srv.dispatch(cl, []string{"MGET", "a", "b", "c"})
+		if a, b, c := got.items[0], got.items[1], got.items[2]; a.text != b.text || b.text != c.text {
+			t.Fatalf("MGET saw a partial MSET: %q %q %q", a.text, b.text, c.text)
+		}
+	}
+	wg.Wait()
+}
+
+// BenchmarkParallelSet runs SETs of distinct keys from every CPU against
+// one shard, which is one lock as before sharding, and against the
+// default shard count.
+func BenchmarkParallelSet(b *testing.B) {
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	for _, n := range []int{1, kvShards} {
+		b.Run("shards="+strconv.Itoa(n), func(b *testing.B) {
+			k := newShardedKV(n)
+			var start atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(start.Add(7919))
+				for pb.Next() {
+					k.set(keys[i%len(keys)], "value")
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+// shutdown stops the server. It closes lns so no new connections are
+// accepted, refuses connections accepted but not yet registered, and asks
+// every handler to exit once the command it is running has replied:
+// idle reads are interrupted by a deadline, and blocking and paused
+// commands are released as if their client had gone. It waits up to
+// timeout for the handlers, then closes the connections of any still
+// running and returns how many it closed, without waiting further.
+func (s *server) shutdown(lns []net.Listener, timeout time.Duration) (forced int) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+	s.mu.Lock()
+	s.draining.Store(true)
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	for _, cl := range s.clientsByID() {
+		cl.cancel()
+		cl.SetReadDeadline(time.Now())
+	}
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+	}
+	for _, cl := range s.clientsByID() {
+		cl.Close()
+		forced++
+	}
+	return forced
+}
+
+// stop shuts the server down on a signal and, if file is set, saves
+// database 0 to it under the password in passFile.
+func (s *server) stop(lns []net.Listener, file, passFile string) error {
+	if n := s.shutdown(lns, s.cfg.shutdownTimeout); n > 0 {
+		slog.Warn("force-closed connections after the shutdown timeout", "connections", n, "timeout", s.cfg.shutdownTimeout)
+	}
+	if a := s.dbs[0].aof; a != nil {
+		if err := a.sync(); err != nil {
+			slog.Error("append-only log fsync failed", "file", a.file, "err", err)
+		}
+	}
+	if file == "" {
+		return nil
+	}
+	pass, err := readPassFile(passFile)
+	if err != nil {
+		return err
+	}
+	defer zero(pass)
+	if err := s.save(s.dbs[0], file, string(pass)); err != nil {
+		return err
+	}
+	slog.Info("saved snapshot on shutdown", "file", file, "keys", s.dbs[0].len())
+	return nil
+}
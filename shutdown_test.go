@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	srv := newServer(config{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		srv.serve(ln)
+		close(served)
+	}()
+	dial := func() (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c, bufio.NewReader(c)
+	}
+	idle, ir := dial()
+	if got := roundTrip(t, idle, ir, "SET a 1"); got != "OK\n" {
+		t.Fatalf("SET = %q", got)
+	}
+	blocked, br := dial()
+	blocked.Write([]byte("XREAD BLOCK 0 STREAMS s $\n"))
+	waitFor(t, "the reader to block", func() bool { return blockedClients(srv) == 1 })
+
+	if n := srv.shutdown([]net.Listener{ln}, time.Second); n != 0 {
+		t.Fatalf("shutdown force-closed %d connections", n)
+	}
+	<-served
+	if got, _ := br.ReadString('\n'); got != "NIL\n" {
+		t.Errorf("blocked XREAD at shutdown = %q", got)
+	}
+	if _, err := ir.ReadString('\n'); err == nil {
+		t.Error("idle connection still open after shutdown")
+	}
+	if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		c.Close()
+		t.Error("listener still accepting after shutdown")
+	}
+	c, _ := net.Pipe()
+	defer c.Close()
+	if cl, _ := srv.register(c); cl != nil {
+		t.Error("register accepted a connection after shutdown")
+	}
+}
+
+func TestShutdownForceClose(t *testing.T) {
+	srv := newServer(config{})
+	// Nothing reads this reply, so the handler stays blocked writing it.
+	c, r := connect(t, srv)
+	c.Write([]byte("PING\n"))
+	idle, ir := connect(t, srv)
+	roundTrip(t, idle, ir, "PING")
+	waitFor(t, "both clients to register", func() bool { return len(srv.clientsByID()) == 2 })
+
+	start := time.Now()
+	if n := srv.shutdown(nil, 50*time.Millisecond); n != 1 {
+		t.Errorf("shutdown force-closed %d connections, want 1", n)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("shutdown took %v", took)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("stuck connection still open after shutdown")
+	}
+	waitFor(t, "the handlers to exit", func() bool { return len(srv.clientsByID()) == 0 })
+}
+
+func TestStopSaves(t *testing.T) {
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "pass")
+	if err := os.WriteFile(passFile, []byte("pw\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(config{})
+	srv.dbs[0].set("a", "1")
+	file := filepath.Join(dir, "db")
+	if err := srv.stop(nil, file, passFile); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newKV()
+	if err := loadFromFile(loaded, file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := loaded.get("a"); v != "1" {
+		t.Errorf("saved %q", v)
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errStreamID  = errors.New("invalid stream ID")
+	errIDTooLow  = errors.New("the ID specified in XADD must be greater than the last one")
+)
+
+// streamID orders stream entries: milliseconds, then a sequence number
+// for entries within the same millisecond.
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+// parseStreamID parses "ms-seq" or "ms". A bare ms takes missingSeq as its
+// sequence, so ranges can include or exclude the whole millisecond.
+func parseStreamID(s string, missingSeq uint64) (streamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, errStreamID
+	}
+	id := streamID{ms: ms, seq: missingSeq}
+	if hasSeq {
+		if id.seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return streamID{}, errStreamID
+		}
+	}
+	return id, nil
+}
+
+// parseRangeID parses an XRANGE bound, where "-" and "+" are the smallest
+// and largest possible IDs.
+func parseRangeID(s string, end bool) (streamID, error) {
+	switch {
+	case s == "-":
+		return streamID{}, nil
+	case s == "+":
+		return streamID{math.MaxUint64, math.MaxUint64}, nil
+	case end:
+		return parseStreamID(s, math.MaxUint64)
+	}
+	return parseStreamID(s, 0)
+}
+
+type streamEntry struct {
+	id     streamID
+	fields [][]byte // field, value, field, value...
+}
+
+// line renders an entry as "id field value ...".
+func (e streamEntry) line() string {
+	parts := make([]string, 0, len(e.fields)+1)
+	parts = append(parts, e.id.String())
+	for _, f := range e.fields {
+		parts = append(parts, string(f))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (e streamEntry) size() int64 {
+	n := int64(16)
+	for _, f := range e.fields {
+		n += int64(len(f))
+	}
+	return n
+}
+
+func (e streamEntry) zero() {
+	for _, f := range e.fields {
+		zero(f)
+	}
+}
+
+// stream is an append-only log of entries in increasing ID order.
+type stream struct {
+	entries []streamEntry
+	last    streamID // highest ID ever added, even if since trimmed
+	groups  map[string]*group
+}
+
+// after returns the index of the first entry with an ID greater than id.
+func (st *stream) after(id streamID) int {
+	return sort.Search(len(st.entries), func(i int) bool { return id.less(st.entries[i].id) })
+}
+
+// from returns the index of the first entry with an ID of at least id.
+func (st *stream) from(id streamID) int {
+	return sort.Search(len(st.entries), func(i int) bool { return !st.entries[i].id.less(id) })
+}
+
+// size is the logical size st contributes to the store under key.
+func (st *stream) size(key string) int64 {
+	n := int64(len(key))
+	for _, e := range st.entries {
+		n += e.size()
+	}
+	return n
+}
+
+// streamLocked returns the stream at key, or nil if there is none. It
+// fails if key holds a different type. k.mu must be held.
+func (k *kvShard) streamLocked(key string) (*stream, error) {
+	if t := k.typeLocked(key); t != "stream" && t != "none" {
+		return nil, errWrongType
+	}
+	return k.streams[key], nil
+}
+
+// xadd appends an entry to the stream at key, creating the stream if
+// needed, and then applies trim. id is "*" for an automatic ID, "ms-*" for
+// an automatic sequence, or an explicit ID above the stream's last one.
+func (k *kvShard) xadd(key, id string, fields []string, trim streamTrim) (streamID, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reapLocked(key)
+	st, err := k.streamLocked(key)
+	if err != nil {
+		return streamID{}, err
+	}
+	exists := st != nil
+	if !exists {
+		st = &stream{}
+	}
+	var next streamID
+	switch {
+	case id == "*":
+		next = streamID{ms: uint64(time.Now().UnixMilli())}
+		if exists && !st.last.less(next) {
+			next = streamID{st.last.ms, st.last.seq + 1}
+		}
+	case strings.HasSuffix(id, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(id, "-*"), 10, 64)
+		if err != nil {
+			return streamID{}, errStreamID
+		}
+		next = streamID{ms: ms}
+		if exists && ms == st.last.ms {
+			next.seq = st.last.seq + 1
+		}
+	default:
+		if next, err = parseStreamID(id, 0); err != nil {
+			return streamID{}, err
+		}
+	}
+	if next == (streamID{}) || (exists && !st.last.less(next)) {
+		return streamID{}, errIDTooLow
+	}
+	e := streamEntry{id: next, fields: make([][]byte, len(fields))}
+	for i, f := range fields {
+		e.fields[i] = []byte(f)
+	}
+	if !exists {
+		k.streams[key] = st
+		k.addUsed(int64(len(key)))
+	}
+	st.entries = append(st.entries, e)
+	st.last = next
+	k.addUsed(e.size())
+	k.trimLocked(st, trim)
+	k.notePeakLocked()
+	if k.lru != nil {
+		k.lru.touch(key)
+		k.evictLocked(key)
+	}
+	return next, nil
+}
+
+// xrange returns entries with IDs in [start, end], at most count of them
+// when count > 0.
+func (k *kvShard) xrange(key string, start, end streamID, count int) ([]string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	st, err := k.streamLocked(key)
+	if err != nil || st == nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range st.entries[st.from(start):] {
+		if end.less(e.id) || (count > 0 && len(out) == count) {
+			break
+		}
+		out = append(out, e.line())
+	}
+	return out, nil
+}
+
+// xread returns entries with IDs greater than after, at most count of them
+// when count > 0.
+func (k *kvShard) xread(key string, after streamID, count int) ([]string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	st, err := k.streamLocked(key)
+	if err != nil || st == nil {
+		return nil, err
+	}
+	entries := st.entries[st.after(after):]
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = e.line()
+	}
+	return out, nil
+}
+
+// lastStreamID is the last ID added to the stream at key, or the zero ID.
+func (k *kvShard) lastStreamID(key string) streamID {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if st := k.streams[key]; st != nil {
+		return st.last
+	}
+	return streamID{}
+}
+
+// streamTrim caps a stream at its newest maxLen entries. With approx,
+// entries are only dropped in whole chunks of trimChunk, so a busy stream
+// is trimmed once per chunk rather than on every add.
+type streamTrim struct {
+	set    bool
+	maxLen int
+	approx bool
+}
+
+const trimChunk = 100
+
+// parseTrim parses a leading MAXLEN [~|=] n, returning the arguments that
+// follow it. Without MAXLEN it returns args unchanged.
+func parseTrim(args []string) (streamTrim, []string, error) {
+	if len(args) == 0 || !strings.EqualFold(args[0], "MAXLEN") {
+		return streamTrim{}, args, nil
+	}
+	args = args[1:]
+	t := streamTrim{set: true}
+	if len(args) > 0 && (args[0] == "~" || args[0] == "=") {
+		t.approx = args[0] == "~"
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return t, nil, errors.New("syntax error")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return t, nil, errors.New("MAXLEN must be a non-negative integer")
+	}
+	t.maxLen = n
+	return t, args[1:], nil
+}
+
+// trimLocked applies t to st, zeroing the dropped entries, and reports how
+// many it dropped. Consumer groups keep pending IDs of dropped entries.
+// k.mu must be held.
+func (k *kvShard) trimLocked(st *stream, t streamTrim) int {
+	drop := len(st.entries) - t.maxLen
+	if t.approx {
+		drop -= drop % trimChunk
+	}
+	if !t.set || drop <= 0 {
+		return 0
+	}
+	for i := range st.entries[:drop] {
+		k.addUsed(-st.entries[i].size())
+		st.entries[i].zero()
+		st.entries[i] = streamEntry{}
+	}
+	st.entries = st.entries[drop:]
+	return drop
+}
+
+// xtrim applies t to the stream at key and reports how many entries it
+// dropped.
+func (k *kvShard) xtrim(key string, t streamTrim) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, err := k.streamLocked(key)
+	if err != nil || st == nil {
+		return 0, err
+	}
+	return k.trimLocked(st, t), nil
+}
+
+// cmdXAdd handles XADD key [MAXLEN [~|=] n] *|id field value
+// [field value ...].
+func cmdXAdd(s *server, cl *client, args []string) reply {
+	trim, rest, err := parseTrim(args[1:])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	if len(rest) < 3 || len(rest[1:])%2 != 0 {
+		return wrongArgs("xadd")
+	}
+	id, err := s.db(cl).xadd(args[0], rest[0], rest[1:], trim)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return strReply(id.String())
+}
+
+// cmdXTrim handles XTRIM key MAXLEN [~|=] n, replying with the number of
+// entries dropped.
+func cmdXTrim(s *server, cl *client, args []string) reply {
+	trim, rest, err := parseTrim(args[1:])
+	if err != nil {
+		return errReply(err.Error())
+	}
+	if !trim.set || len(rest) > 0 {
+		return errReply("syntax error")
+	}
+	n, err := s.db(cl).xtrim(args[0], trim)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return intReply(int64(n))
+}
+
+// cmdXRange handles XRANGE key start end [COUNT n]; each entry is one
+// "id field value ..." line.
+func cmdXRange(s *server, cl *client, args []string) reply {
+	start, err := parseRangeID(args[1], false)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	end, err := parseRangeID(args[2], true)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	count := 0
+	if len(args) > 3 {
+		if count, err = parseCount(args[3:]); err != nil {
+			return errReply(err.Error())
+		}
+	}
+	lines, err := s.db(cl).xrange(args[0], start, end, count)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return arrayReply(lines)
+}
+
+// parseCount parses a trailing "COUNT n" option.
+func parseCount(args []string) (int, error) {
+	if len(args) != 2 || !strings.EqualFold(args[0], "COUNT") {
+		return 0, errors.New("syntax error")
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n <= 0 {
+		return 0, errors.New("COUNT must be a positive integer")
+	}
+	return n, nil
+}
+
+// xreadRequest is a parsed XREAD: the streams to read and, per stream, the
+// ID after which entries are wanted.
+type xreadRequest struct {
+	count int
+	keys  []string
+	ids   []streamID
+}
+
+// streamsArgs is the [COUNT n] [BLOCK ms] STREAMS key [key ...] id [id ...]
+// tail shared by XREAD and XREADGROUP, with the IDs left unparsed.
+type streamsArgs struct {
+	count    int
+	blocking bool
+	block    time.Duration // 0 with blocking set waits forever
+	keys     []string
+	ids      []string
+}
+
+func parseStreamsArgs(args []string) (streamsArgs, error) {
+	var sa streamsArgs
+	for len(args) > 0 && !strings.EqualFold(args[0], "STREAMS") {
+		if len(args) < 2 {
+			return sa, errors.New("syntax error")
+		}
+		switch strings.ToUpper(args[0]) {
+		case "COUNT":
+			n, err := parseCount(args[:2])
+			if err != nil {
+				return sa, err
+			}
+			sa.count = n
+		case "BLOCK":
+			ms, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil || ms < 0 || ms > int64(math.MaxInt64/time.Millisecond) {
+				return sa, errors.New("timeout is not an integer or out of range")
+			}
+			sa.blocking, sa.block = true, time.Duration(ms)*time.Millisecond
+		default:
+			return sa, errors.New("syntax error")
+		}
+		args = args[2:]
+	}
+	if len(args) < 3 || len(args[1:])%2 != 0 {
+		return sa, errors.New("syntax error")
+	}
+	args = args[1:]
+	half := len(args) / 2
+	sa.keys, sa.ids = args[:half], args[half:]
+	return sa, nil
+}
+
+// parseXRead resolves the IDs of an XREAD. An ID of "$" stands for the
+// stream's current last ID, taken once so a blocked read waits for entries
+// added after the command arrived.
+func parseXRead(db *kv, sa streamsArgs) (xreadRequest, error) {
+	req := xreadRequest{count: sa.count, keys: sa.keys}
+	for i, raw := range sa.ids {
+		if raw == "$" {
+			req.ids = append(req.ids, db.lastStreamID(sa.keys[i]))
+			continue
+		}
+		id, err := parseStreamID(raw, 0)
+		if err != nil {
+			return req, err
+		}
+		req.ids = append(req.ids, id)
+	}
+	return req, nil
+}
+
+// run reads every requested stream, prefixing each entry line with its
+// stream's key. There are no lines if no stream has new entries.
+func (req xreadRequest) run(db *kv) ([]string, error) {
+	var out []string
+	for i, key := range req.keys {
+		lines, err := db.xread(key, req.ids[i], req.count)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range lines {
+			out = append(out, key+" "+l)
+		}
+	}
+	return out, nil
+}
+
+// cmdXRead handles XREAD [COUNT n] [BLOCK ms] STREAMS key [key ...]
+// id [id ...]. It replies with "key id field value ..." lines, or NIL when
+// there is nothing newer than the given IDs. With BLOCK it first waits up
+// to ms milliseconds (0 waits forever) for such entries.
+func cmdXRead(s *server, cl *client, args []string) reply {
+	sa, err := parseStreamsArgs(args)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	db := s.db(cl)
+	req, err := parseXRead(db, sa)
+	if err != nil {
+		return errReply(err.Error())
+	}
+	return linesOrBlock(cl, db, "XREAD", sa, func() ([]string, error) { return req.run(db) })
+}
+
+// typeOf names the type of the value at key: "string", "hll", "stream",
+// "counter", "geo" or "none".
+func (k *kvShard) typeOf(key string) string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.typeLocked(key)
+}
+
+func (k *kvShard) typeLocked(key string) string {
+	if _, ok := k.data[key]; ok {
+		if k.hll[key] {
+			return "hll"
+		}
+		return "string"
+	}
+	if _, ok := k.streams[key]; ok {
+		return "stream"
+	}
+	if _, ok := k.counters[key]; ok {
+		return "counter"
+	}
+	if _, ok := k.geos[key]; ok {
+		return "geo"
+	}
+	if k.mapped != nil {
+		if _, ok := k.mapped.lookup(key); ok {
+			return "string"
+		}
+	}
+	return "none"
+}
+
+// streamEntryDump and streamDump are the snapshot form of a stream.
+type streamEntryDump struct {
+	ID     [2]uint64 `json:"id"`
+	Fields [][]byte  `json:"fields"`
+}
+
+type streamDump struct {
+	Last    [2]uint64             `json:"last"`
+	Entries []streamEntryDump     `json:"entries"`
+	Groups  map[string]*groupDump `json:"groups,omitempty"`
+}
+
+func (st *stream) dump() *streamDump {
+	d := &streamDump{Last: [2]uint64{st.last.ms, st.last.seq}}
+	for _, e := range st.entries {
+		fields := make([][]byte, len(e.fields))
+		for i, f := range e.fields {
+			fields[i] = append([]byte(nil), f...)
+		}
+		d.Entries = append(d.Entries, streamEntryDump{ID: [2]uint64{e.id.ms, e.id.seq}, Fields: fields})
+	}
+	if len(st.groups) > 0 {
+		d.Groups = make(map[string]*groupDump, len(st.groups))
+		for name, g := range st.groups {
+			d.Groups[name] = g.dump()
+		}
+	}
+	return d
+}
+
+func (d *streamDump) restore() (*stream, error) {
+	st := &stream{last: streamID{d.Last[0], d.Last[1]}}
+	for _, e := range d.Entries {
+		id := streamID{e.ID[0], e.ID[1]}
+		if n := len(st.entries); (n > 0 && !st.entries[n-1].id.less(id)) || st.last.less(id) {
+			return nil, fmt.Errorf("stream entries out of order at %s", id)
+		}
+		st.entries = append(st.entries, streamEntry{id: id, fields: e.Fields})
+	}
+	for name, gd := range d.Groups {
+		if st.groups == nil {
+			st.groups = make(map[string]*group)
+		}
+		st.groups[name] = gd.restore()
+	}
+	return st, nil
+}
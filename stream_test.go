@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStreamAddRange(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"XADD", "s", "1-1", "a", "1"}, "1-1"},
+		{[]string{"XADD", "s", "1-*", "b", "2"}, "1-2"},
+		{[]string{"XADD", "s", "5", "c", "3"}, "5-0"},
+		{[]string{"XADD", "s", "5-0", "d", "4"}, "ERR " + errIDTooLow.Error()},
+		{[]string{"XADD", "s", "0-0", "d", "4"}, "ERR " + errIDTooLow.Error()},
+		{[]string{"XADD", "s", "x-1", "d", "4"}, "ERR " + errStreamID.Error()},
+		{[]string{"XADD", "s", "*", "odd"}, "ERR wrong number of arguments for 'xadd'"},
+	} {
+		var b strings.Builder
+		srv.dispatch(cl, tc.args).appendText(&b, "\n")
+		if text := strings.TrimSuffix(b.String(), "\n"); text != tc.want {
+			t.Errorf("%v = %q, want %q", tc.args, text, tc.want)
+		}
+	}
+	if got := srv.dispatch(cl, []string{"XADD", "s", "*", "e", "5"}); got.kind != kindValue || got.text == "5-1" {
+		t.Errorf("auto ID = %+v, want a fresh millisecond", got)
+	}
+
+	for _, tc := range []struct {
+		start, end string
+		want       []string
+	}{
+		{"-", "5", []string{"1-1 a 1", "1-2 b 2", "5-0 c 3"}},
+		{"1", "1", []string{"1-1 a 1", "1-2 b 2"}},
+		{"1-2", "5-0", []string{"1-2 b 2", "5-0 c 3"}},
+		{"6", "9", nil},
+	} {
+		got := srv.dispatch(cl, []string{"XRANGE", "s", tc.start, tc.end})
+		if got.kind != kindArray || len(got.items) != len(tc.want) {
+			t.Fatalf("XRANGE %s %s = %+v, want %q", tc.start, tc.end, got, tc.want)
+		}
+		for i, w := range tc.want {
+			if got.items[i].text != w {
+				t.Errorf("XRANGE %s %s [%d] = %q, want %q", tc.start, tc.end, i, got.items[i].text, w)
+			}
+		}
+	}
+	if got := srv.dispatch(cl, []string{"XRANGE", "s", "-", "+", "COUNT", "1"}); len(got.items) != 1 {
+		t.Errorf("XRANGE COUNT 1 = %+v", got)
+	}
+}
+
+func TestStreamRead(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"XADD", "a", "1-0", "f", "x"})
+	srv.dispatch(cl, []string{"XADD", "a", "2-0", "f", "y"})
+	srv.dispatch(cl, []string{"XADD", "b", "3-0", "g", "z"})
+
+	got := srv.dispatch(cl, []string{"XREAD", "STREAMS", "a", "b", "1-0", "0"})
+	want := []string{"a 2-0 f y", "b 3-0 g z"}
+	if got.kind != kindArray || len(got.items) != len(want) {
+		t.Fatalf("XREAD = %+v", got)
+	}
+	for i, w := range want {
+		if got.items[i].text != w {
+			t.Errorf("XREAD [%d] = %q, want %q", i, got.items[i].text, w)
+		}
+	}
+	if got := srv.dispatch(cl, []string{"XREAD", "COUNT", "1", "STREAMS", "a", "0"}); len(got.items) != 1 || got.items[0].text != "a 1-0 f x" {
+		t.Errorf("XREAD COUNT 1 = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"XREAD", "STREAMS", "a", "$"}); got.kind != kindNil {
+		t.Errorf("XREAD $ = %+v, want nil", got)
+	}
+	if got := srv.dispatch(cl, []string{"XREAD", "STREAMS", "a", "b", "0"}); got.kind != kindErr {
+		t.Errorf("XREAD with unpaired IDs = %+v, want an error", got)
+	}
+	if got := srv.dispatch(cl, []string{"XREAD", "BLOCK", strconv.FormatInt(math.MaxInt64, 10), "STREAMS", "a", "$"}); got.kind != kindErr {
+		t.Errorf("XREAD BLOCK MaxInt64 = %+v, want an error", got)
+	}
+}
+
+func TestStreamKeyspace(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	srv.dispatch(cl, []string{"SET", "str", "v"})
+	srv.dispatch(cl, []string{"XADD", "st", "1-0", "f", "v"})
+	if got := srv.dispatch(cl, []string{"XADD", "str", "*", "f", "v"}); got.text != errWrongType.Error() {
+		t.Errorf("XADD on a string = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"GET", "st"}); got.text != errWrongType.Error() {
+		t.Errorf("GET on a stream = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"KEYS", "*"}); len(got.items) != 2 {
+		t.Errorf("KEYS * = %+v, want both keys", got)
+	}
+	srv.dispatch(cl, []string{"SET", "st", "now a string"})
+	if got := srv.dispatch(cl, []string{"GET", "st"}); got.text != "now a string" {
+		t.Errorf("GET after SET over a stream = %+v", got)
+	}
+	srv.dispatch(cl, []string{"XADD", "gone", "1-0", "f", "v"})
+	srv.dispatch(cl, []string{"DEL", "gone"})
+	if got := srv.dispatch(cl, []string{"XRANGE", "gone", "-", "+"}); len(got.items) != 0 {
+		t.Errorf("XRANGE after DEL = %+v", got)
+	}
+	if used, _ := srv.dbs[0].memory(); used != int64(len("str")+len("v")+len("st")+len("now a string")) {
+		t.Errorf("used = %d after the stream was dropped", used)
+	}
+}
+
+func TestStreamSaveLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db")
+	src := newServer(config{})
+	cl := &client{}
+	src.dispatch(cl, []string{"SET", "k", "v"})
+	src.dispatch(cl, []string{"XADD", "s", "1-0", "f", "a b"})
+	src.dispatch(cl, []string{"XADD", "s", "2-0", "f", "c"})
+	if got := src.dispatch(cl, []string{"SAVE", file, "pw"}); got.kind != kindOK {
+		t.Fatalf("SAVE = %+v", got)
+	}
+
+	dst := newServer(config{})
+	if got := dst.dispatch(cl, []string{"LOAD", file, "pw", "EXPECT", "2"}); got.kind != kindOK {
+		t.Fatalf("LOAD = %+v", got)
+	}
+	got := dst.dispatch(cl, []string{"XRANGE", "s", "-", "+"})
+	if len(got.items) != 2 || got.items[0].text != "1-0 f a b" || got.items[1].text != "2-0 f c" {
+		t.Errorf("XRANGE after LOAD = %+v", got)
+	}
+	if got := dst.dispatch(cl, []string{"XADD", "s", "2-0", "f", "d"}); got.kind != kindErr {
+		t.Errorf("XADD at the loaded last ID = %+v, want an error", got)
+	}
+	if v, _ := dst.dbs[0].get("k"); v != "v" {
+		t.Errorf("k = %q", v)
+	}
+}
+
+func TestDecodeLegacySnapshot(t *testing.T) {
+	d, err := decodeSnapshot([]byte(`{"version":"1","data":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Data["version"] != "1" || d.Data["data"] != "x" || d.len() != 2 {
+		t.Errorf("legacy dump = %+v", d)
+	}
+	if _, err := decodeSnapshot([]byte(`{"version":99,"data":{}}`)); err == nil {
+		t.Error("future snapshot version accepted")
+	}
+}
+
+func TestStreamTrim(t *testing.T) {
+	srv := newServer(config{})
+	cl := &client{}
+	for i := 1; i <= 5; i++ {
+		srv.dispatch(cl, []string{"XADD", "s", "MAXLEN", "3", strconv.Itoa(i), "f", "v"})
+	}
+	got := srv.dispatch(cl, []string{"XRANGE", "s", "-", "+"})
+	if len(got.items) != 3 || got.items[0].text != "3-0 f v" {
+		t.Fatalf("after XADD MAXLEN 3 = %+v", got)
+	}
+	if used, _ := srv.dbs[0].memory(); used != int64(len("s")+3*(16+2)) {
+		t.Errorf("used = %d after trimming", used)
+	}
+	if got := srv.dispatch(cl, []string{"XTRIM", "s", "MAXLEN", "=", "1"}); got.text != "2" {
+		t.Errorf("XTRIM MAXLEN = 1 = %+v", got)
+	}
+	if got := srv.dispatch(cl, []string{"XTRIM", "s", "MAXLEN", "-1"}); got.kind != kindErr {
+		t.Errorf("XTRIM MAXLEN -1 = %+v", got)
+	}
+
+	for i := 10; i < 10+trimChunk+50; i++ {
+		srv.dispatch(cl, []string{"XADD", "a", strconv.Itoa(i), "f", "v"})
+	}
+	if got := srv.dispatch(cl, []string{"XTRIM", "a", "MAXLEN", "~", "10"}); got.text != strconv.Itoa(trimChunk) {
+		t.Errorf("XTRIM MAXLEN ~ 10 = %+v, want one whole chunk", got)
+	}
+	if got := srv.dispatch(cl, []string{"XTRIM", "a", "MAXLEN", "~", "10"}); got.text != "0" {
+		t.Errorf("second XTRIM MAXLEN ~ 10 = %+v, want less than a chunk left over", got)
+	}
+}
+
+func TestStreamSaveLoadLargeIDs(t *testing.T) {
+	// 2^53+1 is the first integer a float64 cannot hold.
+	ids := []string{"9007199254740993-0", "18446744073709551615-18446744073709551614"}
+	file := filepath.Join(t.TempDir(), "db")
+	src := newServer(config{})
+	cl := &client{}
+	for _, id := range ids {
+		if got := src.dispatch(cl, []string{"XADD", "s", id, "f", "v"}); got.text != id {
+			t.Fatalf("XADD %s = %+v", id, got)
+		}
+	}
+	if err := saveToFile(src.dbs[0], file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	dst := newServer(config{})
+	if err := loadFromFile(dst.dbs[0], file, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	got := dst.dispatch(cl, []string{"XRANGE", "s", "-", "+"})
+	if len(got.items) != len(ids) {
+		t.Fatalf("XRANGE after LOAD = %+v", got)
+	}
+	for i, id := range ids {
+		if want := id + " f v"; got.items[i].text != want {
+			t.Errorf("entry %d = %q, want %q", i, got.items[i].text, want)
+		}
+	}
+}
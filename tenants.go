@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a TLS client may take to say which
+// tenant it wants.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsTenant maps one SNI server name to a certificate and the database
+// its connections are confined to.
+type tlsTenant struct {
+	host string
+	db   int
+	cert tls.Certificate
+}
+
+// parseTenant parses a -tls-tenant value, host=db,certfile,keyfile, and
+// loads the key pair.
+func parseTenant(spec string, databases int) (tlsTenant, error) {
+	host, rest, ok := strings.Cut(spec, "=")
+	parts := strings.Split(rest, ",")
+	if !ok || host == "" || len(parts) != 3 {
+		return tlsTenant{}, fmt.Errorf("invalid -tls-tenant %q, want host=db,certfile,keyfile", spec)
+	}
+	db, err := strconv.Atoi(parts[0])
+	if err != nil || db < 0 || db >= databases {
+		return tlsTenant{}, fmt.Errorf("-tls-tenant %q: database must be between 0 and %d", spec, databases-1)
+	}
+	cert, err := tls.LoadX509KeyPair(parts[1], parts[2])
+	if err != nil {
+		return tlsTenant{}, fmt.Errorf("-tls-tenant %q: %w", spec, err)
+	}
+	return tlsTenant{host: strings.ToLower(host), db: db, cert: cert}, nil
+}
+
+// serverTLS loads the -tls-cert and -tls-key pair that encrypts the main
+// listener. It returns nil if neither is set.
+func serverTLS(certFile, keyFile string) (*tls.Config, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if certFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("-tls-cert %s: %w", certFile, err)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}, nil
+}
+
+// tenantRouter picks a tenant's certificate by SNI during the handshake.
+// Clients naming no configured host fail the handshake.
+type tenantRouter struct {
+	config  *tls.Config
+	tenants map[string]*tlsTenant
+}
+
+func newTenantRouter(tenants []tlsTenant) (*tenantRouter, error) {
+	rt := &tenantRouter{tenants: make(map[string]*tlsTenant, len(tenants))}
+	for i := range tenants {
+		t := &tenants[i]
+		if _, dup := rt.tenants[t.host]; dup {
+			return nil, fmt.Errorf("-tls-tenant %s given twice", t.host)
+		}
+		rt.tenants[t.host] = t
+	}
+	rt.config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			t, ok := rt.tenants[strings.ToLower(hello.ServerName)]
+			if !ok {
+				return nil, fmt.Errorf("no tenant for server name %q", hello.ServerName)
+			}
+			return &t.cert, nil
+		},
+	}
+	return rt, nil
+}
+
+// tenantConn is a TLS connection routed to a tenant's database. register
+// pins the client to that database.
+type tenantConn struct {
+	net.Conn
+	db int
+}
+
+var errPinned = errors.New("the database is fixed for this connection")
+
+// serveTLS accepts TLS connections, completes each handshake and hands
+// the connection to the handler pinned to its tenant's database.
+func (s *server) serveTLS(ln net.Listener, rt *tenantRouter) {
+	var backoff acceptBackoff
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			backoff.failed(ln, err)
+			continue
+		}
+		backoff.ok()
+		s.spawn(func() { s.handleTLS(tls.Server(conn, rt.config), rt) })
+	}
+}
+
+func (s *server) handleTLS(tc *tls.Conn, rt *tenantRouter) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		slog.Debug("TLS handshake failed", "addr", tc.RemoteAddr(), "err", err)
+		tc.Close()
+		return
+	}
+	t := rt.tenants[strings.ToLower(tc.ConnectionState().ServerName)]
+	s.handle(&tenantConn{Conn: tc, db: t.db})
+}
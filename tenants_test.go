@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate and key for host into dir.
+func writeCert(t *testing.T, dir, host string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSTenants(t *testing.T) {
+	dir := t.TempDir()
+	srv := newServer(config{})
+	var tenants []tlsTenant
+	for _, spec := range []struct {
+		host string
+		db   string
+	}{{"a.example", "1"}, {"b.example", "2"}} {
+		cert, key := writeCert(t, dir, spec.host)
+		tn, err := parseTenant(spec.host+"="+spec.db+","+cert+","+key, len(srv.dbs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tenants = append(tenants, tn)
+	}
+	if _, err := parseTenant("c.example=99,x,y", len(srv.dbs)); err == nil {
+		t.Error("tenant with an out of range database accepted")
+	}
+	rt, err := newTenantRouter(tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.serveTLS(ln, rt)
+
+	dial := func(host string) (*tls.Conn, error) {
+		return tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	}
+	for _, tc := range []struct{ host, value string }{{"a.example", "va"}, {"B.example", "vb"}} {
+		c, err := dial(tc.host)
+		if err != nil {
+			t.Fatalf("dial %s: %v", tc.host, err)
+		}
+		r := bufio.NewReader(c)
+		if got := roundTrip(t, c, r, "SET k "+tc.value); got != "OK\n" {
+			t.Errorf("%s SET = %q", tc.host, got)
+		}
+		if got := roundTrip(t, c, r, "SELECT 0"); got != "ERR "+errPinned.Error()+"\n" {
+			t.Errorf("%s SELECT = %q", tc.host, got)
+		}
+		if cn := c.ConnectionState().PeerCertificates[0].Subject.CommonName; !strings.EqualFold(cn, tc.host) {
+			t.Errorf("%s got the certificate for %s", tc.host, cn)
+		}
+		c.Close()
+	}
+	if v, _ := srv.dbs[1].get("k"); v != "va" {
+		t.Errorf("db 1 k = %q", v)
+	}
+	if v, _ := srv.dbs[2].get("k"); v != "vb" {
+		t.Errorf("db 2 k = %q", v)
+	}
+	if _, ok := srv.dbs[0].get("k"); ok {
+		t.Error("tenant write reached db 0")
+	}
+	if c, err := dial("unknown.example"); err == nil {
+		c.Close()
+		t.Error("handshake with an unknown server name succeeded")
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	cert, key := writeCert(t, t.TempDir(), "localhost")
+	for _, files := range [][2]string{{cert, ""}, {"", key}, {key, key}} {
+		if _, err := serverTLS(files[0], files[1]); err == nil {
+			t.Errorf("serverTLS(%q, %q) succeeded", files[0], files[1])
+		}
+	}
+	if cfg, err := serverTLS("", ""); cfg != nil || err != nil {
+		t.Errorf("serverTLS without files = %v, %v", cfg, err)
+	}
+	cfg, err := serverTLS(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := newServer(config{})
+	go srv.serve(tls.NewListener(ln, cfg))
+
+	c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := roundTrip(t, c, bufio.NewReader(c), "SET k v"); got != "OK\n" {
+		t.Errorf("SET over TLS = %q", got)
+	}
+	plain, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Write([]byte("GET k\n"))
+	plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, _ := bufio.NewReader(plain).ReadString('\n'); got == "v\n" {
+		t.Error("plaintext client was served")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bos.sock")
+	// A socket left by a server that died without closing it.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket mode %v, want 0600", perm)
+	}
+	srv := newServer(config{})
+	go srv.serve(ln)
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("PING\n"))
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); err != nil || string(buf) != "PONG\n" {
+		t.Errorf("PING over the socket = %q, %v", buf, err)
+	}
+	c.Close()
+
+	if _, err := listenUnix(path); err == nil {
+		t.Error("listened on a socket another server is using")
+	}
+	ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after Close: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path); err == nil {
+		t.Error("replaced a regular file with the socket")
+	}
+}